@@ -3,8 +3,11 @@ package main
 import (
 	"github.com/Chendemo12/functools/environ"
 	"github.com/Chendemo12/functools/zaplog"
+	"github.com/Chendemo12/micromq/src/engine"
 	"github.com/Chendemo12/micromq/src/mq"
 	"github.com/Chendemo12/micromq/src/proto"
+	"github.com/Chendemo12/micromq/src/storage"
+	"time"
 )
 
 const VERSION = "v0.3.7"
@@ -22,11 +25,35 @@ func main() {
 	conf.Broker.BufferSize = environ.GetInt("BROKER_BUFFER_SIZE", 100)
 	conf.Broker.MaxOpenConn = environ.GetInt("BROKER_MAX_OPEN_SIZE", 50)
 	conf.Broker.HeartbeatTimeout = float64(environ.GetInt("BROKER_HEARTBEAT_TIMEOUT", 60))
+	// 主题内低优先级消息在有消息等待时, 最多连续让行于高优先级消息的数量
+	conf.Broker.StarvationLimit = environ.GetInt("BROKER_STARVATION_LIMIT", 8)
+	// 主题缺省的分区数量, 以及各主题的分区数量, 如 "ORDERS=4,LOGS=2"
+	conf.Broker.Partitions = environ.GetInt("BROKER_PARTITIONS", 1)
+	conf.Broker.TopicPartitions = engine.ParseTopicPartitions(environ.GetString("BROKER_TOPIC_PARTITIONS", ""))
+	// 主题日志的存储目录, 为空时消息仅保存在内存中
+	conf.Broker.DataDir = environ.GetString("BROKER_DATA_DIR", "")
+	conf.Broker.SegmentBytes = int64(environ.GetInt("BROKER_SEGMENT_MB", 16)) << 20
+	// 每个主题日志的大小上限和消息的最长保留时间, 0 表示不限制
+	conf.Broker.RetentionBytes = int64(environ.GetInt("BROKER_RETENTION_MB", 0)) << 20
+	conf.Broker.RetentionAge = time.Duration(environ.GetInt("BROKER_RETENTION_HOURS", 168)) * time.Hour
+	// 写入磁盘的策略, 支持 always/interval/never
+	conf.Broker.FsyncPolicy = storage.FsyncPolicy(environ.GetString("BROKER_FSYNC_POLICY", "interval"))
+	conf.Broker.FsyncInterval = time.Duration(environ.GetInt("BROKER_FSYNC_INTERVAL", 1000)) * time.Millisecond
 	conf.Broker.Token = proto.CalcSHA(environ.GetString("BROKER_TOKEN", ""))
 	// 是否开启消息加密
 	msgEncrypt := environ.GetBool("BROKER_MESSAGE_ENCRYPT", false)
-	// 消息加密方案, 目前仅支持基于 Token 的加密
+	// 消息加密方案, 支持 TOKEN/AES-GCM/CHACHA20-POLY1305, 未知的方案会导致启动失败
 	msgEncryptPlan := environ.GetString("BROKER_MESSAGE_ENCRYPT_OPTION", "TOKEN")
+	// 消息压缩方案, 支持 gzip/deflate/no
+	conf.Compression = environ.GetString("BROKER_MESSAGE_COMPRESSION", "no")
+	// 不符合主题模式的消息被转投的隔离主题
+	conf.QuarantineTopic = environ.GetString("BROKER_QUARANTINE_TOPIC", "__QUARANTINE__")
+	// 构建失败或未能送达消费者的消息被转投的死信主题
+	conf.DeadLetterTopic = environ.GetString("BROKER_DEAD_LETTER_TOPIC", "__DEAD_LETTER__")
+	// 消费者确认消息的超时时间(秒), 超时未确认的消息会被重新推送
+	conf.Broker.AckTimeout = time.Duration(environ.GetInt("BROKER_ACK_TIMEOUT", 30)) * time.Second
+	// 消息最多被重新推送的次数, 超过后转投死信主题, 0 表示不限制
+	conf.Broker.MaxRedeliveries = environ.GetInt("BROKER_MAX_REDELIVERIES", 10)
 
 	conf.EdgeHttpPort = environ.GetString("EDGE_LISTEN_PORT", "7280")
 	conf.EdgeEnabled = environ.GetBool("EDGE_ENABLED", false)
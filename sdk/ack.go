@@ -0,0 +1,73 @@
+package sdk
+
+import (
+	"github.com/Chendemo12/micromq/src/proto"
+)
+
+// 单个确认消息最多携带的确认数量
+const maxAcksPerMessage = 1024
+
+// ConsumerID 消费者ID, 在重连后保持不变
+func (client *Consumer) ConsumerID() string { return client.broker.conf.ConsumerID }
+
+// 服务端是否等待消费者确认消息, 仅当 Config.Ack 不为 proto.NoConfirm 且服务端支持 proto.AckCapability 时有效
+func (client *Consumer) needAck() bool {
+	return client.broker.conf.Ack != proto.NoConfirm && client.broker.HasCapability(proto.AckCapability)
+}
+
+// Ack 确认消息已处理, 服务端此后不再重新推送; 未启用 Config.ManualAck 时消息在 ConsumerHandler.Handler 返回后自动确认.
+// 确认被合并后异步发送, 确认丢失或未在服务端的超时时间内到达时消息会被重新推送, 因此消息可能被重复处理
+func (client *Consumer) Ack(msgs ...*ConsumerMessage) {
+	for _, m := range msgs {
+		client.AckOffset(m.Topic, m.Partition, m.Offset)
+	}
+}
+
+// AckOffset 以主题, 分区和分区内的偏移量确认消息, 用于在 ConsumerHandler.Handler 返回之后确认已被回收的消息
+func (client *Consumer) AckOffset(topic string, partition int, offset uint64) {
+	if !client.needAck() {
+		return
+	}
+
+	client.ackLock.Lock()
+	client.acks = append(client.acks, &proto.Acknowledgement{
+		Topic: topic, Partition: uint16(partition), Offset: offset,
+	})
+	client.ackLock.Unlock()
+
+	select {
+	case client.ackSignal <- struct{}{}:
+	default: // 已有待发送的确认, 将一并发送
+	}
+}
+
+// 发送待发送的确认, 发送期间新增的确认在下一次合并发送, 直到消费者关闭
+func (client *Consumer) flushAcks() {
+	for {
+		select {
+		case <-client.broker.Done():
+			return
+		case <-client.ackSignal:
+		}
+
+		client.ackLock.Lock()
+		acks := client.acks
+		client.acks = nil
+		client.ackLock.Unlock()
+
+		for len(acks) > 0 {
+			n := len(acks)
+			if n > maxAcksPerMessage {
+				n = maxAcksPerMessage
+			}
+			frame := framePool.Get()
+			err := client.broker.Send(frame, &proto.AckMessage{Acks: acks[:n]})
+			framePool.Put(frame)
+			if err != nil { // 未确认的消息会被重新推送
+				client.Logger().Warn("send ack failed: ", err)
+				break
+			}
+			acks = acks[n:]
+		}
+	}
+}
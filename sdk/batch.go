@@ -0,0 +1,97 @@
+package sdk
+
+import (
+	"context"
+	"fmt"
+	"github.com/Chendemo12/micromq/src/proto"
+	"github.com/Chendemo12/micromq/src/transfer"
+)
+
+// SendBatch 以全部或全不的方式同步发送一批消息, 消息可属于不同主题, 并按顺序返回每个消息的偏移量
+// 若 ctx 未设置截止时间, 则最多等待 DefaultCallTimeout; 若 Config.Ack 为 NoConfirm, 服务端不会响应, 偏移量为nil
+//
+// 消息仍由调用方持有, 若服务端支持幂等生产者, 超时后以相同的消息重发不会产生重复消息
+//
+//	@param	ctx		context.Context		用于取消等待
+//	@param	msgs	*ProducerMessage	待发送的消息
+//	@return	[]uint64					每个消息的偏移量
+func (client *Producer) SendBatch(ctx context.Context, msgs ...*ProducerMessage) ([]uint64, error) {
+	if len(msgs) == 0 {
+		return nil, ErrBatchEmpty
+	}
+	if !client.broker.HasCapability(proto.BatchCapability) {
+		return nil, ErrBatchUnsupported
+	}
+	for _, msg := range msgs {
+		if msg.Topic == "" {
+			return nil, ErrTopicEmpty
+		}
+	}
+	if !client.broker.IsConnected() {
+		return nil, ErrProducerUnconnected
+	}
+	if !client.broker.IsRegistered() {
+		return nil, ErrProducerUnregistered
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultCallTimeout)
+		defer cancel()
+	}
+
+	batch := &proto.BatchMessage{}
+	for _, msg := range msgs {
+		batch.Append(client.toPMessage(msg))
+	}
+
+	client.batchLock.Lock()
+	defer client.batchLock.Unlock()
+
+	select { // 丢弃上一个已超时的批量消息的响应
+	case <-client.batchResp:
+	default:
+	}
+
+	frame := framePool.Get()
+	err := client.broker.Send(frame, batch)
+	framePool.Put(frame)
+	if err != nil {
+		return nil, err
+	}
+	if client.broker.conf.Ack == proto.NoConfirm {
+		return nil, nil
+	}
+
+	select {
+	case resp := <-client.batchResp:
+		switch resp.Status {
+		case proto.AcceptedStatus:
+			return resp.Offsets, nil
+		case proto.SchemaInvalidStatus:
+			return nil, ErrSchemaInvalid
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrBatchRejected, proto.GetMessageResponseStatusText(resp.Status))
+		}
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, ErrBatchTimeout
+		}
+		return nil, ctx.Err()
+	case <-client.Done():
+		return nil, client.broker.ctx.Err()
+	}
+}
+
+// 处理批量消息的响应, 响应以 proto.BatchMessageRespType 帧返回
+func (client *Producer) handleBatchResponse(frame *proto.TransferFrame, con transfer.Conn) {
+	resp := client.broker.handleMessageResponse(frame, con)
+	if resp == nil {
+		return
+	}
+
+	select {
+	case client.batchResp <- resp:
+	default: // 没有等待中的批量消息
+		client.Logger().Debug("batch response without pending batch, dropped: ", resp.String())
+	}
+}
@@ -3,7 +3,6 @@ package sdk
 import (
 	"github.com/Chendemo12/fastapi-tool/helper"
 	"github.com/Chendemo12/fastapi-tool/logger"
-	"github.com/Chendemo12/functools/python"
 	"github.com/Chendemo12/micromq/src/proto"
 	"github.com/Chendemo12/micromq/src/transfer"
 	"sync"
@@ -34,6 +33,24 @@ type Consumer struct {
 	broker  *Broker
 	handler ConsumerHandler // 消息处理方法
 	mu      *sync.Mutex
+	// 各主题的起始位置, 仅在首次注册时生效, 重连后自已收到的最新消息之后继续消费
+	positions map[string]*proto.StartPosition
+	offsets   map[string]map[int]uint64 // 各主题内各分区下一个待接收的偏移量, 仅记录指定了起始位置的主题
+	// 各主题内各分区待处理的消息, 同一分区内的消息依次交由 ConsumerHandler.Handler 处理
+	queues  map[partitionKey]chan *ConsumerMessage
+	topics  []string                    // 订阅列表, 初始为 ConsumerHandler.Topics, 每次注册时携带最新的订阅列表
+	subLock *sync.Mutex                 // 同一时刻仅允许一个等待中的订阅消息, 以保证响应与请求对应
+	subResp chan *proto.MessageResponse // 订阅和取消订阅的响应
+	// 待发送的确认, 由 flushAcks 合并发送
+	acks      []*proto.Acknowledgement
+	ackLock   *sync.Mutex
+	ackSignal chan struct{}
+}
+
+// 主题内的一个分区
+type partitionKey struct {
+	topic     string
+	partition int
 }
 
 func (client *Consumer) handleMessage(frame *proto.TransferFrame) {
@@ -50,28 +67,88 @@ func (client *Consumer) handleMessage(frame *proto.TransferFrame) {
 	for i := 0; i < len(serverCMs); i++ {
 		cms[i] = hmPool.GetCM()
 		cms[i].ParseFromCMessage(serverCMs[i])
+		cms[i].broker = client.broker
+		cms[i].consumer = client
 	}
+	client.advance(cms)
 
-	for _, msg := range cms {
-		cm := msg
-		go func() {
-			defer hmPool.PutCM(cm)
-			// 出现脏数据
-			if client.broker.IsRegistered() && python.Has[string](client.handler.Topics(), cm.Topic) {
-				client.handler.Handler(cm)
-			} else {
-				return
-			}
-		}()
+	for _, cm := range cms {
+		client.dispatch(cm)
 	}
 }
 
+// 将消息加入其所属分区的队列, 不同主题或分区的消息并发处理
+func (client *Consumer) dispatch(cm *ConsumerMessage) {
+	key := partitionKey{topic: cm.Topic, partition: cm.Partition}
+
+	client.mu.Lock()
+	queue, ok := client.queues[key]
+	if !ok {
+		queue = make(chan *ConsumerMessage, DefaultPartitionQueueSize)
+		client.queues[key] = queue
+		go client.work(queue)
+	}
+	client.mu.Unlock()
+
+	select {
+	case queue <- cm:
+	case <-client.broker.Done():
+		hmPool.PutCM(cm)
+	}
+}
+
+// 依次处理一个分区内的消息, 直到消费者关闭
+func (client *Consumer) work(queue chan *ConsumerMessage) {
+	for {
+		select {
+		case <-client.broker.Done():
+			return
+		case cm := <-queue:
+			client.handle(cm)
+			hmPool.PutCM(cm)
+		}
+	}
+}
+
+// 处理一个消息, 未启用 Config.ManualAck 时在处理之后确认; 已取消订阅的主题的消息直接确认而不处理,
+// 未注册时收到的脏数据既不处理也不确认, 由服务端在重连后重新推送
+func (client *Consumer) handle(cm *ConsumerMessage) {
+	if !client.broker.IsRegistered() {
+		return
+	}
+	if client.subscribed(cm.Topic) {
+		client.handler.Handler(cm)
+		if client.broker.conf.ManualAck {
+			return
+		}
+	}
+	client.Ack(cm)
+}
+
+// 消息所属的主题是否已订阅, 服务端支持 proto.WildcardCapability 时通配符模式匹配的主题也视为已订阅
+func (client *Consumer) subscribed(topic string) bool {
+	client.mu.Lock()
+	topics := client.topics // 订阅列表总是整体替换, 无需复制
+	client.mu.Unlock()
+
+	wildcard := client.broker.HasCapability(proto.WildcardCapability)
+	for _, name := range topics {
+		if name == topic || (wildcard && proto.MatchTopic(name, topic)) {
+			return true
+		}
+	}
+	return false
+}
+
 func (client *Consumer) distribute(frame *proto.TransferFrame, con transfer.Conn) {
 
 	switch frame.Type() {
-	case proto.CMessageType:
+	case proto.CMessageType, proto.HCMessageType:
 		client.handleMessage(frame)
 
+	case proto.SubscribeMessageRespType: // 订阅和取消订阅的响应
+		client.handleSubscribeResponse(frame, con)
+
 	default: // 未识别的帧类型
 		client.handler.OnNotImplementMessageType(frame, con)
 	}
@@ -88,6 +165,9 @@ func (client *Consumer) IsRegistered() bool { return client.broker.IsRegistered(
 // StatusOK 连接状态是否正常,以及是否可以向服务器发送消息
 func (client *Consumer) StatusOK() bool { return client.broker.StatusOK() }
 
+// Capabilities 与服务端协商后双方均支持的能力
+func (client *Consumer) Capabilities() proto.Capabilities { return client.broker.Capabilities() }
+
 // HeartbeatInterval 心跳周期
 func (client *Consumer) HeartbeatInterval() time.Duration {
 	return client.broker.HeartbeatInterval()
@@ -112,7 +192,7 @@ func (client *Consumer) SetCrypto(crypto proto.Crypto) *Consumer {
 
 // SetCryptoPlan 设置加密方案
 //
-//	@param	option	string		加密方案, 支持token/no (令牌加密和不加密)
+//	@param	option	string		加密方案, 支持no/token/aes-gcm/chacha20-poly1305, 详见 proto.CreateCrypto
 //	@param	key 	[]string	其他加密参数
 func (client *Consumer) SetCryptoPlan(option string, key ...string) *Consumer {
 	client.broker.SetCryptoPlan(option, key...)
@@ -120,12 +200,28 @@ func (client *Consumer) SetCryptoPlan(option string, key ...string) *Consumer {
 	return client
 }
 
+// BindMessageHandler 绑定一个自定义消息的处理器, 可在 Start 之前调用, 详见 Broker.BindMessageHandler
+func (client *Consumer) BindMessageHandler(m proto.Message, handler MessageHandler) error {
+	return client.broker.BindMessageHandler(m, handler)
+}
+
+// SendMessage 发送一个自定义消息, 不等待响应
+func (client *Consumer) SendMessage(m proto.Message) error { return client.broker.SendMessage(m) }
+
+// Call 发送一个自定义消息, 并在超时时间内等待服务端的响应, 详见 Broker.Call
+func (client *Consumer) Call(m proto.Message, resp proto.Message, timeout time.Duration) error {
+	return client.broker.Call(m, resp, timeout)
+}
+
 // HandlerFunc 获取注册的消息处理方法
 func (client *Consumer) HandlerFunc() ConsumerHandler { return client.handler }
 
 // Start 异步启动
 func (client *Consumer) Start() error {
 	client.broker.init()
+	if client.broker.cryptoErr != nil {
+		return client.broker.cryptoErr
+	}
 
 	err := client.broker.link.Connect()
 	if err != nil {
@@ -134,6 +230,7 @@ func (client *Consumer) Start() error {
 	}
 
 	go client.broker.HeartbeatTask()
+	go client.flushAcks()
 
 	return nil
 }
@@ -156,12 +253,12 @@ func (client *Consumer) JSONMarshal(v any) ([]byte, error) {
 
 // NewConsumer 创建一个消费者，需要手动Start
 func NewConsumer(conf Config, handler ConsumerHandler) (*Consumer, error) {
-	if handler == nil || len(handler.Topics()) < 1 {
-		return nil, ErrTopicEmpty
+	if handler == nil {
+		return nil, ErrConsumerHandlerIsNil
 	}
 
-	if handler == nil || handler.Handler == nil {
-		return nil, ErrConsumerHandlerIsNil
+	if len(handler.Topics()) < 1 {
+		return nil, ErrTopicEmpty
 	}
 
 	c := &Config{
@@ -171,20 +268,51 @@ func NewConsumer(conf Config, handler ConsumerHandler) (*Consumer, error) {
 		PCtx:   conf.PCtx,
 		Logger: conf.Logger,
 		Token:  proto.CalcSHA(conf.Token),
+		// 帧版本
+		FrameVersion: conf.FrameVersion,
+		Capabilities: conf.Capabilities,
+		Compression:  conf.Compression,
+		// 控制消息编码
+		MarshalMethod: conf.MarshalMethod,
+		// 消费者组
+		Group:   conf.Group,
+		Balance: conf.Balance,
+		// 消息确认
+		ConsumerID: conf.ConsumerID,
+		ManualAck:  conf.ManualAck,
 	}
 	c.clean()
+	if c.ConsumerID == "" {
+		c.ConsumerID = newClientID()
+	}
 
-	con := &Consumer{handler: handler, mu: &sync.Mutex{}}
+	con := &Consumer{
+		handler:   handler,
+		mu:        &sync.Mutex{},
+		positions: make(map[string]*proto.StartPosition),
+		offsets:   make(map[string]map[int]uint64),
+		queues:    make(map[partitionKey]chan *ConsumerMessage),
+		topics:    append([]string{}, handler.Topics()...),
+		subLock:   &sync.Mutex{},
+		subResp:   make(chan *proto.MessageResponse, 1),
+		ackLock:   &sync.Mutex{},
+		ackSignal: make(chan struct{}, 1),
+	}
 	con.broker = &Broker{
 		conf:           c,
 		linkType:       proto.ConsumerLinkType,
 		event:          handler,
+		customs:        newCustoms(),
 		messageHandler: con.distribute,
 	}
 
+	con.broker.beforeRegister = con.beforeRegister
 	con.broker.SetTransfer("tcp") // TODO: 目前仅支持TCP
 	con.broker.SetRegisterMessage(&proto.RegisterMessage{
-		Topics: handler.Topics(),
+		Topics:  handler.Topics(),
+		Group:   c.Group,
+		Balance: c.Balance,
+		ID:      c.ConsumerID,
 	})
 
 	return con, nil
@@ -0,0 +1,160 @@
+package sdk
+
+import (
+	"github.com/Chendemo12/micromq/src/proto"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// DefaultCallTimeout 自定义消息等待响应的默认超时时间
+const DefaultCallTimeout = 5 * time.Second
+
+// MessageHandler 自定义消息处理器, msg 为已解密并反序列化的消息, 其类型与绑定时传入的消息一致
+type MessageHandler func(msg proto.Message)
+
+type customHandler struct {
+	rt      reflect.Type // 消息的结构体类型, 每收到一个消息帧都会创建一个新的实例
+	handler MessageHandler
+}
+
+// 等待响应中的自定义消息
+type customCall struct {
+	resp proto.Message
+	done chan error
+}
+
+// 自定义消息的处理器和等待中的调用
+type customs struct {
+	mu       *sync.Mutex
+	callLock *sync.Mutex // 同一时刻仅允许一个等待中的调用, 以保证响应与请求对应
+	handlers map[proto.MessageType]*customHandler
+	calls    map[proto.MessageType]*customCall
+}
+
+func newCustoms() *customs {
+	return &customs{
+		mu:       &sync.Mutex{},
+		callLock: &sync.Mutex{},
+		handlers: make(map[proto.MessageType]*customHandler),
+		calls:    make(map[proto.MessageType]*customCall),
+	}
+}
+
+// 处理自定义消息, 返回此消息是否已被处理
+// 等待中的调用优先于处理器, 且每个调用仅接收一个响应
+func (b *Broker) handleCustomMessage(frame *proto.TransferFrame) bool {
+	b.customs.mu.Lock()
+	if call, ok := b.customs.calls[frame.Type()]; ok {
+		delete(b.customs.calls, frame.Type())
+		// 在锁内解析, 以避免调用超时返回之后 resp 仍被修改
+		call.done <- frame.Unmarshal(call.resp, b.crypto.Decrypt)
+		b.customs.mu.Unlock()
+		return true
+	}
+	h, ok := b.customs.handlers[frame.Type()]
+	b.customs.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	msg := reflect.New(h.rt).Interface().(proto.Message)
+	if err := frame.Unmarshal(msg, b.crypto.Decrypt); err != nil {
+		b.Logger().Warn("custom message unmarshal failed: ", frame.String(), " ", err.Error())
+		return true
+	}
+	h.handler(msg)
+
+	return true
+}
+
+// BindMessageHandler 绑定一个自定义消息的处理器, 收到此类消息时不再触发 OnNotImplementMessageType
+//
+//	@param	m		proto.Message	自定义消息的指针, 不允许与内置消息冲突, 编解码方式详见 proto.NotImplementMessage
+//	@param	handler	MessageHandler	消息处理方法, 为nil时解除绑定
+func (b *Broker) BindMessageHandler(m proto.Message, handler MessageHandler) error {
+	if !proto.IsMessageDefined(m.MessageType()) {
+		return ErrBuiltinMessageType
+	}
+	rt := reflect.TypeOf(m)
+	if rt.Kind() != reflect.Ptr {
+		return ErrMessageNotPointer
+	}
+
+	b.customs.mu.Lock()
+	defer b.customs.mu.Unlock()
+	if handler == nil {
+		delete(b.customs.handlers, m.MessageType())
+	} else {
+		b.customs.handlers[m.MessageType()] = &customHandler{rt: rt.Elem(), handler: handler}
+	}
+
+	return nil
+}
+
+// SendMessage 发送一个自定义消息, 不等待响应
+func (b *Broker) SendMessage(m proto.Message) error {
+	if !proto.IsMessageDefined(m.MessageType()) {
+		return ErrBuiltinMessageType
+	}
+	if !b.StatusOK() {
+		return b.unregisteredErr()
+	}
+
+	frame := framePool.Get()
+	defer framePool.Put(frame)
+
+	return b.Send(frame, m)
+}
+
+// Call 发送一个自定义消息, 并等待服务端返回类型为 resp.MessageType() 的响应
+// 调用是串行的, 上一个调用返回之前, 后续调用会被阻塞
+//
+//	@param	m		proto.Message	自定义消息
+//	@param	resp	proto.Message	响应消息的指针, 收到响应后会被就地解析, 必须为自定义消息
+//	@param	timeout	time.Duration	等待响应的超时时间, <=0 时为 DefaultCallTimeout
+func (b *Broker) Call(m proto.Message, resp proto.Message, timeout time.Duration) error {
+	if !proto.IsMessageDefined(resp.MessageType()) {
+		return ErrBuiltinMessageType
+	}
+	if timeout <= 0 {
+		timeout = DefaultCallTimeout
+	}
+
+	b.customs.callLock.Lock()
+	defer b.customs.callLock.Unlock()
+
+	call := &customCall{resp: resp, done: make(chan error, 1)}
+	b.customs.mu.Lock()
+	b.customs.calls[resp.MessageType()] = call
+	b.customs.mu.Unlock()
+	defer func() {
+		b.customs.mu.Lock()
+		delete(b.customs.calls, resp.MessageType())
+		b.customs.mu.Unlock()
+	}()
+
+	if err := b.SendMessage(m); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-call.done:
+		return err
+	case <-timer.C:
+		return ErrCallTimeout
+	case <-b.ctx.Done():
+		return b.ctx.Err()
+	}
+}
+
+// 未注册时返回的错误
+func (b *Broker) unregisteredErr() error {
+	if b.linkType == proto.ConsumerLinkType {
+		return ErrConsumerUnregistered
+	}
+	return ErrProducerUnregistered
+}
@@ -30,6 +30,8 @@ type ProducerForm struct {
 	Key   string `json:"key" description:"消息键"`
 	Value string `json:"value" description:"base64编码后的消息体"`
 	Token string `json:"token,omitempty" description:"认证密钥"`
+	// 消息头不参与加密
+	Headers map[string]string `json:"headers,omitempty" description:"消息头, 值为base64编码后的明文"`
 }
 
 func (m ProducerForm) String() string {
@@ -43,7 +45,7 @@ func (m ProducerForm) IsEncrypt() bool { return m.Topic != "" }
 
 // ProductResponse 消息返回值; 仅当 status=Accepted 时才认为服务器接受了请求并正确的处理了消息
 type ProductResponse struct {
-	Status       string `json:"status" validate:"oneof=Accepted UnmarshalFailed TokenIncorrect Let-ReRegister Refused" description:"消息接收状态"`
+	Status       string `json:"status" validate:"oneof=Accepted UnmarshalFailed TokenIncorrect Let-ReRegister Refused SchemaInvalid" description:"消息接收状态"`
 	Offset       uint64 `json:"offset" description:"消息偏移量"`
 	ResponseTime int64  `json:"response_time" description:"服务端返回消息时的时间戳"`
 	Message      string `json:"message" description:"额外的消息描述"`
@@ -62,6 +64,8 @@ func (m ProductResponse) Error() error {
 		return errors.New("broker refused message")
 	case proto.GetMessageResponseStatusText(proto.TokenIncorrectStatus):
 		return ErrTokenIncorrect
+	case proto.GetMessageResponseStatusText(proto.SchemaInvalidStatus):
+		return ErrSchemaInvalid
 	default:
 		return nil
 	}
@@ -126,6 +130,11 @@ func (p *HttpProducer) SetAsyncPath(path string) *HttpProducer {
 
 // Send 发送消息
 func (p *HttpProducer) Send(topic, key string, value []byte) (*ProductResponse, error) {
+	return p.SendWithHeaders(topic, key, value, nil)
+}
+
+// SendWithHeaders 发送携带消息头的消息
+func (p *HttpProducer) SendWithHeaders(topic, key string, value []byte, headers proto.Headers) (*ProductResponse, error) {
 	if topic == "" {
 		return nil, ErrTopicEmpty
 	}
@@ -134,6 +143,12 @@ func (p *HttpProducer) Send(topic, key string, value []byte) (*ProductResponse,
 	msg.Topic = topic
 	msg.Key = key
 	msg.Token = p.token
+	if len(headers) > 0 {
+		msg.Headers = make(map[string]string, len(headers))
+		for k, v := range headers {
+			msg.Headers[k] = helper.Base64Encode(v)
+		}
+	}
 
 	var content []byte
 	var err error
@@ -8,8 +8,8 @@ import (
 	"github.com/Chendemo12/functools/tcp"
 	"github.com/Chendemo12/micromq/src/proto"
 	"github.com/Chendemo12/micromq/src/transfer"
-	"io"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -25,6 +25,26 @@ type Config struct {
 	PCtx     context.Context `json:"-"` // 父context，默认为 context.Background()
 	Logger   logger.Iface    `json:"-"`
 	Token    string          `json:"-"`
+	// 帧格式版本, 默认为 proto.FrameV1 以兼容旧版本的服务端
+	FrameVersion proto.FrameVersion `json:"frame_version"`
+	// 客户端声明支持的可选能力, 默认为 proto.DefaultCapabilities, 最终启用的能力由服务端协商确定
+	Capabilities proto.Capabilities `json:"capabilities"`
+	// 生产者消息的压缩方案, 支持gzip/deflate/no, 仅当 FrameVersion 为 proto.FrameV2 且服务端支持时有效
+	Compression string `json:"compression"`
+	// 心跳和响应等控制消息的序列化方法, 默认为 proto.JsonMarshalMethod
+	// 仅当 FrameVersion 为 proto.FrameV2 且服务端支持时有效, 注册消息始终采用 JSON 编码
+	MarshalMethod proto.MarshalMethodType `json:"marshal_method"`
+	// 幂等生产者ID, 仅对生产者有效, 缺省时随机生成; 固定的ID可使服务端在生产者进程重启后继续去除重复消息
+	ProducerID string `json:"producer_id"`
+	// 消费者组名称, 仅对消费者有效; 同一组内的消费者分担主题内的消息, 每个消息仅推送给组内的一个成员
+	Group string `json:"group"`
+	// 消费者组内分配消息的方式, 默认为 proto.RoundRobinBalance, 以组内首个成员的设置为准
+	Balance proto.BalanceType `json:"balance"`
+	// 消费者ID, 仅对消费者有效, 缺省时随机生成; 服务端据此在重连后重新推送未确认的消息,
+	// 固定的ID可使未确认的消息在消费者进程重启后继续推送
+	ConsumerID string `json:"consumer_id"`
+	// 手动确认消息, 仅对消费者有效; 默认在 ConsumerHandler.Handler 返回后自动确认, 详见 Consumer.Ack
+	ManualAck bool `json:"manual_ack"`
 }
 
 func (c *Config) clean() *Config {
@@ -43,6 +63,15 @@ func (c *Config) clean() *Config {
 	if c.LinkType == "" {
 		c.LinkType = "tcp"
 	}
+	if c.FrameVersion != proto.FrameV2 {
+		c.FrameVersion = proto.FrameV1
+	}
+	if c.Capabilities == nil {
+		c.Capabilities = proto.DefaultCapabilities()
+	}
+	if c.MarshalMethod != proto.BinaryMarshalMethod {
+		c.MarshalMethod = proto.JsonMarshalMethod
+	}
 
 	return c
 }
@@ -54,6 +83,7 @@ type Link interface {
 	SetUDPHandler(handler func())
 	Write(p []byte) (int, error) // 将切片buf中的内容追加到发数据缓冲区内，并返回写入的数据长度
 	Drain() error                // 将缓冲区的数据发生到客户端
+	sync.Locker                  // 写入一个完整的帧期间持有锁, 以免分段发送的帧被其他帧打断
 }
 
 // Broker Broker连接管理，负责连接服务器并完成注册任务
@@ -72,15 +102,27 @@ type Broker struct {
 	event       ProducerHandler        // 事件触发器
 	tokenCrypto *proto.TokenCrypto     // 用于注册消息加解密
 	crypto      proto.Crypto           // 加解密器
+	cryptoErr   error                  // 加密方案设置错误, 会阻止客户端启动
+	compressor  proto.Compressor       // 压缩器
+	customs     *customs               // 自定义消息的处理器和等待中的调用
+	partial     []byte                 // 上一个消息末尾不完整的帧, 仅由读取连接的协程访问
+	// 每次发送注册消息之前的回调, 用于更新注册消息
+	beforeRegister func(reg *proto.RegisterMessage)
+	// 每次注册成功之后的回调, 异步执行
+	afterRegister func()
+	// 消息响应的回调, 在读取数据的协程内执行
+	responseHandler func(resp *proto.MessageResponse)
 	// 消息处理器
 	messageHandler func(frame *proto.TransferFrame, con transfer.Conn)
 }
 
+// 注册响应在读取数据的协程内处理, 因此重新注册和事件回调均异步执行, 以免阻塞读取
 func (b *Broker) handleRegisterMessage(frame *proto.TransferFrame, con transfer.Conn) {
+	b.regResp.Reset()                 // 旧版本的服务端不会返回协商结果, 需清除上一次的记录
 	err := frame.Unmarshal(b.regResp) // 注册响应不加密
 	if err != nil {
 		b.Logger().Warn("register message response unmarshal failed: ", err.Error())
-		_ = b.ReRegister(true) // retry
+		go func() { _ = b.ReRegister(true) }() // retry
 		return
 	}
 
@@ -89,27 +131,34 @@ func (b *Broker) handleRegisterMessage(frame *proto.TransferFrame, con transfer.
 
 	case proto.AcceptedStatus:
 		b.isRegister.Store(true)
-		b.Logger().Info(b.linkType + " register successfully")
-		b.event.OnRegistered()
+		b.Logger().Info(fmt.Sprintf(
+			"%s register successfully, protocol version: %d, capabilities: %v",
+			b.linkType, b.ProtocolVersion(), b.Capabilities(),
+		))
+		if b.afterRegister != nil {
+			go b.afterRegister()
+		}
+		go b.event.OnRegistered()
 
 	case proto.ReRegisterStatus:
 		b.isRegister.Store(false)
 		b.Logger().Warn(b.linkType+" register delay: ", proto.GetMessageResponseStatusText(b.regResp.Status))
-		_ = b.ReRegister(true)
+		go func() { _ = b.ReRegister(true) }()
 
 	default:
 		b.isRegister.Store(false)
 		b.Logger().Warn(b.linkType+" register failed: ", proto.GetMessageResponseStatusText(b.regResp.Status))
-		b.event.OnRegisterFailed(b.regResp.Status)
+		go b.event.OnRegisterFailed(b.regResp.Status)
 	}
 }
 
-func (b *Broker) handleMessageResponse(frame *proto.TransferFrame, con transfer.Conn) {
+// 处理消息响应, 解析失败时返回nil
+func (b *Broker) handleMessageResponse(frame *proto.TransferFrame, con transfer.Conn) *proto.MessageResponse {
 	resp := &proto.MessageResponse{}
 	err := frame.Unmarshal(resp, b.crypto.Decrypt)
 	if err != nil {
 		b.Logger().Warn("frame decrypt failed: ", frame.String(), " ", err.Error())
-		return
+		return nil
 	}
 
 	switch resp.Status {
@@ -124,12 +173,18 @@ func (b *Broker) handleMessageResponse(frame *proto.TransferFrame, con transfer.
 		))
 		b.event.OnRegisterFailed(resp.Status)
 
+	case proto.SchemaInvalidStatus: // 存在不符合主题模式而被拒绝的消息, 连接仍然有效
+		b.receiveACK()
+		b.Logger().Warn(b.linkType, " message rejected by topic schema, offset: ", resp.Offset)
+
 	case proto.ReRegisterStatus: // 服务器令客户端重新注册
 		b.isRegister.Store(false)
 		b.Logger().Debug(b.linkType, " register expire, sever let re-register")
 		b.event.OnRegisterExpire()
 		_ = b.ReRegister(true)
 	}
+
+	return resp
 }
 
 func (b *Broker) distribute(frame *proto.TransferFrame, con transfer.Conn) {
@@ -139,10 +194,14 @@ func (b *Broker) distribute(frame *proto.TransferFrame, con transfer.Conn) {
 		b.handleRegisterMessage(frame, con)
 
 	case proto.MessageRespType:
-		b.handleMessageResponse(frame, con)
+		if resp := b.handleMessageResponse(frame, con); resp != nil && b.responseHandler != nil {
+			b.responseHandler(resp)
+		}
 
-	default: // 处理其他消息类型，交由上层处理
-		b.messageHandler(frame, con)
+	default: // 优先处理已绑定的自定义消息, 其他消息类型交由上层处理
+		if !b.handleCustomMessage(frame) {
+			b.messageHandler(frame, con)
+		}
 	}
 }
 
@@ -161,6 +220,9 @@ func (b *Broker) init() *Broker {
 		// 初始化为不加密
 		b.crypto = proto.DefaultCrypto()
 	}
+	if b.compressor == nil {
+		b.compressor = proto.CreateCompressor(b.conf.Compression)
+	}
 	b.regResp = &proto.MessageResponse{}
 	b.isRegister = &atomic.Bool{}
 	b.isConnected = &atomic.Bool{}
@@ -169,6 +231,7 @@ func (b *Broker) init() *Broker {
 		b.Logger().Debug("broker token authentication is enabled.")
 	}
 	b.Logger().Debug("broker global crypto: ", b.crypto.String())
+	b.Logger().Debug("broker compressor: ", b.compressor.String())
 
 	return b
 }
@@ -178,8 +241,8 @@ func (b *Broker) init() *Broker {
 // IsConnected 与服务端是否连接成功
 func (b *Broker) IsConnected() bool { return b.isConnected.Load() }
 
-// IsRegistered 向服务端注册消费者是否成功
-func (b *Broker) IsRegistered() bool { return b.isRegister.Load() }
+// IsRegistered 向服务端注册消费者是否成功, 在 Start 之前亦可调用
+func (b *Broker) IsRegistered() bool { return b.isRegister != nil && b.isRegister.Load() }
 
 // StatusOK 连接状态是否正常
 func (b *Broker) StatusOK() bool { return b.isConnected.Load() && b.isRegister.Load() }
@@ -188,6 +251,27 @@ func (b *Broker) Logger() logger.Iface { return b.conf.Logger }
 
 func (b *Broker) LinkType() proto.LinkType { return b.linkType }
 
+// ProtocolVersion 与服务端协商后的协议版本, 旧版本的服务端视为 proto.LegacyProtocolVersion
+func (b *Broker) ProtocolVersion() int {
+	if b.regResp.Version < proto.LegacyProtocolVersion {
+		return proto.LegacyProtocolVersion
+	}
+	return b.regResp.Version
+}
+
+// Capabilities 与服务端协商后双方均支持的能力, 注册成功之前为空
+func (b *Broker) Capabilities() proto.Capabilities {
+	return b.regResp.Capabilities
+}
+
+// HasCapability 协商后的能力集合中是否包含某项能力
+func (b *Broker) HasCapability(capability proto.Capability) bool {
+	return b.regResp.Capabilities.Has(capability)
+}
+
+// FrameVersion 与服务端通信所采用的帧版本
+func (b *Broker) FrameVersion() proto.FrameVersion { return b.conf.FrameVersion }
+
 func (b *Broker) Done() <-chan struct{} { return b.ctx.Done() }
 
 // SetCrypto 修改全局加解密器, 必须在 Serve 之前设置
@@ -199,18 +283,47 @@ func (b *Broker) SetCrypto(crypto proto.Crypto) *Broker {
 	return b
 }
 
-// SetCryptoPlan 设置加密方案
+// SetCryptoPlan 设置加密方案, 若方案不存在或参数错误, 则客户端启动时会返回错误而不会退化为不加密
 //
-//	@param	option	string		加密方案, 支持token/no (令牌加密和不加密)
-//	@param	key 	[]string	其他加密参数
+//	@param	option	string		加密方案, 支持no/token/aes-gcm/chacha20-poly1305, 详见 proto.CreateCrypto
+//	@param	key 	[]string	其他加密参数, AEAD 方案为密钥(第一个用于加密), 缺省时采用令牌, 详见 proto.CryptoKeys
 func (b *Broker) SetCryptoPlan(option string, key ...string) *Broker {
-	args := append([]string{b.conf.Token}, key...)
-	b.crypto = proto.CreateCrypto(option, args...)
+	crypto, err := proto.CreateCrypto(option, proto.CryptoKeys(option, b.conf.Token, key...)...)
+	if err != nil {
+		b.cryptoErr = err
+		b.Logger().Error("broker crypto plan is invalid: ", err)
+		return b
+	}
 
+	b.crypto = crypto
+	b.cryptoErr = nil
 	b.Logger().Debug("broker global crypto reset: ", b.crypto.String())
 	return b
 }
 
+// SetCompressor 修改压缩器, 必须在 Serve 之前设置
+func (b *Broker) SetCompressor(compressor proto.Compressor) *Broker {
+	if compressor != nil {
+		b.compressor = compressor
+	}
+
+	return b
+}
+
+// 仅当服务端支持时才压缩消息, 否则服务端无法解析
+func (b *Broker) setCompressor(frame *proto.TransferFrame) {
+	if b.HasCapability(proto.CompressionCapability) {
+		frame.SetCompressor(b.compressor)
+	}
+}
+
+// 仅当服务端支持时才采用二进制编码控制消息, 服务端的响应会沿用相同的编码
+func (b *Broker) setMarshalMethod(frame *proto.TransferFrame) {
+	if b.HasCapability(proto.BinaryMarshalCapability) {
+		frame.SetMessageMarshalMethod(b.conf.MarshalMethod)
+	}
+}
+
 // HeartbeatTask 心跳轮询任务
 func (b *Broker) HeartbeatTask() {
 	for {
@@ -244,13 +357,17 @@ func (b *Broker) ReRegister(delay bool) error {
 	frame := framePool.Get()
 	defer framePool.Put(frame)
 
+	if b.beforeRegister != nil {
+		b.beforeRegister(b.reg)
+	}
+
+	frame.SetVersion(b.FrameVersion())
 	err := frame.BuildFrom(b.reg, b.tokenCrypto.Encrypt)
 	if err != nil {
 		return err
 	}
 
-	_, _ = frame.WriteTo(b.link)
-	return b.link.Drain()
+	return frame.DrainTo(b.link)
 }
 
 // TickerInterval 数据发送周期
@@ -273,6 +390,8 @@ func (b *Broker) SetRegisterMessage(message *proto.RegisterMessage) *Broker {
 	message.Type = b.linkType
 	message.Token = b.conf.Token
 	message.Ack = b.conf.Ack
+	message.Version = proto.ProtocolVersion
+	message.Capabilities = b.conf.Capabilities
 	b.reg = message
 
 	return b
@@ -286,6 +405,7 @@ func (b *Broker) SetTransfer(trans string) *Broker {
 			Host:     b.conf.Host,
 			Port:     b.conf.Port,
 			LinkType: b.linkType,
+			mu:       &sync.Mutex{},
 			handler:  b,
 			logger:   b.Logger(),
 		}
@@ -301,18 +421,16 @@ func (b *Broker) Send(frame *proto.TransferFrame, message proto.Message) error {
 	//	frame, []*proto.PMessage{serverPM}, client.Crypto().Encrypt,
 	//)
 
-	// 加密消息帧
+	// 压缩并加密消息帧
+	frame.SetVersion(b.FrameVersion())
+	b.setCompressor(frame)
+	b.setMarshalMethod(frame)
 	err := frame.BuildFrom(message, b.crypto.Encrypt)
 	if err != nil {
 		return err
 	}
-	_, _ = frame.WriteTo(b.link)
-	err = b.link.Drain()
-	if err != nil {
-		return err
-	}
 
-	return nil
+	return frame.DrainTo(b.link)
 }
 
 // AsyncSend 异步发送消息
@@ -321,15 +439,30 @@ func (b *Broker) AsyncSend(frame *proto.TransferFrame, message proto.Message) er
 	//	frame, []*proto.PMessage{serverPM}, client.Crypto().Encrypt,
 	//)
 
-	// 加密消息帧
+	// 压缩并加密消息帧
+	frame.SetVersion(b.FrameVersion())
+	b.setCompressor(frame)
+	b.setMarshalMethod(frame)
 	err := frame.BuildFrom(message, b.crypto.Encrypt)
 	if err != nil {
 		return err
 	}
 
-	_, _ = frame.WriteTo(b.link)
+	// 帧在返回之后即被释放, 因此分段发送的帧须在返回之前发出
+	if frame.Length() > proto.MaxTransferMessageLength {
+		return frame.DrainTo(b.link)
+	}
+
+	b.link.Lock()
+	_, err = frame.WriteTo(b.link)
+	b.link.Unlock()
+	if err != nil {
+		return err
+	}
 	go func() {
-		err = b.link.Drain()
+		b.link.Lock()
+		err := b.link.Drain()
+		b.link.Unlock()
 		if err != nil {
 			b.Logger().Warn("send message to server failed: ", err)
 		}
@@ -346,6 +479,7 @@ func (b *Broker) OnAccepted(_ *tcp.Remote) error {
 
 	b.isConnected.Store(true)
 	b.isRegister.Store(false)
+	b.partial = nil // 断开之前未收完的帧不再有后续数据
 	b.event.OnConnected()
 
 	// 连接成功,发送注册消息
@@ -363,26 +497,58 @@ func (b *Broker) OnClosed(_ *tcp.Remote) error {
 }
 
 func (b *Broker) Handler(r *tcp.Remote) error {
-	if r.Len() < proto.FrameMinLength {
+	if b.partial == nil && r.Len() < proto.FrameMinLength {
 		//return proto.ErrMessageNotFull
 		return nil
 	}
 
-	frame := framePool.Get()
-	err := frame.ParseFrom(r) // 此操作不应并发读取，避免消息2覆盖消息1的缓冲区
+	// 一次读取的数据内可能包含多个帧, 损坏的数据会被跳过
+	stream := r.Unread()
+	r.ReadN(len(stream)) // 标记数据已被读取
 
-	// 异步执行，立刻读取下一条消息
-	go func(f *proto.TransferFrame, client transfer.Conn, err error) { // 处理消息帧
-		defer framePool.Put(f)
+	// 超过传输层单个消息长度的帧被分割为多个消息, 与上一个消息末尾不完整的帧拼接后解析
+	owned := b.partial != nil
+	if owned {
+		stream = append(b.partial, stream...)
+		b.partial = nil
+	}
 
-		if err != nil {
-			if !errors.Is(err, io.EOF) {
+	scanner := proto.NewFrameScanner(stream, b.FrameVersion()).AllowPartial()
+	for scanner.More() {
+		frame := framePool.Get()
+		err := scanner.Next(frame) // 此操作不应并发读取，避免消息2覆盖消息1的缓冲区
+		if errors.Is(err, proto.ErrFrameIncomplete) {
+			framePool.Put(frame)
+			break
+		}
+
+		// 注册响应须在其后的消息之前处理, 否则服务端紧随其后推送的消息会因尚未注册而被丢弃;
+		// 消费者消息须按到达的顺序分发, 以保证分区内的顺序
+		if err == nil && (frame.Type() == proto.RegisterMessageRespType ||
+			frame.Type() == proto.CMessageType || frame.Type() == proto.HCMessageType) {
+			b.distribute(frame, r)
+			framePool.Put(frame)
+			continue
+		}
+
+		// 异步执行，立刻读取下一条消息
+		go func(f *proto.TransferFrame, client transfer.Conn, err error) { // 处理消息帧
+			defer framePool.Put(f)
+
+			if err != nil {
 				b.Logger().Warn(fmt.Errorf("%s parse frame failed: %v", b.linkType, err))
+			} else {
+				b.distribute(f, client)
 			}
-		} else {
-			b.distribute(f, client)
+		}(frame, r, err)
+	}
+
+	if remainder := scanner.Remainder(); remainder != nil {
+		if !owned { // 接收缓冲区会被下一个消息覆盖
+			remainder = append([]byte{}, remainder...)
 		}
-	}(frame, r, err)
+		b.partial = remainder
+	}
 
 	return nil
 }
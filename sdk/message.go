@@ -15,8 +15,13 @@ type ConsumerMessage struct {
 	Topic       string    `json:"topic"`
 	Key         string    `json:"key"`
 	Value       []byte    `json:"value"`
-	Offset      uint64    `json:"offset"`
+	Offset      uint64    `json:"offset"`       // 消息在其分区内的偏移量
+	Partition   int       `json:"partition"`    // 消息所属的分区, 仅当服务端支持 proto.PartitionCapability 时有效
 	ProductTime time.Time `json:"product_time"` // 服务端收到消息时的时间戳
+	// 消息头, 仅当服务端支持 proto.HeadersCapability 时才会携带
+	Headers  proto.Headers `json:"headers,omitempty"`
+	broker   *Broker       // 用于回复请求, 仅由消费者接收的消息有效
+	consumer *Consumer     // 用于确认消息, 仅由消费者接收的消息有效
 }
 
 func (m *ConsumerMessage) String() string {
@@ -27,7 +32,12 @@ func (m *ConsumerMessage) String() string {
 	)
 }
 
-func (m *ConsumerMessage) MessageType() proto.MessageType { return proto.CMessageType }
+func (m *ConsumerMessage) MessageType() proto.MessageType {
+	if len(m.Headers) > 0 {
+		return proto.HCMessageType
+	}
+	return proto.CMessageType
+}
 
 func (m *ConsumerMessage) MarshalMethod() proto.MarshalMethodType {
 	return proto.JsonMarshalMethod
@@ -38,7 +48,49 @@ func (m *ConsumerMessage) ParseFromCMessage(cm *proto.CMessage) {
 	m.Key = string(cm.PM.Key)
 	m.Value = cm.PM.Value
 	m.Offset = binary.BigEndian.Uint64(cm.Offset)
+	m.Partition = int(cm.Partition)
 	m.ProductTime = time.Unix(int64(binary.BigEndian.Uint64(cm.ProductTime)), 0)
+	m.Headers = cm.PM.Headers
+}
+
+// Header 获取一个消息头, 不存在时返回nil
+func (m *ConsumerMessage) Header(key string) []byte { return m.Headers.Get(key) }
+
+// CorrelationID 请求的关联ID, 非请求消息为空
+func (m *ConsumerMessage) CorrelationID() string { return string(m.Header(proto.CorrelationIDHeader)) }
+
+// ReplyTo 请求的回复主题, 由服务端设置, 非请求消息为空
+func (m *ConsumerMessage) ReplyTo() string { return string(m.Header(proto.ReplyToHeader)) }
+
+// RedeliveryCount 消息被重新推送的次数, 首次推送时为0; 重新推送的消息可能已被处理过
+func (m *ConsumerMessage) RedeliveryCount() int { return m.Headers.RedeliveryCount() }
+
+// Ack 确认此消息已处理, 详见 Consumer.Ack; 由于消息会被回收, 必须在 ConsumerHandler.Handler 返回之前调用,
+// 此后须以 Consumer.AckOffset 确认
+func (m *ConsumerMessage) Ack() {
+	if m.consumer != nil {
+		m.consumer.Ack(m)
+	}
+}
+
+// IsRequest 是否是需要回复的请求
+func (m *ConsumerMessage) IsRequest() bool { return m.CorrelationID() != "" && m.ReplyTo() != "" }
+
+// Reply 回复请求, 回复仅会被投递给请求方; 由于消息会被回收, 必须在 ConsumerHandler.Handler 返回之前调用
+func (m *ConsumerMessage) Reply(value []byte) error {
+	if m.broker == nil {
+		return ErrNotRequest
+	}
+	return m.broker.reply(m, value)
+}
+
+// ReplyJSON 以JSON模型回复请求
+func (m *ConsumerMessage) ReplyJSON(v any) error {
+	_bytes, err := helper.JsonMarshal(v)
+	if err != nil {
+		return err
+	}
+	return m.Reply(_bytes)
 }
 
 func (m *ConsumerMessage) Reset() {
@@ -46,6 +98,10 @@ func (m *ConsumerMessage) Reset() {
 	m.Key = ""
 	m.Value = nil
 	m.Offset = 0
+	m.Partition = 0
+	m.Headers = nil
+	m.broker = nil
+	m.consumer = nil
 }
 
 // ShouldBindJSON 将数据反序列化到一个JSON模型上
@@ -60,6 +116,8 @@ type ProducerMessage struct {
 	Topic   string `json:"topic"`
 	Key     string `json:"key"`
 	Value   []byte `json:"value"`
+	// 消息头, 若服务端不支持 proto.HeadersCapability 则会被丢弃
+	Headers proto.Headers `json:"headers,omitempty"`
 }
 
 func (m *ProducerMessage) String() string {
@@ -70,7 +128,54 @@ func (m *ProducerMessage) String() string {
 	)
 }
 
-func (m *ProducerMessage) MessageType() proto.MessageType { return proto.PMessageType }
+func (m *ProducerMessage) MessageType() proto.MessageType {
+	if len(m.Headers) > 0 {
+		return proto.HPMessageType
+	}
+	return proto.PMessageType
+}
+
+// SetHeader 设置一个消息头
+func (m *ProducerMessage) SetHeader(key string, value []byte) *ProducerMessage {
+	if m.Headers == nil {
+		m.Headers = proto.Headers{}
+	}
+	m.Headers.Set(key, value)
+	return m
+}
+
+// SetTTL 设置消息的存活时间, 消息在推送给消费者之前过期则会被服务端丢弃, 精度为ms
+func (m *ProducerMessage) SetTTL(ttl time.Duration) *ProducerMessage {
+	if m.Headers == nil {
+		m.Headers = proto.Headers{}
+	}
+	m.Headers.SetTTL(ttl)
+	return m
+}
+
+// SetDeliverAt 设置消息的投递时间, 服务端会暂存消息直到此时间再推送给消费者, 精度为ms;
+// 延迟消息的存活时间自投递时起算
+func (m *ProducerMessage) SetDeliverAt(at time.Time) *ProducerMessage {
+	if m.Headers == nil {
+		m.Headers = proto.Headers{}
+	}
+	m.Headers.SetDeliverAt(at)
+	return m
+}
+
+// SetPriority 设置消息的优先级, 主题内高优先级的消息先于低优先级的消息推送给消费者, 缺省为 proto.PriorityNormal
+func (m *ProducerMessage) SetPriority(priority proto.MessagePriority) *ProducerMessage {
+	if m.Headers == nil {
+		m.Headers = proto.Headers{}
+	}
+	m.Headers.SetPriority(priority)
+	return m
+}
+
+// SetDelay 设置消息的延迟投递时长, 等同于 SetDeliverAt(time.Now().Add(delay))
+func (m *ProducerMessage) SetDelay(delay time.Duration) *ProducerMessage {
+	return m.SetDeliverAt(time.Now().Add(delay))
+}
 
 func (m *ProducerMessage) MarshalMethod() proto.MarshalMethodType {
 	return proto.JsonMarshalMethod
@@ -80,6 +185,7 @@ func (m *ProducerMessage) Reset() {
 	m.Topic = ""
 	m.Key = ""
 	m.Value = nil
+	m.Headers = nil
 }
 
 // BindFromJSON 从JSON模型获取序列化数据
@@ -5,9 +5,20 @@ import (
 	"github.com/Chendemo12/fastapi-tool/logger"
 	"github.com/Chendemo12/micromq/src/proto"
 	"github.com/Chendemo12/micromq/src/transfer"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// DefaultSendRetries 幂等生产者发送消息失败时的最大重试次数, 重试的消息保持原有的序列号, 因此不会被服务端重复发布
+const DefaultSendRetries = 3
+
+// MaxUnacknowledged 幂等生产者等待服务端确认的最大消息数量, 与服务端每个生产者ID的去重窗口一致,
+// 以免重发的消息因早于窗口而被服务端视为重复消息
+const MaxUnacknowledged = 256
+
 type ProducerHandler interface {
 	OnConnected()                                        // （同步执行）当连接成功时触发的事件, 此事件必须在执行完成之后才会进行后续的处理，因此需自行控制
 	OnClosed()                                           // （同步执行）当连接中断时触发的事件, 此事件必须在执行完成之后才会进行重连操作（若有）
@@ -37,6 +48,129 @@ type Producer struct {
 	queue    chan *ProducerMessage
 	handler  ProducerHandler
 	dingDong chan struct{}
+	requests *sync.Map // 等待回复的请求: {correlationID: chan *ConsumerMessage}
+	// 幂等生产者ID和下一个消息的序列号, 序列号自创建时的纳秒时间戳开始递增, 以在进程重启后仍保持递增
+	producerID string
+	sequence   *atomic.Uint64
+	// 已发送但未被服务端确认的幂等消息: {sequence: *ProducerMessage}, 重新注册后按序列号顺序重发
+	unacked     map[uint64]*ProducerMessage
+	unackedLock *sync.Mutex
+	// 批量消息同步发送, 同一时刻仅有一个批量消息等待响应
+	batchLock *sync.Mutex
+	batchResp chan *proto.MessageResponse
+}
+
+// 随机生成幂等生产者ID或消费者ID
+func newClientID() string {
+	id, err := newCorrelationID()
+	if err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return id
+}
+
+// 转换为协议消息, 若服务端支持幂等生产者, 则在首次转换时为消息分配序列号
+func (client *Producer) toPMessage(pm *ProducerMessage) *proto.PMessage {
+	serverPM := &proto.PMessage{
+		Topic: helper.S2B(pm.Topic),
+		Key:   helper.S2B(pm.Key),
+		Value: pm.Value,
+	}
+	if client.broker.HasCapability(proto.IdempotenceCapability) {
+		if _, _, ok := pm.Headers.ProducerSequence(); !ok {
+			if pm.Headers == nil {
+				pm.Headers = proto.Headers{}
+			}
+			pm.Headers.SetProducerSequence(client.producerID, client.sequence.Add(1))
+		}
+	}
+	if len(pm.Headers) > 0 {
+		if client.broker.HasCapability(proto.HeadersCapability) {
+			serverPM.Headers = pm.Headers
+		} else {
+			client.Logger().Warn("broker does not support headers, dropped: ", pm.String())
+		}
+	}
+
+	return serverPM
+}
+
+// 发送一个消息到服务端, 需要确认的幂等消息在发送之前记录, 直至收到服务端的确认
+func (client *Producer) send(pm *ProducerMessage) error {
+	frame := framePool.Get()
+	defer framePool.Put(frame) // release
+
+	m := client.toPMessage(pm)
+	if seq, ok := client.needConfirm(pm); ok {
+		client.unackedLock.Lock()
+		client.unacked[seq] = pm
+		client.unackedLock.Unlock()
+	}
+
+	return client.broker.Send(frame, m)
+}
+
+// 消息是否需要等待服务端确认, 仅当消息携带序列号且服务端会返回响应时需要
+func (client *Producer) needConfirm(pm *ProducerMessage) (uint64, bool) {
+	if client.broker.conf.Ack == proto.NoConfirm {
+		return 0, false
+	}
+	_, seq, ok := pm.Headers.ProducerSequence()
+	return seq, ok
+}
+
+// 归还已发送的消息, 返回是否已归还; 等待确认的消息会在重新注册后重发, 且可能被并发地重发, 因此不归还到池
+func (client *Producer) release(pm *ProducerMessage) bool {
+	if _, ok := client.needConfirm(pm); ok {
+		return false
+	}
+	hmPool.PutPM(pm)
+	return true
+}
+
+// 等待确认的消息数量
+func (client *Producer) unackedCount() int {
+	client.unackedLock.Lock()
+	defer client.unackedLock.Unlock()
+
+	return len(client.unacked)
+}
+
+// 收到服务端的消息响应, 被接收的消息不再重发, 其中被主题模式拒绝的消息重发亦无意义
+func (client *Producer) acknowledge(resp *proto.MessageResponse) {
+	if resp.Sequence == 0 || (resp.Status != proto.AcceptedStatus && resp.Status != proto.SchemaInvalidStatus) {
+		return
+	}
+
+	client.unackedLock.Lock()
+	delete(client.unacked, resp.Sequence)
+	client.unackedLock.Unlock()
+}
+
+// 重新注册后按序列号顺序重发未被确认的消息, 例如连接中断前已写入但未收到响应的消息,
+// 服务端会丢弃其中已发布的重复消息
+func (client *Producer) resendUnacked() {
+	client.unackedLock.Lock()
+	seqs := make([]uint64, 0, len(client.unacked))
+	pms := make(map[uint64]*ProducerMessage, len(client.unacked))
+	for seq, pm := range client.unacked {
+		seqs = append(seqs, seq)
+		pms[seq] = pm
+	}
+	client.unackedLock.Unlock()
+
+	if len(seqs) == 0 {
+		return
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	for _, seq := range seqs {
+		if err := client.send(pms[seq]); err != nil {
+			client.Logger().Warn("resend unacknowledged message failed: ", err)
+			return
+		}
+	}
+	client.Logger().Info("resent unacknowledged messages: ", len(seqs))
 }
 
 // 每滴答一次，就产生一个数据发送信号
@@ -55,6 +189,8 @@ func (client *Producer) tick() {
 
 func (client *Producer) sendToServer() {
 	var rate byte = 2
+	var retry *ProducerMessage // 发送失败而等待重试的消息
+	var retries = 0
 	for {
 		if !client.StatusOK() { // 客户端未连接或注册失败
 			if rate > 10 {
@@ -66,6 +202,31 @@ func (client *Producer) sendToServer() {
 		}
 
 		rate = 2 // 重置等待时间
+		if retry != nil {
+			err := client.send(retry)
+			retries++
+			if err == nil || retries >= DefaultSendRetries {
+				released := client.release(retry)
+				if err != nil && released {
+					client.Logger().Warn("send message to server failed, dropped: ", err)
+				} else if err != nil {
+					client.Logger().Warn("send message to server failed, wait to resend after re-register: ", err)
+				}
+				retry, retries = nil, 0
+			}
+			continue
+		}
+
+		if client.unackedCount() >= MaxUnacknowledged { // 等待服务端确认之前的消息
+			select {
+			case <-client.Done():
+				client.Stop()
+				return
+			case <-time.After(client.broker.TickerInterval()):
+			}
+			continue
+		}
+
 		select {
 		case <-client.Done():
 			client.Stop()
@@ -76,26 +237,28 @@ func (client *Producer) sendToServer() {
 			continue
 
 		case pm := <-client.queue:
-			frame := framePool.Get()
-			serverPM := &proto.PMessage{
-				Topic: helper.S2B(pm.Topic),
-				Key:   helper.S2B(pm.Key),
-				Value: pm.Value,
-			}
-
-			err := client.broker.Send(frame, serverPM)
+			err := client.send(pm)
 			if err != nil {
 				client.Logger().Warn("send message to server failed: ", err)
+				// 携带序列号的消息可安全地重发, 服务端会丢弃已发布的重复消息
+				if _, _, ok := pm.Headers.ProducerSequence(); ok {
+					retry = pm
+					continue
+				}
 			}
 
-			framePool.Put(frame) // release
-			hmPool.PutPM(pm)
+			client.release(pm)
 		}
 	}
 }
 
 func (client *Producer) distribute(frame *proto.TransferFrame, r transfer.Conn) {
 	switch frame.Type() {
+	case proto.HCMessageType: // 请求的回复
+		client.handleReply(frame)
+
+	case proto.BatchMessageRespType: // 批量消息的响应
+		client.handleBatchResponse(frame, r)
 
 	default: // 未识别的帧类型
 		client.handler.OnNotImplementMessageType(frame, r)
@@ -113,6 +276,12 @@ func (client *Producer) IsRegistered() bool { return client.broker.IsRegistered(
 // StatusOK 连接状态是否正常,以及是否可以向服务器发送消息
 func (client *Producer) StatusOK() bool { return client.broker.StatusOK() }
 
+// ProducerID 幂等生产者ID, 在重连后保持不变
+func (client *Producer) ProducerID() string { return client.producerID }
+
+// Capabilities 与服务端协商后双方均支持的能力
+func (client *Producer) Capabilities() proto.Capabilities { return client.broker.Capabilities() }
+
 // HeartbeatInterval 心跳周期
 func (client *Producer) HeartbeatInterval() time.Duration {
 	return client.broker.HeartbeatInterval()
@@ -137,7 +306,7 @@ func (client *Producer) SetCrypto(crypto proto.Crypto) *Producer {
 
 // SetCryptoPlan 设置加密方案
 //
-//	@param	option	string		加密方案, 支持token/no (令牌加密和不加密)
+//	@param	option	string		加密方案, 支持no/token/aes-gcm/chacha20-poly1305, 详见 proto.CreateCrypto
 //	@param	key 	[]string	其他加密参数
 func (client *Producer) SetCryptoPlan(option string, key ...string) *Producer {
 	client.broker.SetCryptoPlan(option, key...)
@@ -145,6 +314,26 @@ func (client *Producer) SetCryptoPlan(option string, key ...string) *Producer {
 	return client
 }
 
+// SetCompressor 修改压缩器, 必须在 Serve 之前设置, 优先级高于 Config.Compression
+func (client *Producer) SetCompressor(compressor proto.Compressor) *Producer {
+	client.broker.SetCompressor(compressor)
+
+	return client
+}
+
+// BindMessageHandler 绑定一个自定义消息的处理器, 可在 Start 之前调用, 详见 Broker.BindMessageHandler
+func (client *Producer) BindMessageHandler(m proto.Message, handler MessageHandler) error {
+	return client.broker.BindMessageHandler(m, handler)
+}
+
+// SendMessage 发送一个自定义消息, 不等待响应
+func (client *Producer) SendMessage(m proto.Message) error { return client.broker.SendMessage(m) }
+
+// Call 发送一个自定义消息, 并在超时时间内等待服务端的响应, 详见 Broker.Call
+func (client *Producer) Call(m proto.Message, resp proto.Message, timeout time.Duration) error {
+	return client.broker.Call(m, resp, timeout)
+}
+
 // NewRecord 从池中初始化一个新的消息记录
 func (client *Producer) NewRecord() *ProducerMessage {
 	return hmPool.GetPM()
@@ -189,6 +378,9 @@ func (client *Producer) Send(fn func(record *ProducerMessage) error) error {
 
 func (client *Producer) Start() error {
 	client.broker.init()
+	if client.broker.cryptoErr != nil {
+		return client.broker.cryptoErr
+	}
 	err := client.broker.link.Connect()
 	if err != nil {
 		// 连接服务器失败
@@ -232,15 +424,33 @@ func NewProducer(conf Config, handlers ...ProducerHandler) *Producer {
 		PCtx:   conf.PCtx,
 		Logger: conf.Logger,
 		Token:  proto.CalcSHA(conf.Token),
+		// 帧版本
+		FrameVersion: conf.FrameVersion,
+		Capabilities: conf.Capabilities,
+		Compression:  conf.Compression,
+		// 控制消息编码
+		MarshalMethod: conf.MarshalMethod,
+		ProducerID:    conf.ProducerID,
 	}
 	c.clean()
+	if c.ProducerID == "" {
+		c.ProducerID = newClientID()
+	}
 
 	con := &Producer{
-		broker:   nil,
-		queue:    make(chan *ProducerMessage, 10),
-		handler:  nil,
-		dingDong: make(chan struct{}, 1),
+		broker:      nil,
+		queue:       make(chan *ProducerMessage, 10),
+		handler:     nil,
+		dingDong:    make(chan struct{}, 1),
+		requests:    &sync.Map{},
+		producerID:  c.ProducerID,
+		sequence:    &atomic.Uint64{},
+		unacked:     make(map[uint64]*ProducerMessage),
+		unackedLock: &sync.Mutex{},
+		batchLock:   &sync.Mutex{},
+		batchResp:   make(chan *proto.MessageResponse, 1),
 	}
+	con.sequence.Store(uint64(time.Now().UnixNano()))
 	if len(handlers) > 0 && handlers[0] != nil {
 		con.handler = handlers[0]
 	} else {
@@ -251,8 +461,11 @@ func NewProducer(conf Config, handlers ...ProducerHandler) *Producer {
 		conf:           c,
 		linkType:       proto.ProducerLinkType,
 		event:          con.handler,
+		customs:        newCustoms(),
 		messageHandler: con.distribute,
 	}
+	con.broker.afterRegister = con.resendUnacked
+	con.broker.responseHandler = con.acknowledge
 
 	con.broker.SetTransfer("tcp") // TODO: 目前仅支持TCP
 	con.broker.SetRegisterMessage(&proto.RegisterMessage{})
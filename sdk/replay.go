@@ -0,0 +1,139 @@
+package sdk
+
+import (
+	"github.com/Chendemo12/micromq/src/proto"
+	"time"
+)
+
+// StartEarliest 自服务端保留的最早的消息开始消费
+func StartEarliest() *proto.StartPosition {
+	return &proto.StartPosition{Type: proto.StartEarliest}
+}
+
+// StartLatest 仅消费注册之后发布的消息, 即默认行为
+func StartLatest() *proto.StartPosition {
+	return &proto.StartPosition{Type: proto.StartLatest}
+}
+
+// StartAt 自指定的偏移量开始消费, 早于服务端保留的最早的消息时自最早的消息开始
+func StartAt(offset uint64) *proto.StartPosition {
+	return &proto.StartPosition{Type: proto.StartOffset, Value: offset}
+}
+
+// StartAtTime 自指定时间之后发布的消息开始消费
+func StartAtTime(t time.Time) *proto.StartPosition {
+	return &proto.StartPosition{Type: proto.StartTimestamp, Value: uint64(t.UnixMilli())}
+}
+
+// SetStartPosition 设置消费者在主题内的起始位置, 必须在 Start 或 Subscribe 此主题之前设置, 需要服务端支持 proto.ReplayCapability;
+// 服务端会先推送保留的历史消息, 再推送实时消息; 断线重连后自已收到的最新消息之后继续消费, 而不会重复回放
+//
+//	@param	topic	string					主题名称, 须为订阅列表之一; 为通配符模式时作用于其匹配的全部主题
+//	@param	pos		*proto.StartPosition	起始位置, 可通过 StartEarliest, StartAt 和 StartAtTime 创建
+func (client *Consumer) SetStartPosition(topic string, pos *proto.StartPosition) *Consumer {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if pos == nil || pos.Type == proto.StartLatest {
+		delete(client.positions, topic)
+	} else {
+		client.positions[topic] = pos
+	}
+
+	return client
+}
+
+// 记录各主题内各分区已收到的最新偏移量
+func (client *Consumer) advance(cms []*ConsumerMessage) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	for _, cm := range cms {
+		if client.positionOf(cm.Topic) == nil {
+			continue
+		}
+		offsets, ok := client.offsets[cm.Topic]
+		if !ok {
+			offsets = make(map[int]uint64)
+			client.offsets[cm.Topic] = offsets
+		}
+		if next, ok := offsets[cm.Partition]; !ok || cm.Offset >= next {
+			offsets[cm.Partition] = cm.Offset + 1
+		}
+	}
+}
+
+// 主题的起始位置, 未设置时取其所匹配的通配符模式的起始位置, 均未设置时为nil
+func (client *Consumer) positionOf(topic string) *proto.StartPosition {
+	if pos, ok := client.positions[topic]; ok {
+		return pos
+	}
+	if client.broker.HasCapability(proto.WildcardCapability) {
+		for name, pos := range client.positions {
+			if proto.MatchTopic(name, topic) {
+				return pos
+			}
+		}
+	}
+	return nil
+}
+
+// 在每次注册之前更新起始位置
+func (client *Consumer) setPositions(reg *proto.RegisterMessage) {
+	reg.Positions = client.startPositions(nil)
+}
+
+// 各主题的当前起始位置, topics 不为空时仅包含这些主题及其通配符模式所匹配的主题, 均未设置时为nil;
+// 已收到过消息的分区自下一个偏移量开始, 其余分区仍依据最初的起始位置;
+// 通配符模式匹配的主题以主题名称单独指定其位置, 服务端优先于模式采用;
+// 服务端不支持 proto.PartitionCapability 时, 消息均属于首个分区, 此时以 StartAt 表示, 以兼容旧版本的服务端
+func (client *Consumer) startPositions(topics []string) map[string]*proto.StartPosition {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if len(client.positions) == 0 {
+		return nil
+	}
+
+	wildcard := client.broker.HasCapability(proto.WildcardCapability)
+	include := func(topic string) bool {
+		if topics == nil {
+			return true
+		}
+		for _, name := range topics {
+			if name == topic || (wildcard && proto.MatchTopic(name, topic)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	positions := make(map[string]*proto.StartPosition, len(client.positions))
+	partitioned := client.broker.HasCapability(proto.PartitionCapability)
+	for topic, pos := range client.positions {
+		if include(topic) {
+			positions[topic] = pos
+		}
+	}
+	for topic, offsets := range client.offsets {
+		pos := client.positionOf(topic)
+		if pos == nil || len(offsets) == 0 || !include(topic) {
+			continue
+		}
+		if !partitioned {
+			positions[topic] = StartAt(offsets[0])
+			continue
+		}
+
+		p := &proto.StartPosition{Type: pos.Type, Value: pos.Value, Offsets: make(map[uint16]uint64, len(offsets))}
+		for partition, next := range offsets {
+			p.Offsets[uint16(partition)] = next
+		}
+		positions[topic] = p
+	}
+	if len(positions) == 0 {
+		return nil
+	}
+
+	return positions
+}
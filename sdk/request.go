@@ -0,0 +1,117 @@
+package sdk
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/Chendemo12/micromq/src/proto"
+)
+
+// 生成一个请求的关联ID
+func newCorrelationID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Request 向主题发送一个请求, 并等待消费者通过 ConsumerMessage.Reply 回复
+// 若 ctx 未设置截止时间, 则最多等待 DefaultCallTimeout
+//
+//	@param	ctx		context.Context	用于取消等待
+//	@param	topic	string			请求主题
+//	@param	key		string			消息键
+//	@param	value	[]byte			消息体
+//	@return	*ConsumerMessage		回复消息, 其 Topic 为请求主题
+func (client *Producer) Request(ctx context.Context, topic, key string, value []byte) (*ConsumerMessage, error) {
+	if !client.broker.HasCapability(proto.RequestReplyCapability) ||
+		!client.broker.HasCapability(proto.HeadersCapability) {
+		return nil, ErrRequestReplyUnsupported
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultCallTimeout)
+		defer cancel()
+	}
+
+	id, err := newCorrelationID()
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan *ConsumerMessage, 1)
+	client.requests.Store(id, ch)
+	defer client.requests.Delete(id)
+
+	err = client.Send(func(record *ProducerMessage) error {
+		record.Topic = topic
+		record.Key = key
+		record.Value = value
+		record.SetHeader(proto.CorrelationIDHeader, []byte(id))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply := <-ch:
+		return reply, nil
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, ErrRequestTimeout
+		}
+		return nil, ctx.Err()
+	case <-client.Done():
+		return nil, client.broker.ctx.Err()
+	}
+}
+
+// 处理服务端推送的回复, 回复以 proto.HCMessageType 帧推送
+func (client *Producer) handleReply(frame *proto.TransferFrame) {
+	cm := &proto.CMessage{PM: &proto.PMessage{}}
+	cm.Reset()
+	err := frame.Unmarshal(cm, client.Crypto().Decrypt)
+	if err != nil {
+		client.Logger().Warn(frame.Text(), " decrypt or parse failed: ", err.Error())
+		return
+	}
+
+	reply := &ConsumerMessage{}
+	reply.ParseFromCMessage(cm)
+	v, ok := client.requests.Load(reply.CorrelationID())
+	if !ok { // 请求已超时
+		client.Logger().Debug("reply without pending request, dropped: ", reply.String())
+		return
+	}
+
+	select {
+	case v.(chan *ConsumerMessage) <- reply:
+	default: // 仅接收第一个回复
+	}
+}
+
+// 回复一个请求
+func (b *Broker) reply(req *ConsumerMessage, value []byte) error {
+	if !req.IsRequest() {
+		return ErrNotRequest
+	}
+	if !b.HasCapability(proto.RequestReplyCapability) {
+		return ErrRequestReplyUnsupported
+	}
+	if !b.StatusOK() {
+		return b.unregisteredErr()
+	}
+
+	rm := &proto.ReplyMessage{PMessage: proto.PMessage{
+		Topic:   []byte(req.ReplyTo()),
+		Key:     []byte(req.Key),
+		Value:   value,
+		Headers: proto.Headers{proto.CorrelationIDHeader: []byte(req.CorrelationID())},
+	}}
+
+	frame := framePool.Get()
+	defer framePool.Put(frame)
+
+	return b.Send(frame, rm)
+}
@@ -18,17 +18,32 @@ var (
 
 //goland:noinspection GoUnusedGlobalVariable
 var (
-	ErrTopicEmpty           = errors.New("topic is empty")
-	ErrConsumerHandlerIsNil = errors.New("consumer messageHandler is nil")
-	ErrConsumerUnregistered = errors.New("consumer unregistered")
-	ErrConsumerUnconnected  = errors.New("consumer unconnected")
-	ErrProducerUnregistered = errors.New("producer unregistered")
-	ErrProducerUnconnected  = errors.New("producer unconnected")
-	ErrTokenIncorrect       = errors.New("token incorrect")
+	ErrTopicEmpty              = errors.New("topic is empty")
+	ErrConsumerHandlerIsNil    = errors.New("consumer messageHandler is nil")
+	ErrConsumerUnregistered    = errors.New("consumer unregistered")
+	ErrConsumerUnconnected     = errors.New("consumer unconnected")
+	ErrProducerUnregistered    = errors.New("producer unregistered")
+	ErrProducerUnconnected     = errors.New("producer unconnected")
+	ErrTokenIncorrect          = errors.New("token incorrect")
+	ErrSchemaInvalid           = errors.New("message value does not match the topic schema")
+	ErrBuiltinMessageType      = errors.New("built-in message type cannot be customized")
+	ErrMessageNotPointer       = errors.New("custom message must be a pointer")
+	ErrCallTimeout             = errors.New("wait for custom message response timeout")
+	ErrRequestTimeout          = errors.New("wait for reply timeout")
+	ErrRequestReplyUnsupported = errors.New("broker does not support request-reply")
+	ErrNotRequest              = errors.New("message is not a request")
+	ErrBatchEmpty              = errors.New("batch is empty")
+	ErrBatchUnsupported        = errors.New("broker does not support batch")
+	ErrBatchRejected           = errors.New("batch rejected")
+	ErrBatchTimeout            = errors.New("wait for batch response timeout")
+	ErrSubscribeUnsupported    = errors.New("broker does not support subscribe")
+	ErrSubscribeRejected       = errors.New("subscription rejected")
+	ErrSubscribeTimeout        = errors.New("wait for subscribe response timeout")
 )
 
 const (
 	DefaultProducerSendInterval = 500 * time.Millisecond
+	DefaultPartitionQueueSize   = 256 // 消费者每个分区内待处理消息的队列容量, 队列已满时暂停读取连接
 )
 
 //goland:noinspection GoUnusedGlobalVariable
@@ -0,0 +1,155 @@
+package sdk
+
+import (
+	"fmt"
+	"github.com/Chendemo12/functools/python"
+	"github.com/Chendemo12/micromq/src/proto"
+	"github.com/Chendemo12/micromq/src/transfer"
+	"time"
+)
+
+// Topics 消费者当前的订阅列表, 初始为 ConsumerHandler.Topics, 并随 Subscribe 和 Unsubscribe 变化
+func (client *Consumer) Topics() []string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	return append([]string{}, client.topics...)
+}
+
+// Subscribe 在不重新连接的情况下订阅主题, 已订阅的主题被忽略, 需要服务端支持 proto.SubscribeCapability;
+// 订阅列表在本地保存, 断线重连后以最新的订阅列表重新注册; 尚未注册时仅更新本地的订阅列表, 在注册时生效.
+// 主题的起始位置可通过 SetStartPosition 在订阅之前设置
+//
+//	@param	topics	string	主题名称, 服务端支持 proto.WildcardCapability 时可为通配符模式
+func (client *Consumer) Subscribe(topics ...string) error {
+	if !client.broker.IsRegistered() {
+		client.addTopics(topics)
+		return nil
+	}
+	if !client.broker.HasCapability(proto.SubscribeCapability) {
+		return ErrSubscribeUnsupported
+	}
+
+	added := client.addTopics(topics)
+	if len(added) == 0 {
+		return nil
+	}
+
+	return client.sendSubscription(&proto.SubscribeMessage{
+		Type:      proto.SubscribeMessageType,
+		Topics:    added,
+		Positions: client.startPositions(added),
+	})
+}
+
+// Unsubscribe 在不重新连接的情况下取消订阅主题, 未订阅的主题被忽略, 需要服务端支持 proto.SubscribeCapability;
+// 通配符模式须以订阅时的原样取消; 取消订阅之前已推送的消息仍会交由 ConsumerHandler.Handler 处理
+func (client *Consumer) Unsubscribe(topics ...string) error {
+	if !client.broker.IsRegistered() {
+		client.removeTopics(topics)
+		return nil
+	}
+	if !client.broker.HasCapability(proto.SubscribeCapability) {
+		return ErrSubscribeUnsupported
+	}
+
+	removed := client.removeTopics(topics)
+	if len(removed) == 0 {
+		return nil
+	}
+
+	return client.sendSubscription(&proto.SubscribeMessage{Type: proto.UnsubscribeMessageType, Topics: removed})
+}
+
+// 将主题加入本地的订阅列表, 并返回新增的主题
+func (client *Consumer) addTopics(topics []string) []string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	added := make([]string, 0, len(topics))
+	for _, name := range topics {
+		if name != "" && !python.Has[string](client.topics, name) && !python.Has[string](added, name) {
+			added = append(added, name)
+		}
+	}
+	// 以新的切片替换订阅列表, 以免影响已返回的订阅列表
+	client.topics = append(append(make([]string, 0, len(client.topics)+len(added)), client.topics...), added...)
+
+	return added
+}
+
+// 将主题移出本地的订阅列表, 并返回实际删除的主题
+func (client *Consumer) removeTopics(topics []string) []string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	removed := make([]string, 0, len(topics))
+	remains := make([]string, 0, len(client.topics))
+	for _, name := range client.topics {
+		if python.Has[string](topics, name) {
+			removed = append(removed, name)
+		} else {
+			remains = append(remains, name)
+		}
+	}
+	client.topics = remains
+
+	return removed
+}
+
+// 发送订阅或取消订阅消息, 并等待服务端的响应; 同一时刻仅允许一个等待中的订阅消息
+func (client *Consumer) sendSubscription(m *proto.SubscribeMessage) error {
+	client.subLock.Lock()
+	defer client.subLock.Unlock()
+
+	select { // 丢弃上一个已超时的订阅消息的响应
+	case <-client.subResp:
+	default:
+	}
+
+	frame := framePool.Get()
+	err := client.broker.Send(frame, m)
+	framePool.Put(frame)
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(DefaultCallTimeout)
+	defer timer.Stop()
+
+	select {
+	case resp := <-client.subResp:
+		switch resp.Status {
+		case proto.AcceptedStatus:
+			return nil
+		case proto.ReRegisterStatus: // 服务端令客户端重新注册, 重新注册时携带最新的订阅列表
+			return nil
+		default:
+			return fmt.Errorf("%w: %s", ErrSubscribeRejected, proto.GetMessageResponseStatusText(resp.Status))
+		}
+	case <-timer.C:
+		return ErrSubscribeTimeout
+	case <-client.Done():
+		return client.broker.ctx.Err()
+	}
+}
+
+// 处理订阅和取消订阅的响应, 响应以 proto.SubscribeMessageRespType 帧返回
+func (client *Consumer) handleSubscribeResponse(frame *proto.TransferFrame, con transfer.Conn) {
+	resp := client.broker.handleMessageResponse(frame, con)
+	if resp == nil {
+		return
+	}
+
+	select {
+	case client.subResp <- resp:
+	default: // 没有等待中的订阅消息
+		client.Logger().Debug("subscribe response without pending subscription, dropped: ", resp.String())
+	}
+}
+
+// 在每次注册之前更新注册消息, 以携带最新的订阅列表和起始位置
+func (client *Consumer) beforeRegister(reg *proto.RegisterMessage) {
+	reg.Topics = client.Topics()
+	client.setPositions(reg)
+}
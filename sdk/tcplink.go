@@ -4,12 +4,14 @@ import (
 	"github.com/Chendemo12/fastapi-tool/logger"
 	"github.com/Chendemo12/functools/tcp"
 	"github.com/Chendemo12/micromq/src/proto"
+	"sync"
 )
 
 type TCPLink struct {
 	Host     string          `json:"host"`
 	Port     string          `json:"port"`
 	LinkType proto.LinkType  `json:"link_type"`
+	mu       *sync.Mutex     // 同一连接上的帧须依次写入, 见 proto.TransferFrame.DrainTo
 	client   *tcp.Client     // 对端连接
 	handler  tcp.HandlerFunc // 消息处理程序
 	logger   logger.Iface
@@ -19,6 +21,10 @@ func (l *TCPLink) Write(p []byte) (int, error) { return l.client.Write(p) }
 
 func (l *TCPLink) Drain() error { return l.client.Drain() }
 
+func (l *TCPLink) Lock() { l.mu.Lock() }
+
+func (l *TCPLink) Unlock() { l.mu.Unlock() }
+
 func (l *TCPLink) SetTCPHandler(handler tcp.HandlerFunc) {
 	l.handler = handler
 }
@@ -0,0 +1,326 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"github.com/Chendemo12/micromq/src/proto"
+	"sync"
+	"time"
+)
+
+// DefaultAckTimeout 消费者确认消息的缺省超时时间, 超时未确认的消息会被重新推送
+const DefaultAckTimeout = 30 * time.Second
+
+// 检查未确认消息是否超时的最长间隔
+const maxAckCheckInterval = time.Second
+
+// 未确认的消息, 以主题, 分区和分区内的偏移量唯一确定
+type ackKey struct {
+	topic     string
+	partition int
+	offset    uint64
+}
+
+// 已推送给消费者但尚未确认的消息
+type unackedMessage struct {
+	record   *HistoryRecord
+	group    string    // 推送时消费者所属的消费者组, 重新推送时由组内依据分配方式选中的成员接收
+	deadline time.Time // 超过此时间仍未确认则重新推送
+	count    int       // 已重新推送的次数
+}
+
+// 一个消费者的未确认消息, 以消费者ID标识, 在消费者重连后保持不变
+type ackSession struct {
+	mu       *sync.Mutex
+	id       string
+	consumer *Consumer // 消费者当前的连接, 断开时为nil
+	messages map[ackKey]*unackedMessage
+	closed   bool // 已自 Engine.sessions 中删除, 不再接受新的消息
+}
+
+// 是否需要跟踪推送给此消费者的消息, 仅当消费者要求确认且协商了 proto.AckCapability 时有效
+func (c *Consumer) acknowledges() bool {
+	conf := c.Conf
+	return conf != nil && conf.Ack != proto.NoConfirm &&
+		conf.Capabilities.Has(proto.AckCapability) && conf.Capabilities.Has(proto.HeadersCapability)
+}
+
+// 是否需要跟踪推送给消费者的此主题内的消息; 确认以分区号区分消息,
+// 因此未收到分区号的消费者仅对单分区的主题有效
+func (t *Topic) acknowledgedBy(c *Consumer) bool {
+	return c.acknowledges() && (t.Partitions() == 1 || t.frameFormat(c, nil).partition)
+}
+
+// 消费者的确认会话ID, 未提供消费者ID时以连接地址代替, 此时重连后无法取回未确认的消息
+func (c *Consumer) sessionID() string {
+	if conf := c.Conf; conf != nil && conf.ID != "" {
+		return conf.ID
+	}
+	return c.Addr
+}
+
+// AckTimeout 消费者确认消息的超时时间
+func (e *Engine) AckTimeout() time.Duration { return e.conf.AckTimeout }
+
+// MaxRedeliveries 消息最多被重新推送的次数, 超过后转投死信主题, 0 表示不限制
+func (e *Engine) MaxRedeliveries() int { return e.conf.MaxRedeliveries }
+
+// 获取消费者的确认会话, 不存在时创建; 返回的会话已加锁且未关闭
+func (e *Engine) lockSession(c *Consumer) *ackSession {
+	id := c.sessionID()
+	for {
+		v, _ := e.sessions.LoadOrStore(id, &ackSession{
+			mu: &sync.Mutex{}, id: id, consumer: c, messages: make(map[ackKey]*unackedMessage),
+		})
+		s := v.(*ackSession)
+		s.mu.Lock()
+		if !s.closed {
+			return s
+		}
+		s.mu.Unlock() // 会话恰好被删除, 重新创建
+	}
+}
+
+// 记录推送给消费者的主题内的消息, 无需确认的消息被忽略; count 为消息已被重新推送的次数.
+// 须在推送之前调用, 以免确认先于记录到达, 返回的方法用于在推送失败时撤销记录
+func (e *Engine) track(topic *Topic, c *Consumer, record *HistoryRecord, count int) (cancel func()) {
+	if !topic.acknowledgedBy(c) {
+		return func() {}
+	}
+
+	key := ackKey{topic: string(record.Topic), partition: record.Partition, offset: record.Offset}
+	m := &unackedMessage{record: record, group: c.Group(), deadline: time.Now().Add(e.AckTimeout()), count: count}
+
+	s := e.lockSession(c)
+	s.messages[key] = m
+	s.mu.Unlock()
+
+	return func() {
+		s.mu.Lock()
+		if s.messages[key] == m {
+			delete(s.messages, key)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Acknowledge 确认消费者已处理的消息, 未记录或已确认的消息被忽略, 返回实际确认的消息数量
+func (e *Engine) Acknowledge(addr string, acks []*proto.Acknowledgement) (int, error) {
+	c, exist := e.QueryConsumer(addr)
+	if !exist {
+		return 0, ErrConsumerNotRegister
+	}
+	v, ok := e.sessions.Load(c.sessionID())
+	if !ok {
+		return 0, nil
+	}
+	s := v.(*ackSession)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, ack := range acks {
+		key := ackKey{topic: ack.Topic, partition: int(ack.Partition), offset: ack.Offset}
+		if _, ok = s.messages[key]; ok {
+			delete(s.messages, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Unacked 消费者已推送但尚未确认的消息数量
+func (e *Engine) Unacked(c *Consumer) int {
+	v, ok := e.sessions.Load(c.sessionID())
+	if !ok {
+		return 0
+	}
+	s := v.(*ackSession)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.consumer != c {
+		return 0
+	}
+	return len(s.messages)
+}
+
+// 将注册的消费者关联到其确认会话, 返回向其重新推送上一个连接未确认的消息的方法, 无需推送时为nil;
+// 调用方应在注册响应发出之后调用, 否则客户端会将其视为未注册时的脏数据
+func (e *Engine) resumeSession(c *Consumer) (start func()) {
+	if !c.acknowledges() {
+		return nil
+	}
+
+	s := e.lockSession(c)
+	s.consumer = c
+	pending := make([]*unackedMessage, 0, len(s.messages))
+	for key, m := range s.messages {
+		delete(s.messages, key)
+		pending = append(pending, m)
+	}
+	s.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+	return func() {
+		for _, m := range pending {
+			e.redeliver(s.id, c, m)
+		}
+	}
+}
+
+// 消费者断开连接, 其所在消费者组的消息立即由组内的其他成员接收,
+// 其余消息等待消费者在 AckTimeout 内以相同的消费者ID重连, 否则转投死信主题
+func (e *Engine) suspendSession(c *Consumer) {
+	v, ok := e.sessions.Load(c.sessionID())
+	if !ok {
+		return
+	}
+	s := v.(*ackSession)
+
+	s.mu.Lock()
+	if s.consumer != c { // 消费者已以新的连接重连
+		s.mu.Unlock()
+		return
+	}
+	s.consumer = nil
+	deadline := time.Now().Add(e.AckTimeout())
+	grouped := make([]*unackedMessage, 0)
+	for key, m := range s.messages {
+		if m.group != "" {
+			delete(s.messages, key)
+			grouped = append(grouped, m)
+		} else {
+			m.deadline = deadline
+		}
+	}
+	s.mu.Unlock()
+
+	if len(grouped) > 0 {
+		go func() {
+			for _, m := range grouped {
+				e.redeliver(s.id, nil, m)
+			}
+		}()
+	}
+}
+
+// 重新推送一个未确认的消息; 属于消费者组的消息由组内依据分配方式选中的成员接收, 其余消息由消费者 c 接收,
+// 无可用的消费者或超过最大重新推送次数时转投死信主题
+func (e *Engine) redeliver(id string, c *Consumer, m *unackedMessage) {
+	v, ok := e.topics.Load(string(m.record.Topic))
+	if !ok {
+		return
+	}
+	topic := v.(*Topic)
+
+	target := c
+	if target != nil && target.sessionID() != id { // 连接已断开, 且其位置已被其他消费者占用
+		target = nil
+	}
+	if m.group != "" {
+		if members := topic.groupMembers(m.group, m.record.Key); len(members) > 0 {
+			target = members[0]
+		}
+	}
+	consumer := id
+	if target != nil {
+		consumer = target.Addr
+	}
+
+	if max := e.MaxRedeliveries(); max > 0 && m.count >= max {
+		topic.undeliver(m.record, consumer, fmt.Errorf("%w: %d", ErrRedeliveryExceeded, m.count))
+		return
+	}
+	if target == nil {
+		topic.undeliver(m.record, consumer, ErrConsumerNotReconnected)
+		return
+	}
+
+	// 推送失败时保留记录, 在下一次超时后重试
+	e.track(topic, target, m.record, m.count+1)
+	if err := topic.Redeliver(target, m.record, m.count+1); err != nil {
+		e.Logger().Warn(fmt.Sprintf(
+			"message '%s' offset %d redeliver to '%s' failed: %v", m.record.Topic, m.record.Offset, target.Addr, err,
+		))
+	}
+}
+
+// 重新推送全部超时未确认的消息, 并删除已断开且不再有未确认消息的会话
+func (e *Engine) redeliverExpired(now time.Time) {
+	e.sessions.Range(func(key, value any) bool {
+		s := value.(*ackSession)
+
+		s.mu.Lock()
+		expired := make([]*unackedMessage, 0)
+		for k, m := range s.messages {
+			if now.After(m.deadline) {
+				delete(s.messages, k)
+				expired = append(expired, m)
+			}
+		}
+		c := s.consumer
+		if c == nil && len(s.messages) == 0 {
+			s.closed = true
+			e.sessions.CompareAndDelete(key, s)
+		}
+		s.mu.Unlock()
+
+		for _, m := range expired {
+			e.redeliver(s.id, c, m)
+		}
+		return true
+	})
+}
+
+// 定期检查超时未确认的消息
+func (e *Engine) checkAcks(ctx context.Context) {
+	interval := e.AckTimeout() / 4
+	if interval > maxAckCheckInterval {
+		interval = maxAckCheckInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			e.redeliverExpired(now)
+		}
+	}
+}
+
+// ============================= ack message =============================
+
+// 解析消费者的确认消息, 确认消息无需响应
+func (e *Engine) ackParser(args *ChainArgs) (stop bool) {
+	args.SetError(ErrNoNeedToReply)
+
+	args.am = &proto.AckMessage{}
+	if err := args.frame.Unmarshal(args.am, e.Crypto().Decrypt); err != nil {
+		e.Logger().Warn(fmt.Sprintf("ack from '%s' decrypt failed: %v", args.con.Addr(), err))
+		return true
+	}
+
+	return
+}
+
+// 删除已确认的消息, 使其不再被重新推送
+func (e *Engine) ackHandler(args *ChainArgs) (stop bool) {
+	n, err := e.Acknowledge(args.con.Addr(), args.am.Acks)
+	if err != nil {
+		e.Logger().Debug("found unregister consumer ack, dropped: ", args.con.Addr())
+		return true
+	}
+	if n < len(args.am.Acks) {
+		e.Logger().Debug(fmt.Sprintf("%s from '%s': %d unknown", args.am, args.con.Addr(), len(args.am.Acks)-n))
+	}
+
+	return
+}
@@ -0,0 +1,78 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/Chendemo12/micromq/src/proto"
+)
+
+// PublishBatch 以全部或全不的方式发布一批消息, 并按顺序返回每个消息的偏移量;
+// 只要有一个消息被主题模式拒绝, 则整批消息均不发布, 并返回校验错误; 此时仅计入被拒绝的消息,
+// 其余消息既不会被隔离或修改, 也不会计入主题模式的统计
+//
+//	@param	pms			[]*proto.PMessage	可属于不同主题的消息
+//	@param	idempotent	bool				是否依据生产者ID和序列号去除重复消息, 详见 Engine.PublishIdempotent
+func (e *Engine) PublishBatch(pms []*proto.PMessage, idempotent bool) ([]uint64, error) {
+	schemas := make([]*TopicSchema, len(pms))
+	errs := make([]error, len(pms))
+	for i, pm := range pms {
+		schemas[i], errs[i] = e.validateSchema(pm)
+		if errs[i] != nil && schemas[i].Action != SchemaActionQuarantine {
+			_ = e.applySchema(schemas[i], pm, errs[i])
+			return nil, fmt.Errorf("messages[%d] on '%s': %w", i, pm.Topic, errs[i])
+		}
+	}
+
+	offsets := make([]uint64, len(pms))
+	for i, pm := range pms {
+		_ = e.applySchema(schemas[i], pm, errs[i]) // 需隔离的消息在此修改为隔离消息
+		if idempotent {
+			offsets[i], _ = e.PublishIdempotent(pm)
+		} else {
+			offsets[i] = e.Publisher(pm)
+		}
+	}
+
+	return offsets, nil
+}
+
+// ============================= batch message =============================
+
+// 解析批量消息, 批量消息以单个消息帧传输, 因此不会因连接中断而只被部分接收
+func (e *Engine) batchParser(args *ChainArgs) (stop bool) {
+	args.resp.Type = proto.BatchMessageRespType
+
+	batch := &proto.BatchMessage{}
+	err := args.frame.Unmarshal(batch, e.Crypto().Decrypt)
+	if err != nil {
+		args.resp.Status = proto.TokenIncorrectStatus
+		args.SetError(fmt.Errorf("frame decrypt failed: %v", err))
+
+		return true
+	}
+
+	args.pms = batch.Messages
+	return
+}
+
+// 全部或全不地发布批量消息, 响应中包含每个消息的偏移量
+func (e *Engine) batchPublisher(args *ChainArgs) (stop bool) {
+	offsets, err := e.PublishBatch(args.pms, args.producer.HasCapability(proto.IdempotenceCapability))
+	if err != nil {
+		e.Logger().Debug(fmt.Sprintf("batch from '%s' rejected: %v", args.con.Addr(), err))
+		args.resp.Status = proto.SchemaInvalidStatus
+		args.SetError(err)
+		return true
+	}
+
+	args.resp.Offsets = offsets
+	if len(offsets) > 0 {
+		args.resp.Offset = offsets[len(offsets)-1]
+	}
+
+	if !args.producer.NeedConfirm() {
+		args.SetError(ErrNoNeedToReply)
+		stop = true
+	}
+
+	return
+}
@@ -6,6 +6,13 @@ var (
 	ErrConsumerNotRegister = errors.New("consumer not register")
 	ErrProducerNotRegister = errors.New("producer not register")
 	ErrPMNotFound          = errors.New("producer-message not found in frame")
+	ErrSchemaViolation     = errors.New("message value does not match the topic schema")
+	ErrSchemaRefNotAllowed = errors.New("schema reference to external resource is not allowed")
+	ErrMessageExpired      = errors.New("message expired before delivery")
+	// ErrRedeliveryExceeded 消息超过最大重新推送次数仍未被确认
+	ErrRedeliveryExceeded = errors.New("message not acknowledged within max redeliveries")
+	// ErrConsumerNotReconnected 消费者断开后未在确认超时时间内重连, 其未确认的消息无法重新推送
+	ErrConsumerNotReconnected = errors.New("consumer not reconnected within ack timeout")
 	// ErrNoNeedToReply 不再回复响应给客户端
 	ErrNoNeedToReply = errors.New("no need to reply to the client")
 )
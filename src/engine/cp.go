@@ -8,12 +8,21 @@ import (
 )
 
 type ConsumerConfig struct {
-	Topics []string      `json:"topics"`
-	Ack    proto.AckType `json:"ack"`
+	Topics       []string           `json:"topics"`
+	Ack          proto.AckType      `json:"ack"`
+	FrameVersion proto.FrameVersion `json:"frame_version"` // 由注册消息帧确定
+	Version      int                `json:"version"`       // 协商后的协议版本
+	Capabilities proto.Capabilities `json:"capabilities"`  // 协商后的能力集合
+	Group        string             `json:"group"`         // 消费者组名称, 为空时接收主题内的全部消息
+	Balance      proto.BalanceType  `json:"balance"`       // 消费者组内分配消息的方式
+	ID           string             `json:"id"`            // 消费者ID, 重连后据此取回未确认的消息, 为空时以连接地址代替
 }
 
 type ProducerConfig struct {
-	Ack proto.AckType `json:"ack"`
+	Ack          proto.AckType      `json:"ack"`
+	FrameVersion proto.FrameVersion `json:"frame_version"` // 由注册消息帧确定
+	Version      int                `json:"version"`       // 协商后的协议版本
+	Capabilities proto.Capabilities `json:"capabilities"`  // 协商后的能力集合
 	// 定时器间隔，单位ms，仅生产者有效，生产者需要按照此间隔发送帧消息
 	TickerInterval time.Duration `json:"ticker_duration"`
 }
@@ -48,11 +57,36 @@ func (c *Consumer) Index() int { return c.index }
 // NeedConfirm 是否需要返回确认消息给客户端
 func (c *Consumer) NeedConfirm() bool { return c.Conf.Ack != proto.NoConfirm }
 
+// HasCapability 与消费者协商后的能力集合中是否包含某项能力
+func (c *Consumer) HasCapability(capability proto.Capability) bool {
+	conf := c.Conf
+	return conf != nil && conf.Capabilities.Has(capability)
+}
+
+// Group 消费者所属的消费者组, 未加入消费者组时为空
+func (c *Consumer) Group() string {
+	conf := c.Conf
+	if conf == nil {
+		return ""
+	}
+	return conf.Group
+}
+
+// FrameVersion 消费者连接所采用的帧版本
+func (c *Consumer) FrameVersion() proto.FrameVersion {
+	conf := c.Conf
+	if conf == nil || conf.FrameVersion == proto.FrameVersionAuto {
+		return proto.FrameV1
+	}
+	return conf.FrameVersion
+}
+
 // Send 向消费者客户端推送消息, 此操作是线程安全的
 func (c *Consumer) Send(msg proto.Message) error {
 	frame := framePool.Get()
 	defer framePool.Put(frame)
 
+	frame.SetVersion(c.FrameVersion())
 	err := frame.BuildFrom(msg)
 	if err != nil {
 		return err
@@ -61,11 +95,7 @@ func (c *Consumer) Send(msg proto.Message) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	_, err = frame.WriteTo(c.Conn)
-	if err != nil {
-		return err
-	}
-	return c.Conn.Drain()
+	return frame.DrainTo(c.Conn)
 }
 
 type Producer struct {
@@ -96,3 +126,18 @@ func (p *Producer) SetConn(r transfer.Conn) *Producer {
 func (p *Producer) Index() int { return p.index }
 
 func (p *Producer) NeedConfirm() bool { return p.Conf.Ack != proto.NoConfirm }
+
+// HasCapability 与生产者协商后的能力集合中是否包含某项能力
+func (p *Producer) HasCapability(capability proto.Capability) bool {
+	conf := p.Conf
+	return conf != nil && conf.Capabilities.Has(capability)
+}
+
+// FrameVersion 生产者连接所采用的帧版本
+func (p *Producer) FrameVersion() proto.FrameVersion {
+	conf := p.Conf
+	if conf == nil || conf.FrameVersion == proto.FrameVersionAuto {
+		return proto.FrameV1
+	}
+	return conf.FrameVersion
+}
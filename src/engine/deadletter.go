@@ -0,0 +1,89 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"github.com/Chendemo12/micromq/src/proto"
+	"strconv"
+)
+
+// DefaultDeadLetterTopic 默认的死信主题
+const DefaultDeadLetterTopic = "__DEAD_LETTER__"
+
+// 死信消息的消息头, 用于记录消息的来源和投递失败的原因; 死信消息同时保留原始消息的消息头
+const (
+	DeadLetterTopicHeader     = "x-origin-topic"         // 原始主题
+	DeadLetterOffsetHeader    = "x-origin-offset"        // 消息在原始分区内的偏移量, 十进制数值
+	DeadLetterPartitionHeader = "x-origin-partition"     // 消息在原始主题内的分区, 十进制数值
+	DeadLetterReasonHeader    = "x-dead-letter-reason"   // 投递失败的原因
+	DeadLetterConsumerHeader  = "x-dead-letter-consumer" // 目标消费者的地址, 构建失败时为全部消费者以逗号分隔的地址
+)
+
+// 死信消息头中投递失败原因的最大字节数
+const maxDeadLetterReasonLength = 1024
+
+// SetDeadLetterTopic 修改死信主题, 必须在 Serve 之前设置
+func (e *Engine) SetDeadLetterTopic(topic string) *Engine {
+	if topic != "" {
+		e.deadLetterTopic = topic
+	}
+
+	return e
+}
+
+// DeadLetterTopic 构建失败或未能送达消费者的消息被转投的主题
+func (e *Engine) DeadLetterTopic() string { return e.deadLetterTopic }
+
+// 将构建失败或未能送达消费者的消息转投至死信主题;
+// 死信主题自身的消息投递失败时仅记录日志, 以避免循环转投;
+// 此方法在推送路径中被调用, 可能持有主题的推送锁, 因此死信消息仅放入队列, 由 publishDeadLetters 在锁外发布
+func (e *Engine) deadLetter(record *HistoryRecord, consumer string, err error) {
+	e.Logger().Warn(fmt.Sprintf(
+		"message '%s' offset %d undelivered to '%s': %v", record.Topic, record.Offset, consumer, err,
+	))
+	if string(record.Topic) == e.DeadLetterTopic() {
+		return
+	}
+
+	reason := proto.TruncateString(err.Error(), maxDeadLetterReasonLength)
+
+	headers := make(proto.Headers, len(record.Headers)+5)
+	for k, v := range record.Headers {
+		switch k {
+		case proto.TTLHeader, proto.DeliverAtHeader: // 死信消息不应再过期或被延迟
+		case proto.CorrelationIDHeader, proto.ReplyToHeader: // 死信消息不是请求, 不应被当作回复路由
+		case proto.ProducerIDHeader, proto.SequenceHeader: // 死信消息不应参与原生产者的去重
+		default:
+			headers.Set(k, v)
+		}
+	}
+	headers.Set(DeadLetterTopicHeader, append([]byte{}, record.Topic...))
+	headers.Set(DeadLetterOffsetHeader, []byte(strconv.FormatUint(record.Offset, 10)))
+	headers.Set(DeadLetterPartitionHeader, []byte(strconv.Itoa(record.Partition)))
+	headers.Set(DeadLetterReasonHeader, []byte(reason))
+	headers.Set(DeadLetterConsumerHeader, []byte(consumer))
+
+	pm := &proto.PMessage{
+		Topic:   []byte(e.DeadLetterTopic()),
+		Key:     record.Key,
+		Value:   record.Value,
+		Headers: headers,
+	}
+	select {
+	case e.deadLetters <- pm:
+	default: // 队列已满时不阻塞推送路径
+		go func() { e.deadLetters <- pm }()
+	}
+}
+
+// 依次发布死信队列中的消息, 直至 ctx 结束
+func (e *Engine) publishDeadLetters(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case pm := <-e.deadLetters:
+			e.Publisher(pm)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package engine
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"github.com/Chendemo12/micromq/src/proto"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DelayedMessage 等待投递的延迟消息
+type DelayedMessage struct {
+	ID        uint64    `json:"id"`
+	Topic     string    `json:"topic"`
+	Key       string    `json:"key"`
+	Size      int       `json:"size" description:"消息体字节数"`
+	CreatedAt time.Time `json:"created_at"`
+	DeliverAt time.Time `json:"deliver_at"`
+	pm        *proto.PMessage
+	index     int // 在堆中的索引
+}
+
+// 按投递时间排序的最小堆
+type delayHeap []*DelayedMessage
+
+func (h delayHeap) Len() int { return len(h) }
+
+func (h delayHeap) Less(i, j int) bool {
+	if h[i].DeliverAt.Equal(h[j].DeliverAt) {
+		return h[i].ID < h[j].ID // 投递时间相同时保持发布顺序
+	}
+	return h[i].DeliverAt.Before(h[j].DeliverAt)
+}
+
+func (h delayHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *delayHeap) Push(x any) {
+	m := x.(*DelayedMessage)
+	m.index = len(*h)
+	*h = append(*h, m)
+}
+
+func (h *delayHeap) Pop() any {
+	old := *h
+	n := len(old)
+	m := old[n-1]
+	old[n-1] = nil
+	m.index = -1
+	*h = old[:n-1]
+	return m
+}
+
+// DelayQueue 延迟消息的定时器, 到期的消息经由 Topic.Publisher 正常投递, 此操作是线程安全的
+type DelayQueue struct {
+	mu       *sync.Mutex
+	heap     delayHeap
+	messages map[uint64]*DelayedMessage
+	lastID   *atomic.Uint64
+	wakeup   chan struct{} // 最早的投递时间发生变化
+	deliver  func(pm *proto.PMessage)
+}
+
+func NewDelayQueue(deliver func(pm *proto.PMessage)) *DelayQueue {
+	return &DelayQueue{
+		mu:       &sync.Mutex{},
+		heap:     make(delayHeap, 0),
+		messages: make(map[uint64]*DelayedMessage),
+		lastID:   &atomic.Uint64{},
+		wakeup:   make(chan struct{}, 1),
+		deliver:  deliver,
+	}
+}
+
+func (q *DelayQueue) notify() {
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Schedule 添加一个延迟消息, 并返回其记录
+func (q *DelayQueue) Schedule(pm *proto.PMessage, deliverAt time.Time) *DelayedMessage {
+	m := &DelayedMessage{
+		ID:        q.lastID.Add(1),
+		Topic:     string(pm.Topic),
+		Key:       string(pm.Key),
+		Size:      len(pm.Value),
+		CreatedAt: time.Now(),
+		DeliverAt: deliverAt,
+		pm:        pm,
+	}
+
+	q.mu.Lock()
+	heap.Push(&q.heap, m)
+	q.messages[m.ID] = m
+	earliest := q.heap[0] == m
+	q.mu.Unlock()
+
+	if earliest {
+		q.notify()
+	}
+	return m
+}
+
+// Cancel 取消一个尚未投递的延迟消息, 返回此消息是否存在
+func (q *DelayQueue) Cancel(id uint64) (*DelayedMessage, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	m, ok := q.messages[id]
+	if !ok {
+		return nil, false
+	}
+	heap.Remove(&q.heap, m.index)
+	delete(q.messages, id)
+
+	return m, true
+}
+
+// Query 查询一个尚未投递的延迟消息
+func (q *DelayQueue) Query(id uint64) (*DelayedMessage, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	m, ok := q.messages[id]
+	return m, ok
+}
+
+// List 获取全部尚未投递的延迟消息, 按投递时间排序
+func (q *DelayQueue) List() []*DelayedMessage {
+	q.mu.Lock()
+	ms := make([]*DelayedMessage, len(q.heap))
+	copy(ms, q.heap)
+	q.mu.Unlock()
+
+	sort.Slice(ms, func(i, j int) bool { return delayHeap(ms).Less(i, j) })
+	return ms
+}
+
+// Len 尚未投递的延迟消息数量
+func (q *DelayQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.heap)
+}
+
+// 取出全部已到期的消息, 并返回下一个消息的等待时间
+func (q *DelayQueue) popDue(now time.Time) ([]*DelayedMessage, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	due := make([]*DelayedMessage, 0)
+	for len(q.heap) > 0 && !q.heap[0].DeliverAt.After(now) {
+		m := heap.Pop(&q.heap).(*DelayedMessage)
+		delete(q.messages, m.ID)
+		due = append(due, m)
+	}
+	if len(q.heap) == 0 {
+		return due, -1
+	}
+	return due, q.heap[0].DeliverAt.Sub(now)
+}
+
+// Run 阻塞运行, 直到 ctx 结束
+func (q *DelayQueue) Run(ctx context.Context) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		due, wait := q.popDue(time.Now())
+		for _, m := range due {
+			q.deliver(m.pm)
+		}
+
+		if wait < 0 {
+			wait = time.Hour // 无待投递的消息, 等待唤醒
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wakeup:
+		case <-timer.C:
+		}
+	}
+}
+
+// ================================ engine ================================
+
+// DelayQueue 延迟消息的定时器
+func (e *Engine) DelayQueue() *DelayQueue { return e.delayed }
+
+// 到期的延迟消息经由正常的路径投递
+func (e *Engine) deliverDelayed(pm *proto.PMessage) {
+	offset := e.GetTopic(pm.Topic).Publisher(pm)
+	e.Logger().Debug(fmt.Sprintf("delayed %s delivered, offset: %d", pm, offset))
+}
+
+// ScheduleMessage 若消息指定了未来的投递时间, 则将其加入延迟队列, 否则返回false
+func (e *Engine) ScheduleMessage(pm *proto.PMessage) (*DelayedMessage, bool) {
+	at, ok := pm.Headers.DeliverAt()
+	if !ok || !at.After(time.Now()) {
+		return nil, false
+	}
+
+	return e.delayed.Schedule(pm, at), true
+}
+
+// CancelDelayed 取消一个尚未投递的延迟消息, 返回此消息是否存在
+func (e *Engine) CancelDelayed(id uint64) (*DelayedMessage, bool) {
+	m, ok := e.delayed.Cancel(id)
+	if ok {
+		e.Logger().Info(fmt.Sprintf("delayed message %d on '%s' cancelled", id, m.Topic))
+	}
+	return m, ok
+}
@@ -7,22 +7,37 @@ import (
 	"github.com/Chendemo12/fastapi-tool/cronjob"
 	"github.com/Chendemo12/fastapi-tool/logger"
 	"github.com/Chendemo12/micromq/src/proto"
+	"github.com/Chendemo12/micromq/src/storage"
 	"github.com/Chendemo12/micromq/src/transfer"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Config struct {
-	Host             string          `json:"host"`
-	Port             string          `json:"port"`
-	MaxOpenConn      int             `json:"max_open_conn"` // 允许的最大连接数, 即 生产者+消费者最多有 MaxOpenConn 个
-	BufferSize       int             `json:"buffer_size"`   // 生产者消息历史记录最大数量
-	HeartbeatTimeout float64         `json:"heartbeat_timeout"`
-	Logger           logger.Iface    `json:"-"`
-	Token            string          `json:"-"` // 注册认证密钥
-	EventHandler     EventHandler    `json:"-"` // 事件触发器
-	Ctx              context.Context `json:"-"`
-	topicHistorySize int             // topic 历史缓存大小
+	Host             string  `json:"host"`
+	Port             string  `json:"port"`
+	MaxOpenConn      int     `json:"max_open_conn"` // 允许的最大连接数, 即 生产者+消费者最多有 MaxOpenConn 个
+	BufferSize       int     `json:"buffer_size"`   // 生产者消息历史记录最大数量
+	HeartbeatTimeout float64 `json:"heartbeat_timeout"`
+	StarvationLimit  int     `json:"starvation_limit"` // 低优先级消息连续让行的上限
+	Partitions       int     `json:"partitions"`       // 主题缺省的分区数量, 缺省为 DefaultPartitions
+	// 各主题的分区数量, 优先于 Partitions; 已持久化的主题的分区只增不减
+	TopicPartitions map[string]int `json:"topic_partitions"`
+	// 主题日志的存储目录, 为空时消息仅保存在内存中
+	DataDir          string              `json:"data_dir"`
+	SegmentBytes     int64               `json:"segment_bytes"`    // 段文件的大小上限, 缺省为 storage.DefaultSegmentBytes
+	RetentionBytes   int64               `json:"retention_bytes"`  // 每个主题日志的大小上限, 0 表示不限制
+	RetentionAge     time.Duration       `json:"retention_age"`    // 消息的最长保留时间, 0 表示不限制
+	FsyncPolicy      storage.FsyncPolicy `json:"fsync_policy"`     // 写入磁盘的策略, 缺省为 storage.FsyncInterval
+	FsyncInterval    time.Duration       `json:"fsync_interval"`   // FsyncInterval 策略的同步间隔, 缺省为 DefaultFsyncInterval
+	AckTimeout       time.Duration       `json:"ack_timeout"`      // 消费者确认消息的超时时间, 缺省为 DefaultAckTimeout
+	MaxRedeliveries  int                 `json:"max_redeliveries"` // 消息最多被重新推送的次数, 超过后转投死信主题, 0 表示不限制
+	Logger           logger.Iface        `json:"-"`
+	Token            string              `json:"-"` // 注册认证密钥
+	EventHandler     EventHandler        `json:"-"` // 事件触发器
+	Ctx              context.Context     `json:"-"`
+	topicHistorySize int                 // topic 历史缓存大小
 }
 
 func (c *Config) clean() *Config {
@@ -32,6 +47,21 @@ func (c *Config) clean() *Config {
 	if !(c.MaxOpenConn > 0 && c.MaxOpenConn <= 100) {
 		c.MaxOpenConn = 50
 	}
+	if c.StarvationLimit <= 0 {
+		c.StarvationLimit = DefaultStarvationLimit
+	}
+	if !(c.Partitions > 0 && c.Partitions <= MaxPartitions) {
+		c.Partitions = DefaultPartitions
+	}
+	if c.FsyncInterval <= 0 {
+		c.FsyncInterval = DefaultFsyncInterval
+	}
+	if c.AckTimeout <= 0 {
+		c.AckTimeout = DefaultAckTimeout
+	}
+	if c.MaxRedeliveries < 0 {
+		c.MaxRedeliveries = 0
+	}
 
 	if c.Logger == nil {
 		c.Logger = logger.NewDefaultLogger()
@@ -55,21 +85,41 @@ type Engine struct {
 	consumers            []*Consumer // 消费者
 	transfer             transfer.Transfer
 	topics               *sync.Map
+	topicLock            *sync.Mutex // 避免并发地创建同一个主题
+	schemas              *sync.Map   // 主题的消息体模式 map[string]*TopicSchema
+	quarantineTopic      string      // 不符合模式的消息被转投的主题
+	deadLetterTopic      string      // 无法投递的消息被转投的主题
 	monitor              *Monitor
 	stat                 *Statistic
 	scheduler            *cronjob.Scheduler
 	ePool                *EPool                             // 池化各种数据
 	tokenCrypto          *proto.TokenCrypto                 // 用于注册消息加解密
 	crypto               proto.Crypto                       // 加解密器
+	cryptoErr            error                              // 加密方案设置错误, 会阻止服务启动
+	compressor           proto.Compressor                   // 向消费者推送消息时的压缩器
+	capabilities         proto.Capabilities                 // 服务端支持的可选能力
 	producerSendInterval time.Duration                      // 生产者发送消息的时间间隔 = 500ms
 	hooks                [proto.TotalNumberOfMessages]*Hook // 各种协议的处理者
 	// 消息帧处理链，每一个链内部无需直接向客户端写入消息,通过修改frame实现返回消息
-	flows  [proto.TotalNumberOfMessages][]FlowHandler
-	cpLock *sync.RWMutex // consumer producer add/remove lock
+	flows    [proto.TotalNumberOfMessages][]FlowHandler
+	cpLock   *sync.RWMutex // consumer producer add/remove lock
+	requests *sync.Map     // 等待回复的请求: {requestKey: *pendingRequest}
+	delayed  *DelayQueue   // 尚未到达投递时间的延迟消息
+	// 需在响应写入客户端之后执行的操作: {*proto.TransferFrame: []func()}
+	afterReply *sync.Map
+	// 以通配符模式订阅主题的消费者, 新建的匹配主题会自动加入这些消费者: {addr: *Consumer}
+	wildcards *sync.Map
+	// 幂等生产者的已发布序列号: {producerID: *producerSequence}
+	sequences  *sync.Map
+	duplicates *atomic.Uint64 // 因重复而被丢弃的生产者消息数量
+	// 消费者已推送但尚未确认的消息: {consumerID: *ackSession}
+	sessions *sync.Map
+	// 等待发布的死信消息, 与推送路径解耦以避免在持有主题锁时发布
+	deadLetters chan *proto.PMessage
 }
 
-func (e *Engine) beforeServe() *Engine {
-	// 初始化全部内存对象
+// 初始化全部消息处理者, 以允许在 Serve 之前绑定自定义消息
+func (e *Engine) initHooks() *Engine {
 	for i := 0; i < proto.TotalNumberOfMessages; i++ {
 		// 初始化为未实现
 		e.hooks[i] = &Hook{
@@ -81,6 +131,11 @@ func (e *Engine) beforeServe() *Engine {
 		e.flows[i] = make([]FlowHandler, 0)
 	}
 
+	return e
+}
+
+func (e *Engine) beforeServe() *Engine {
+	// 初始化全部内存对象
 	e.producers = make([]*Producer, e.conf.MaxOpenConn)
 	e.consumers = make([]*Consumer, e.conf.MaxOpenConn)
 
@@ -103,8 +158,8 @@ func (e *Engine) beforeServe() *Engine {
 	}
 
 	// 监视器
-	e.monitor = &Monitor{broker: e}
-	e.stat = &Statistic{broker: e}
+	e.monitor = (&Monitor{broker: e}).init()
+	e.stat = &Statistic{broker: e, frameErrors: &frameErrorCounter{}}
 	e.scheduler = cronjob.NewScheduler(e.Ctx(), e.Logger())
 	e.scheduler.AddCronjob(e.monitor)
 	// 初始化池
@@ -138,7 +193,7 @@ func (e *Engine) bindTransfer() *Engine {
 	e.transfer.SetOnConnectedHandler(e.whenClientConnected)
 	e.transfer.SetOnClosedHandler(e.whenClientClosed)
 	e.transfer.SetOnReceivedHandler(e.distribute)
-	e.transfer.SetOnFrameParseErrorHandler(e.EventHandler().OnFrameParseError)
+	e.transfer.SetOnFrameParseErrorHandler(e.whenFrameParseError)
 
 	return e
 }
@@ -160,9 +215,51 @@ func (e *Engine) bindMessageHandler() *Engine {
 	e.flows[proto.PMessageType] = []FlowHandler{
 		e.producerNotFound,
 		e.pmParser,
+		e.pmValidator,
 		e.pmPublisher,
 	}
 
+	// 携带消息头的生产者消息, 处理流程与生产者消息一致, 携带 proto.CorrelationIDHeader 的消息为请求
+	e.hooks[proto.HPMessageType].Type = proto.HPMessageType
+	e.flows[proto.HPMessageType] = []FlowHandler{
+		e.producerNotFound,
+		e.pmParser,
+		e.pmValidator,
+		e.pmRequestTracker,
+		e.pmPublisher,
+	}
+
+	// 批量生产者消息, 可包含不同主题的消息, 全部或全不地发布
+	e.hooks[proto.BatchMessageType].Type = proto.BatchMessageType
+	e.flows[proto.BatchMessageType] = []FlowHandler{
+		e.producerNotFound,
+		e.batchParser,
+		e.batchPublisher,
+	}
+
+	// 订阅和取消订阅, 在已注册的连接上更新消费者的订阅列表
+	for _, typ := range []proto.MessageType{proto.SubscribeMessageType, proto.UnsubscribeMessageType} {
+		e.hooks[typ].Type = typ
+		e.flows[typ] = []FlowHandler{
+			e.subscribeParser,
+			e.subscribeHandler,
+		}
+	}
+
+	// 请求的回复, 仅路由至请求方的连接
+	e.hooks[proto.ReplyMessageType].Type = proto.ReplyMessageType
+	e.flows[proto.ReplyMessageType] = []FlowHandler{
+		e.replyParser,
+		e.replyRouter,
+	}
+
+	// 消费者确认已处理的消息, 无需响应
+	e.hooks[proto.AckMessageType].Type = proto.AckMessageType
+	e.flows[proto.AckMessageType] = []FlowHandler{
+		e.ackParser,
+		e.ackHandler,
+	}
+
 	// 心跳保活
 	e.hooks[proto.HeartbeatMessageType].Type = proto.HeartbeatMessageType
 	e.flows[proto.HeartbeatMessageType] = []FlowHandler{
@@ -186,6 +283,16 @@ func (e *Engine) whenClientClosed(addr string) {
 	e.monitor.OnClientClosed(addr)
 }
 
+// 帧解析出错，记录错误原因
+func (e *Engine) whenFrameParseError(frame *proto.TransferFrame, con transfer.Conn, err error) {
+	e.stat.frameErrors.record(err)
+	if h, ok := e.EventHandler().(FrameParseErrorHandler); ok {
+		h.OnFrameParseFailed(frame, con, err)
+		return
+	}
+	e.EventHandler().OnFrameParseError(frame, con)
+}
+
 // 查找一个空闲的 生产者槽位，若未找到则返回 -1，应在查找之前主动加锁
 func (e *Engine) findProducerSlot() int {
 	for i := 0; i < e.conf.MaxOpenConn; i++ {
@@ -217,6 +324,9 @@ func (e *Engine) flowToHookHandler(frame *proto.TransferFrame, con transfer.Conn
 			break
 		}
 	}
+	if len(args.after) > 0 {
+		e.afterReply.Store(frame, args.after)
+	}
 
 	// 不需要回复响应, 不再构建帧消息
 	if !args.ReplyClient() {
@@ -236,6 +346,8 @@ func (e *Engine) flowToHookHandler(frame *proto.TransferFrame, con transfer.Conn
 
 // 分发消息
 func (e *Engine) distribute(frame *proto.TransferFrame, con transfer.Conn) {
+	defer e.runAfterReply(frame)
+
 	var err error
 	// 依据消息定义, 判断此消息是否应该返回响应给客户端
 	var needResp = proto.GetDescriptor(frame.Type()).NeedACK()
@@ -258,8 +370,7 @@ func (e *Engine) distribute(frame *proto.TransferFrame, con transfer.Conn) {
 	}
 
 	// 重新构建并写入消息帧
-	_, err = frame.WriteTo(con)
-	err = con.Drain()
+	err = frame.DrainTo(con)
 	if err != nil {
 		e.Logger().Warn(fmt.Sprintf(
 			"send <message:%d> to '%s' failed: %s", frame.Type(), con.Addr(), err,
@@ -267,6 +378,17 @@ func (e *Engine) distribute(frame *proto.TransferFrame, con transfer.Conn) {
 	}
 }
 
+// 执行处理流程中登记的需在响应写入之后执行的操作, 无论响应是否写入成功
+func (e *Engine) runAfterReply(frame *proto.TransferFrame) {
+	v, ok := e.afterReply.LoadAndDelete(frame)
+	if !ok {
+		return
+	}
+	for _, fn := range v.([]func()) {
+		fn()
+	}
+}
+
 // 断开与客户端的连接
 func (e *Engine) closeConnection(addr string) {
 	err := e.transfer.Close(addr)
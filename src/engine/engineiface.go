@@ -10,6 +10,7 @@ import (
 	"github.com/Chendemo12/micromq/src/transfer"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -114,7 +115,15 @@ func (e *Engine) AddTopic(name []byte) *Topic {
 		e.conf.topicHistorySize,
 	)
 	nt.SetOnConsumed(e.EventHandler().OnCMConsumed)
+	nt.SetOnExpired(e.EventHandler().OnCMExpired)
+	nt.SetOnUndelivered(e.deadLetter)
+	nt.SetOnSend(func(c *Consumer, record *HistoryRecord) func() { return e.track(nt, c, record, 0) })
 	nt.SetCrypto(e.Crypto())
+	nt.SetCompressor(e.Compressor())
+	nt.SetStarvationLimit(e.conf.StarvationLimit)
+	nt.SetPartitions(e.topicPartitions(string(name)))
+	e.openLog(nt)
+	e.joinWildcards(nt)
 
 	e.topics.Store(string(name), nt)
 
@@ -126,10 +135,16 @@ func (e *Engine) GetTopic(name []byte) *Topic {
 	var topic *Topic
 
 	v, ok := e.topics.Load(string(name))
-	if !ok {
-		topic = e.AddTopic(name)
-	} else {
+	if ok {
+		return v.(*Topic)
+	}
+
+	e.topicLock.Lock()
+	defer e.topicLock.Unlock()
+	if v, ok = e.topics.Load(string(name)); ok {
 		topic = v.(*Topic)
+	} else {
+		topic = e.AddTopic(name)
 	}
 
 	return topic
@@ -141,7 +156,7 @@ func (e *Engine) GetTopicOffset(name []byte) uint64 {
 
 	e.RangeTopic(func(topic *Topic) bool {
 		if bytes.Compare(topic.Name, name) == 0 {
-			offset = topic.Offset
+			offset = topic.Offset()
 			return false
 		}
 		return true
@@ -160,10 +175,10 @@ func (e *Engine) RemoveConsumer(addr string) {
 		return // consumer not found
 	}
 
-	for _, name := range c.Conf.Topics {
-		// 从相关 topic 中删除消费者记录
-		e.GetTopic([]byte(name)).RemoveConsumer(addr)
-	}
+	// 从相关 topic 中删除消费者记录
+	e.leaveAll(c)
+	// 须在移出主题之后, 组内的消息才不会再次推送给此消费者
+	e.suspendSession(c)
 
 	c.reset()
 	e.Logger().Info(fmt.Sprintf("connection <%s:%s> removed.", proto.ConsumerLinkType, addr))
@@ -177,14 +192,19 @@ func (e *Engine) RemoveProducer(addr string) {
 
 	p, exist := e.QueryProducer(addr)
 	if exist {
+		e.clearRequests(addr)
 		p.reset()
 		e.Logger().Debug(fmt.Sprintf("connection <%s:%s> removed.", proto.ProducerLinkType, addr))
 		go e.EventHandler().OnProducerClosed(addr)
 	}
 }
 
-// Publisher 发布消息,并返回此消息在当前topic中的偏移量
+// Publisher 发布消息,并返回此消息在当前topic中的偏移量;
+// 若消息指定了未来的投递时间, 则加入延迟队列并返回0, 到期后再经由 Topic.Publisher 投递
 func (e *Engine) Publisher(msg *proto.PMessage) uint64 {
+	if _, ok := e.ScheduleMessage(msg); ok {
+		return 0
+	}
 	return e.GetTopic(msg.Topic).Publisher(msg)
 }
 
@@ -205,7 +225,9 @@ func (e *Engine) HeartbeatInterval() float64 {
 //
 //	参数handler为收到此消息后的同步处理函数, 如果需要在处理完成之后向客户端返回消息,则直接就地修改frame对象,
 //		HookHandler 的第一个参数为接收到的消息帧, 可通过 proto.TransferFrame.Unmarshal 方法解码, 第二个参数为当前的客户端连接,
-//		此方法返回"处理是否正确"一个参数, 若定义了 needAck 则需要返回错误消息给客户端
+//		此方法返回"处理是否正确"一个参数, 若定义了 needAck 则需要返回错误消息给客户端,
+//		自定义消息允许加密, 因此解码和构建响应时应分别传入 Engine.Crypto 的 Decrypt 和 Encrypt 方法,
+//	自定义消息的编解码方式详见 proto.NotImplementMessage, 此方法可在 Serve 之前调用
 //
 //	@param	m		proto.Message	实现了 proto.Message 接口的自定义消息, 不允许与内置消息冲突, 可通过 proto.IsMessageDefined 判断
 //	@param	handler	HookHandler		消息处理方法
@@ -243,20 +265,60 @@ func (e *Engine) SetCrypto(crypto proto.Crypto) *Engine {
 	return e
 }
 
-// SetCryptoPlan 设置加密方案
+// SetCryptoPlan 设置加密方案, 若方案不存在或参数错误, 则 Serve 会返回错误而不会退化为不加密
 //
-//	@param	option	string		加密方案, 支持token/no (令牌加密和不加密)
-//	@param	key 	[]string	其他加密参数
+//	@param	option	string		加密方案, 支持no/token/aes-gcm/chacha20-poly1305, 详见 proto.CreateCrypto
+//	@param	key 	[]string	其他加密参数, AEAD 方案为密钥(第一个用于加密), 缺省时采用令牌, 详见 proto.CryptoKeys
 func (e *Engine) SetCryptoPlan(option string, key ...string) *Engine {
-	args := append([]string{e.conf.Token}, key...)
-	e.crypto = proto.CreateCrypto(option, args...)
+	crypto, err := proto.CreateCrypto(option, proto.CryptoKeys(option, e.conf.Token, key...)...)
+	if err != nil {
+		e.cryptoErr = err
+		e.Logger().Error("broker crypto plan is invalid: ", err)
+		return e
+	}
 
+	e.crypto = crypto
+	e.cryptoErr = nil
 	return e
 }
 
 // Crypto 全局加解密器
 func (e *Engine) Crypto() proto.Crypto { return e.crypto }
 
+// SetCompressor 修改向消费者推送消息时的压缩器, 必须在 Serve 之前设置
+// 仅对采用 FrameV2 且协商了 proto.CompressionCapability 的消费者有效, 来自客户端的压缩帧总是会被解压
+func (e *Engine) SetCompressor(compressor proto.Compressor) *Engine {
+	if compressor != nil {
+		e.compressor = compressor
+	}
+
+	return e
+}
+
+// SetCompressPlan 设置压缩方案
+//
+//	@param	option	string	压缩方案, 支持gzip/deflate/no
+//	@param	level 	[]int	压缩等级
+func (e *Engine) SetCompressPlan(option string, level ...int) *Engine {
+	e.compressor = proto.CreateCompressor(option, level...)
+
+	return e
+}
+
+// Compressor 向消费者推送消息时的压缩器
+func (e *Engine) Compressor() proto.Compressor { return e.compressor }
+
+// SetCapabilities 修改服务端支持的可选能力, 必须在 Serve 之前设置
+// 客户端注册时, 仅双方均支持的能力才会被启用
+func (e *Engine) SetCapabilities(capabilities ...proto.Capability) *Engine {
+	e.capabilities = capabilities
+
+	return e
+}
+
+// Capabilities 服务端支持的可选能力
+func (e *Engine) Capabilities() proto.Capabilities { return e.capabilities }
+
 // TokenCrypto Token加解密器，亦可作为全局加解密器
 func (e *Engine) TokenCrypto() *proto.TokenCrypto { return e.tokenCrypto }
 
@@ -276,19 +338,33 @@ func (e *Engine) Serve() error {
 	if e.transfer == nil {
 		return errors.New("transfer instance is not implemented")
 	}
+	if e.cryptoErr != nil {
+		return fmt.Errorf("broker crypto plan is invalid: %w", e.cryptoErr)
+	}
 
 	e.Logger().Debug("broker starting...")
 	e.beforeServe()
+	if err := e.recoverTopics(); err != nil {
+		return fmt.Errorf("broker recover topics failed: %w", err)
+	}
 	e.scheduler.Run()
+	go e.delayed.Run(e.Ctx())
+	go e.syncLogs(e.Ctx())
+	go e.checkAcks(e.Ctx())
+	go e.publishDeadLetters(e.Ctx())
 
 	if e.NeedToken() {
 		e.Logger().Debug("broker token authentication is enabled.")
 	}
 	e.Logger().Debug("broker global crypto: ", e.crypto.String())
+	e.Logger().Debug("broker compressor: ", e.compressor.String())
 	return e.transfer.Serve()
 }
 
-func (e *Engine) Stop() { e.transfer.Stop() }
+func (e *Engine) Stop() {
+	e.transfer.Stop()
+	e.closeLogs()
+}
 
 // New 创建一个新的服务器
 func New(cs ...Config) *Engine {
@@ -308,17 +384,42 @@ func New(cs ...Config) *Engine {
 		conf.Token = cs[0].Token
 		conf.EventHandler = cs[0].EventHandler
 		conf.HeartbeatTimeout = cs[0].HeartbeatTimeout
+		conf.StarvationLimit = cs[0].StarvationLimit
+		conf.DataDir = cs[0].DataDir
+		conf.SegmentBytes = cs[0].SegmentBytes
+		conf.RetentionBytes = cs[0].RetentionBytes
+		conf.RetentionAge = cs[0].RetentionAge
+		conf.FsyncPolicy = cs[0].FsyncPolicy
+		conf.FsyncInterval = cs[0].FsyncInterval
+		conf.Partitions = cs[0].Partitions
+		conf.TopicPartitions = cs[0].TopicPartitions
+		conf.AckTimeout = cs[0].AckTimeout
+		conf.MaxRedeliveries = cs[0].MaxRedeliveries
 	}
 
 	conf.clean()
 	eng := &Engine{
 		conf:                 conf,
 		topics:               &sync.Map{},
+		topicLock:            &sync.Mutex{},
+		schemas:              &sync.Map{},
+		requests:             &sync.Map{},
+		afterReply:           &sync.Map{},
+		wildcards:            &sync.Map{},
+		sequences:            &sync.Map{},
+		duplicates:           &atomic.Uint64{},
+		sessions:             &sync.Map{},
+		deadLetters:          make(chan *proto.PMessage, conf.BufferSize),
+		quarantineTopic:      DefaultQuarantineTopic,
+		deadLetterTopic:      DefaultDeadLetterTopic,
 		transfer:             nil,
 		producerSendInterval: 500 * time.Millisecond,
 		cpLock:               &sync.RWMutex{},
 		crypto:               proto.DefaultCrypto(),
+		compressor:           proto.DefaultCompressor(),
+		capabilities:         proto.DefaultCapabilities(),
 	}
+	eng.delayed = NewDelayQueue(eng.deliverDelayed)
 
-	return eng
+	return eng.initHooks()
 }
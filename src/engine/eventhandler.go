@@ -7,7 +7,8 @@ import (
 
 // EventHandler 事件触发器
 type EventHandler interface {
-	// OnFrameParseError 当来自客户端消息帧解析出错时触发的事件(同步调用)
+	// OnFrameParseError 当来自客户端消息帧解析出错时触发的事件(同步调用), 每一个损坏的帧都会触发一次;
+	// 若同时实现了 FrameParseErrorHandler, 则以 FrameParseErrorHandler.OnFrameParseFailed 代替
 	OnFrameParseError(frame *proto.TransferFrame, con transfer.Conn)
 	// OnConsumerRegister 当消费者注册成功时触发的事件(异步调用)
 	OnConsumerRegister(addr string)
@@ -29,8 +30,18 @@ type EventHandler interface {
 	OnNotImplementMessageType(frame *proto.TransferFrame, con transfer.Conn) error
 	// OnCMConsumed 当一个消费者被消费成功(成功发送给全部消费者)后时触发的事件(同步调用)
 	OnCMConsumed(record *HistoryRecord)
+	// OnCMExpired 当一个消息在推送给消费者之前已超过其存活时间而被丢弃时触发的事件(同步调用)
+	OnCMExpired(record *HistoryRecord)
 }
 
+// FrameParseErrorHandler 可选的事件触发器, 用于获取帧解析出错的具体原因, 由 EventHandler 按需实现
+type FrameParseErrorHandler interface {
+	// OnFrameParseFailed 当来自客户端消息帧解析出错时触发的事件(同步调用), 代替 EventHandler.OnFrameParseError,
+	// err 为 proto.ErrFrameHeadInvalid, proto.ErrFrameChecksumMismatch 等具体的错误原因
+	OnFrameParseFailed(frame *proto.TransferFrame, con transfer.Conn, err error)
+}
+
+// DefaultEventHandler 默认的事件触发器, 不实现 FrameParseErrorHandler, 以免嵌入后屏蔽 OnFrameParseError
 type DefaultEventHandler struct{}
 
 func (e DefaultEventHandler) OnFrameParseError(_ *proto.TransferFrame, _ transfer.Conn) {}
@@ -47,6 +58,8 @@ func (e DefaultEventHandler) OnProducerRegisterTimeout(event TimeoutEvent)  {}
 
 func (e DefaultEventHandler) OnCMConsumed(_ *HistoryRecord) {}
 
+func (e DefaultEventHandler) OnCMExpired(_ *HistoryRecord) {}
+
 func (e DefaultEventHandler) OnNotImplementMessageType(frame *proto.TransferFrame, con transfer.Conn) error {
 	return nil
 }
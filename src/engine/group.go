@@ -0,0 +1,109 @@
+package engine
+
+import (
+	"github.com/Chendemo12/micromq/src/proto"
+)
+
+// 主题内的一个消费者组, 组内的每个消息仅推送给一个成员
+type consumerGroup struct {
+	name    string
+	balance proto.BalanceType
+	members []*Consumer // 按加入的顺序排列, 成员变化时消息即按新的成员重新分配
+	cursor  int         // 下一个依次分配的成员
+}
+
+// 依据分配方式选择推送消息的成员, 返回的成员列表以选中的成员开始, 其余成员依次排列, 用于选中的成员不可达时转投
+func (g *consumerGroup) candidates(key []byte) []*Consumer {
+	n := len(g.members)
+	var start int
+	if g.balance == proto.KeyHashBalance && len(key) > 0 {
+		start = hashKey(key, n)
+	} else {
+		start = g.cursor % n
+		g.cursor = (start + 1) % n
+	}
+
+	members := make([]*Consumer, 0, n)
+	members = append(members, g.members[start:]...)
+	return append(members, g.members[:start]...)
+}
+
+// 将消费者加入其所属的消费者组, 组不存在时以此消费者的分配方式创建
+func (t *Topic) joinGroup(con *Consumer) {
+	t.groupLock.Lock()
+	defer t.groupLock.Unlock()
+
+	name := con.Group()
+	g, ok := t.groups[name]
+	if !ok {
+		g = &consumerGroup{name: name, balance: con.Conf.Balance, members: make([]*Consumer, 0, 1)}
+		t.groups[name] = g
+	}
+	for _, m := range g.members {
+		if m.Addr == con.Addr {
+			return
+		}
+	}
+	g.members = append(g.members, con)
+}
+
+// 将消费者移出其所在的消费者组, 组内不再有成员时删除此组
+func (t *Topic) leaveGroup(addr string) {
+	t.groupLock.Lock()
+	defer t.groupLock.Unlock()
+
+	for name, g := range t.groups {
+		for i, m := range g.members {
+			if m.Addr != addr {
+				continue
+			}
+			g.members = append(g.members[:i:i], g.members[i+1:]...)
+			if len(g.members) == 0 {
+				delete(t.groups, name)
+			} else if g.cursor > i {
+				g.cursor--
+			}
+			return
+		}
+	}
+}
+
+// 依据消费者组的分配方式选择推送消息的成员, 返回的成员列表以选中的成员开始, 组不存在时为nil
+func (t *Topic) groupMembers(name string, key []byte) []*Consumer {
+	t.groupLock.Lock()
+	defer t.groupLock.Unlock()
+
+	g, ok := t.groups[name]
+	if !ok {
+		return nil
+	}
+	return g.candidates(key)
+}
+
+// 为每个消费者组选择推送消息的成员
+func (t *Topic) groupCandidates(key []byte) [][]*Consumer {
+	t.groupLock.Lock()
+	defer t.groupLock.Unlock()
+
+	candidates := make([][]*Consumer, 0, len(t.groups))
+	for _, g := range t.groups {
+		candidates = append(candidates, g.candidates(key))
+	}
+	return candidates
+}
+
+// Groups 主题内的消费者组及其成员地址: {group: [addr]}
+func (t *Topic) Groups() map[string][]string {
+	t.groupLock.Lock()
+	defer t.groupLock.Unlock()
+
+	groups := make(map[string][]string, len(t.groups))
+	for name, g := range t.groups {
+		addrs := make([]string, len(g.members))
+		for i, m := range g.members {
+			addrs[i] = m.Addr
+		}
+		groups[name] = addrs
+	}
+	return groups
+}
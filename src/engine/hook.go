@@ -24,7 +24,11 @@ type ChainArgs struct {
 	producer *Producer
 	rm       *proto.RegisterMessage
 	pms      []*proto.PMessage
-	stopErr  error // 不回复客户端的原因
+	reply    *proto.ReplyMessage
+	sm       *proto.SubscribeMessage
+	am       *proto.AckMessage
+	stopErr  error    // 不回复客户端的原因
+	after    []func() // 需在响应写入客户端之后执行的操作
 }
 
 func (args *ChainArgs) Reset() {
@@ -33,8 +37,19 @@ func (args *ChainArgs) Reset() {
 	args.producer = nil
 	args.rm = nil
 	args.pms = nil
+	args.reply = nil
+	args.sm = nil
+	args.am = nil
 	args.resp = nil
 	args.stopErr = nil
+	args.after = nil
+}
+
+// AfterReply 登记一个需在响应写入客户端之后执行的操作, 例如向刚注册的消费者推送消息
+func (args *ChainArgs) AfterReply(fn func()) *ChainArgs {
+	args.after = append(args.after, fn)
+
+	return args
 }
 
 // ReplyClient 是否需要回复客户端, 只要未显示设置不回复，均需要回复响应给客户端
@@ -0,0 +1,99 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/Chendemo12/micromq/src/proto"
+	"sync"
+	"time"
+)
+
+// ProducerSequenceTTL 生产者序列号记录的保留时长, 超时未发送消息的生产者ID会被清除
+const ProducerSequenceTTL = 30 * time.Minute
+
+// 每个生产者ID保留的序列号与偏移量的数量;
+// 同一连接的多个消息帧会被并发处理, 因此窗口内的序列号允许乱序到达, 早于窗口的消息则均被视为重复消息
+const sequenceWindow = 256
+
+type sequenceOffset struct {
+	seq    uint64
+	offset uint64
+	used   bool
+}
+
+// 生产者ID最近已发布的序列号
+type producerSequence struct {
+	mu        *sync.Mutex
+	offsets   [sequenceWindow]sequenceOffset
+	next      int  // offsets 中下一个写入的位置
+	full      bool // offsets 是否已写满
+	updatedAt time.Time
+}
+
+// 查询序列号是否已发布, 并返回其原始偏移量, 早于窗口的消息无法得知其偏移量
+func (s *producerSequence) lookup(seq uint64) (offset uint64, duplicated bool) {
+	oldest := seq
+	for _, so := range s.offsets {
+		if !so.used {
+			continue
+		}
+		if so.seq == seq {
+			return so.offset, true
+		}
+		if so.seq < oldest {
+			oldest = so.seq
+		}
+	}
+
+	return 0, s.full && seq < oldest
+}
+
+func (s *producerSequence) record(seq, offset uint64) {
+	s.offsets[s.next] = sequenceOffset{seq: seq, offset: offset, used: true}
+	s.next = (s.next + 1) % sequenceWindow
+	s.full = s.full || s.next == 0
+}
+
+// PublishIdempotent 发布携带生产者ID和序列号的消息, 重复的消息不再发布, 而是返回其原始偏移量,
+// 若原始偏移量已不在记录窗口内则返回0; 未携带生产者ID和序列号的消息直接发布
+func (e *Engine) PublishIdempotent(pm *proto.PMessage) (offset uint64, duplicated bool) {
+	id, seq, ok := pm.Headers.ProducerSequence()
+	if !ok {
+		return e.Publisher(pm), false
+	}
+
+	v, _ := e.sequences.LoadOrStore(id, &producerSequence{mu: &sync.Mutex{}})
+	s := v.(*producerSequence)
+
+	// 同一生产者ID可能在重连期间同时存在两个连接, 检查与发布必须是原子的
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.updatedAt = time.Now()
+	if offset, duplicated = s.lookup(seq); duplicated {
+		e.duplicates.Add(1)
+		e.Logger().Debug(fmt.Sprintf("%s duplicated, producer: %s, sequence: %d", pm, id, seq))
+		return offset, true
+	}
+
+	offset = e.Publisher(pm)
+	s.record(seq, offset)
+
+	return offset, false
+}
+
+// 清除超时未发送消息的生产者ID
+func (e *Engine) clearSequences() {
+	deadline := time.Now().Add(-ProducerSequenceTTL)
+	e.sequences.Range(func(key, value any) bool {
+		s := value.(*producerSequence)
+		s.mu.Lock()
+		if s.updatedAt.Before(deadline) {
+			e.sequences.Delete(key)
+		}
+		s.mu.Unlock()
+		return true
+	})
+}
+
+// DuplicateMessages 因重复而被丢弃的生产者消息数量
+func (e *Engine) DuplicateMessages() uint64 { return e.duplicates.Load() }
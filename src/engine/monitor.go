@@ -232,13 +232,15 @@ func (k *Monitor) Interval() time.Duration {
 	return time.Duration(k.broker.HeartbeatInterval()/2) * time.Second
 }
 
-func (k *Monitor) OnStartup() {
+// 在传输层启动之前初始化, 调度器的 OnStartup 在独立协程中执行, 可能晚于首个连接
+func (k *Monitor) init() *Monitor {
 	k.lock = &sync.RWMutex{}
 	k.timeInfos = make([]*TimeInfo, k.broker.conf.MaxOpenConn)
 
 	for i := 0; i < k.broker.conf.MaxOpenConn; i++ {
 		k.timeInfos[i] = &TimeInfo{}
 	}
+	return k
 }
 
 func (k *Monitor) Do(ctx context.Context) error {
@@ -247,6 +249,9 @@ func (k *Monitor) Do(ctx context.Context) error {
 	// 必须先释放锁才能继续清除连接
 	k.closeRegisterTimeout(rTimeout)
 	k.closeHeartbeatTimeout(hTimeout)
+	k.broker.clearRequests("") // 清除超时未回复的请求
+	k.broker.clearSequences()  // 清除长时间未发送消息的生产者ID
+	k.broker.retainLogs()      // 依据保留策略删除旧的日志段
 
 	return nil
 }
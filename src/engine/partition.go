@@ -0,0 +1,223 @@
+package engine
+
+import (
+	"github.com/Chendemo12/micromq/src/proto"
+	"github.com/Chendemo12/micromq/src/storage"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultPartitions 主题缺省的分区数量
+const DefaultPartitions = 1
+
+// MaxPartitions 主题允许的最大分区数量, 分区号在消费者消息中以2字节编码
+const MaxPartitions = 1024
+
+// 主题内的一个分区, 每个分区拥有独立的偏移量和推送队列;
+// 分区内的消息依次推送, 前一个消息推送给全部消费者之后才推送下一个消息, 以保证分区内的顺序;
+// 同一连接的帧由传输层依次处理, 因此同一生产者连接发布的消息按发送顺序分配偏移量.
+// 顺序仅对相同优先级的消息保证, 尚未推送的高优先级消息会越过低优先级的消息, 见 partition.next
+type partition struct {
+	index   int
+	offset  *atomic.Uint64   // 当前数据偏移量,仅用于模糊显示
+	counter *proto.Counter   // 生产者消息计数器,用于计算数据偏移量
+	lanes   []chan queueItem // 各优先级的等待消费者消费的数据, 以 proto.MessagePriority 为索引
+	slots   []chan struct{}  // 各优先级通道已占用的容量, 发布者在加锁之前占用, 以免持有 mu 时阻塞
+	pending chan struct{}    // 全部通道中等待消费的数据数量
+	starved []int            // 各通道在有消息等待时连续让行的次数
+	log     *storage.Log     // 分区日志, 为nil时不持久化
+	mu      *sync.Mutex      // 保证偏移量按顺序写入日志
+}
+
+func newPartition(index, bufferSize int) *partition {
+	p := &partition{
+		index:   index,
+		offset:  &atomic.Uint64{},
+		counter: proto.NewCounter(),
+		lanes:   make([]chan queueItem, proto.NumberOfPriorities),
+		slots:   make([]chan struct{}, proto.NumberOfPriorities),
+		pending: make(chan struct{}, bufferSize*proto.NumberOfPriorities),
+		starved: make([]int, proto.NumberOfPriorities),
+		mu:      &sync.Mutex{},
+	}
+	for i := range p.lanes {
+		p.lanes[i] = make(chan queueItem, bufferSize)
+		p.slots[i] = make(chan struct{}, bufferSize)
+	}
+
+	return p
+}
+
+// 取出下一个待推送的消息: 通常按优先级从高到低选择通道,
+// 但当某个低优先级通道连续让行达到上限时, 优先取出此通道的消息, 以避免其饥饿;
+// 每个 pending 均对应一个已加入通道的消息, 因此总能取到消息
+func (p *partition) next(starvation int) queueItem {
+	lane := -1
+	for i := 0; i < len(p.lanes)-1; i++ { // 最高优先级的通道不会饥饿
+		if p.starved[i] >= starvation && len(p.lanes[i]) > 0 {
+			lane = i
+			break
+		}
+	}
+
+	var item queueItem
+	if lane < 0 {
+	outer:
+		for {
+			for i := len(p.lanes) - 1; i >= 0; i-- {
+				select {
+				case item = <-p.lanes[i]:
+					lane = i
+					break outer
+				default:
+				}
+			}
+		}
+	} else {
+		item = <-p.lanes[lane]
+	}
+
+	<-p.slots[lane]
+	p.starved[lane] = 0
+	for i := 0; i < lane; i++ {
+		if len(p.lanes[i]) > 0 {
+			p.starved[i]++
+		} else {
+			p.starved[i] = 0
+		}
+	}
+
+	return item
+}
+
+// 各优先级通道中等待推送的消息数量
+func (p *partition) queueDepth() []int {
+	depth := make([]int, len(p.lanes))
+	for i, lane := range p.lanes {
+		depth[i] = len(lane)
+	}
+	return depth
+}
+
+// 依据消息键计算其所属的序号, 相同的键总是得到相同的序号
+func hashKey(key []byte, n int) int {
+	h := fnv.New32a()
+	_, _ = h.Write(key)
+	return int(h.Sum32() % uint32(n))
+}
+
+// 为消息选择分区: 依据消息键的哈希值分配, 以使相同键的消息有序; 未设置键的消息依次分配给各分区
+func (t *Topic) partitionOf(key []byte) *partition {
+	n := len(t.partitions)
+	if n == 1 {
+		return t.partitions[0]
+	}
+	if len(key) > 0 {
+		return t.partitions[hashKey(key, n)]
+	}
+	return t.partitions[(t.cursor.Add(1)-1)%uint64(n)]
+}
+
+// SetPartitions 设置主题的分区数量, 分区只增不减, 且不超过 MaxPartitions; 必须在发布消息之前设置
+func (t *Topic) SetPartitions(n int) *Topic {
+	if n > MaxPartitions {
+		n = MaxPartitions
+	}
+	for i := len(t.partitions); i < n; i++ {
+		p := newPartition(i, t.bufferSize)
+		t.partitions = append(t.partitions, p)
+		go t.consume(p)
+	}
+
+	return t
+}
+
+// Partitions 主题的分区数量
+func (t *Topic) Partitions() int { return len(t.partitions) }
+
+// PartitionOffset 分区内最新的消息偏移量, 分区不存在时为0
+func (t *Topic) PartitionOffset(partition int) uint64 {
+	if partition < 0 || partition >= len(t.partitions) {
+		return 0
+	}
+	return t.partitions[partition].offset.Load()
+}
+
+// PartitionQueueDepth 分区内各优先级通道中等待推送的消息数量, 以 proto.MessagePriority 为索引
+func (t *Topic) PartitionQueueDepth(partition int) []int {
+	if partition < 0 || partition >= len(t.partitions) {
+		return make([]int, proto.NumberOfPriorities)
+	}
+	return t.partitions[partition].queueDepth()
+}
+
+// SetPartitionLog 设置分区日志, 此后分区内的消息均会追加到日志中, 偏移量从日志的 NextOffset 继续; 必须在发布消息之前设置
+//
+//	@param	partition	int				分区号, 不存在的分区被忽略
+//	@param	log			*storage.Log	分区日志
+//	@param	onFailed	func(err error)	消息写入日志失败时的回调, 消息仍会推送给消费者
+func (t *Topic) SetPartitionLog(partition int, log *storage.Log, onFailed func(err error)) *Topic {
+	if partition < 0 || partition >= len(t.partitions) {
+		return t
+	}
+	p := t.partitions[partition]
+	p.log = log
+	t.onLogFailed = onFailed
+	if next := log.NextOffset(); next > 0 {
+		p.counter.Store(next)
+		p.offset.Store(next - 1)
+		if next-1 > t.Offset() {
+			t.offset.Store(next - 1)
+		}
+	}
+
+	return t
+}
+
+// PartitionLog 分区日志, 分区不存在或未持久化时为nil
+func (t *Topic) PartitionLog(partition int) *storage.Log {
+	if partition < 0 || partition >= len(t.partitions) {
+		return nil
+	}
+	return t.partitions[partition].log
+}
+
+// Logs 全部分区的日志, 未持久化时为空
+func (t *Topic) Logs() []*storage.Log {
+	logs := make([]*storage.Log, 0, len(t.partitions))
+	for _, p := range t.partitions {
+		if p.log != nil {
+			logs = append(logs, p.log)
+		}
+	}
+	return logs
+}
+
+// 主题的分区数量, 回复主题仅有一个分区
+func (e *Engine) topicPartitions(name string) int {
+	if strings.HasPrefix(name, ReplyTopicPrefix) {
+		return 1
+	}
+	if n, ok := e.conf.TopicPartitions[name]; ok && n > 0 {
+		return n
+	}
+	return e.conf.Partitions
+}
+
+// ParseTopicPartitions 解析以逗号分隔的各主题分区数量, 如 "ORDERS=4,LOGS=2", 格式错误的项被忽略
+func ParseTopicPartitions(s string) map[string]int {
+	partitions := make(map[string]int)
+	for _, item := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok || name == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			partitions[name] = n
+		}
+	}
+	return partitions
+}
@@ -0,0 +1,226 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"github.com/Chendemo12/micromq/src/storage"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultFsyncInterval storage.FsyncInterval 策略的默认同步间隔
+const DefaultFsyncInterval = time.Second
+
+// Persistent 是否将消息持久化到主题日志
+func (e *Engine) Persistent() bool { return e.conf.DataDir != "" }
+
+// 主题日志所在的目录, 主题名称经过转义, 以避免路径分隔符和相对路径
+func (e *Engine) topicDir(name string) string {
+	dir := url.PathEscape(name)
+	if strings.HasPrefix(dir, ".") {
+		dir = "%2E" + dir[1:]
+	}
+	return filepath.Join(e.conf.DataDir, dir)
+}
+
+// 分区日志目录的前缀, 首个分区的日志位于主题日志目录内, 其余分区位于其子目录内
+const partitionDirPrefix = "partition-"
+
+// 分区日志所在的目录
+func (e *Engine) partitionDir(name string, partition int) string {
+	if partition == 0 {
+		return e.topicDir(name)
+	}
+	return filepath.Join(e.topicDir(name), partitionDirPrefix+strconv.Itoa(partition))
+}
+
+// 主题已持久化的分区数量, 依据分区日志目录确定
+func (e *Engine) persistedPartitions(name string) int {
+	entries, err := os.ReadDir(e.topicDir(name))
+	if err != nil {
+		return 0
+	}
+
+	n := 1
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), partitionDirPrefix) {
+			continue
+		}
+		if i, _err := strconv.Atoi(strings.TrimPrefix(entry.Name(), partitionDirPrefix)); _err == nil && i >= n {
+			n = i + 1
+		}
+	}
+	return n
+}
+
+// 为主题的各分区打开日志, 已持久化的分区多于配置时以持久化的为准; 回复主题仅与当前连接有关, 因此不持久化
+func (e *Engine) openLog(topic *Topic) {
+	name := string(topic.Name)
+	if !e.Persistent() || strings.HasPrefix(name, ReplyTopicPrefix) {
+		return
+	}
+	topic.SetPartitions(e.persistedPartitions(name))
+
+	for i := 0; i < topic.Partitions(); i++ {
+		log, err := storage.Open(e.partitionDir(name, i), storage.Options{
+			SegmentBytes:   e.conf.SegmentBytes,
+			RetentionBytes: e.conf.RetentionBytes,
+			RetentionAge:   e.conf.RetentionAge,
+			Fsync:          e.conf.FsyncPolicy,
+		})
+		if err != nil {
+			e.Logger().Error(fmt.Sprintf(
+				"topic '%s' partition %d log open failed, messages will not be persisted: %v", name, i, err,
+			))
+			continue
+		}
+		if n := log.Truncated(); n > 0 {
+			e.Logger().Warn(fmt.Sprintf(
+				"topic '%s' partition %d log recovered, %d bytes of broken records truncated", name, i, n,
+			))
+		}
+
+		topic.SetPartitionLog(i, log, func(err error) {
+			e.Logger().Error(fmt.Sprintf("topic '%s' log append failed: %v", name, err))
+		})
+	}
+	e.recoverHistory(topic)
+}
+
+// 自分区日志恢复主题最近的历史记录, 各分区的记录按写入时间合并;
+// 服务端不保存消费者的推送进度, 因此重启前已写入日志但尚未推送的消息不会被重新推送, 只能由消费者指定起始位置回放
+func (e *Engine) recoverHistory(topic *Topic) {
+	if topic.HistorySize <= 0 {
+		return
+	}
+
+	type logRecord struct {
+		*storage.Record
+		partition int
+	}
+	records := make([]logRecord, 0)
+	for _, p := range topic.partitions {
+		if p.log == nil {
+			continue
+		}
+		from := p.log.OldestOffset()
+		if next := p.log.NextOffset(); next-from > uint64(topic.HistorySize) {
+			from = next - uint64(topic.HistorySize)
+		}
+		err := p.log.Read(from, func(r *storage.Record) bool {
+			records = append(records, logRecord{Record: r, partition: p.index})
+			return true
+		})
+		if err != nil {
+			e.Logger().Warn(fmt.Sprintf("topic '%s' partition %d history recover failed: %v", topic.Name, p.index, err))
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time < records[j].Time })
+	if len(records) > topic.HistorySize {
+		records = records[len(records)-topic.HistorySize:]
+	}
+
+	for _, r := range records {
+		topic.historyRecords.Append(&HistoryRecord{
+			Topic:     topic.Name,
+			Key:       r.Key,
+			Value:     r.Value,
+			Headers:   r.Headers,
+			Offset:    r.Offset,
+			Partition: r.partition,
+			Time:      r.Time / 1000,
+		})
+	}
+}
+
+// 依据存储目录恢复全部主题, 主题的偏移量从日志中继续
+func (e *Engine) recoverTopics() error {
+	if !e.Persistent() {
+		return nil
+	}
+	if err := os.MkdirAll(e.conf.DataDir, 0o755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(e.conf.DataDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		name, _err := url.PathUnescape(entry.Name())
+		if _err != nil {
+			continue
+		}
+		topic := e.GetTopic([]byte(name))
+		for i := 0; i < topic.Partitions(); i++ {
+			if log := topic.PartitionLog(i); log != nil {
+				e.Logger().Info(fmt.Sprintf(
+					"topic '%s' partition %d recovered, offsets: [%d, %d)", name, i, log.OldestOffset(), log.NextOffset(),
+				))
+			}
+		}
+	}
+
+	return nil
+}
+
+// 按照 storage.FsyncInterval 策略定期同步全部主题日志
+func (e *Engine) syncLogs(ctx context.Context) {
+	if !e.Persistent() || (e.conf.FsyncPolicy != "" && e.conf.FsyncPolicy != storage.FsyncInterval) {
+		return
+	}
+
+	ticker := time.NewTicker(e.conf.FsyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.RangeTopic(func(topic *Topic) bool {
+				for _, log := range topic.Logs() {
+					if err := log.Sync(); err != nil {
+						e.Logger().Warn(fmt.Sprintf("topic '%s' log sync failed: %v", topic.Name, err))
+					}
+				}
+				return true
+			})
+		}
+	}
+}
+
+// 依据保留策略删除全部主题日志中的旧段
+func (e *Engine) retainLogs() {
+	now := time.Now()
+	e.RangeTopic(func(topic *Topic) bool {
+		for _, log := range topic.Logs() {
+			removed, err := log.Retain(now)
+			if err != nil {
+				e.Logger().Warn(fmt.Sprintf("topic '%s' log retention failed: %v", topic.Name, err))
+			} else if removed > 0 {
+				e.Logger().Debug(fmt.Sprintf("topic '%s' %d log segments removed", topic.Name, removed))
+			}
+		}
+		return true
+	})
+}
+
+// 同步并关闭全部主题日志
+func (e *Engine) closeLogs() {
+	e.RangeTopic(func(topic *Topic) bool {
+		for _, log := range topic.Logs() {
+			if err := log.Close(); err != nil {
+				e.Logger().Warn(fmt.Sprintf("topic '%s' log close failed: %v", topic.Name, err))
+			}
+		}
+		return true
+	})
+}
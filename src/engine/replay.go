@@ -0,0 +1,229 @@
+package engine
+
+import (
+	"encoding/binary"
+	"github.com/Chendemo12/micromq/src/proto"
+	"github.com/Chendemo12/micromq/src/storage"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 消费者的回放状态, 回放期间推送给此消费者的实时消息被暂存, 待历史消息推送完成后再推送
+type replayState struct {
+	mu      *sync.Mutex
+	pending []*HistoryRecord // 回放期间暂存的实时消息
+	live    bool             // 是否已切换为实时推送
+	// 各分区自日志回放的偏移量上限, 低于此偏移量的实时消息已在回放中推送;
+	// 回放可能先于推送协程完成, 因此切换为实时推送后仍需跳过这些消息
+	skipBelow []uint64
+}
+
+// 暂存或丢弃推送给回放消费者的实时消息, 返回消息是否已被处理;
+// 回放期间的消息均被暂存, 回放完成后丢弃已自日志回放的消息
+func (s *replayState) hold(record *HistoryRecord) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.live {
+		return record.Offset < s.skipBelow[record.Partition]
+	}
+	s.pending = append(s.pending, record)
+
+	return true
+}
+
+// 回放的消息来源, 按偏移量递增的顺序迭代, fn 返回false时停止迭代
+type replaySource func(fn func(record *HistoryRecord) bool)
+
+// AddReplayConsumer 添加一个自指定位置开始消费的消费者, 并返回开始回放的方法, 调用方应在注册响应发出之后调用;
+// 分区存在日志时自日志回放, 否则自历史记录回放, 回放期间的实时消息被暂存, 以保证推送给消费者的偏移量连续.
+// 各分区依次回放, 起始偏移量依据 proto.StartPosition.Offsets 或 Type 和 Value 确定;
+// 全部分区的起始位置均为 proto.StartLatest 或不早于下一个偏移量时, 等同于 AddConsumer 并返回nil;
+// 早于最早保留的消息时, 自最早保留的消息开始回放
+func (t *Topic) AddReplayConsumer(con *Consumer, pos *proto.StartPosition) (start func()) {
+	// 等待正在推送的消息完成, 此后的消息均会被暂存
+	t.deliver.Lock()
+	defer t.deliver.Unlock()
+
+	sources := make([]replaySource, 0, len(t.partitions))
+	skipBelow := make([]uint64, len(t.partitions)) // 各分区暂存的实时消息中需跳过的偏移量, 这些消息已在回放中推送
+	for _, p := range t.partitions {
+		p.mu.Lock()
+		next := p.counter.Value() // 此前的消息均已写入日志
+		p.mu.Unlock()
+
+		var from uint64
+		var after int64 // Unix毫秒时间戳, 早于此时间发布的消息不回放
+		if offset, ok := pos.Offsets[uint16(p.index)]; ok {
+			from = offset
+		} else {
+			switch pos.Type {
+			case proto.StartEarliest:
+			case proto.StartOffset:
+				from = pos.Value
+			case proto.StartTimestamp:
+				after = int64(pos.Value)
+			default:
+				from = next
+			}
+		}
+		if from >= next {
+			continue
+		}
+
+		if p.log != nil {
+			sources = append(sources, t.logSource(p, from, next, after))
+			skipBelow[p.index] = next
+		} else {
+			// 历史记录在消息推送完成后才加入, 因此与暂存的实时消息不会重复
+			sources = append(sources, t.historySource(p.index, from, after))
+		}
+	}
+	if len(sources) == 0 {
+		t.AddConsumer(con)
+		return nil
+	}
+
+	source := func(fn func(record *HistoryRecord) bool) {
+		next := true
+		for _, s := range sources {
+			s(func(record *HistoryRecord) bool {
+				next = fn(record)
+				return next
+			})
+			if !next {
+				return
+			}
+		}
+	}
+
+	state := &replayState{mu: &sync.Mutex{}, pending: make([]*HistoryRecord, 0), skipBelow: skipBelow}
+	t.replays.Store(con.Addr, state)
+	t.AddConsumer(con)
+
+	return func() { go t.replay(con, state, source) }
+}
+
+// 自分区日志回放偏移量在 [from, next) 之间的消息
+func (t *Topic) logSource(p *partition, from, next uint64, after int64) replaySource {
+	log := p.log
+	now := time.Now()
+
+	return func(fn func(record *HistoryRecord) bool) {
+		_ = log.Read(from, func(r *storage.Record) bool {
+			if r.Offset >= next {
+				return false
+			}
+			if r.Time < after || replayExpired(r.Time, r.Headers, now) {
+				return true
+			}
+			return fn(&HistoryRecord{
+				Topic:     t.Name,
+				Key:       r.Key,
+				Value:     r.Value,
+				Headers:   r.Headers,
+				Offset:    r.Offset,
+				Partition: p.index,
+				Time:      r.Time / 1000,
+			})
+		})
+	}
+}
+
+// 自历史记录回放分区内偏移量不小于 from 的消息, 历史记录的时间戳精度为秒,
+// 因此 after 所在的一秒内的消息均被回放, 以免遗漏晚于 after 的消息
+func (t *Topic) historySource(partition int, from uint64, after int64) replaySource {
+	records := make([]*HistoryRecord, 0, t.historyRecords.Length())
+	now := time.Now()
+
+	t.historyRecords.Range(func(value any) bool {
+		record, ok := value.(*HistoryRecord)
+		if ok && record.Partition == partition && record.Offset >= from && record.Time >= after/1000 &&
+			!replayExpired(record.Time*1000, record.Headers, now) {
+			records = append(records, record)
+		}
+		return true
+	})
+	// 历史记录按推送完成的顺序加入, 不一定按偏移量递增
+	sort.Slice(records, func(i, j int) bool { return records[i].Offset < records[j].Offset })
+
+	return func(fn func(record *HistoryRecord) bool) {
+		for _, record := range records {
+			if !fn(record) {
+				return
+			}
+		}
+	}
+}
+
+// 消息是否已超过其存活时间
+func replayExpired(timeMs int64, headers proto.Headers, now time.Time) bool {
+	ttl, ok := headers.TTL()
+	return ok && now.After(time.UnixMilli(timeMs).Add(ttl))
+}
+
+// 向消费者推送历史消息, 然后推送回放期间暂存的实时消息, 并切换为实时推送;
+// 未能送达的消息在释放 state.mu 之后才记录, 以免死信回调在持有回放锁时执行
+func (t *Topic) replay(con *Consumer, state *replayState, source replaySource) {
+	var err error
+	source(func(record *HistoryRecord) bool {
+		err = t.tracked(con, record, func() error { return t.sendRecord(con, record) })
+		return err == nil
+	})
+
+	undelivered := make([]*HistoryRecord, 0)
+	state.mu.Lock()
+	for _, record := range state.pending {
+		if record.Offset < state.skipBelow[record.Partition] {
+			continue
+		}
+		if err != nil { // 消费者已不可达, 其余的实时消息均未能送达
+			undelivered = append(undelivered, record)
+			continue
+		}
+		if err = t.tracked(con, record, func() error { return t.sendRecord(con, record) }); err != nil {
+			undelivered = append(undelivered, record)
+		}
+	}
+	state.pending = nil
+	state.live = true
+	state.mu.Unlock()
+
+	for _, record := range undelivered {
+		t.undeliver(record, con.Addr, err)
+	}
+}
+
+// 消费者的回放状态, 未自指定位置开始消费的消费者返回nil; 状态保留至消费者移出主题,
+// 因为加入时正在推送的消息可能晚于回放完成才推送, 这些消息仍需推送或跳过
+func (t *Topic) replayOf(addr string) *replayState {
+	v, ok := t.replays.Load(addr)
+	if !ok {
+		return nil
+	}
+	return v.(*replayState)
+}
+
+// 依据消费者所需的格式构建消息帧并推送
+func (t *Topic) sendRecord(con *Consumer, record *HistoryRecord) error {
+	cm := &proto.CMessage{
+		Offset:      make([]byte, 8),
+		ProductTime: make([]byte, 8),
+		PM:          &proto.PMessage{Topic: record.Topic, Key: record.Key, Value: record.Value, Headers: record.Headers},
+		Partition:   uint16(record.Partition),
+	}
+	binary.BigEndian.PutUint64(cm.Offset, record.Offset)
+	binary.BigEndian.PutUint64(cm.ProductTime, uint64(record.Time))
+
+	frame, err := t.buildFrame(cm, t.frameFormat(con, record.Headers))
+	defer framePool.Put(frame)
+	if err != nil {
+		return err
+	}
+
+	con.mu.Lock()
+	defer con.mu.Unlock()
+
+	return frame.DrainTo(con.Conn)
+}
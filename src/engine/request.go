@@ -0,0 +1,157 @@
+package engine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/Chendemo12/micromq/src/proto"
+	"strings"
+	"time"
+)
+
+// ReplyTopicPrefix 回复主题的前缀, 回复主题由服务端依据请求方的连接生成
+const ReplyTopicPrefix = "__REPLY__/"
+
+// MaxRequestAge 等待回复的请求的最长保留时间, 超时后其回复会被丢弃
+const MaxRequestAge = 5 * time.Minute
+
+// 等待回复的请求的键, 关联ID由请求方生成, 不同的请求方可能使用相同的关联ID
+type requestKey struct {
+	addr string // 请求方的连接地址
+	id   string // 关联ID
+}
+
+// 等待回复的请求
+type pendingRequest struct {
+	addr      string // 请求方的连接地址
+	topic     []byte // 请求所属的主题
+	createdAt time.Time
+}
+
+// ReplyTopic 请求方连接的回复主题
+func ReplyTopic(addr string) string { return ReplyTopicPrefix + addr }
+
+// 记录携带 proto.CorrelationIDHeader 的请求, 并将回复主题设置为请求方的连接
+func (e *Engine) trackRequest(pm *proto.PMessage, addr string) {
+	id := string(pm.Headers.Get(proto.CorrelationIDHeader))
+	if id == "" {
+		return
+	}
+
+	pm.Headers.Set(proto.ReplyToHeader, []byte(ReplyTopic(addr)))
+	e.requests.Store(requestKey{addr: addr, id: id}, &pendingRequest{
+		addr:      addr,
+		topic:     append([]byte{}, pm.Topic...),
+		createdAt: time.Now(),
+	})
+}
+
+// 取出回复所对应的请求, 请求方由回复主题确定, 每个请求仅接收第一个回复
+func (e *Engine) takeRequest(reply *proto.ReplyMessage) (*pendingRequest, bool) {
+	addr, ok := strings.CutPrefix(string(reply.Topic), ReplyTopicPrefix)
+	if !ok { // 不是回复主题, 可能是伪造的回复
+		return nil, false
+	}
+	v, ok := e.requests.LoadAndDelete(requestKey{addr: addr, id: reply.CorrelationID()})
+	if !ok {
+		return nil, false
+	}
+
+	return v.(*pendingRequest), true
+}
+
+// 清除某个连接或已超时的请求, addr 为空时仅清除超时的请求
+func (e *Engine) clearRequests(addr string) {
+	deadline := time.Now().Add(-MaxRequestAge)
+	e.requests.Range(func(key, value any) bool {
+		req := value.(*pendingRequest)
+		if req.addr == addr || req.createdAt.Before(deadline) {
+			e.requests.Delete(key)
+		}
+		return true
+	})
+}
+
+// 将回复投递给请求方, 回复以 proto.HCMessageType 推送, 且仅会发送到请求方的连接
+func (e *Engine) deliverReply(req *pendingRequest, reply *proto.ReplyMessage) error {
+	producer, ok := e.QueryProducer(req.addr)
+	if !ok {
+		return ErrProducerNotRegister
+	}
+
+	cm := &proto.CMessage{
+		Offset:      make([]byte, 8),
+		ProductTime: make([]byte, 8),
+		PM: &proto.PMessage{
+			Topic: req.topic, Key: reply.Key, Value: reply.Value, Headers: reply.Headers,
+		},
+	}
+	binary.BigEndian.PutUint64(cm.ProductTime, uint64(time.Now().Unix()))
+
+	frame := framePool.Get()
+	defer framePool.Put(frame)
+
+	frame.SetVersion(producer.FrameVersion())
+	if err := frame.BuildFrom(cm, e.Crypto().Encrypt); err != nil {
+		return err
+	}
+
+	producer.mu.Lock()
+	defer producer.mu.Unlock()
+
+	return frame.DrainTo(producer.Conn)
+}
+
+// ============================= request message =============================
+
+// 记录生产者消息中的请求, 仅对协商了 proto.RequestReplyCapability 的生产者有效
+func (e *Engine) pmRequestTracker(args *ChainArgs) (stop bool) {
+	if !args.producer.HasCapability(proto.RequestReplyCapability) {
+		return
+	}
+
+	for _, pm := range args.pms {
+		if len(pm.Headers) > 0 {
+			e.trackRequest(pm, args.con.Addr())
+		}
+	}
+
+	return
+}
+
+// ============================= reply message =============================
+
+// 解析回复消息, 回复不需要响应, 且只允许已注册的客户端发送
+func (e *Engine) replyParser(args *ChainArgs) (stop bool) {
+	args.SetError(ErrNoNeedToReply)
+
+	_, isConsumer := e.QueryConsumer(args.con.Addr())
+	_, isProducer := e.QueryProducer(args.con.Addr())
+	if !isConsumer && !isProducer {
+		e.Logger().Debug("found unregister client reply, dropped: ", args.con.Addr())
+		return true
+	}
+
+	reply := &proto.ReplyMessage{}
+	if err := args.frame.Unmarshal(reply, e.Crypto().Decrypt); err != nil {
+		e.Logger().Warn(fmt.Sprintf("reply from '%s' decrypt failed: %v", args.con.Addr(), err))
+		return true
+	}
+	args.reply = reply
+
+	return
+}
+
+// 将回复路由至请求方的连接
+func (e *Engine) replyRouter(args *ChainArgs) (stop bool) {
+	req, ok := e.takeRequest(args.reply)
+	if !ok {
+		e.Logger().Debug(fmt.Sprintf("%s from '%s' has no pending request, dropped", args.reply, args.con.Addr()))
+		return true
+	}
+
+	if err := e.deliverReply(req, args.reply); err != nil {
+		e.Logger().Warn(fmt.Sprintf("deliver %s to '%s' failed: %v", args.reply, req.addr, err))
+	}
+
+	return
+}
@@ -0,0 +1,202 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Chendemo12/micromq/src/proto"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"io"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// SchemaAction 消息不符合主题模式时的处理方式
+type SchemaAction string
+
+const (
+	SchemaActionReject     SchemaAction = "reject"     // 拒绝消息, 向生产者返回 proto.SchemaInvalidStatus
+	SchemaActionQuarantine SchemaAction = "quarantine" // 将消息转投至隔离主题, 生产者仍会收到 proto.AcceptedStatus
+)
+
+// DefaultQuarantineTopic 默认的隔离主题
+const DefaultQuarantineTopic = "__QUARANTINE__"
+
+// 隔离消息的消息头, 用于记录消息的原始主题和校验错误
+const (
+	QuarantineTopicHeader = "x-origin-topic"
+	QuarantineErrorHeader = "x-schema-error"
+)
+
+// 隔离消息头中校验错误的最大长度
+const maxSchemaErrorLength = 1024
+
+// TopicSchema 主题的消息体模式, 消息体必须是符合 JSON Schema 定义的 JSON
+type TopicSchema struct {
+	Topic       string       `json:"topic"`
+	Schema      string       `json:"schema"` // 原始的 JSON Schema 文本
+	Action      SchemaAction `json:"action"`
+	CreatedAt   int64        `json:"created_at"`
+	accepted    *atomic.Uint64
+	rejected    *atomic.Uint64
+	quarantined *atomic.Uint64
+	compiled    *jsonschema.Schema
+}
+
+// NewTopicSchema 编译 JSON Schema, 不允许引用外部资源
+func NewTopicSchema(topic string, schema []byte, action SchemaAction) (*TopicSchema, error) {
+	if action != SchemaActionQuarantine {
+		action = SchemaActionReject
+	}
+
+	c := jsonschema.NewCompiler()
+	c.LoadURL = func(s string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("%w: %s", ErrSchemaRefNotAllowed, s)
+	}
+
+	schemaURL := "mem://topic/" + url.PathEscape(topic)
+	if err := c.AddResource(schemaURL, bytes.NewReader(schema)); err != nil {
+		return nil, err
+	}
+	compiled, err := c.Compile(schemaURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TopicSchema{
+		Topic:       topic,
+		Schema:      string(schema),
+		Action:      action,
+		CreatedAt:   time.Now().Unix(),
+		accepted:    &atomic.Uint64{},
+		rejected:    &atomic.Uint64{},
+		quarantined: &atomic.Uint64{},
+		compiled:    compiled,
+	}, nil
+}
+
+// Validate 校验消息体, 错误可通过 errors.Is 判断为 ErrSchemaViolation
+func (s *TopicSchema) Validate(value []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+
+	var v any
+	if err := decoder.Decode(&v); err != nil {
+		return fmt.Errorf("%w: %v", ErrSchemaViolation, err)
+	}
+	if decoder.More() {
+		return fmt.Errorf("%w: trailing data after json value", ErrSchemaViolation)
+	}
+	if err := s.compiled.Validate(v); err != nil {
+		return fmt.Errorf("%w: %v", ErrSchemaViolation, err)
+	}
+
+	return nil
+}
+
+// Accepted 通过校验的消息数量
+func (s *TopicSchema) Accepted() uint64 { return s.accepted.Load() }
+
+// Rejected 被拒绝的消息数量
+func (s *TopicSchema) Rejected() uint64 { return s.rejected.Load() }
+
+// Quarantined 被转投至隔离主题的消息数量
+func (s *TopicSchema) Quarantined() uint64 { return s.quarantined.Load() }
+
+// RegisterSchema 为主题设置消息体模式, 若已存在则替换, 此操作是线程安全的
+//
+//	@param	topic	string			主题名称
+//	@param	schema	[]byte			JSON Schema 文本, 未声明 $schema 时视为 draft 2020-12
+//	@param	action	SchemaAction	消息不符合模式时的处理方式, 缺省为 SchemaActionReject
+func (e *Engine) RegisterSchema(topic string, schema []byte, action SchemaAction) (*TopicSchema, error) {
+	s, err := NewTopicSchema(topic, schema, action)
+	if err != nil {
+		return nil, err
+	}
+
+	e.schemas.Store(topic, s)
+	e.Logger().Info(fmt.Sprintf("topic '%s' schema registered, action: %s", topic, s.Action))
+	return s, nil
+}
+
+// RemoveSchema 删除主题的消息体模式, 返回此模式是否存在
+func (e *Engine) RemoveSchema(topic string) bool {
+	_, exist := e.schemas.LoadAndDelete(topic)
+	if exist {
+		e.Logger().Info(fmt.Sprintf("topic '%s' schema removed", topic))
+	}
+	return exist
+}
+
+// QuerySchema 查询主题的消息体模式
+func (e *Engine) QuerySchema(topic string) (*TopicSchema, bool) {
+	v, ok := e.schemas.Load(topic)
+	if !ok {
+		return nil, false
+	}
+	return v.(*TopicSchema), true
+}
+
+// RangeSchema if false returned, for-loop will stop
+func (e *Engine) RangeSchema(fn func(s *TopicSchema) bool) {
+	e.schemas.Range(func(key, value any) bool {
+		return fn(value.(*TopicSchema))
+	})
+}
+
+// SetQuarantineTopic 修改隔离主题, 必须在 Serve 之前设置
+func (e *Engine) SetQuarantineTopic(topic string) *Engine {
+	if topic != "" {
+		e.quarantineTopic = topic
+	}
+
+	return e
+}
+
+// QuarantineTopic 不符合模式的消息被转投的主题
+func (e *Engine) QuarantineTopic() string { return e.quarantineTopic }
+
+// CheckSchema 依据主题模式校验消息, 未设置模式的主题不做校验
+// 对于 SchemaActionQuarantine 的主题, 不符合模式的消息会被就地修改为隔离消息, 并返回nil;
+// 对于 SchemaActionReject 的主题, 则返回校验错误, 此消息不应再被发布
+func (e *Engine) CheckSchema(pm *proto.PMessage) error {
+	s, err := e.validateSchema(pm)
+	return e.applySchema(s, pm, err)
+}
+
+// 依据主题模式校验消息, 既不修改消息也不计数; 返回主题模式和校验错误, 未设置模式时均为nil
+func (e *Engine) validateSchema(pm *proto.PMessage) (*TopicSchema, error) {
+	s, ok := e.QuerySchema(string(pm.Topic))
+	if !ok {
+		return nil, nil
+	}
+	return s, s.Validate(pm.Value)
+}
+
+// 依据 validateSchema 的结果计数, 并将需隔离的消息就地修改为隔离消息; 返回拒绝消息的校验错误
+func (e *Engine) applySchema(s *TopicSchema, pm *proto.PMessage, err error) error {
+	if s == nil {
+		return nil
+	}
+	if err == nil {
+		s.accepted.Add(1)
+		return nil
+	}
+
+	if s.Action != SchemaActionQuarantine {
+		s.rejected.Add(1)
+		return err
+	}
+
+	s.quarantined.Add(1)
+	reason := proto.TruncateString(err.Error(), maxSchemaErrorLength)
+	if pm.Headers == nil {
+		pm.Headers = make(proto.Headers)
+	}
+	pm.Headers.Set(QuarantineTopicHeader, append([]byte{}, pm.Topic...))
+	pm.Headers.Set(QuarantineErrorHeader, []byte(reason))
+	pm.Topic = []byte(e.QuarantineTopic())
+
+	return nil
+}
@@ -13,7 +13,7 @@ func (e *Engine) registerParser(args *ChainArgs) (stop bool) {
 	args.resp.Type = proto.RegisterMessageRespType
 	// 默认拒绝注册
 	args.resp.Status = proto.ReRegisterStatus
-	args.resp.TickerInterval = int(e.ProducerSendInterval())
+	args.resp.TickerInterval = int(e.ProducerSendInterval().Milliseconds())
 	args.resp.Keepalive = e.HeartbeatInterval()
 
 	// 消息解密并反序列化
@@ -44,10 +44,21 @@ func (e *Engine) registerAuth(args *ChainArgs) (stop bool) {
 	return
 }
 
+// 协商协议版本和可选能力, 旧版本客户端不具备任何可选能力
+func (e *Engine) negotiate(rm *proto.RegisterMessage) (int, proto.Capabilities) {
+	version := rm.ProtocolVersion()
+	if version > proto.ProtocolVersion {
+		version = proto.ProtocolVersion
+	}
+
+	return version, e.capabilities.Intersect(rm.Capabilities)
+}
+
 // 密钥验证通过, 寻找空闲空间
 func (e *Engine) registerAllow(args *ChainArgs) (stop bool) {
 	// 记录注册时间戳
 	e.monitor.OnClientRegistered(args.con.Addr(), args.rm.Type)
+	version, capabilities := e.negotiate(args.rm)
 
 	switch args.rm.Type {
 	case proto.ProducerLinkType:
@@ -59,6 +70,9 @@ func (e *Engine) registerAllow(args *ChainArgs) (stop bool) {
 			producer.Conf = &ProducerConfig{
 				Ack:            args.rm.Ack,
 				TickerInterval: e.ProducerSendInterval(),
+				FrameVersion:   args.frame.Version(),
+				Version:        version,
+				Capabilities:   capabilities,
 			}
 
 			args.resp.Status = proto.AcceptedStatus
@@ -72,10 +86,26 @@ func (e *Engine) registerAllow(args *ChainArgs) (stop bool) {
 		if i := e.findConsumerSlot(); i != -1 {
 			c := e.consumers[i]
 			c.SetConn(args.con)
-			c.Conf = &ConsumerConfig{Topics: args.rm.Topics, Ack: args.rm.Ack}
+			c.Conf = &ConsumerConfig{
+				Topics:       args.rm.Topics,
+				Ack:          args.rm.Ack,
+				FrameVersion: args.frame.Version(),
+				Version:      version,
+				Capabilities: capabilities,
+				ID:           args.rm.ID,
+			}
+			if capabilities.Has(proto.GroupCapability) {
+				c.Conf.Group = args.rm.Group
+				c.Conf.Balance = args.rm.Balance
+			}
 
-			for _, name := range args.rm.Topics {
-				e.GetTopic([]byte(name)).AddConsumer(c)
+			// 历史消息须在注册响应之后推送, 否则客户端会将其视为未注册时的脏数据
+			if start := e.subscribe(c, c.Conf.Topics, args.rm.Positions); start != nil {
+				args.AfterReply(start)
+			}
+			// 上一个连接未确认的消息同样在注册响应之后重新推送
+			if start := e.resumeSession(c); start != nil {
+				args.AfterReply(start)
 			}
 			args.resp.Status = proto.AcceptedStatus
 		}
@@ -85,7 +115,12 @@ func (e *Engine) registerAllow(args *ChainArgs) (stop bool) {
 
 	// 输出日志
 	if args.resp.Status == proto.AcceptedStatus {
-		e.Logger().Info(fmt.Sprintf("%s::%s register successfully", args.con.Addr(), args.rm.Type))
+		args.resp.Version = version
+		args.resp.Capabilities = capabilities
+		e.Logger().Info(fmt.Sprintf(
+			"%s::%s register successfully, protocol version: %d, capabilities: %v",
+			args.con.Addr(), args.rm.Type, version, capabilities,
+		))
 	} else {
 		stop = true
 		e.Logger().Warn(fmt.Sprintf(
@@ -150,6 +185,33 @@ func (e *Engine) pmParser(args *ChainArgs) (stop bool) {
 		// 无需向客户端返回解析失败响应，客户端在收不到FIN时会自行处理
 		args.SetError(ErrPMNotFound)
 		stop = true
+	} else if _, seq, ok := args.pms[len(args.pms)-1].Headers.ProducerSequence(); ok {
+		// 生产者据此确认消息已被服务端接收, 即便消息随后被拒绝
+		args.resp.Sequence = seq
+	}
+
+	return
+}
+
+// 依据主题模式校验消息, 被拒绝的消息不再发布, 其余消息仍会正常发布
+func (e *Engine) pmValidator(args *ChainArgs) (stop bool) {
+	var rejected error
+	pms := args.pms[:0]
+	for _, pm := range args.pms {
+		if err := e.CheckSchema(pm); err != nil {
+			rejected = err
+			e.Logger().Debug(fmt.Sprintf("%s from '%s' rejected: %v", pm, args.con.Addr(), err))
+			continue
+		}
+		pms = append(pms, pm)
+	}
+	args.pms = pms
+
+	if rejected != nil {
+		// 即便部分消息已发布, 也需要告知生产者存在被拒绝的消息
+		args.resp.Status = proto.SchemaInvalidStatus
+		args.SetError(rejected)
+		stop = len(args.pms) == 0
 	}
 
 	return
@@ -159,7 +221,12 @@ func (e *Engine) pmPublisher(args *ChainArgs) (stop bool) {
 	// 若是批量发送数据,则取最后一条消息的偏移量
 	var offset uint64 = 0
 	for _, pm := range args.pms {
-		offset = e.Publisher(pm)
+		if args.producer.HasCapability(proto.IdempotenceCapability) {
+			// 重复的消息不再发布, 返回其原始偏移量
+			offset, _ = e.PublishIdempotent(pm)
+		} else {
+			offset = e.Publisher(pm)
+		}
 	}
 
 	args.resp.Offset = offset
@@ -0,0 +1,227 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Chendemo12/micromq/src/proto"
+	"sort"
+)
+
+// AsyncAPIVersion 所生成文档遵循的 AsyncAPI 规范版本
+const AsyncAPIVersion = "2.6.0"
+
+// ProtocolSpec TCP 协议的机器可读描述, 用于校验其他语言实现的客户端
+type ProtocolSpec struct {
+	Version      int                            `json:"version" description:"服务端实现的协议版本"`
+	Capabilities proto.Capabilities             `json:"capabilities" description:"服务端支持的可选能力"`
+	ByteOrder    string                         `json:"byte_order"`
+	Frames       map[string][]proto.FieldLayout `json:"frames" description:"各版本的帧编码布局"`
+	Flags        map[proto.FrameFlag]string     `json:"flags" description:"v2 帧标志位"`
+	Statuses     map[string]string              `json:"statuses" description:"MessageResponseStatus 及其文字描述"`
+	Crypto       string                         `json:"crypto" description:"全局加解密器"`
+	Compressor   string                         `json:"compressor" description:"向消费者推送消息时的压缩器"`
+	Messages     []*proto.MessageSpec           `json:"messages" description:"已实现的消息, 包括自定义消息"`
+}
+
+// ProtocolSpec 获取当前服务端所实现的协议描述
+func (e *Engine) ProtocolSpec() *ProtocolSpec {
+	spec := &ProtocolSpec{
+		Version:      proto.ProtocolVersion,
+		Capabilities: e.Capabilities(),
+		ByteOrder:    "big-endian",
+		Frames: map[string][]proto.FieldLayout{
+			"v1": proto.FrameLayout(proto.FrameV1),
+			"v2": proto.FrameLayout(proto.FrameV2),
+		},
+		Flags:      proto.FrameFlagLayout(),
+		Statuses:   make(map[string]string),
+		Crypto:     e.Crypto().String(),
+		Compressor: e.Compressor().String(),
+		Messages:   make([]*proto.MessageSpec, 0),
+	}
+
+	for _, status := range []proto.MessageResponseStatus{
+		proto.AcceptedStatus, proto.RefusedStatus, proto.TokenIncorrectStatus,
+		proto.ReRegisterStatus, proto.SchemaInvalidStatus,
+	} {
+		spec.Statuses[string(status)] = proto.GetMessageResponseStatusText(status)
+	}
+	for _, d := range proto.Descriptors() {
+		spec.Messages = append(spec.Messages, d.Spec())
+	}
+
+	return spec
+}
+
+// AsyncAPI AsyncAPI 风格的协议文档
+type AsyncAPI struct {
+	AsyncAPI           string                      `json:"asyncapi"`
+	Info               AsyncAPIInfo                `json:"info"`
+	Servers            map[string]*AsyncAPIServer  `json:"servers"`
+	DefaultContentType string                      `json:"defaultContentType"`
+	Channels           map[string]*AsyncAPIChannel `json:"channels"`
+	Components         AsyncAPIComponents          `json:"components"`
+	Protocol           *ProtocolSpec               `json:"x-protocol"`
+}
+
+type AsyncAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type AsyncAPIServer struct {
+	URL         string `json:"url"`
+	Protocol    string `json:"protocol"`
+	Description string `json:"description,omitempty"`
+}
+
+type AsyncAPIChannel struct {
+	Description string             `json:"description,omitempty"`
+	Publish     *AsyncAPIOperation `json:"publish,omitempty"`
+	Subscribe   *AsyncAPIOperation `json:"subscribe,omitempty"`
+	Offset      uint64             `json:"x-offset"`
+	Consumers   int                `json:"x-consumers"`
+	Schema      json.RawMessage    `json:"x-value-schema,omitempty"` // 主题注册的消息体模式
+}
+
+type AsyncAPIOperation struct {
+	OperationID string         `json:"operationId"`
+	Summary     string         `json:"summary,omitempty"`
+	Message     map[string]any `json:"message"`
+}
+
+type AsyncAPIComponents struct {
+	Messages map[string]*AsyncAPIMessage `json:"messages"`
+}
+
+type AsyncAPIMessage struct {
+	Name         string                    `json:"name"`
+	Title        string                    `json:"title,omitempty"`
+	ContentType  string                    `json:"contentType"`
+	Payload      map[string]any            `json:"payload"`
+	Code         proto.MessageType         `json:"x-message-type"`
+	UserDefined  bool                      `json:"x-user-defined"`
+	Ack          string                    `json:"x-ack,omitempty"`
+	Marshal      []proto.MarshalMethodType `json:"x-marshal-methods"`
+	BinaryLayout []proto.FieldLayout       `json:"x-binary-layout,omitempty"`
+}
+
+// 依据字段布局生成 JSON Schema 风格的载荷描述
+func layoutPayload(fields []proto.FieldLayout) map[string]any {
+	properties := make(map[string]any, len(fields))
+	for _, f := range fields {
+		typ := "string"
+		switch f.Type {
+		case "uint8", "uint16", "uint32", "uint64", "int64", "uint16/uint32", "integer":
+			typ = "integer"
+		case "float64", "number":
+			typ = "number"
+		case "boolean", "array", "object":
+			typ = f.Type
+		case "strings":
+			typ = "array"
+		case "headers":
+			typ = "object"
+		}
+		properties[f.Name] = map[string]any{"type": typ, "description": f.Description}
+	}
+
+	return map[string]any{"type": "object", "properties": properties}
+}
+
+// 引用一个或多个消息
+func messageRef(names ...string) map[string]any {
+	refs := make([]map[string]any, len(names))
+	for i, name := range names {
+		refs[i] = map[string]any{"$ref": "#/components/messages/" + name}
+	}
+	if len(refs) == 1 {
+		return refs[0]
+	}
+	return map[string]any{"oneOf": refs}
+}
+
+// AsyncAPI 生成 AsyncAPI 风格的协议文档, 包含帧布局, 消息布局和当前已存在的主题
+//
+//	@param	title	string	文档标题
+//	@param	version	string	服务版本
+func (e *Engine) AsyncAPI(title, version string) *AsyncAPI {
+	spec := e.ProtocolSpec()
+	doc := &AsyncAPI{
+		AsyncAPI: AsyncAPIVersion,
+		Info: AsyncAPIInfo{
+			Title:       title,
+			Version:     version,
+			Description: fmt.Sprintf("TCP protocol version %d, all integers are %s", spec.Version, spec.ByteOrder),
+		},
+		Servers: map[string]*AsyncAPIServer{
+			"broker": {
+				URL:         e.conf.Host + ":" + e.conf.Port,
+				Protocol:    "tcp",
+				Description: "消息以 TransferFrame 帧传输, 帧布局见 x-protocol.frames",
+			},
+		},
+		DefaultContentType: "application/octet-stream",
+		Channels:           make(map[string]*AsyncAPIChannel),
+		Components:         AsyncAPIComponents{Messages: make(map[string]*AsyncAPIMessage)},
+		Protocol:           spec,
+	}
+
+	for _, m := range spec.Messages {
+		msg := &AsyncAPIMessage{
+			Name:         m.Name,
+			Title:        m.Name,
+			ContentType:  "application/octet-stream",
+			Code:         m.Code,
+			UserDefined:  m.UserDefined,
+			Ack:          m.Ack,
+			Marshal:      m.MarshalMethods,
+			BinaryLayout: m.Binary,
+		}
+		if len(m.JSON) > 0 { // 同时支持两种编码的控制消息默认为JSON
+			msg.ContentType = "application/json"
+			msg.Payload = layoutPayload(m.JSON)
+		} else {
+			msg.Payload = layoutPayload(m.Binary)
+		}
+		doc.Components.Messages[m.Name] = msg
+	}
+
+	pm := proto.GetDescriptor(proto.PMessageType).Text()
+	hpm := proto.GetDescriptor(proto.HPMessageType).Text()
+	cm := proto.GetDescriptor(proto.CMessageType).Text()
+	hcm := proto.GetDescriptor(proto.HCMessageType).Text()
+
+	topics := make([]*Topic, 0)
+	e.RangeTopic(func(topic *Topic) bool {
+		topics = append(topics, topic)
+		return true
+	})
+	sort.Slice(topics, func(i, j int) bool { return string(topics[i].Name) < string(topics[j].Name) })
+
+	for _, topic := range topics {
+		name := string(topic.Name)
+		channel := &AsyncAPIChannel{
+			Publish: &AsyncAPIOperation{
+				OperationID: "publish" + name,
+				Summary:     "生产者向主题发送消息",
+				Message:     messageRef(pm, hpm),
+			},
+			Subscribe: &AsyncAPIOperation{
+				OperationID: "subscribe" + name,
+				Summary:     "消费者接收主题内的消息",
+				Message:     messageRef(cm, hcm),
+			},
+			Offset: topic.Offset(),
+		}
+		topic.RangeConsumer(func(c *Consumer) { channel.Consumers++ })
+		if s, ok := e.QuerySchema(name); ok {
+			channel.Description = fmt.Sprintf("消息体必须符合主题模式, 否则将被%s", s.Action)
+			channel.Schema = json.RawMessage(s.Schema)
+		}
+		doc.Channels[name] = channel
+	}
+
+	return doc
+}
@@ -1,7 +1,14 @@
 package engine
 
+import (
+	"errors"
+	"github.com/Chendemo12/micromq/src/proto"
+	"sync/atomic"
+)
+
 type Statistic struct {
-	broker *Engine
+	broker      *Engine
+	frameErrors *frameErrorCounter // 帧解析错误计数
 }
 
 // TopicsName 获取当前全部Topic名称
@@ -17,18 +24,63 @@ func (k Statistic) TopicsName() []string {
 }
 
 type TopicOffset struct {
-	Name   string `json:"name" description:"名称"`
-	Offset uint64 `json:"offset" description:"最新的消息偏移量"`
+	Name    string `json:"name" description:"名称"`
+	Offset  uint64 `json:"offset" description:"最新的消息偏移量"`
+	Expired uint64 `json:"expired" description:"过期而被丢弃的消息数量"`
+	// 构建失败或未能送达消费者而被转投至死信主题的次数
+	Undelivered uint64 `json:"undelivered" description:"未能投递的次数"`
+	Redelivered uint64 `json:"redelivered" description:"因未确认而被重新推送的次数"`
+	// 主题日志的大小, 未持久化时为0
+	LogSize int64 `json:"log_size" description:"主题日志的字节数"`
+	// 各优先级通道中等待推送的消息数量: {priority: depth}
+	QueueDepth map[string]int `json:"queue_depth" description:"各优先级通道中等待推送的消息数量"`
+	// 各分区的偏移量, 以分区号为索引
+	Partitions []*PartitionOffset `json:"partitions" description:"各分区的偏移量"`
+}
+
+// PartitionOffset 主题内一个分区的偏移量
+type PartitionOffset struct {
+	Partition  int            `json:"partition" description:"分区号"`
+	Offset     uint64         `json:"offset" description:"分区内最新的消息偏移量"`
+	LogSize    int64          `json:"log_size" description:"分区日志的字节数"`
+	QueueDepth map[string]int `json:"queue_depth" description:"各优先级通道中等待推送的消息数量"`
+}
+
+// 将以 proto.MessagePriority 为索引的通道深度转换为以优先级名称为键
+func queueDepthOf(depth []int) map[string]int {
+	m := make(map[string]int, proto.NumberOfPriorities)
+	for priority, n := range depth {
+		m[proto.MessagePriority(priority).String()] = n
+	}
+	return m
 }
 
 // TopicsOffset 获取全部的Topic以及响应的偏移量
 func (k Statistic) TopicsOffset() []*TopicOffset {
 	topics := make([]*TopicOffset, 0)
 	k.broker.RangeTopic(func(topic *Topic) bool {
-		topics = append(topics, &TopicOffset{
-			Name:   string(topic.Name),
-			Offset: topic.Offset,
-		})
+		offset := &TopicOffset{
+			Name:        string(topic.Name),
+			Offset:      topic.Offset(),
+			Expired:     topic.Expired(),
+			Undelivered: topic.Undelivered(),
+			Redelivered: topic.Redelivered(),
+			QueueDepth:  queueDepthOf(topic.QueueDepth()),
+			Partitions:  make([]*PartitionOffset, topic.Partitions()),
+		}
+		for i := range offset.Partitions {
+			p := &PartitionOffset{
+				Partition:  i,
+				Offset:     topic.PartitionOffset(i),
+				QueueDepth: queueDepthOf(topic.PartitionQueueDepth(i)),
+			}
+			if log := topic.PartitionLog(i); log != nil {
+				p.LogSize = log.Size()
+				offset.LogSize += p.LogSize
+			}
+			offset.Partitions[i] = p
+		}
+		topics = append(topics, offset)
 
 		return true
 	})
@@ -38,8 +90,9 @@ func (k Statistic) TopicsOffset() []*TopicOffset {
 
 // TopicConsumer topic内的消费者
 type TopicConsumer struct {
-	Name      string   `json:"name" description:"名称"`
-	Consumers []string `json:"consumers" description:"消费者连接"`
+	Name      string              `json:"name" description:"名称"`
+	Consumers []string            `json:"consumers" description:"消费者连接"`
+	Groups    map[string][]string `json:"groups" description:"消费者组及其成员连接"`
 }
 
 // TopicConsumers 获取topic内的消费者连接
@@ -52,6 +105,7 @@ func (k Statistic) TopicConsumers() []*TopicConsumer {
 		topic.RangeConsumer(func(c *Consumer) {
 			consumer.Consumers = append(consumer.Consumers, c.Addr)
 		})
+		consumer.Groups = topic.Groups()
 		consumers = append(consumers, consumer)
 		return true
 	})
@@ -61,8 +115,12 @@ func (k Statistic) TopicConsumers() []*TopicConsumer {
 
 // ConsumerTopic 消费者订阅的topic
 type ConsumerTopic struct {
-	Addr   string   `json:"addr" description:"连接地址"`
-	Topics []string `json:"topics" description:"订阅的主题名列表"`
+	Addr     string              `json:"addr" description:"连接地址"`
+	Topics   []string            `json:"topics" description:"订阅的主题名列表"`
+	Group    string              `json:"group" description:"消费者组名称"`
+	Patterns map[string][]string `json:"patterns" description:"通配符模式及其当前匹配的主题"`
+	ID       string              `json:"id" description:"消费者ID"`
+	Unacked  int                 `json:"unacked" description:"已推送但尚未确认的消息数量"`
 }
 
 // ConsumerTopics 获取消费者订阅的主题名
@@ -71,8 +129,12 @@ func (k Statistic) ConsumerTopics() []*ConsumerTopic {
 
 	k.broker.RangeConsumer(func(c *Consumer) bool {
 		ct := &ConsumerTopic{
-			Addr:   c.Addr,
-			Topics: make([]string, len(c.Conf.Topics)),
+			Addr:     c.Addr,
+			Topics:   make([]string, len(c.Conf.Topics)),
+			Group:    c.Group(),
+			Patterns: k.broker.patternTopics(c),
+			ID:       c.Conf.ID,
+			Unacked:  k.broker.Unacked(c),
 		}
 		copy(ct.Topics, c.Conf.Topics)
 		cts = append(cts, ct)
@@ -108,3 +170,57 @@ func (k Statistic) Producers() []string {
 
 	return ps
 }
+
+// FrameParseErrors 帧解析错误计数, 按错误原因分类
+type FrameParseErrors struct {
+	Total     uint64 `json:"total" description:"损坏的帧总数"`
+	Head      uint64 `json:"head" description:"帧头错误"`
+	Tail      uint64 `json:"tail" description:"帧尾错误"`
+	Checksum  uint64 `json:"checksum" description:"校验和错误"`
+	Truncated uint64 `json:"truncated" description:"帧不完整"`
+	TooLarge  uint64 `json:"too_large" description:"帧载荷过长"`
+	Other     uint64 `json:"other" description:"其他错误"`
+}
+
+type frameErrorCounter struct {
+	head      atomic.Uint64
+	tail      atomic.Uint64
+	checksum  atomic.Uint64
+	truncated atomic.Uint64
+	tooLarge  atomic.Uint64
+	other     atomic.Uint64
+}
+
+// 依据错误原因计数
+func (c *frameErrorCounter) record(err error) {
+	switch {
+	case errors.Is(err, proto.ErrFrameHeadInvalid):
+		c.head.Add(1)
+	case errors.Is(err, proto.ErrFrameTailInvalid):
+		c.tail.Add(1)
+	case errors.Is(err, proto.ErrFrameChecksumMismatch):
+		c.checksum.Add(1)
+	case errors.Is(err, proto.ErrFrameTruncated):
+		c.truncated.Add(1)
+	case errors.Is(err, proto.ErrFrameTooLarge):
+		c.tooLarge.Add(1)
+	default:
+		c.other.Add(1)
+	}
+}
+
+// FrameParseErrors 获取帧解析错误计数
+func (k Statistic) FrameParseErrors() *FrameParseErrors {
+	c := k.frameErrors
+	fe := &FrameParseErrors{
+		Head:      c.head.Load(),
+		Tail:      c.tail.Load(),
+		Checksum:  c.checksum.Load(),
+		Truncated: c.truncated.Load(),
+		TooLarge:  c.tooLarge.Load(),
+		Other:     c.other.Load(),
+	}
+	fe.Total = fe.Head + fe.Tail + fe.Checksum + fe.Truncated + fe.TooLarge + fe.Other
+
+	return fe
+}
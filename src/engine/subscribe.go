@@ -0,0 +1,230 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/Chendemo12/micromq/src/proto"
+)
+
+// 消费者当前是否订阅了此主题, 包括其通配符模式所匹配的主题
+func (e *Engine) subscribes(c *Consumer, topic string) bool {
+	topics, _ := c.subscriptions()
+	for _, name := range topics {
+		if name == topic {
+			return true
+		}
+	}
+	return e.matchPattern(c, topic) != ""
+}
+
+// Subscribe 令已注册的消费者订阅主题, 已订阅的主题和模式被忽略; 通配符模式同样作用于此后创建的匹配主题.
+// 返回开始回放历史消息的方法, 调用方应在响应发出之后调用, 无需回放时为nil
+//
+//	@param	addr		string							消费者的连接地址
+//	@param	topics		[]string						主题名称, 协商了 proto.WildcardCapability 时可为通配符模式
+//	@param	positions	map[string]*proto.StartPosition	新订阅的主题的起始位置, 依赖 proto.ReplayCapability
+func (e *Engine) Subscribe(addr string, topics []string, positions map[string]*proto.StartPosition) (start func(), err error) {
+	e.cpLock.Lock()
+	defer e.cpLock.Unlock()
+
+	c, exist := e.QueryConsumer(addr)
+	if !exist {
+		return nil, ErrConsumerNotRegister
+	}
+
+	subscribed := make(map[string]struct{}, len(c.Conf.Topics)+len(topics))
+	for _, name := range c.Conf.Topics {
+		subscribed[name] = struct{}{}
+	}
+	added := make([]string, 0, len(topics))
+	for _, name := range topics {
+		if _, ok := subscribed[name]; !ok && name != "" {
+			subscribed[name] = struct{}{}
+			added = append(added, name)
+		}
+	}
+	if len(added) == 0 {
+		return nil, nil
+	}
+
+	// 以新的切片替换订阅列表, 以免并发的读取观察到修改了一半的列表
+	names := make([]string, 0, len(c.Conf.Topics)+len(added))
+	c.Conf.Topics = append(append(names, c.Conf.Topics...), added...)
+
+	return e.subscribe(c, added, positions), nil
+}
+
+// Unsubscribe 令已注册的消费者取消订阅主题, 未订阅的主题被忽略; 通配符模式须以订阅时的原样取消,
+// 仍被其余订阅匹配的主题不受影响
+func (e *Engine) Unsubscribe(addr string, topics []string) error {
+	e.cpLock.Lock()
+	defer e.cpLock.Unlock()
+
+	c, exist := e.QueryConsumer(addr)
+	if !exist {
+		return ErrConsumerNotRegister
+	}
+
+	removed := make(map[string]struct{}, len(topics))
+	for _, name := range topics {
+		removed[name] = struct{}{}
+	}
+	names := make([]string, 0, len(c.Conf.Topics))
+	for _, name := range c.Conf.Topics {
+		if _, ok := removed[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) == len(c.Conf.Topics) {
+		return nil
+	}
+	c.Conf.Topics = names
+
+	e.leave(c, topics)
+	return nil
+}
+
+// 将消费者加入指定的主题, names 须已包含在消费者的订阅列表中; 通配符模式匹配现有的全部主题,
+// 此后创建的匹配主题也会自动加入此消费者; 已加入的主题被忽略.
+// 主题的起始位置优先取 positions 中主题名称对应的项, 其次取其所匹配的模式对应的项;
+// 返回开始回放历史消息的方法, 调用方应在响应发出之后调用, 无需回放时为nil
+func (e *Engine) subscribe(c *Consumer, names []string, positions map[string]*proto.StartPosition) (start func()) {
+	starts := make([]func(), 0)
+	join := func(topic *Topic, pos *proto.StartPosition) {
+		if topic.HasConsumer(c.Addr) {
+			return
+		}
+		if fn := e.joinTopic(topic, c, pos); fn != nil {
+			starts = append(starts, fn)
+		}
+	}
+
+	topics, patterns := c.splitTopics(names)
+	for _, name := range topics {
+		join(e.GetTopic([]byte(name)), positions[name])
+	}
+	if len(patterns) > 0 {
+		// 避免遍历期间创建的主题遗漏此消费者
+		e.topicLock.Lock()
+		e.wildcards.Store(c.Addr, c)
+		e.RangeTopic(func(topic *Topic) bool {
+			name := string(topic.Name)
+			for _, pattern := range patterns {
+				if !e.matchTopic(pattern, name) {
+					continue
+				}
+				pos := positions[name]
+				if pos == nil {
+					pos = positions[pattern]
+				}
+				join(topic, pos)
+				break
+			}
+			return true
+		})
+		e.topicLock.Unlock()
+	}
+
+	if len(starts) == 0 {
+		return nil
+	}
+	return func() {
+		for _, fn := range starts {
+			fn()
+		}
+	}
+}
+
+// 将消费者加入主题, 指定了起始位置且协商了 proto.ReplayCapability 时返回开始回放的方法
+func (e *Engine) joinTopic(topic *Topic, c *Consumer, pos *proto.StartPosition) (start func()) {
+	if pos == nil || !c.HasCapability(proto.ReplayCapability) {
+		topic.AddConsumer(c)
+		return nil
+	}
+	return topic.AddReplayConsumer(c, pos)
+}
+
+// 将消费者移出已取消订阅的主题, names 须已自消费者的订阅列表中删除; 仍被其余订阅匹配的主题被保留
+func (e *Engine) leave(c *Consumer, names []string) {
+	topics, patterns := c.splitTopics(names)
+	for _, name := range topics {
+		if v, ok := e.topics.Load(name); ok && !e.subscribes(c, name) {
+			v.(*Topic).RemoveConsumer(c.Addr)
+		}
+	}
+	if len(patterns) == 0 {
+		return
+	}
+
+	e.topicLock.Lock()
+	defer e.topicLock.Unlock()
+
+	if len(c.Patterns()) == 0 {
+		e.wildcards.Delete(c.Addr)
+	}
+	e.RangeTopic(func(topic *Topic) bool {
+		if topic.HasConsumer(c.Addr) && !e.subscribes(c, string(topic.Name)) {
+			topic.RemoveConsumer(c.Addr)
+		}
+		return true
+	})
+}
+
+// 将消费者移出其订阅的全部主题, 包括通配符模式所匹配的主题
+func (e *Engine) leaveAll(c *Consumer) {
+	topics, _ := c.subscriptions()
+	for _, name := range topics {
+		e.GetTopic([]byte(name)).RemoveConsumer(c.Addr)
+	}
+
+	if _, ok := e.wildcards.LoadAndDelete(c.Addr); ok {
+		e.topicLock.Lock()
+		defer e.topicLock.Unlock()
+
+		e.RangeTopic(func(topic *Topic) bool {
+			topic.RemoveConsumer(c.Addr)
+			return true
+		})
+	}
+}
+
+// ============================= subscribe message =============================
+
+// 解析订阅和取消订阅消息, 二者共用同一处理流程
+func (e *Engine) subscribeParser(args *ChainArgs) (stop bool) {
+	args.resp.Type = proto.SubscribeMessageRespType
+
+	args.sm = &proto.SubscribeMessage{Type: args.frame.Type()}
+	err := args.frame.Unmarshal(args.sm, e.Crypto().Decrypt)
+	if err != nil {
+		args.resp.Status = proto.TokenIncorrectStatus
+		args.SetError(fmt.Errorf("frame decrypt failed: %v", err))
+
+		return true
+	}
+
+	return
+}
+
+// 更新消费者的订阅列表, 新订阅的主题的历史消息在响应发出之后推送
+func (e *Engine) subscribeHandler(args *ChainArgs) (stop bool) {
+	var err error
+	if args.sm.MessageType() == proto.UnsubscribeMessageType {
+		err = e.Unsubscribe(args.con.Addr(), args.sm.Topics)
+	} else {
+		var start func()
+		start, err = e.Subscribe(args.con.Addr(), args.sm.Topics, args.sm.Positions)
+		if start != nil {
+			args.AfterReply(start)
+		}
+	}
+
+	if err != nil {
+		// 未注册, 令客户端重新注册, 重新注册时会携带最新的订阅列表
+		args.resp.Status = proto.ReRegisterStatus
+		args.SetError(err)
+		return true
+	}
+
+	e.Logger().Info(fmt.Sprintf("%s %s: %v", args.con.Addr(), args.frame.MessageText(), args.sm.Topics))
+	return
+}
@@ -3,7 +3,10 @@ package engine
 import (
 	"encoding/binary"
 	"github.com/Chendemo12/micromq/src/proto"
+	"github.com/Chendemo12/micromq/src/storage"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,41 +19,83 @@ const (
 	BuildFailed HistoryRecordStatus = ""
 )
 
+// 消息帧的编码格式, 消费者依据其帧版本和所协商的能力选择对应的帧
+type frameFormat struct {
+	version    proto.FrameVersion
+	headers    bool
+	compressed bool
+	partition  bool
+}
+
+// DefaultStarvationLimit 低优先级通道在有消息等待时, 最多连续让行于高优先级通道的消息数量
+const DefaultStarvationLimit = 8
+
+// 等待推送给消费者的消息
+type queueItem struct {
+	cm       *proto.CMessage
+	expireAt time.Time // 过期时间, 零值表示永不过期
+}
+
+func (i queueItem) expired(now time.Time) bool { return !i.expireAt.IsZero() && now.After(i.expireAt) }
+
 type HistoryRecord struct {
-	frame       *proto.TransferFrame //
-	Topic       []byte               // 历史记录所属的topic
-	Key         []byte               //
-	Value       []byte               //
-	Offset      uint64               // 历史记录所属的偏移量
-	MessageType proto.MessageType    // CM协议类型,以此来反序列化
-	Time        int64                // 历史记录创建时间戳,而非CM被创建的事件戳
-	Error       string               //
+	frames map[frameFormat]*proto.TransferFrame // 各编码格式的消息帧
+
+	Topic       []byte            // 历史记录所属的topic
+	Key         []byte            //
+	Value       []byte            //
+	Headers     proto.Headers     // 消息头, 可能为nil
+	Offset      uint64            // 历史记录所属的偏移量
+	Partition   int               // 历史记录所属的分区
+	MessageType proto.MessageType // CM协议类型,以此来反序列化
+	Time        int64             // 历史记录创建时间戳,而非CM被创建的事件戳
+	Error       string            //
 }
 
 type Topic struct {
-	Name           []byte               `json:"name"`         // 唯一标识
-	HistorySize    int                  `json:"history_size"` // 生产者消息缓冲区大小
-	Offset         uint64               `json:"offset"`       // 当前数据偏移量,仅用于模糊显示
-	counter        *proto.Counter       // 生产者消息计数器,用于计算数据偏移量
-	consumers      *sync.Map            // 全部消费者: {addr: Consumer}
-	queue          chan *proto.CMessage // 等待消费者消费的数据
-	historyRecords *proto.Queue         // proto.Queue[*HistoryRecord], 历史消息,由web查询展示
-	crypto         proto.Crypto         // 加解密器
+	Name           []byte           `json:"name"`         // 唯一标识
+	HistorySize    int              `json:"history_size"` // 生产者消息缓冲区大小
+	offset         *atomic.Uint64   // 最近一个消息在其分区内的偏移量,仅用于模糊显示; 各分区并发写入
+	consumers      *sync.Map        // 全部消费者: {addr: Consumer}
+	replays        *sync.Map        // 自指定位置开始消费的消费者: {addr: *replayState}
+	deliver        *sync.RWMutex    // 推送消息时持有读锁, 添加回放消费者时持有写锁
+	starvation     int              // 连续让行的上限, 达到后优先推送此通道的消息
+	expired        *atomic.Uint64   // 过期而被丢弃的消息数量
+	undelivered    *atomic.Uint64   // 构建失败或未能送达消费者的消息数量
+	redelivered    *atomic.Uint64   // 因未确认而被重新推送的消息数量
+	historyRecords *proto.Queue     // proto.Queue[*HistoryRecord], 历史消息,由web查询展示
+	crypto         proto.Crypto     // 加解密器
+	compressor     proto.Compressor // 压缩器
 	mu             *sync.Mutex
 	onConsumed     func(record *HistoryRecord)
+	onExpired      func(record *HistoryRecord)
+	onUndelivered  func(record *HistoryRecord, consumer string, err error)
+	onSend         func(c *Consumer, record *HistoryRecord) (cancel func())
+	onLogFailed    func(err error)
+	// 主题内的消费者组: {group: *consumerGroup}
+	groups    map[string]*consumerGroup
+	groupLock *sync.Mutex
+	// 主题的分区, 以分区号为索引, 至少包含一个分区
+	partitions []*partition
+	bufferSize int            // 每个分区内各优先级通道的容量
+	cursor     *atomic.Uint64 // 未设置键的消息依次分配分区的游标
 }
 
-// 计算当前消息偏移量
-func (t *Topic) refreshOffset() uint64 {
-	t.Offset = t.counter.ValueBeforeIncrement()
-	return t.Offset
+// 计算分区内的当前消息偏移量
+func (t *Topic) refreshOffset(p *partition) uint64 {
+	offset := p.counter.ValueBeforeIncrement()
+	p.offset.Store(offset)
+	t.offset.Store(offset)
+	return offset
 }
 
 // 当一个消息发送给所有消费者后需要处理的事件
 func (t *Topic) onMessageConsumed(record *HistoryRecord) {
 	// 缓存帧序列数据
-	framePool.Put(record.frame)
-	record.frame = nil
+	for _, frame := range record.frames {
+		framePool.Put(frame)
+	}
+	record.frames = nil
 
 	// 添加到历史记录
 	t.historyRecords.Append(record)
@@ -58,69 +103,240 @@ func (t *Topic) onMessageConsumed(record *HistoryRecord) {
 	t.onConsumed(record)
 }
 
-// 发送并等待所有消费者收到消息
+// 发送并等待所有消费者收到消息, 未加入消费者组的消费者均会收到消息, 每个消费者组仅有一个成员收到消息
 func (t *Topic) sendAndWait(record *HistoryRecord) {
+	t.deliver.RLock()
+	defer t.deliver.RUnlock()
+
 	wg := &sync.WaitGroup{}
 
-	t.consumers.Range(func(key, value any) bool {
-		c, ok := value.(*Consumer)
-		if ok {
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-
-				c.mu.Lock() // 保证线程安全
-				_, _ = record.frame.WriteTo(c.Conn)
-				_ = c.Conn.Drain()
-				c.mu.Unlock()
-			}()
+	t.RangeConsumer(func(c *Consumer) {
+		if c.Group() != "" {
+			return
 		}
-		return true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if _, err := t.sendTo(c, record); err != nil {
+				t.undeliver(record, c.Addr, err)
+			}
+		}()
 	})
 
+	for _, candidates := range t.groupCandidates(record.Key) {
+		members := candidates
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// 选中的成员不可达时, 依次转投组内的其他成员
+			var addr string
+			var err error
+			for _, c := range members {
+				sent, e := t.sendTo(c, record)
+				if sent {
+					return
+				}
+				if e != nil {
+					addr, err = c.Addr, e
+				}
+			}
+			if err != nil {
+				t.undeliver(record, addr, err)
+			}
+		}()
+	}
+
 	wg.Wait() // 所有消费者都收到了消息,触发事件
 	t.onMessageConsumed(record)
 }
 
-// 向消费者发送消息帧
-func (t *Topic) consume() {
-	t.historyRecords = proto.NewQueue(t.HistorySize)
+// 向消费者推送消息帧, 返回消息是否已推送或已暂存; 在构建帧之后才加入的消费者, 可能不存在对应格式的帧,
+// 此时仅自指定位置开始消费的消费者单独构建帧, 因为此消息既不在其回放范围内, 也不会再次推送
+func (t *Topic) sendTo(c *Consumer, record *HistoryRecord) (bool, error) {
+	state := t.replayOf(c.Addr)
+	if state != nil && state.hold(record) {
+		return true, nil
+	}
+	frame, ok := record.frames[t.frameFormat(c, record.Headers)]
+	if !ok {
+		if state == nil {
+			return false, nil
+		}
+		err := t.tracked(c, record, func() error { return t.sendRecord(c, record) })
+		return err == nil, err
+	}
+
+	err := t.tracked(c, record, func() error {
+		c.mu.Lock() // 保证线程安全
+		defer c.mu.Unlock()
 
-	for cm := range t.queue {
+		return frame.DrainTo(c.Conn)
+	})
+
+	return err == nil, err
+}
+
+// 推送消息, 推送之前触发 onSend 回调, 推送失败时撤销
+func (t *Topic) tracked(c *Consumer, record *HistoryRecord, send func() error) error {
+	cancel := t.onSend(c, record)
+	err := send()
+	if err != nil {
+		cancel()
+	}
+	return err
+}
+
+// Redeliver 向消费者重新推送一个消息, 消息携带 proto.RedeliveryHeader 以记录重新推送的次数
+func (t *Topic) Redeliver(c *Consumer, record *HistoryRecord, count int) error {
+	headers := make(proto.Headers, len(record.Headers)+1)
+	for k, v := range record.Headers {
+		headers.Set(k, v)
+	}
+	headers.SetRedeliveryCount(count)
+
+	// 不复制 frames 和 Error, 二者可能正被推送协程修改
+	r := &HistoryRecord{
+		Topic:       record.Topic,
+		Key:         record.Key,
+		Value:       record.Value,
+		Headers:     headers,
+		Offset:      record.Offset,
+		Partition:   record.Partition,
+		MessageType: record.MessageType,
+		Time:        record.Time,
+	}
+	t.redelivered.Add(1)
+
+	return t.sendRecord(c, r)
+}
+
+// 记录一个构建失败或未能送达消费者的消息, 并触发回调, 此方法是线程安全的
+func (t *Topic) undeliver(record *HistoryRecord, consumer string, err error) {
+	t.undelivered.Add(1)
+
+	t.mu.Lock()
+	if record.Error == "" {
+		record.Error = err.Error()
+	}
+	t.mu.Unlock()
+
+	t.onUndelivered(record, consumer, err)
+}
+
+// 向消费者发送分区内的消息帧, 消息依次推送以保证分区内的顺序
+func (t *Topic) consume(p *partition) {
+	for range p.pending {
+		item := p.next(t.starvation)
+		cm := item.cm
 		record := &HistoryRecord{
 			Topic:       t.Name,
 			Offset:      binary.BigEndian.Uint64(cm.Offset),
+			Partition:   p.index,
 			MessageType: cm.MessageType(),
 			Time:        time.Now().Unix(),
-			frame:       nil,
+			frames:      nil,
 		}
 		record.Key = make([]byte, len(cm.PM.Key))
 		record.Value = make([]byte, len(cm.PM.Value))
 		copy(record.Key, cm.PM.Key)
 		copy(record.Value, cm.PM.Value)
+		record.Headers = cm.PM.Headers // 释放PM时只会丢弃引用, 不会修改其内容
+
+		// 过期的消息不再构建帧, 也不会加入历史记录
+		if item.expired(time.Now()) {
+			cpmp.PutCM(cm)
+			t.expired.Add(1)
+			record.Error = ErrMessageExpired.Error()
+			t.onExpired(record)
+			continue
+		}
 
-		frame := framePool.Get()
 		// TODO: 实现多个消息压缩为帧
 		//err := proto.FrameCombine[*proto.CMessage](frame, []*proto.CMessage{cm})
-		err := frame.BuildFrom(cm, t.crypto.Encrypt)
+		frames, err := t.buildFrames(cm)
 		cpmp.PutCM(cm)
 
-		if err != nil { // 消息构建失败, 增加日志记录
-			record.Error = err.Error()
+		if err != nil { // 消息构建失败, 目标为当前的全部消费者
+			addrs := make([]string, 0)
+			t.RangeConsumer(func(c *Consumer) { addrs = append(addrs, c.Addr) })
+			t.undeliver(record, strings.Join(addrs, ","), err)
 			continue
 		}
 
-		record.frame = frame
+		record.frames = frames
 
 		// cm:
 		//	1. Topic.Publisher 创建, 并绑定pm
 		//	2. Publisher 加入到 Topic.queue
 		//	3. Topic.consume 从 Topic.queue 中消费 cm
 		//	4. 此步骤构建cm二进制序列到frame上并释放CM时会同时释放PM
-		go t.sendAndWait(record)
+		t.sendAndWait(record)
 	}
 }
 
+// 消费者所需的消息帧格式, 未协商 proto.HeadersCapability 的消费者只能接收不含消息头的 CMessageType,
+// 未协商 proto.CompressionCapability 的消费者只能接收未压缩的帧, 未协商 proto.PartitionCapability 的消费者不会收到分区号
+func (t *Topic) frameFormat(c *Consumer, headers proto.Headers) frameFormat {
+	version := c.FrameVersion()
+	return frameFormat{
+		version:    version,
+		headers:    len(headers) > 0 && c.HasCapability(proto.HeadersCapability),
+		compressed: version == proto.FrameV2 && c.HasCapability(proto.CompressionCapability),
+		partition:  version == proto.FrameV2 && c.HasCapability(proto.PartitionCapability),
+	}
+}
+
+// 依据消费者所需的格式构建消息帧, 相同格式的消费者共享同一个帧
+func (t *Topic) buildFrames(cm *proto.CMessage) (map[frameFormat]*proto.TransferFrame, error) {
+	frames := make(map[frameFormat]*proto.TransferFrame)
+	var err error
+
+	t.RangeConsumer(func(c *Consumer) {
+		format := t.frameFormat(c, cm.PM.Headers)
+		if _, ok := frames[format]; ok || err != nil {
+			return
+		}
+
+		frames[format], err = t.buildFrame(cm, format)
+	})
+
+	if err != nil {
+		for _, frame := range frames {
+			framePool.Put(frame)
+		}
+		return nil, err
+	}
+
+	return frames, nil
+}
+
+// 依据指定的格式构建消息帧, 返回的帧需由调用方归还 framePool
+func (t *Topic) buildFrame(cm *proto.CMessage, format frameFormat) (*proto.TransferFrame, error) {
+	msg := cm
+	if !format.headers && cm.MessageType() == proto.HCMessageType { // 去除消息头
+		msg = &proto.CMessage{
+			Offset:      cm.Offset,
+			ProductTime: cm.ProductTime,
+			PM:          &proto.PMessage{Topic: cm.PM.Topic, Key: cm.PM.Key, Value: cm.PM.Value},
+			Partition:   cm.Partition,
+		}
+	}
+
+	frame := framePool.Get()
+	frame.SetVersion(format.version)
+	if format.compressed {
+		frame.SetCompressor(t.compressor)
+	}
+	if format.partition {
+		frame.SetFlag(proto.FlagPartition)
+	}
+	err := frame.BuildFrom(msg, t.crypto.Encrypt)
+
+	return frame, err
+}
+
 // RangeConsumer 逐个迭代内部消费者
 func (t *Topic) RangeConsumer(fn func(c *Consumer)) {
 	t.consumers.Range(func(key, value any) bool {
@@ -132,24 +348,61 @@ func (t *Topic) RangeConsumer(fn func(c *Consumer)) {
 	})
 }
 
-// AddConsumer 添加一个消费者
+// AddConsumer 添加一个消费者, 属于消费者组的消费者同时加入主题内的同名组
 func (t *Topic) AddConsumer(con *Consumer) {
+	if con.Group() != "" {
+		t.joinGroup(con)
+	}
 	t.consumers.Store(con.Addr, con)
 }
 
-// RemoveConsumer 移除一个消费者
+// HasConsumer 消费者是否已加入此主题
+func (t *Topic) HasConsumer(addr string) bool {
+	_, ok := t.consumers.Load(addr)
+	return ok
+}
+
+// RemoveConsumer 移除一个消费者, 其所在的消费者组内的消息随即分配给其余成员
 func (t *Topic) RemoveConsumer(addr string) {
 	t.consumers.Delete(addr)
+	t.replays.Delete(addr)
+	t.leaveGroup(addr)
 }
 
-// Publisher 发布消费者消息,此处会将来自生产者的消息转换成消费者消息
+// Publisher 发布消费者消息,此处会将来自生产者的消息转换成消费者消息;
+// 消息依据其键分配到分区内, 返回消息在其分区内的偏移量
 func (t *Topic) Publisher(pm *proto.PMessage) uint64 {
-	offset := t.refreshOffset()
+	now := time.Now()
+	p := t.partitionOf(pm.Key)
+
+	item := queueItem{}
+	if ttl, ok := pm.Headers.TTL(); ok {
+		item.expireAt = now.Add(ttl)
+	}
+
+	// 偏移量必须按顺序写入日志, 且按顺序加入推送通道; 通道已满时在加锁之前等待
+	lane := pm.Headers.Priority()
+	p.slots[lane] <- struct{}{}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	offset := t.refreshOffset(p)
+	if p.log != nil {
+		err := p.log.Append(&storage.Record{
+			Offset: offset, Time: now.UnixMilli(), Key: pm.Key, Value: pm.Value, Headers: pm.Headers,
+		})
+		if err != nil {
+			t.onLogFailed(err)
+		}
+	}
+
 	cm := cpmp.GetCM() // cm.PM is nil
 
 	binary.BigEndian.PutUint64(cm.Offset, offset)
-	binary.BigEndian.PutUint64(cm.ProductTime, uint64(time.Now().Unix()))
+	binary.BigEndian.PutUint64(cm.ProductTime, uint64(now.Unix()))
 	cm.PM = pm
+	cm.Partition = uint16(p.index)
+	item.cm = cm
 
 	// pm:
 	//	1. Engine.handlePMessage 创建
@@ -157,8 +410,10 @@ func (t *Topic) Publisher(pm *proto.PMessage) uint64 {
 	//	3. Topic.Publisher 绑定到cm上
 	//	4. CPMPool 释放CM时会同时释放PM
 	//
+	// 相同优先级的消息在通道内按偏移量排列; 不同优先级的消息之间, 高优先级的消息可能先于偏移量更小的消息推送
 
-	t.queue <- cm
+	p.lanes[lane] <- item
+	p.pending <- struct{}{}
 
 	return offset
 }
@@ -169,12 +424,78 @@ func (t *Topic) SetOnConsumed(onConsumed func(record *HistoryRecord)) *Topic {
 	return t
 }
 
+// SetOnExpired 设置消息过期而被丢弃时的回调
+func (t *Topic) SetOnExpired(onExpired func(record *HistoryRecord)) *Topic {
+	t.onExpired = onExpired
+
+	return t
+}
+
+// SetLog 设置首个分区的日志, 等同于 SetPartitionLog(0, log, onFailed)
+func (t *Topic) SetLog(log *storage.Log, onFailed func(err error)) *Topic {
+	return t.SetPartitionLog(0, log, onFailed)
+}
+
+// Log 首个分区的日志, 未持久化时为nil
+func (t *Topic) Log() *storage.Log { return t.PartitionLog(0) }
+
+// Expired 过期而被丢弃的消息数量
+func (t *Topic) Expired() uint64 { return t.expired.Load() }
+
+// SetOnUndelivered 设置消息构建失败或未能送达消费者时的回调, 回调可能被并发调用
+// consumer 为目标消费者的地址, 构建失败时为全部消费者以逗号分隔的地址
+func (t *Topic) SetOnUndelivered(onUndelivered func(record *HistoryRecord, consumer string, err error)) *Topic {
+	t.onUndelivered = onUndelivered
+
+	return t
+}
+
+// Undelivered 构建失败或未能送达消费者的消息数量, 同一消息未能送达多个消费者时计数多次
+func (t *Topic) Undelivered() uint64 { return t.undelivered.Load() }
+
+// SetOnSend 设置向消费者推送消息之前的回调, 返回的方法在推送失败时调用; 重新推送的消息不会触发此回调
+func (t *Topic) SetOnSend(onSend func(c *Consumer, record *HistoryRecord) (cancel func())) *Topic {
+	t.onSend = onSend
+
+	return t
+}
+
+// Redelivered 因未确认而被重新推送的消息数量, 同一消息被重新推送多次时计数多次
+func (t *Topic) Redelivered() uint64 { return t.redelivered.Load() }
+
+// SetStarvationLimit 设置低优先级通道连续让行的上限, 必须在发布消息之前设置
+func (t *Topic) SetStarvationLimit(limit int) *Topic {
+	if limit > 0 {
+		t.starvation = limit
+	}
+	return t
+}
+
+// QueueDepth 全部分区内各优先级通道中等待推送的消息数量, 以 proto.MessagePriority 为索引
+func (t *Topic) QueueDepth() []int {
+	depth := make([]int, proto.NumberOfPriorities)
+	for _, p := range t.partitions {
+		for i, n := range p.queueDepth() {
+			depth[i] += n
+		}
+	}
+	return depth
+}
+
 func (t *Topic) SetCrypto(crypto proto.Crypto) *Topic {
 	t.crypto = crypto
 	return t
 }
 
-// LatestMessage 最新的消息记录
+func (t *Topic) SetCompressor(compressor proto.Compressor) *Topic {
+	t.compressor = compressor
+	return t
+}
+
+// Offset 最近一个消息在其分区内的偏移量,仅用于模糊显示
+func (t *Topic) Offset() uint64 { return t.offset.Load() }
+
+// LatestMessage 最新的消息记录, 尚无消息时返回nil
 func (t *Topic) LatestMessage() *HistoryRecord {
 	v := t.historyRecords.Right()
 	r, ok := v.(*HistoryRecord)
@@ -186,17 +507,30 @@ func (t *Topic) LatestMessage() *HistoryRecord {
 
 func NewTopic(name []byte, bufferSize, historySize int) *Topic {
 	t := &Topic{
-		Name:        name,
-		HistorySize: historySize,
-		Offset:      0,
-		counter:     proto.NewCounter(),
-		consumers:   &sync.Map{},
-		queue:       make(chan *proto.CMessage, bufferSize),
-		crypto:      &proto.NoCrypto{},
-		mu:          &sync.Mutex{},
-		onConsumed:  func(_ *HistoryRecord) {},
-	}
-	go t.consume()
+		Name:           name,
+		HistorySize:    historySize,
+		offset:         &atomic.Uint64{},
+		consumers:      &sync.Map{},
+		replays:        &sync.Map{},
+		deliver:        &sync.RWMutex{},
+		groups:         make(map[string]*consumerGroup),
+		groupLock:      &sync.Mutex{},
+		partitions:     make([]*partition, 0, DefaultPartitions),
+		bufferSize:     bufferSize,
+		cursor:         &atomic.Uint64{},
+		starvation:     DefaultStarvationLimit,
+		historyRecords: proto.NewQueue(historySize),
+		expired:        &atomic.Uint64{},
+		undelivered:    &atomic.Uint64{},
+		redelivered:    &atomic.Uint64{},
+		crypto:         &proto.NoCrypto{},
+		compressor:     &proto.NoCompressor{},
+		mu:             &sync.Mutex{},
+		onConsumed:     func(_ *HistoryRecord) {},
+		onExpired:      func(_ *HistoryRecord) {},
+		onUndelivered:  func(_ *HistoryRecord, _ string, _ error) {},
+		onSend:         func(_ *Consumer, _ *HistoryRecord) func() { return func() {} },
+	}
 
-	return t
+	return t.SetPartitions(DefaultPartitions)
 }
@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"github.com/Chendemo12/micromq/src/proto"
+	"sort"
+	"strings"
+)
+
+// 区分主题名称和通配符模式, 未协商 proto.WildcardCapability 时全部视为主题名称
+func (c *Consumer) splitTopics(names []string) (topics, patterns []string) {
+	if !c.HasCapability(proto.WildcardCapability) {
+		return names, nil
+	}
+
+	topics = make([]string, 0, len(names))
+	for _, name := range names {
+		if proto.IsTopicPattern(name) {
+			patterns = append(patterns, name)
+		} else {
+			topics = append(topics, name)
+		}
+	}
+	return topics, patterns
+}
+
+// 消费者订阅的主题名称和通配符模式
+func (c *Consumer) subscriptions() (topics, patterns []string) {
+	conf := c.Conf
+	if conf == nil {
+		return nil, nil
+	}
+	return c.splitTopics(conf.Topics)
+}
+
+// Patterns 消费者订阅的通配符模式
+func (c *Consumer) Patterns() []string {
+	_, patterns := c.subscriptions()
+	return patterns
+}
+
+// 是否为服务端保留的内部主题: 死信主题, 隔离主题和回复主题, 这些主题只能以名称订阅
+func (e *Engine) reservedTopic(name string) bool {
+	return name == e.DeadLetterTopic() || name == e.QuarantineTopic() || strings.HasPrefix(name, ReplyTopicPrefix)
+}
+
+// 主题是否匹配通配符模式, 保留的内部主题不会被任何通配符模式匹配, 以免消费者收到其他连接的回复或死信
+func (e *Engine) matchTopic(pattern, topic string) bool {
+	if proto.IsTopicPattern(pattern) && e.reservedTopic(topic) {
+		return false
+	}
+	return proto.MatchTopic(pattern, topic)
+}
+
+// 主题所匹配的消费者的首个通配符模式, 不匹配任何模式时为空
+func (e *Engine) matchPattern(c *Consumer, topic string) string {
+	for _, pattern := range c.Patterns() {
+		if e.matchTopic(pattern, topic) {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// 将通配符模式匹配新主题的消费者加入此主题, 须在主题可被查询之前调用
+func (e *Engine) joinWildcards(topic *Topic) {
+	name := string(topic.Name)
+	e.wildcards.Range(func(key, value any) bool {
+		if c := value.(*Consumer); e.matchPattern(c, name) != "" {
+			topic.AddConsumer(c)
+		}
+		return true
+	})
+}
+
+// 消费者的各通配符模式当前匹配的主题: {pattern: [topic]}
+func (e *Engine) patternTopics(c *Consumer) map[string][]string {
+	patterns := c.Patterns()
+	matches := make(map[string][]string, len(patterns))
+	for _, pattern := range patterns {
+		matches[pattern] = make([]string, 0)
+	}
+	if len(patterns) == 0 {
+		return matches
+	}
+
+	e.RangeTopic(func(topic *Topic) bool {
+		name := string(topic.Name)
+		for _, pattern := range patterns {
+			if e.matchTopic(pattern, name) {
+				matches[pattern] = append(matches[pattern], name)
+			}
+		}
+		return true
+	})
+	for _, names := range matches {
+		sort.Strings(names)
+	}
+
+	return matches
+}
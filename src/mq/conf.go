@@ -16,8 +16,24 @@ type Config struct {
 	SwaggerDisabled   bool           `json:"swagger_disabled"`   // 禁用调试文档
 	StatisticDisabled bool           `json:"statistic_disabled"` // 禁用统计功能
 	Broker            *engine.Config `json:"broker"`             //
-	crypto            proto.Crypto
-	cryptoPlan        []string
+	// 向消费者推送消息时的压缩方案, 支持gzip/deflate/no, 仅对采用 FrameV2 的消费者有效
+	Compression string `json:"compression"`
+	// 不符合主题模式的消息被转投的隔离主题, 默认为 engine.DefaultQuarantineTopic
+	QuarantineTopic string `json:"quarantine_topic"`
+	// 构建失败或未能送达消费者的消息被转投的死信主题, 默认为 engine.DefaultDeadLetterTopic
+	DeadLetterTopic string `json:"dead_letter_topic"`
+	crypto          proto.Crypto
+	cryptoPlan      []string
+	compressor      proto.Compressor
+	hooks           []*customHook // 自定义消息的处理器
+}
+
+// 待绑定到 engine.Engine 的自定义消息处理器
+type customHook struct {
+	message proto.Message
+	ack     proto.Message
+	handler engine.HookHandler
+	text    string
 }
 
 var defaultConf = Config{
@@ -0,0 +1,97 @@
+package mq
+
+import (
+	"fmt"
+	"github.com/Chendemo12/fastapi"
+	"github.com/Chendemo12/micromq/src/engine"
+	"net/http"
+	"strconv"
+)
+
+// DelayRouter 延迟消息管理路由组
+func DelayRouter() *fastapi.Router {
+	var router = fastapi.APIRouter("/api/delay", []string{"Delay"})
+
+	{
+		router.Get("", getDelayedMessages, opt{
+			Summary:       "获取全部尚未投递的延迟消息",
+			Description:   "按投递时间排序",
+			ResponseModel: List(&DelayedStatistic{}),
+		})
+
+		router.Get("/:id", getDelayedMessage, opt{
+			Summary:       "获取一个尚未投递的延迟消息",
+			ResponseModel: &DelayedStatistic{},
+		})
+
+		router.Delete("/:id", deleteDelayedMessage, opt{
+			Summary:       "取消一个尚未投递的延迟消息",
+			ResponseModel: &DelayedStatistic{},
+		})
+	}
+
+	return router
+}
+
+type DelayedStatistic struct {
+	fastapi.BaseModel
+	ID        uint64 `json:"id" description:"延迟消息ID"`
+	Topic     string `json:"topic" description:"消息主题"`
+	Key       string `json:"key" description:"消息键"`
+	Size      int    `json:"size" description:"消息体字节数"`
+	CreatedAt int64  `json:"created_at" description:"服务端收到消息时的Unix毫秒时间戳"`
+	DeliverAt int64  `json:"deliver_at" description:"投递时间, Unix毫秒时间戳"`
+}
+
+func (m *DelayedStatistic) SchemaDesc() string {
+	return "尚未到达投递时间的延迟消息"
+}
+
+func toDelayedStatistic(m *engine.DelayedMessage) *DelayedStatistic {
+	return &DelayedStatistic{
+		ID:        m.ID,
+		Topic:     m.Topic,
+		Key:       m.Key,
+		Size:      m.Size,
+		CreatedAt: m.CreatedAt.UnixMilli(),
+		DeliverAt: m.DeliverAt.UnixMilli(),
+	}
+}
+
+func getDelayedMessages(c *fastapi.Context) *fastapi.Response {
+	ms := mq.broker.DelayQueue().List()
+	forms := make([]*DelayedStatistic, len(ms))
+	for i, m := range ms {
+		forms[i] = toDelayedStatistic(m)
+	}
+
+	return c.OKResponse(forms)
+}
+
+func getDelayedMessage(c *fastapi.Context) *fastapi.Response {
+	id, err := strconv.ParseUint(c.PathFields["id"], 10, 64)
+	if err != nil {
+		return c.JSONResponse(http.StatusBadRequest, fmt.Sprintf("invalid id '%s'", c.PathFields["id"]))
+	}
+
+	m, ok := mq.broker.DelayQueue().Query(id)
+	if !ok {
+		return c.JSONResponse(http.StatusNotFound, fmt.Sprintf("delayed message %d not found", id))
+	}
+
+	return c.OKResponse(toDelayedStatistic(m))
+}
+
+func deleteDelayedMessage(c *fastapi.Context) *fastapi.Response {
+	id, err := strconv.ParseUint(c.PathFields["id"], 10, 64)
+	if err != nil {
+		return c.JSONResponse(http.StatusBadRequest, fmt.Sprintf("invalid id '%s'", c.PathFields["id"]))
+	}
+
+	m, ok := mq.broker.CancelDelayed(id)
+	if !ok {
+		return c.JSONResponse(http.StatusNotFound, fmt.Sprintf("delayed message %d not found", id))
+	}
+
+	return c.OKResponse(toDelayedStatistic(m))
+}
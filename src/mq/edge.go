@@ -28,6 +28,13 @@ func EdgeRouter() *fastapi.Router {
 			RequestModel:  &ProducerForm{},
 			ResponseModel: &ProductResponse{},
 		})
+
+		router.Post("/batch", PostBatchMessage, opt{
+			Summary:       "批量发送生产者消息",
+			Description:   "以全部或全不的方式发送多个主题的生产者消息, 任一消息不合法时整批消息均不发布",
+			RequestModel:  &BatchForm{},
+			ResponseModel: &BatchResponse{},
+		})
 	}
 
 	return router
@@ -39,6 +46,13 @@ type ProducerForm struct {
 	Topic string `json:"topic" description:"消息主题"`
 	Key   string `json:"key" description:"消息键"`
 	Value string `json:"value" description:"base64编码后的消息体"`
+	// 消息头不参与加密
+	Headers map[string]string `json:"headers,omitempty" description:"消息头, 值为base64编码后的明文"`
+	TTL     int64             `json:"ttl,omitempty" validate:"gte=0" description:"消息存活时间, 单位ms, 0表示永不过期"`
+	// 延迟投递, 同时设置时以 DeliverAt 为准
+	DeliverAt int64  `json:"deliver_at,omitempty" validate:"gte=0" description:"投递时间, Unix毫秒时间戳, 0表示立即投递"`
+	Delay     int64  `json:"delay,omitempty" validate:"gte=0" description:"延迟投递的时长, 单位ms, 0表示立即投递"`
+	Priority  string `json:"priority,omitempty" validate:"omitempty,oneof=low normal high" description:"消息优先级, 缺省为normal"`
 }
 
 func (m *ProducerForm) String() string {
@@ -52,7 +66,8 @@ func (m *ProducerForm) String() string {
 func (m *ProducerForm) SchemaDesc() string {
 	return `生产者消息投递表单, 不允许将多个消息编码成一个消息帧; 
 token若为空则认为不加密; 
-value是对加密后的消息体进行base64编码后的结果,依据token判断是否需要解密`
+value是对加密后的消息体进行base64编码后的结果,依据token判断是否需要解密;
+headers的值是对明文进行base64编码后的结果, 不参与加密`
 }
 
 func (m *ProducerForm) IsEncrypt() bool { return m.Token != "" }
@@ -60,7 +75,7 @@ func (m *ProducerForm) IsEncrypt() bool { return m.Token != "" }
 type ProductResponse struct {
 	fastapi.BaseModel
 	// 仅当 Accepted 时才认为服务器接受了请求并下方了有效的参数
-	Status       string `json:"status" validate:"oneof=Accepted UnmarshalFailed TokenIncorrect Let-ReRegister Refused" description:"消息接收状态"`
+	Status       string `json:"status" validate:"oneof=Accepted UnmarshalFailed TokenIncorrect Let-ReRegister Refused SchemaInvalid" description:"消息接收状态"`
 	Offset       uint64 `json:"offset" description:"消息偏移量"`
 	ResponseTime int64  `json:"response_time" description:"服务端返回消息时的时间戳"`
 	Message      string `json:"message" description:"额外的消息描述"`
@@ -83,6 +98,15 @@ func toPMessage(c *fastapi.Context) (*proto.PMessage, *fastapi.Response) {
 		return nil, resp
 	}
 
+	pm, failed := formToPMessage(c, form)
+	if failed != nil {
+		return nil, c.OKResponse(failed)
+	}
+	return pm, nil
+}
+
+// 将表单转换为生产者消息, 转换失败时返回应答给客户端的响应
+func formToPMessage(c *fastapi.Context, form *ProducerForm) (*proto.PMessage, *ProductResponse) {
 	c.Logger().Debug(fmt.Sprintf("receive: %s, from '%s' ", form, c.EngineCtx().IP()))
 	pm := &proto.PMessage{}
 	// 首先反序列化消息体
@@ -90,12 +114,12 @@ func toPMessage(c *fastapi.Context) (*proto.PMessage, *fastapi.Response) {
 	if err != nil {
 		c.Logger().Info("message UnmarshalFailed about:", c.EngineCtx().IP())
 		c.Logger().Info(err)
-		return nil, c.OKResponse(&ProductResponse{
+		return nil, &ProductResponse{
 			Status:       "UnmarshalFailed",
 			Offset:       0,
 			ResponseTime: time.Now().Unix(),
 			Message:      err.Error(),
-		})
+		}
 	}
 
 	// 解密消息
@@ -104,23 +128,23 @@ func toPMessage(c *fastapi.Context) (*proto.PMessage, *fastapi.Response) {
 	} else {
 		if !mq.broker.IsTokenCorrect(form.Token) {
 			c.Logger().Info(c.EngineCtx().IP(), "has wrong token")
-			return nil, c.OKResponse(&ProductResponse{
+			return nil, &ProductResponse{
 				Status:       proto.GetMessageResponseStatusText(proto.TokenIncorrectStatus),
 				Offset:       0,
 				ResponseTime: time.Now().Unix(),
-				Message:      err.Error(),
-			})
+				Message:      "token incorrect",
+			}
 		} else {
 			// 如果设置了密钥，HTTP传输的数据必须进行加密
 			_bytes, _err := mq.broker.Crypto().Decrypt(decode)
 			if _err != nil {
 				c.Logger().Warn(c.EngineCtx().IP(), "has correct token, but value decrypt failed: ", _err)
-				return nil, c.OKResponse(&ProductResponse{
+				return nil, &ProductResponse{
 					Status:       proto.GetMessageResponseStatusText(proto.TokenIncorrectStatus),
 					Offset:       0,
 					ResponseTime: time.Now().Unix(),
 					Message:      _err.Error(),
-				})
+				}
 			}
 			pm.Value = _bytes
 		}
@@ -129,6 +153,49 @@ func toPMessage(c *fastapi.Context) (*proto.PMessage, *fastapi.Response) {
 	pm.Key = []byte(form.Key)
 	pm.Topic = []byte(form.Topic)
 
+	if len(form.Headers) > 0 {
+		pm.Headers = make(proto.Headers, len(form.Headers))
+		for k, v := range form.Headers {
+			value, _err := helper.Base64Decode(v)
+			if _err != nil {
+				c.Logger().Info("message headers UnmarshalFailed about:", c.EngineCtx().IP())
+				return nil, &ProductResponse{
+					Status:       "UnmarshalFailed",
+					Offset:       0,
+					ResponseTime: time.Now().Unix(),
+					Message:      fmt.Sprintf("header '%s': %v", k, _err),
+				}
+			}
+			pm.Headers.Set(k, value)
+		}
+	}
+	if form.TTL > 0 {
+		if pm.Headers == nil {
+			pm.Headers = make(proto.Headers)
+		}
+		pm.Headers.SetTTL(time.Duration(form.TTL) * time.Millisecond)
+	}
+	if form.Priority != "" {
+		if pm.Headers == nil {
+			pm.Headers = make(proto.Headers)
+		}
+		for p := proto.PriorityLow; p <= proto.PriorityHigh; p++ {
+			if p.String() == form.Priority {
+				pm.Headers.SetPriority(p)
+			}
+		}
+	}
+	if form.DeliverAt > 0 || form.Delay > 0 {
+		if pm.Headers == nil {
+			pm.Headers = make(proto.Headers)
+		}
+		if form.DeliverAt > 0 {
+			pm.Headers.SetDeliverAt(time.UnixMilli(form.DeliverAt))
+		} else {
+			pm.Headers.SetDeliverAt(time.Now().Add(time.Duration(form.Delay) * time.Millisecond))
+		}
+	}
+
 	return pm, nil
 }
 
@@ -139,9 +206,30 @@ func PostProducerMessage(c *fastapi.Context) *fastapi.Response {
 		return resp
 	}
 
+	// 依据主题模式校验, 不符合模式的消息会被拒绝或转投至隔离主题
+	if err := mq.broker.CheckSchema(pm); err != nil {
+		c.Logger().Info(c.EngineCtx().IP(), " message rejected by topic schema: ", err)
+		return c.OKResponse(&ProductResponse{
+			Status:       proto.GetMessageResponseStatusText(proto.SchemaInvalidStatus),
+			Offset:       0,
+			ResponseTime: time.Now().Unix(),
+			Message:      err.Error(),
+		})
+	}
+
 	respForm := &ProductResponse{}
 	respForm.Status = proto.GetMessageResponseStatusText(proto.AcceptedStatus)
-	respForm.Offset = mq.broker.Publisher(pm)
+	if d, ok := mq.broker.ScheduleMessage(pm); ok {
+		// 延迟消息尚无偏移量, 返回其ID以便取消
+		respForm.Message = fmt.Sprintf("delayed message %d scheduled at %d", d.ID, d.DeliverAt.UnixMilli())
+	} else {
+		// 携带生产者ID和序列号的消息可安全地重发, 重复的消息返回其原始偏移量
+		var duplicated bool
+		respForm.Offset, duplicated = mq.broker.PublishIdempotent(pm)
+		if duplicated {
+			respForm.Message = "duplicated message dropped"
+		}
+	}
 	respForm.ResponseTime = time.Now().Unix()
 
 	c.Logger().Debug(fmt.Sprintf("return: %s, to '%s' ", respForm, c.EngineCtx().IP()))
@@ -153,3 +241,64 @@ func PostProducerMessage(c *fastapi.Context) *fastapi.Response {
 func AsyncPostProducerMessage(c *fastapi.Context) *fastapi.Response {
 	return PostProducerMessage(c)
 }
+
+type BatchForm struct {
+	fastapi.BaseModel
+	Messages []*ProducerForm `json:"messages" validate:"required,min=1,dive" description:"生产者消息, 可属于不同主题"`
+}
+
+func (m *BatchForm) SchemaDesc() string {
+	return "批量消息投递表单, 每个消息的编码同生产者消息投递表单"
+}
+
+type BatchResponse struct {
+	fastapi.BaseModel
+	Status       string   `json:"status" validate:"oneof=Accepted UnmarshalFailed TokenIncorrect Let-ReRegister Refused SchemaInvalid" description:"消息接收状态"`
+	Offsets      []uint64 `json:"offsets" description:"按顺序排列的每个消息的偏移量"`
+	ResponseTime int64    `json:"response_time" description:"服务端返回消息时的时间戳"`
+	Message      string   `json:"message" description:"额外的消息描述"`
+}
+
+func (m *BatchResponse) SchemaDesc() string {
+	return "批量消息返回值; 仅当 status=Accepted 时整批消息均被发布, 否则均未发布"
+}
+
+// PostBatchMessage 全部或全不地发送批量消息
+func PostBatchMessage(c *fastapi.Context) *fastapi.Response {
+	form := &BatchForm{}
+	resp := c.ShouldBindJSON(form)
+	if resp != nil {
+		return resp
+	}
+
+	pms := make([]*proto.PMessage, len(form.Messages))
+	for i, item := range form.Messages {
+		pm, failed := formToPMessage(c, item)
+		if failed != nil {
+			return c.OKResponse(&BatchResponse{
+				Status:       failed.Status,
+				Offsets:      []uint64{},
+				ResponseTime: time.Now().Unix(),
+				Message:      fmt.Sprintf("messages[%d]: %s", i, failed.Message),
+			})
+		}
+		pms[i] = pm
+	}
+
+	offsets, err := mq.broker.PublishBatch(pms, true)
+	if err != nil {
+		c.Logger().Info(c.EngineCtx().IP(), " batch rejected by topic schema: ", err)
+		return c.OKResponse(&BatchResponse{
+			Status:       proto.GetMessageResponseStatusText(proto.SchemaInvalidStatus),
+			Offsets:      []uint64{},
+			ResponseTime: time.Now().Unix(),
+			Message:      err.Error(),
+		})
+	}
+
+	return c.OKResponse(&BatchResponse{
+		Status:       proto.GetMessageResponseStatusText(proto.AcceptedStatus),
+		Offsets:      offsets,
+		ResponseTime: time.Now().Unix(),
+	})
+}
@@ -2,6 +2,7 @@ package mq
 
 import (
 	"context"
+	"errors"
 	"github.com/Chendemo12/fastapi"
 	"github.com/Chendemo12/fastapi-tool/logger"
 	"github.com/Chendemo12/functools/python"
@@ -58,8 +59,14 @@ func (m *MQ) initHttp() *MQ {
 		m.faster.IncludeRouter(EdgeRouter())
 	}
 
+	if python.Any(m.conf.EdgeEnabled, m.conf.Debug) {
+		m.faster.IncludeRouter(SchemaRouter())
+		m.faster.IncludeRouter(DelayRouter())
+	}
+
 	if python.Any(!m.conf.StatisticDisabled, m.conf.Debug) {
 		m.faster.IncludeRouter(StatRouter())
+		m.faster.IncludeRouter(ProtocolRouter())
 	}
 
 	return m
@@ -94,6 +101,26 @@ func (m *MQ) SetCryptoPlan(option string, key ...string) *MQ {
 	return m
 }
 
+// SetCompressor 设置向消费者推送消息时的压缩器, 优先级高于 Config.Compression
+func (m *MQ) SetCompressor(compressor proto.Compressor) *MQ {
+	m.conf.compressor = compressor
+
+	return m
+}
+
+// BindMessageHandler 绑定一个自定义消息的处理器, 必须在 Serve 之前设置, 详见 engine.Engine.BindMessageHandler
+func (m *MQ) BindMessageHandler(message proto.Message, ack proto.Message, handler engine.HookHandler, text string) error {
+	if !proto.IsMessageDefined(message.MessageType()) {
+		return errors.New("built-in message type cannot be modified")
+	}
+	m.conf.hooks = append(m.conf.hooks, &customHook{message: message, ack: ack, handler: handler, text: text})
+
+	return nil
+}
+
+// Crypto 服务端的全局加解密器, 自定义消息的处理器可借此解密消息和加密响应, 仅在 Serve 之后有效
+func (m *MQ) Crypto() proto.Crypto { return m.broker.Crypto() }
+
 // Serve 阻塞启动
 func (m *MQ) Serve() {
 	if m.logger == nil {
@@ -106,6 +133,15 @@ func (m *MQ) Serve() {
 	if len(m.conf.cryptoPlan) > 0 {
 		m.broker.SetCryptoPlan(m.conf.cryptoPlan[0], m.conf.cryptoPlan[1:]...)
 	}
+	if m.conf.Compression != "" {
+		m.broker.SetCompressPlan(m.conf.Compression)
+	}
+	m.broker.SetCompressor(m.conf.compressor)
+	m.broker.SetQuarantineTopic(m.conf.QuarantineTopic)
+	m.broker.SetDeadLetterTopic(m.conf.DeadLetterTopic)
+	for _, hook := range m.conf.hooks {
+		_ = m.broker.BindMessageHandler(hook.message, hook.ack, hook.handler, hook.text)
+	}
 
 	go func() {
 		err := m.broker.Serve()
@@ -142,11 +178,25 @@ func New(cs ...Config) *MQ {
 		conf.EdgeHttpHost = python.GetS(cs[0].EdgeHttpHost, conf.EdgeHttpHost)
 		conf.EdgeHttpPort = python.GetS(cs[0].EdgeHttpPort, conf.EdgeHttpPort)
 		conf.Debug = cs[0].Debug
+		conf.Compression = cs[0].Compression
+		conf.QuarantineTopic = cs[0].QuarantineTopic
+		conf.DeadLetterTopic = cs[0].DeadLetterTopic
 		conf.Broker.Host = cs[0].Broker.Host
 		conf.Broker.Port = cs[0].Broker.Port
 		conf.Broker.MaxOpenConn = cs[0].Broker.MaxOpenConn
 		conf.Broker.BufferSize = cs[0].Broker.BufferSize
 		conf.Broker.HeartbeatTimeout = cs[0].Broker.HeartbeatTimeout
+		conf.Broker.StarvationLimit = cs[0].Broker.StarvationLimit
+		conf.Broker.DataDir = cs[0].Broker.DataDir
+		conf.Broker.SegmentBytes = cs[0].Broker.SegmentBytes
+		conf.Broker.RetentionBytes = cs[0].Broker.RetentionBytes
+		conf.Broker.RetentionAge = cs[0].Broker.RetentionAge
+		conf.Broker.FsyncPolicy = cs[0].Broker.FsyncPolicy
+		conf.Broker.FsyncInterval = cs[0].Broker.FsyncInterval
+		conf.Broker.Partitions = cs[0].Broker.Partitions
+		conf.Broker.TopicPartitions = cs[0].Broker.TopicPartitions
+		conf.Broker.AckTimeout = cs[0].Broker.AckTimeout
+		conf.Broker.MaxRedeliveries = cs[0].Broker.MaxRedeliveries
 		conf.Broker.Token = cs[0].Broker.Token
 
 		if cs[0].EdgeEnabled {
@@ -0,0 +1,30 @@
+package mq
+
+import (
+	"github.com/Chendemo12/fastapi"
+)
+
+// ProtocolRouter 协议自省路由组
+func ProtocolRouter() *fastapi.Router {
+	router := fastapi.APIRouter("/api/protocol", []string{"Protocol"})
+	{
+		router.Get("", getProtocol, opt{
+			Summary:     "获取服务端实现的TCP协议描述",
+			Description: "包含帧布局, 标志位, 响应状态以及全部已实现的消息, 包括通过 BindMessageHandler 添加的自定义消息",
+		})
+
+		router.Get("/asyncapi", getAsyncAPI, opt{
+			Summary:     "导出 AsyncAPI 风格的协议文档",
+			Description: "在协议描述之外, 还包含当前已存在的主题及其消息体模式, 可用于校验其他语言实现的客户端",
+		})
+	}
+	return router
+}
+
+func getProtocol(c *fastapi.Context) *fastapi.Response {
+	return c.OKResponse(mq.broker.ProtocolSpec())
+}
+
+func getAsyncAPI(c *fastapi.Context) *fastapi.Response {
+	return c.OKResponse(mq.broker.AsyncAPI(mq.conf.AppName, mq.conf.Version))
+}
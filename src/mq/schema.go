@@ -0,0 +1,129 @@
+package mq
+
+import (
+	"fmt"
+	"github.com/Chendemo12/fastapi"
+	"github.com/Chendemo12/micromq/src/engine"
+	"net/http"
+)
+
+// SchemaRouter 主题模式管理路由组
+func SchemaRouter() *fastapi.Router {
+	var router = fastapi.APIRouter("/api/schema", []string{"Schema"})
+
+	{
+		router.Get("", getSchemas, opt{
+			Summary:       "获取全部主题的消息体模式",
+			ResponseModel: List(&SchemaStatistic{}),
+		})
+
+		router.Get("/:topic", getSchema, opt{
+			Summary:       "获取主题的消息体模式",
+			ResponseModel: &SchemaStatistic{},
+		})
+
+		router.Post("", postSchema, opt{
+			Summary:       "注册主题的消息体模式",
+			Description:   "为主题设置 JSON Schema, 若已存在则替换; 此后该主题的消息体必须是符合模式的 JSON",
+			RequestModel:  &SchemaForm{},
+			ResponseModel: &SchemaStatistic{},
+		})
+
+		router.Delete("/:topic", deleteSchema, opt{
+			Summary:       "删除主题的消息体模式",
+			ResponseModel: &SchemaStatistic{},
+		})
+	}
+
+	return router
+}
+
+type SchemaForm struct {
+	fastapi.BaseModel
+	Topic      string `json:"topic" validate:"required" description:"消息主题"`
+	JSONSchema string `json:"schema" validate:"required" description:"JSON Schema 文本, 未声明$schema时视为draft 2020-12"`
+	Action     string `json:"action,omitempty" validate:"omitempty,oneof=reject quarantine" description:"消息不符合模式时的处理方式"`
+}
+
+func (m *SchemaForm) SchemaDesc() string {
+	return `主题模式注册表单;
+schema不允许通过$ref引用外部资源;
+action=reject时拒绝消息并返回SchemaInvalid, action=quarantine时将消息转投至隔离主题, 缺省为reject`
+}
+
+type SchemaStatistic struct {
+	fastapi.BaseModel
+	Topic       string `json:"topic" description:"消息主题"`
+	JSONSchema  string `json:"schema" description:"JSON Schema 文本"`
+	Action      string `json:"action" description:"消息不符合模式时的处理方式"`
+	Quarantine  string `json:"quarantine,omitempty" description:"隔离主题, 仅action=quarantine时有效"`
+	CreatedAt   int64  `json:"created_at" description:"注册时间戳"`
+	Accepted    uint64 `json:"accepted" description:"通过校验的消息数量"`
+	Rejected    uint64 `json:"rejected" description:"被拒绝的消息数量"`
+	Quarantined uint64 `json:"quarantined" description:"被转投至隔离主题的消息数量"`
+}
+
+func (m *SchemaStatistic) SchemaDesc() string {
+	return "主题的消息体模式及其校验计数"
+}
+
+func toSchemaStatistic(s *engine.TopicSchema) *SchemaStatistic {
+	form := &SchemaStatistic{
+		Topic:       s.Topic,
+		JSONSchema:  s.Schema,
+		Action:      string(s.Action),
+		CreatedAt:   s.CreatedAt,
+		Accepted:    s.Accepted(),
+		Rejected:    s.Rejected(),
+		Quarantined: s.Quarantined(),
+	}
+	if s.Action == engine.SchemaActionQuarantine {
+		form.Quarantine = mq.broker.QuarantineTopic()
+	}
+
+	return form
+}
+
+func getSchemas(c *fastapi.Context) *fastapi.Response {
+	forms := make([]*SchemaStatistic, 0)
+	mq.broker.RangeSchema(func(s *engine.TopicSchema) bool {
+		forms = append(forms, toSchemaStatistic(s))
+		return true
+	})
+
+	return c.OKResponse(forms)
+}
+
+func getSchema(c *fastapi.Context) *fastapi.Response {
+	s, ok := mq.broker.QuerySchema(c.PathFields["topic"])
+	if !ok {
+		return c.JSONResponse(http.StatusNotFound, fmt.Sprintf("topic '%s' has no schema", c.PathFields["topic"]))
+	}
+
+	return c.OKResponse(toSchemaStatistic(s))
+}
+
+func postSchema(c *fastapi.Context) *fastapi.Response {
+	form := &SchemaForm{}
+	resp := c.ShouldBindJSON(form)
+	if resp != nil {
+		return resp
+	}
+
+	s, err := mq.broker.RegisterSchema(form.Topic, []byte(form.JSONSchema), engine.SchemaAction(form.Action))
+	if err != nil {
+		c.Logger().Info(fmt.Sprintf("topic '%s' schema is invalid: %v", form.Topic, err))
+		return c.JSONResponse(http.StatusBadRequest, err.Error())
+	}
+
+	return c.OKResponse(toSchemaStatistic(s))
+}
+
+func deleteSchema(c *fastapi.Context) *fastapi.Response {
+	s, ok := mq.broker.QuerySchema(c.PathFields["topic"])
+	if !ok || !mq.broker.RemoveSchema(s.Topic) {
+		return c.JSONResponse(http.StatusNotFound, fmt.Sprintf("topic '%s' has no schema", c.PathFields["topic"]))
+	}
+
+	return c.OKResponse(toSchemaStatistic(s))
+}
@@ -26,7 +26,7 @@ func StatRouter() *fastapi.Router {
 		})
 
 		router.Get("/topic/offset", getTopicsOffset, opt{
-			Summary:       "获取Broker内的topic名称及其最新的消息计数",
+			Summary:       "获取Broker内的topic名称及其最新的消息计数, 以及过期而被丢弃的消息数量",
 			ResponseModel: List(&TopicOffsetStatistic{}),
 		})
 
@@ -38,6 +38,11 @@ func StatRouter() *fastapi.Router {
 			Summary:       "获取主题内部的消费者连接",
 			ResponseModel: List(&TopicConsumerStatistic{}),
 		})
+
+		router.Get("/frame/errors", getFrameParseErrors, opt{
+			Summary:       "获取消息帧解析错误计数",
+			ResponseModel: &FrameErrorStatistic{},
+		})
 	}
 	return router
 }
@@ -52,8 +57,12 @@ func getProducers(c *fastapi.Context) *fastapi.Response {
 
 type ConsumerStatistic struct {
 	fastapi.BaseModel
-	Addr   string   `json:"addr" description:"连接地址"`
-	Topics []string `json:"topics" description:"订阅的主题名列表"`
+	Addr     string              `json:"addr" description:"连接地址"`
+	Topics   []string            `json:"topics" description:"订阅的主题名列表"`
+	Group    string              `json:"group" description:"消费者组名称, 为空时接收主题内的全部消息"`
+	Patterns map[string][]string `json:"patterns" description:"通配符模式及其当前匹配的主题"`
+	ID       string              `json:"id" description:"消费者ID, 重连后据此取回未确认的消息"`
+	Unacked  int                 `json:"unacked" description:"已推送但尚未确认的消息数量"`
 }
 
 func (m *ConsumerStatistic) SchemaDesc() string {
@@ -65,8 +74,12 @@ func getConsumers(c *fastapi.Context) *fastapi.Response {
 	tcs := make([]*ConsumerStatistic, len(cs))
 	for i := 0; i < len(cs); i++ {
 		tcs[i] = &ConsumerStatistic{
-			Addr:   cs[i].Addr,
-			Topics: cs[i].Topics,
+			Addr:     cs[i].Addr,
+			Topics:   cs[i].Topics,
+			Group:    cs[i].Group,
+			Patterns: cs[i].Patterns,
+			ID:       cs[i].ID,
+			Unacked:  cs[i].Unacked,
 		}
 	}
 
@@ -75,20 +88,59 @@ func getConsumers(c *fastapi.Context) *fastapi.Response {
 
 type TopicOffsetStatistic struct {
 	fastapi.BaseModel
-	Topic  string `json:"topic" description:"名称"`
-	Offset uint64 `json:"offset" description:"最新的消息偏移量"`
+	Topic   string `json:"topic" description:"名称"`
+	Offset  uint64 `json:"offset" description:"最新的消息偏移量"`
+	Expired uint64 `json:"expired" description:"过期而被丢弃的消息数量"`
+	// 同一消息未能送达多个消费者时计数多次
+	Undelivered uint64 `json:"undelivered" description:"构建失败或未能送达消费者的次数"`
+	// 同一消息被重新推送多次时计数多次
+	Redelivered uint64 `json:"redelivered" description:"因未确认而被重新推送的次数"`
+	LogSize     int64  `json:"log_size" description:"主题日志的字节数, 未持久化时为0"`
+	// 键为优先级名称: low/normal/high
+	QueueDepth map[string]int `json:"queue_depth" description:"各优先级通道中等待推送的消息数量"`
+	// 以分区号为索引
+	Partitions []*PartitionOffsetStatistic `json:"partitions" description:"各分区的偏移量"`
 }
 
 func (m *TopicOffsetStatistic) SchemaDesc() string {
 	return "Topic的消息偏移量信息"
 }
 
+type PartitionOffsetStatistic struct {
+	fastapi.BaseModel
+	Partition  int            `json:"partition" description:"分区号"`
+	Offset     uint64         `json:"offset" description:"分区内最新的消息偏移量"`
+	LogSize    int64          `json:"log_size" description:"分区日志的字节数, 未持久化时为0"`
+	QueueDepth map[string]int `json:"queue_depth" description:"各优先级通道中等待推送的消息数量"`
+}
+
+func (m *PartitionOffsetStatistic) SchemaDesc() string {
+	return "Topic内一个分区的消息偏移量信息"
+}
+
 func getTopicsOffset(c *fastapi.Context) *fastapi.Response {
 	ss := mq.Stat().TopicsOffset()
 
 	form := make([]*TopicOffsetStatistic, len(ss))
 	for i := 0; i < len(ss); i++ {
-		form[i] = &TopicOffsetStatistic{Topic: ss[i].Name, Offset: ss[i].Offset}
+		form[i] = &TopicOffsetStatistic{
+			Topic:       ss[i].Name,
+			Offset:      ss[i].Offset,
+			Expired:     ss[i].Expired,
+			Undelivered: ss[i].Undelivered,
+			Redelivered: ss[i].Redelivered,
+			LogSize:     ss[i].LogSize,
+			QueueDepth:  ss[i].QueueDepth,
+			Partitions:  make([]*PartitionOffsetStatistic, len(ss[i].Partitions)),
+		}
+		for j, p := range ss[i].Partitions {
+			form[i].Partitions[j] = &PartitionOffsetStatistic{
+				Partition:  p.Partition,
+				Offset:     p.Offset,
+				LogSize:    p.LogSize,
+				QueueDepth: p.QueueDepth,
+			}
+		}
 	}
 
 	return c.OKResponse(form)
@@ -99,8 +151,11 @@ type TopicRecordStatistic struct {
 	Topic       string `json:"topic" description:"名称"`
 	Key         string `json:"key"`
 	Value       string `json:"value" description:"base64编码后的消息体明文"`
-	Offset      uint64 `json:"offset" description:"消息偏移量"`
+	Offset      uint64 `json:"offset" description:"消息在其分区内的偏移量"`
+	Partition   int    `json:"partition" description:"消息所属的分区"`
 	ProductTime int64  `json:"product_time" description:"消息接收时间戳"`
+	// 消息头的值为base64编码后的明文
+	Headers map[string]string `json:"headers,omitempty" description:"消息头"`
 }
 
 func getTopicsMessage(c *fastapi.Context) *fastapi.Response {
@@ -112,10 +167,17 @@ func getTopicsMessage(c *fastapi.Context) *fastapi.Response {
 		cs[i] = &TopicRecordStatistic{
 			Topic:       string(record.Topic),
 			Offset:      record.Offset,
+			Partition:   record.Partition,
 			Key:         string(record.Key),
 			Value:       helper.Base64Encode(record.Value),
 			ProductTime: record.Time,
 		}
+		if len(record.Headers) > 0 {
+			cs[i].Headers = make(map[string]string, len(record.Headers))
+			for k, v := range record.Headers {
+				cs[i].Headers[k] = helper.Base64Encode(v)
+			}
+		}
 	}
 
 	return c.OKResponse(cs)
@@ -125,6 +187,8 @@ type TopicConsumerStatistic struct {
 	fastapi.BaseModel
 	Topic     string   `json:"topic" description:"名称"`
 	Consumers []string `json:"consumers" description:"消费者连接"`
+	// 每个消费者组内的消息仅推送给一个成员
+	Groups map[string][]string `json:"groups" description:"消费者组及其成员连接"`
 }
 
 func getTopicConsumer(c *fastapi.Context) *fastapi.Response {
@@ -134,7 +198,37 @@ func getTopicConsumer(c *fastapi.Context) *fastapi.Response {
 		cc[i] = &TopicConsumerStatistic{
 			Topic:     cs[i].Name,
 			Consumers: cs[i].Consumers,
+			Groups:    cs[i].Groups,
 		}
 	}
 	return c.OKResponse(cc)
 }
+
+type FrameErrorStatistic struct {
+	fastapi.BaseModel
+	Total     uint64 `json:"total" description:"损坏的帧总数"`
+	Head      uint64 `json:"head" description:"帧头错误"`
+	Tail      uint64 `json:"tail" description:"帧尾错误"`
+	Checksum  uint64 `json:"checksum" description:"校验和错误"`
+	Truncated uint64 `json:"truncated" description:"帧不完整"`
+	TooLarge  uint64 `json:"too_large" description:"帧载荷过长"`
+	Other     uint64 `json:"other" description:"其他错误"`
+}
+
+func (m *FrameErrorStatistic) SchemaDesc() string {
+	return "来自客户端的损坏消息帧计数, 损坏的帧会被丢弃并从下一个帧头处重新同步"
+}
+
+func getFrameParseErrors(c *fastapi.Context) *fastapi.Response {
+	fe := mq.Stat().FrameParseErrors()
+
+	return c.OKResponse(&FrameErrorStatistic{
+		Total:     fe.Total,
+		Head:      fe.Head,
+		Tail:      fe.Tail,
+		Checksum:  fe.Checksum,
+		Truncated: fe.Truncated,
+		TooLarge:  fe.TooLarge,
+		Other:     fe.Other,
+	})
+}
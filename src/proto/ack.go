@@ -0,0 +1,64 @@
+package proto
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Chendemo12/fastapi-tool/helper"
+	"io"
+)
+
+// ========================================== 确认消息协议定义 ==========================================
+
+// AckMessage 消费者确认已处理的消息, 依赖 AckCapability; 服务端不响应此消息,
+// 确认丢失时消息会在超时后被重新推送, 因此消费者须能处理重复的消息
+type AckMessage struct {
+	Acks    []*Acknowledgement `json:"acks"`
+	marshal MarshalMethodType  // 由所在帧决定的序列化方法
+}
+
+// Acknowledgement 一个已处理的消息, 以主题, 分区和分区内的偏移量唯一确定
+type Acknowledgement struct {
+	Topic     string `json:"topic"`
+	Partition uint16 `json:"partition"`
+	Offset    uint64 `json:"offset"`
+}
+
+func (m *AckMessage) String() string {
+	return fmt.Sprintf("<Message:%s> %d messages", descriptors[m.MessageType()].text, len(m.Acks))
+}
+
+func (m *AckMessage) MessageType() MessageType { return AckMessageType }
+
+func (m *AckMessage) MarshalMethod() MarshalMethodType {
+	if m.marshal == BinaryMarshalMethod {
+		return BinaryMarshalMethod
+	}
+	return JsonMarshalMethod
+}
+
+func (m *AckMessage) setMarshalMethod(method MarshalMethodType) { m.marshal = method }
+
+func (m *AckMessage) Reset() {
+	m.Acks = nil
+}
+
+func (m *AckMessage) parse(stream []byte) error {
+	if m.MarshalMethod() == BinaryMarshalMethod {
+		return m.parseBinary(bytes.NewReader(stream))
+	}
+	return helper.JsonUnmarshal(stream, m)
+}
+
+func (m *AckMessage) parseFrom(reader io.Reader) error {
+	if m.MarshalMethod() == BinaryMarshalMethod {
+		return m.parseBinary(reader)
+	}
+	return JsonMessageParseFrom(reader, m)
+}
+
+func (m *AckMessage) build() ([]byte, error) {
+	if m.MarshalMethod() == BinaryMarshalMethod {
+		return m.buildBinary()
+	}
+	return helper.JsonMarshal(m)
+}
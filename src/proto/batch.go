@@ -0,0 +1,95 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// ========================================== 批量生产者消息协议定义 ==========================================
+
+// BatchMessage 批量生产者消息, 可包含多个不同主题的生产者消息, 服务端以全部或全不的方式发布,
+// 并在 MessageResponse.Offsets 中按顺序返回每个消息的偏移量
+//
+//	编码结构：
+//		|   Num   |  PMessage  |  ...  |
+//		|---------|------------|-------|
+//	len	|    2    |      N     |  ...  |
+//
+// 其中 PMessage 的编码与 HPMessageType 一致, 即始终携带消息头
+type BatchMessage struct {
+	Messages []*PMessage
+	version  FrameVersion // 所属帧的版本, 决定 PMessage 内 ValueLen 的长度
+}
+
+func (m *BatchMessage) setFrameVersion(version FrameVersion) { m.version = version }
+
+func (m *BatchMessage) String() string {
+	return fmt.Sprintf(
+		"<Message:%s> with %d messages", descriptors[m.MessageType()].text, len(m.Messages),
+	)
+}
+
+func (m *BatchMessage) MessageType() MessageType { return BatchMessageType }
+
+func (m *BatchMessage) MarshalMethod() MarshalMethodType { return BinaryMarshalMethod }
+
+func (m *BatchMessage) Reset() {
+	m.Messages = nil
+	m.version = FrameV1
+}
+
+// Append 添加一个生产者消息
+func (m *BatchMessage) Append(pm *PMessage) *BatchMessage {
+	m.Messages = append(m.Messages, pm)
+	return m
+}
+
+func (m *BatchMessage) parse(stream []byte) error {
+	return m.parseFrom(bytes.NewReader(stream))
+}
+
+func (m *BatchMessage) parseFrom(reader io.Reader) error {
+	bc := bcPool.Get()
+	if err := readMessageField(reader, bc.twoByte, "num"); err != nil {
+		bcPool.Put(bc)
+		return err
+	}
+	num := bc.TwoValue()
+	bcPool.Put(bc)
+
+	m.Messages = make([]*PMessage, 0, num)
+	for i := 0; i < num; i++ {
+		pm := &PMessage{}
+		pm.Reset()
+		pm.setFrameVersion(m.version)
+		pm.setWithHeaders(true)
+		if err := pm.parseFrom(reader); err != nil {
+			return &FieldError{Field: fmt.Sprintf("messages[%d]", i), Err: err}
+		}
+		m.Messages = append(m.Messages, pm)
+	}
+
+	return nil
+}
+
+func (m *BatchMessage) build() ([]byte, error) {
+	if len(m.Messages) > math.MaxUint16 {
+		return nil, &FieldError{Field: "num", Err: ErrFieldTooLong}
+	}
+
+	slice := binary.BigEndian.AppendUint16(make([]byte, 0, 64), uint16(len(m.Messages)))
+	for i, pm := range m.Messages {
+		pm.setFrameVersion(m.version)
+		pm.setWithHeaders(true)
+		_bytes, err := pm.build()
+		if err != nil {
+			return nil, &FieldError{Field: fmt.Sprintf("messages[%d]", i), Err: err}
+		}
+		slice = append(slice, _bytes...)
+	}
+
+	return slice, nil
+}
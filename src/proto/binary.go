@@ -0,0 +1,633 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// 控制消息的二进制编码
+//
+// RegisterMessage, SubscribeMessage, AckMessage, HeartbeatMessage 和 MessageResponse 默认采用 JsonMarshalMethod,
+// 当 FrameV2 帧设置了 FlagBinaryMarshal 时则采用紧凑的二进制编码, 字符串列表均编码为:
+//
+//	|   Num   |   Len   |   String   |  ...  |
+//	|---------|---------|------------|-------|
+//	|    1    |    1    |  N bytes   |  ...  |
+
+// 可选择序列化方法的消息
+type marshalMessage interface {
+	setMarshalMethod(method MarshalMethodType)
+}
+
+// 将帧所采用的序列化方法传递给消息
+func setMessageMarshal(m Message, method MarshalMethodType) {
+	if mm, ok := m.(marshalMessage); ok {
+		mm.setMarshalMethod(method)
+	}
+}
+
+// 二进制编码时 LinkType 和 AckType 的代码即为其在表中的索引
+var (
+	linkTypeCodes = []LinkType{"", ConsumerLinkType, ProducerLinkType}
+	ackTypeCodes  = []AckType{"", NoConfirm, LeaderConfirm, AllConfirm}
+	positionCodes = []StartPositionType{StartLatest, StartEarliest, StartOffset, StartTimestamp}
+	balanceCodes  = []BalanceType{"", RoundRobinBalance, KeyHashBalance}
+)
+
+func indexOf[T comparable](table []T, v T, field string) (byte, error) {
+	for i, t := range table {
+		if t == v {
+			return byte(i), nil
+		}
+	}
+	return 0, &FieldError{Field: field, Err: ErrFieldValueInvalid}
+}
+
+func valueOf[T any](table []T, code byte, field string) (T, error) {
+	if int(code) >= len(table) {
+		var zero T
+		return zero, &FieldError{Field: field, Err: ErrFieldValueInvalid}
+	}
+	return table[code], nil
+}
+
+func appendShortString(slice []byte, s string, field string) ([]byte, error) {
+	if len(s) > math.MaxUint8 {
+		return nil, &FieldError{Field: field, Err: ErrFieldTooLong}
+	}
+	slice = append(slice, byte(len(s)))
+	return append(slice, s...), nil
+}
+
+func appendShortStrings[T ~string](slice []byte, ss []T, field string) ([]byte, error) {
+	if len(ss) > math.MaxUint8 {
+		return nil, &FieldError{Field: field, Err: ErrFieldTooLong}
+	}
+
+	var err error
+	slice = append(slice, byte(len(ss)))
+	for _, s := range ss {
+		if slice, err = appendShortString(slice, string(s), field); err != nil {
+			return nil, err
+		}
+	}
+	return slice, nil
+}
+
+func readShortString(reader io.Reader, bc *bytesCache, field string) (string, error) {
+	if err := readMessageField(reader, bc.oneByte, field); err != nil {
+		return "", err
+	}
+	_bytes, err := readMessageBytes(reader, bc.OneValue(), field)
+	return string(_bytes), err
+}
+
+func readShortStrings[T ~string](reader io.Reader, bc *bytesCache, field string) ([]T, error) {
+	if err := readMessageField(reader, bc.oneByte, field); err != nil {
+		return nil, err
+	}
+
+	num := bc.OneValue()
+	if num == 0 {
+		return nil, nil
+	}
+	ss := make([]T, 0, num)
+	for i := 0; i < num; i++ {
+		s, err := readShortString(reader, bc, field)
+		if err != nil {
+			return nil, err
+		}
+		ss = append(ss, T(s))
+	}
+	return ss, nil
+}
+
+func readUint64(reader io.Reader, bc *bytesCache, field string) (uint64, error) {
+	if err := readMessageField(reader, bc.eightByte, field); err != nil {
+		return 0, err
+	}
+	return bc.EightValue(), nil
+}
+
+// ========================================== RegisterMessage ==========================================
+
+// |  Type  |  Ack  |  Version  |  Token  |  Topics  |  Capabilities  |  Positions  |  Group  |  Balance  |  Offsets  |  ID  |
+// |--------|-------|-----------|---------|----------|----------------|-------------|---------|-----------|-----------|------|
+// |   1    |   1   |     1     |    N    |     N    |        N       |      N      |    N    |     1     |     N     |   N  |
+//
+// Positions 编码为: num(1) | [topic | type(1) | value(8)]*, 按主题名称排序;
+// Offsets 为各起始位置内的分区偏移量: num(1) | [topic | num(1) | [partition(2) | offset(8)]*]*, 按主题名称和分区排序;
+// 未设置 ID 时 ID 可省略, 若同时未设置 Offsets, 则 Offsets 亦可省略, 若同时未设置 Group, 则 Group 和 Balance 亦可省略, 依此类推
+func (m *RegisterMessage) buildBinary() ([]byte, error) {
+	typ, err := indexOf(linkTypeCodes, m.Type, "type")
+	if err != nil {
+		return nil, err
+	}
+	ack, err := indexOf(ackTypeCodes, m.Ack, "ack")
+	if err != nil {
+		return nil, err
+	}
+	if m.Version < 0 || m.Version > math.MaxUint8 {
+		return nil, &FieldError{Field: "version", Err: ErrFieldValueInvalid}
+	}
+
+	slice := make([]byte, 0, 64)
+	slice = append(slice, typ, ack, byte(m.Version))
+	if slice, err = appendShortString(slice, m.Token, "token"); err != nil {
+		return nil, err
+	}
+	if slice, err = appendShortStrings(slice, m.Topics, "topics"); err != nil {
+		return nil, err
+	}
+
+	if slice, err = appendShortStrings(slice, m.Capabilities, "capabilities"); err != nil {
+		return nil, err
+	}
+	if len(m.Positions) == 0 && m.Group == "" && m.ID == "" { // 省略起始位置和消费者组, 以兼容旧版本的解析
+		return slice, nil
+	}
+	if slice, err = appendPositions(slice, m.Positions); err != nil {
+		return nil, err
+	}
+	if m.Group == "" && !hasPositionOffsets(m.Positions) && m.ID == "" {
+		return slice, nil
+	}
+
+	balance, err := indexOf(balanceCodes, m.Balance, "balance")
+	if err != nil {
+		return nil, err
+	}
+	if slice, err = appendShortString(slice, m.Group, "group"); err != nil {
+		return nil, err
+	}
+	slice = append(slice, balance)
+	if !hasPositionOffsets(m.Positions) && m.ID == "" {
+		return slice, nil
+	}
+
+	if slice, err = appendPositionOffsets(slice, m.Positions); err != nil {
+		return nil, err
+	}
+	if m.ID == "" {
+		return slice, nil
+	}
+
+	return appendShortString(slice, m.ID, "id")
+}
+
+func (m *RegisterMessage) parseBinary(reader io.Reader) error {
+	bc := bcPool.Get()
+	defer bcPool.Put(bc)
+
+	var err error
+	if err = readMessageField(reader, bc.threeByte, "type"); err != nil {
+		return err
+	}
+	if m.Type, err = valueOf(linkTypeCodes, bc.threeByte[0], "type"); err != nil {
+		return err
+	}
+	if m.Ack, err = valueOf(ackTypeCodes, bc.threeByte[1], "ack"); err != nil {
+		return err
+	}
+	m.Version = int(bc.threeByte[2])
+
+	if m.Token, err = readShortString(reader, bc, "token"); err != nil {
+		return err
+	}
+	if m.Topics, err = readShortStrings[string](reader, bc, "topics"); err != nil {
+		return err
+	}
+	if m.Capabilities, err = readShortStrings[Capability](reader, bc, "capabilities"); err != nil {
+		return err
+	}
+
+	// 起始位置可省略
+	if err = readMessageField(reader, bc.oneByte, "positions"); err != nil {
+		if errors.Is(err, ErrMessageTruncated) {
+			return nil
+		}
+		return err
+	}
+	if m.Positions, err = readPositions(reader, bc, bc.OneValue()); err != nil {
+		return err
+	}
+
+	// 消费者组可省略
+	if m.Group, err = readShortString(reader, bc, "group"); err != nil {
+		if errors.Is(err, ErrMessageTruncated) {
+			return nil
+		}
+		return err
+	}
+	if err = readMessageField(reader, bc.oneByte, "balance"); err != nil {
+		return err
+	}
+	if m.Balance, err = valueOf(balanceCodes, bc.oneByte[0], "balance"); err != nil {
+		return err
+	}
+
+	// 分区偏移量可省略
+	if err = readMessageField(reader, bc.oneByte, "offsets"); err != nil {
+		if errors.Is(err, ErrMessageTruncated) {
+			return nil
+		}
+		return err
+	}
+	if err = readPositionOffsets(reader, bc, m.Positions, bc.OneValue()); err != nil {
+		return err
+	}
+
+	// 消费者ID可省略
+	if m.ID, err = readShortString(reader, bc, "id"); err != nil {
+		if errors.Is(err, ErrMessageTruncated) {
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+// 编码起始位置: num(1) | [topic | type(1) | value(8)]*, 按主题名称排序
+func appendPositions(slice []byte, positions map[string]*StartPosition) ([]byte, error) {
+	if len(positions) > math.MaxUint8 {
+		return nil, &FieldError{Field: "positions", Err: ErrFieldTooLong}
+	}
+
+	slice = append(slice, byte(len(positions)))
+	for _, topic := range sortedKeys(positions) {
+		pos := positions[topic]
+		if pos == nil {
+			pos = &StartPosition{Type: StartLatest}
+		}
+		code, err := indexOf(positionCodes, pos.Type, "positions")
+		if err != nil {
+			return nil, err
+		}
+		if slice, err = appendShortString(slice, topic, "positions"); err != nil {
+			return nil, err
+		}
+		slice = append(slice, code)
+		slice = binary.BigEndian.AppendUint64(slice, pos.Value)
+	}
+
+	return slice, nil
+}
+
+// 起始位置内是否存在分区偏移量
+func hasPositionOffsets(positions map[string]*StartPosition) bool {
+	for _, pos := range positions {
+		if pos != nil && len(pos.Offsets) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// 编码起始位置内的分区偏移量: num(1) | [topic | num(1) | [partition(2) | offset(8)]*]*, 按主题名称和分区排序;
+// 须在 appendPositions 之后调用, 主题名称的长度已在其中检查过
+func appendPositionOffsets(slice []byte, positions map[string]*StartPosition) ([]byte, error) {
+	topics := make([]string, 0)
+	for _, topic := range sortedKeys(positions) {
+		if pos := positions[topic]; pos != nil && len(pos.Offsets) > 0 {
+			topics = append(topics, topic)
+		}
+	}
+
+	slice = append(slice, byte(len(topics)))
+	for _, topic := range topics {
+		pos := positions[topic]
+		if len(pos.Offsets) > math.MaxUint8 {
+			return nil, &FieldError{Field: "offsets", Err: ErrFieldTooLong}
+		}
+		partitions := make([]uint16, 0, len(pos.Offsets))
+		for partition := range pos.Offsets {
+			partitions = append(partitions, partition)
+		}
+		sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+
+		slice, _ = appendShortString(slice, topic, "offsets")
+		slice = append(slice, byte(len(partitions)))
+		for _, partition := range partitions {
+			slice = binary.BigEndian.AppendUint16(slice, partition)
+			slice = binary.BigEndian.AppendUint64(slice, pos.Offsets[partition])
+		}
+	}
+
+	return slice, nil
+}
+
+// 解析 num 个起始位置, num 为0时返回nil
+func readPositions(reader io.Reader, bc *bytesCache, num int) (map[string]*StartPosition, error) {
+	if num == 0 {
+		return nil, nil
+	}
+
+	positions := make(map[string]*StartPosition, num)
+	for i := 0; i < num; i++ {
+		topic, err := readShortString(reader, bc, "positions")
+		if err != nil {
+			return nil, err
+		}
+		if err = readMessageField(reader, bc.oneByte, "positions"); err != nil {
+			return nil, err
+		}
+		pos := &StartPosition{}
+		if pos.Type, err = valueOf(positionCodes, bc.oneByte[0], "positions"); err != nil {
+			return nil, err
+		}
+		if pos.Value, err = readUint64(reader, bc, "positions"); err != nil {
+			return nil, err
+		}
+		positions[topic] = pos
+	}
+
+	return positions, nil
+}
+
+// 解析 num 个主题的分区偏移量, 并设置到同名主题的起始位置中, 未设置起始位置的主题被忽略
+func readPositionOffsets(reader io.Reader, bc *bytesCache, positions map[string]*StartPosition, num int) error {
+	for i := 0; i < num; i++ {
+		topic, err := readShortString(reader, bc, "offsets")
+		if err != nil {
+			return err
+		}
+		if err = readMessageField(reader, bc.oneByte, "offsets"); err != nil {
+			return err
+		}
+		count := bc.OneValue()
+		offsets := make(map[uint16]uint64, count)
+		for j := 0; j < count; j++ {
+			if err = readMessageField(reader, bc.twoByte, "offsets"); err != nil {
+				return err
+			}
+			partition := binary.BigEndian.Uint16(bc.twoByte)
+			if offsets[partition], err = readUint64(reader, bc, "offsets"); err != nil {
+				return err
+			}
+		}
+		if pos, ok := positions[topic]; ok {
+			pos.Offsets = offsets
+		}
+	}
+
+	return nil
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ========================================== SubscribeMessage ==========================================
+
+// |  Topics  |  Positions  |  Offsets  |
+// |----------|-------------|-----------|
+// |     N    |      N      |     N     |
+//
+// Positions 和 Offsets 的编码与 RegisterMessage 一致, 未设置起始位置时二者均可省略
+func (m *SubscribeMessage) buildBinary() ([]byte, error) {
+	slice, err := appendShortStrings(make([]byte, 0, 32), m.Topics, "topics")
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Positions) == 0 {
+		return slice, nil
+	}
+	if slice, err = appendPositions(slice, m.Positions); err != nil {
+		return nil, err
+	}
+
+	return appendPositionOffsets(slice, m.Positions)
+}
+
+func (m *SubscribeMessage) parseBinary(reader io.Reader) error {
+	bc := bcPool.Get()
+	defer bcPool.Put(bc)
+
+	var err error
+	if m.Topics, err = readShortStrings[string](reader, bc, "topics"); err != nil {
+		return err
+	}
+
+	// 起始位置可省略
+	if err = readMessageField(reader, bc.oneByte, "positions"); err != nil {
+		if errors.Is(err, ErrMessageTruncated) {
+			return nil
+		}
+		return err
+	}
+	if m.Positions, err = readPositions(reader, bc, bc.OneValue()); err != nil {
+		return err
+	}
+	if err = readMessageField(reader, bc.oneByte, "offsets"); err != nil {
+		return err
+	}
+
+	return readPositionOffsets(reader, bc, m.Positions, bc.OneValue())
+}
+
+// ========================================== AckMessage ==========================================
+
+// |  Num  |  Topic  |  Partition  |  Offset  |  ...  |
+// |-------|---------|-------------|----------|-------|
+// |   2   |    N    |      2      |     8    |  ...  |
+func (m *AckMessage) buildBinary() ([]byte, error) {
+	if len(m.Acks) > math.MaxUint16 {
+		return nil, &FieldError{Field: "acks", Err: ErrFieldTooLong}
+	}
+
+	slice := make([]byte, 0, 2+len(m.Acks)*24)
+	slice = binary.BigEndian.AppendUint16(slice, uint16(len(m.Acks)))
+	var err error
+	for _, ack := range m.Acks {
+		if slice, err = appendShortString(slice, ack.Topic, "acks"); err != nil {
+			return nil, err
+		}
+		slice = binary.BigEndian.AppendUint16(slice, ack.Partition)
+		slice = binary.BigEndian.AppendUint64(slice, ack.Offset)
+	}
+
+	return slice, nil
+}
+
+func (m *AckMessage) parseBinary(reader io.Reader) error {
+	bc := bcPool.Get()
+	defer bcPool.Put(bc)
+
+	if err := readMessageField(reader, bc.twoByte, "acks"); err != nil {
+		return err
+	}
+	num := int(binary.BigEndian.Uint16(bc.twoByte))
+	m.Acks = make([]*Acknowledgement, 0, num)
+	for i := 0; i < num; i++ {
+		ack := &Acknowledgement{}
+		var err error
+		if ack.Topic, err = readShortString(reader, bc, "acks"); err != nil {
+			return err
+		}
+		if err = readMessageField(reader, bc.twoByte, "acks"); err != nil {
+			return err
+		}
+		ack.Partition = binary.BigEndian.Uint16(bc.twoByte)
+		if ack.Offset, err = readUint64(reader, bc, "acks"); err != nil {
+			return err
+		}
+		m.Acks = append(m.Acks, ack)
+	}
+
+	return nil
+}
+
+// ========================================== HeartbeatMessage ==========================================
+
+// |  Type  |  CreatedAt  |
+// |--------|-------------|
+// |   1    |      8      |
+func (m *HeartbeatMessage) buildBinary() ([]byte, error) {
+	typ, err := indexOf(linkTypeCodes, m.Type, "type")
+	if err != nil {
+		return nil, err
+	}
+
+	slice := make([]byte, 0, 9)
+	slice = append(slice, typ)
+	return binary.BigEndian.AppendUint64(slice, uint64(m.CreatedAt)), nil
+}
+
+func (m *HeartbeatMessage) parseBinary(reader io.Reader) error {
+	bc := bcPool.Get()
+	defer bcPool.Put(bc)
+
+	var err error
+	if err = readMessageField(reader, bc.oneByte, "type"); err != nil {
+		return err
+	}
+	if m.Type, err = valueOf(linkTypeCodes, bc.oneByte[0], "type"); err != nil {
+		return err
+	}
+
+	createdAt, err := readUint64(reader, bc, "created at")
+	m.CreatedAt = int64(createdAt)
+
+	return err
+}
+
+// ========================================== MessageResponse ==========================================
+
+// |  Status  |  Offset  |  ReceiveTime  |  TickerInterval  |  Keepalive  |  Version  |  Capabilities  |  Offsets  |  Sequence  |
+// |----------|----------|---------------|------------------|-------------|-----------|----------------|-----------|------------|
+// |    1     |    8     |       8       |        4         |      8      |     1     |        N       |     N     |      8     |
+//
+// Status 为其十进制数值, Keepalive 为 float64 的 IEEE 754 编码;
+// 未设置 Sequence 时 Sequence 可省略, 若同时未设置 Offsets, 则 Offsets 亦可省略
+func (m *MessageResponse) buildBinary() ([]byte, error) {
+	status, err := strconv.ParseUint(string(m.Status), 10, 8)
+	if err != nil {
+		return nil, &FieldError{Field: "status", Err: ErrFieldValueInvalid}
+	}
+	if m.TickerInterval < 0 || m.TickerInterval > math.MaxUint32 {
+		return nil, &FieldError{Field: "ticker interval", Err: ErrFieldValueInvalid}
+	}
+	if m.Version < 0 || m.Version > math.MaxUint8 {
+		return nil, &FieldError{Field: "version", Err: ErrFieldValueInvalid}
+	}
+
+	slice := make([]byte, 0, 32)
+	slice = append(slice, byte(status))
+	slice = binary.BigEndian.AppendUint64(slice, m.Offset)
+	slice = binary.BigEndian.AppendUint64(slice, uint64(m.ReceiveTime))
+	slice = binary.BigEndian.AppendUint32(slice, uint32(m.TickerInterval))
+	slice = binary.BigEndian.AppendUint64(slice, math.Float64bits(m.Keepalive))
+	slice = append(slice, byte(m.Version))
+
+	if slice, err = appendShortStrings(slice, m.Capabilities, "capabilities"); err != nil {
+		return nil, err
+	}
+	if len(m.Offsets) == 0 && m.Sequence == 0 { // 省略偏移量列表和序列号, 以兼容旧版本的解析
+		return slice, nil
+	}
+	if len(m.Offsets) > math.MaxUint16 {
+		return nil, &FieldError{Field: "offsets", Err: ErrFieldTooLong}
+	}
+	slice = binary.BigEndian.AppendUint16(slice, uint16(len(m.Offsets)))
+	for _, offset := range m.Offsets {
+		slice = binary.BigEndian.AppendUint64(slice, offset)
+	}
+	if m.Sequence == 0 {
+		return slice, nil
+	}
+
+	return binary.BigEndian.AppendUint64(slice, m.Sequence), nil
+}
+
+func (m *MessageResponse) parseBinary(reader io.Reader) error {
+	bc := bcPool.Get()
+	defer bcPool.Put(bc)
+
+	var err error
+	var v uint64
+
+	if err = readMessageField(reader, bc.oneByte, "status"); err != nil {
+		return err
+	}
+	m.Status = MessageResponseStatus(strconv.Itoa(bc.OneValue()))
+
+	if m.Offset, err = readUint64(reader, bc, "offset"); err != nil {
+		return err
+	}
+	if v, err = readUint64(reader, bc, "receive time"); err != nil {
+		return err
+	}
+	m.ReceiveTime = int64(v)
+
+	if err = readMessageField(reader, bc.fourByte, "ticker interval"); err != nil {
+		return err
+	}
+	m.TickerInterval = int(bc.FourValue())
+
+	if v, err = readUint64(reader, bc, "keepalive"); err != nil {
+		return err
+	}
+	m.Keepalive = math.Float64frombits(v)
+
+	if err = readMessageField(reader, bc.oneByte, "version"); err != nil {
+		return err
+	}
+	m.Version = bc.OneValue()
+
+	if m.Capabilities, err = readShortStrings[Capability](reader, bc, "capabilities"); err != nil {
+		return err
+	}
+
+	// 偏移量列表可省略
+	if err = readMessageField(reader, bc.twoByte, "offsets"); err != nil {
+		if errors.Is(err, ErrMessageTruncated) {
+			return nil
+		}
+		return err
+	}
+	if num := bc.TwoValue(); num > 0 {
+		m.Offsets = make([]uint64, num)
+		for i := 0; i < num; i++ {
+			if m.Offsets[i], err = readUint64(reader, bc, "offsets"); err != nil {
+				return err
+			}
+		}
+	}
+
+	// 序列号可省略
+	if m.Sequence, err = readUint64(reader, bc, "sequence"); err != nil && errors.Is(err, ErrMessageTruncated) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,160 @@
+package proto
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"strings"
+)
+
+// CompressCode 压缩算法编号, 写入压缩后载荷的首字节, 接收方据此选择解压算法
+type CompressCode byte
+
+const (
+	NoCompressCode      CompressCode = 0
+	GzipCompressCode    CompressCode = 1
+	DeflateCompressCode CompressCode = 2
+)
+
+// MinCompressSize 载荷长度小于此值时不进行压缩
+var MinCompressSize = 128
+
+// Compressor 压缩支持, 压缩发生在加密之前, 解压发生在解密之后
+// 仅 FrameV2 帧可以携带压缩标志, 因此对于 FrameV1 帧不会进行压缩
+type Compressor interface {
+	Code() CompressCode                       // 算法编号, 同一编号的压缩器必须能互相解压
+	Compress(stream []byte) ([]byte, error)   // 压缩数据体
+	Decompress(stream []byte) ([]byte, error) // 解压数据体
+	String() string                           // 名称描述等
+}
+
+// DefaultCompressor 默认的压缩器，就是不压缩
+func DefaultCompressor() Compressor { return &NoCompressor{} }
+
+// NoCompressor 不压缩
+type NoCompressor struct{}
+
+func (c NoCompressor) Code() CompressCode { return NoCompressCode }
+
+func (c NoCompressor) Compress(stream []byte) ([]byte, error) { return stream, nil }
+
+func (c NoCompressor) Decompress(stream []byte) ([]byte, error) { return stream, nil }
+
+func (c NoCompressor) String() string { return "NoCompressor" }
+
+// GzipCompressor gzip 压缩器
+type GzipCompressor struct {
+	Level int `json:"level"` // 压缩等级, 0 则为 gzip.DefaultCompression
+}
+
+func (c GzipCompressor) Code() CompressCode { return GzipCompressCode }
+
+func (c GzipCompressor) Compress(stream []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := gzip.NewWriterLevel(buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(stream); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c GzipCompressor) Decompress(stream []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(stream))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return readAllLimited(r)
+}
+
+func (c GzipCompressor) String() string { return "GzipCompressor" }
+
+// DeflateCompressor deflate 压缩器, 相比于 gzip 没有额外的头部和校验信息
+type DeflateCompressor struct {
+	Level int `json:"level"` // 压缩等级, 0 则为 flate.DefaultCompression
+}
+
+func (c DeflateCompressor) Code() CompressCode { return DeflateCompressCode }
+
+func (c DeflateCompressor) Compress(stream []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := flate.NewWriter(buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(stream); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c DeflateCompressor) Decompress(stream []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(stream))
+	defer r.Close()
+
+	return readAllLimited(r)
+}
+
+func (c DeflateCompressor) String() string { return "DeflateCompressor" }
+
+// 全局压缩器表, 接收方依据算法编号选择解压器
+var compressors = map[CompressCode]Compressor{
+	NoCompressCode:      &NoCompressor{},
+	GzipCompressCode:    &GzipCompressor{},
+	DeflateCompressCode: &DeflateCompressor{},
+}
+
+// RegisterCompressor 添加一个自定义的压缩器, 对于已经存在的算法编号则不允许修改
+// 收发双方需注册相同的压缩器, 且必须在启动之前注册
+func RegisterCompressor(c Compressor) bool {
+	if _, ok := compressors[c.Code()]; ok {
+		return false
+	}
+	compressors[c.Code()] = c
+	return true
+}
+
+// GetCompressor 依据算法编号获取压缩器, 若未注册则返回nil
+func GetCompressor(code CompressCode) Compressor { return compressors[code] }
+
+// CreateCompressor 设置压缩方案
+//
+//	@param	option	string	压缩方案, 支持gzip/deflate/no
+//	@param	level 	[]int	压缩等级
+func CreateCompressor(option string, level ...int) Compressor {
+	lv := 0
+	if len(level) > 0 {
+		lv = level[0]
+	}
+
+	switch strings.ToUpper(option) {
+	case "GZIP":
+		return &GzipCompressor{Level: lv}
+	case "DEFLATE":
+		return &DeflateCompressor{Level: lv}
+	default:
+		return DefaultCompressor()
+	}
+}
@@ -1,8 +1,12 @@
 package proto
 
-import "errors"
+import (
+	"errors"
+	"math"
+)
 
-const FrameMinLength int = 7
+const FrameMinLength int = 7    // v1 帧的最小长度, 同时也是全部版本中最短的帧
+const FrameV2MinLength int = 12 // v2 帧的最小长度
 const TotalNumberOfMessages int = 256
 
 const (
@@ -10,6 +14,52 @@ const (
 	FrameTail = 0x0D // 0x0D (回车符)
 )
 
+// FrameVersion 帧格式版本, 每一个连接在注册时确定其使用的帧版本
+type FrameVersion byte
+
+const (
+	FrameVersionAuto FrameVersion = 0 // 依据收到的第一个帧自动识别版本, 仅用于解析
+	FrameV1          FrameVersion = 1 // 2字节长度, 2字节经典校验和
+	FrameV2          FrameVersion = 2 // 版本号, 标志位, 4字节长度, 4字节校验和
+)
+
+func (v FrameVersion) String() string {
+	switch v {
+	case FrameV1:
+		return "v1"
+	case FrameV2:
+		return "v2"
+	}
+	return "auto"
+}
+
+// MaxDataSize 此版本的帧所能承载的最大载荷长度
+func (v FrameVersion) MaxDataSize() uint64 {
+	if v == FrameV2 {
+		return math.MaxUint32
+	}
+	return math.MaxUint16
+}
+
+// MaxFrameLength 解析此版本的帧时所允许的最大帧长度, v2 帧的载荷受 MaxFrameDataSize 限制;
+// FrameVersionAuto 尚未确定版本, 以 FrameV2 为准
+func (v FrameVersion) MaxFrameLength() int {
+	if v == FrameV1 {
+		return int(v.MaxDataSize()) + FrameMinLength
+	}
+	return int(MaxFrameDataSize) + FrameV2MinLength
+}
+
+// FrameFlag v2 帧的标志位
+type FrameFlag byte
+
+const (
+	FlagCRC32C        FrameFlag = 1 << 0 // 校验和采用 CRC32C, 否则为 CalcChecksum
+	FlagCompressed    FrameFlag = 1 << 1 // 载荷已压缩, 解密后的首字节为 CompressCode
+	FlagBinaryMarshal FrameFlag = 1 << 2 // 控制消息采用二进制编码, 否则为 JSON
+	FlagPartition     FrameFlag = 1 << 3 // 消费者消息在 ProductTime 之后携带2字节的分区号
+)
+
 type MarshalMethodType string
 
 const (
@@ -32,6 +82,131 @@ const (
 	ProducerLinkType LinkType = "PRODUCER"
 )
 
+// ProtocolVersion 当前实现的协议版本, 未声明协议版本的客户端视为 LegacyProtocolVersion
+const (
+	LegacyProtocolVersion = 1
+	ProtocolVersion       = 2
+)
+
+// Capability 客户端与服务端可选的协议能力, 在注册时协商确定
+type Capability string
+
+const (
+	FrameV2Capability       Capability = "frame-v2"       // 支持 FrameV2 帧格式
+	HeadersCapability       Capability = "headers"        // 支持携带消息头的 HPMessageType 和 HCMessageType
+	CompressionCapability   Capability = "compression"    // 支持解压 FlagCompressed 帧, 仅对 FrameV2 有效
+	BinaryMarshalCapability Capability = "binary-marshal" // 支持 FlagBinaryMarshal 帧内二进制编码的控制消息
+	RequestReplyCapability  Capability = "request-reply"  // 支持请求/回复, 依赖 HeadersCapability
+	IdempotenceCapability   Capability = "idempotence"    // 支持依据生产者ID和序列号去除重复消息, 依赖 HeadersCapability
+	BatchCapability         Capability = "batch"          // 支持 BatchMessageType 批量消息
+	ReplayCapability        Capability = "replay"         // 支持在注册时指定各主题的起始位置, 服务端先推送保留的历史消息
+	GroupCapability         Capability = "group"          // 支持消费者组, 组内的每个消息仅推送给一个成员
+	PartitionCapability     Capability = "partition"      // 支持 FlagPartition 帧内携带分区号的消费者消息, 仅对 FrameV2 有效
+	WildcardCapability      Capability = "wildcard"       // 支持以通配符模式订阅主题, 见 IsTopicPattern
+	SubscribeCapability     Capability = "subscribe"      // 支持在已注册的连接上订阅和取消订阅主题
+	AckCapability           Capability = "ack"            // 支持 AckMessageType 确认消息, 未确认的消息会被重新推送, 依赖 HeadersCapability
+)
+
+// 请求/回复所使用的消息头, 携带 CorrelationIDHeader 的生产者消息即为请求
+const (
+	CorrelationIDHeader = "x-correlation-id" // 请求的关联ID, 由请求方生成, 回复时原样带回
+	ReplyToHeader       = "x-reply-to"       // 回复主题, 由服务端依据请求方的连接设置, 请求方设置的值会被覆盖
+)
+
+// 幂等生产者所使用的消息头, 同一生产者ID下序列号已发布过的消息被视为重复消息
+const (
+	ProducerIDHeader = "x-producer-id" // 生产者ID, 由生产者生成, 在重连后保持不变
+	SequenceHeader   = "x-sequence"    // 消息的序列号, 十进制数值, 同一生产者ID下单调递增
+)
+
+// TTLHeader 消息的存活时间, 十进制的毫秒数, 自服务端收到消息时起算, 过期的消息不再推送给消费者
+const TTLHeader = "x-ttl"
+
+// DeliverAtHeader 消息的投递时间, 十进制的Unix毫秒时间戳, 未到达此时间的消息由服务端暂存, 到期后再推送给消费者
+const DeliverAtHeader = "x-deliver-at"
+
+// RedeliveryHeader 消息被重新推送的次数, 十进制数值, 由服务端在重新推送未确认的消息时设置, 首次推送时不携带
+const RedeliveryHeader = "x-redelivery-count"
+
+// PriorityHeader 消息的优先级, MessagePriority 的十进制数值, 未设置时为 PriorityNormal
+const PriorityHeader = "x-priority"
+
+// MessagePriority 消息优先级, 主题内高优先级的消息先于低优先级的消息推送给消费者
+type MessagePriority uint8
+
+const (
+	PriorityLow    MessagePriority = 0
+	PriorityNormal MessagePriority = 1
+	PriorityHigh   MessagePriority = 2
+)
+
+// NumberOfPriorities 优先级的数量, 即主题内优先级通道的数量
+const NumberOfPriorities = int(PriorityHigh) + 1
+
+func (p MessagePriority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "unknown"
+	}
+}
+
+// Capabilities 能力集合
+type Capabilities []Capability
+
+// Has 是否包含某项能力
+func (c Capabilities) Has(capability Capability) bool {
+	for _, v := range c {
+		if v == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Intersect 求双方均支持的能力集合, 顺序与 c 保持一致
+func (c Capabilities) Intersect(other Capabilities) Capabilities {
+	agreed := make(Capabilities, 0, len(c))
+	for _, v := range c {
+		if other.Has(v) && !agreed.Has(v) {
+			agreed = append(agreed, v)
+		}
+	}
+	return agreed
+}
+
+// DefaultCapabilities 当前实现所支持的全部能力
+func DefaultCapabilities() Capabilities {
+	return Capabilities{
+		FrameV2Capability, HeadersCapability, CompressionCapability, BinaryMarshalCapability, RequestReplyCapability,
+		IdempotenceCapability, BatchCapability, ReplayCapability, GroupCapability, PartitionCapability,
+		WildcardCapability, SubscribeCapability, AckCapability,
+	}
+}
+
+// StartPositionType 消费者在主题内开始消费的位置
+type StartPositionType string
+
+const (
+	StartLatest    StartPositionType = "latest"    // 仅消费注册之后发布的消息, 缺省值
+	StartEarliest  StartPositionType = "earliest"  // 自保留的最早的消息开始消费
+	StartOffset    StartPositionType = "offset"    // 自指定的偏移量开始消费
+	StartTimestamp StartPositionType = "timestamp" // 自指定的Unix毫秒时间戳之后发布的消息开始消费
+)
+
+// BalanceType 消费者组内分配消息的方式
+type BalanceType string
+
+const (
+	RoundRobinBalance BalanceType = "round-robin" // 依次分配给组内的各个成员, 缺省值
+	KeyHashBalance    BalanceType = "key-hash"    // 依据消息键的哈希值分配, 成员不变时相同键的消息总是分配给同一成员, 无键的消息依次分配
+)
+
 type MessageResponseStatus string
 
 const (
@@ -39,6 +214,7 @@ const (
 	RefusedStatus        MessageResponseStatus = "1"
 	TokenIncorrectStatus MessageResponseStatus = "10" // 密钥不正确
 	ReRegisterStatus     MessageResponseStatus = "11" // 令客户端重新发起注册流程, 无消息体
+	SchemaInvalidStatus  MessageResponseStatus = "12" // 消息体不符合主题的模式定义, 消息被拒绝
 )
 
 func GetMessageResponseStatusText(status MessageResponseStatus) string {
@@ -49,6 +225,8 @@ func GetMessageResponseStatusText(status MessageResponseStatus) string {
 		return "TokenIncorrect"
 	case ReRegisterStatus:
 		return "Let-ReRegister"
+	case SchemaInvalidStatus:
+		return "SchemaInvalid"
 	}
 
 	return "Refused"
@@ -58,4 +236,19 @@ var (
 	ErrMethodNotImplemented   = errors.New("method not implemented")
 	ErrMessageNotFull         = errors.New("message is not full")
 	ErrMessageSplitNotAllowed = errors.New("split is not allowed")
+	ErrFrameTooLarge          = errors.New("frame payload exceeds the limit of frame version")
+	ErrFieldTooLong           = errors.New("message field exceeds the length limit")
+	ErrFieldValueInvalid      = errors.New("message field value is invalid")
+	ErrFrameHeadInvalid       = errors.New("frame head is invalid")
+	ErrFrameVersionInvalid    = errors.New("frame version is invalid")
+	ErrFrameTailInvalid       = errors.New("frame tail is invalid")
+	ErrFrameChecksumMismatch  = errors.New("frame checksum mismatch")
+	ErrFrameTruncated         = errors.New("frame is truncated")
+	ErrFrameIncomplete        = errors.New("frame is incomplete, wait for more data")
+	ErrMessageTruncated       = errors.New("message is truncated")
+	ErrMessageTypeMismatch    = errors.New("message type mismatch")
+	ErrCompressorNotFound     = errors.New("compressor not found")
+	ErrCryptoPlanUnknown      = errors.New("crypto plan is unknown")
+	ErrCryptoKeyEmpty         = errors.New("crypto key is empty")
+	ErrCryptoKeyNotFound      = errors.New("crypto key id is not found")
 )
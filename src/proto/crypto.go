@@ -6,8 +6,11 @@ import (
 	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"sort"
 	"strings"
 )
 
@@ -151,18 +154,179 @@ func (c TokenCrypto) Decrypt(stream []byte) ([]byte, error) {
 
 func (c TokenCrypto) String() string { return "TokenCrypto" }
 
-// CreateCrypto 设置加密方案
+// KeyIDLength 密钥标识的长度
+const KeyIDLength = 4
+
+// CalcKeyID 计算密钥标识, 取派生密钥 SHA-256 的前 KeyIDLength 个字节, 不会泄露密钥本身
+func CalcKeyID(key []byte) uint32 {
+	hash := sha256.Sum256(key)
+	return binary.BigEndian.Uint32(hash[:KeyIDLength])
+}
+
+// AEADCrypto 基于 AEAD 算法的加解密器, 支持多个密钥以实现密钥轮换
+//
+//	密文结构：
+//		|   KeyID   |   Nonce   |   Ciphertext   |
+//		|-----------|-----------|----------------|
+//	len	|     4     |     N     |        N       |
+//		|-----------|-----------|----------------|
+//
+//	加密时总是采用第一个密钥, 解密时依据 KeyID 选择对应的密钥
+type AEADCrypto struct {
+	name    string
+	primary uint32                 // 加密所采用的密钥标识
+	aeads   map[uint32]cipher.AEAD // 全部可用于解密的密钥
+}
+
+// NewAEADCrypto 创建一个 AEAD 加解密器, 每一个密钥均通过 SHA-256 派生为32字节
+//
+//	@param	name	string									加解密器名称
+//	@param	create	func(key []byte) (cipher.AEAD, error)	由32字节密钥创建 AEAD 的方法
+//	@param	keys 	[]string								密钥, 第一个密钥用于加密, 其余的仅用于解密
+func NewAEADCrypto(name string, create func(key []byte) (cipher.AEAD, error), keys ...string) (*AEADCrypto, error) {
+	c := &AEADCrypto{name: name, aeads: make(map[uint32]cipher.AEAD)}
+
+	for _, k := range keys {
+		if k == "" {
+			continue
+		}
+		hash := sha256.Sum256([]byte(k))
+		aead, err := create(hash[:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s cipher: %v", name, err)
+		}
+
+		id := CalcKeyID(hash[:])
+		if len(c.aeads) == 0 { // 第一个有效的密钥
+			c.primary = id
+		}
+		c.aeads[id] = aead
+	}
+
+	if len(c.aeads) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrCryptoKeyEmpty, name)
+	}
+
+	return c, nil
+}
+
+// KeyID 加密所采用的密钥标识
+func (c *AEADCrypto) KeyID() uint32 { return c.primary }
+
+// Encrypt 加密函数
+func (c *AEADCrypto) Encrypt(stream []byte) ([]byte, error) {
+	aead := c.aeads[c.primary]
+
+	// 生成随机的Nonce
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	// 密钥标识和nonce附加到密文之前
+	encryptedData := make([]byte, KeyIDLength, KeyIDLength+len(nonce)+len(stream)+aead.Overhead())
+	binary.BigEndian.PutUint32(encryptedData, c.primary)
+	encryptedData = append(encryptedData, nonce...)
+
+	return aead.Seal(encryptedData, nonce, stream, nil), nil
+}
+
+// Decrypt 解密函数
+func (c *AEADCrypto) Decrypt(stream []byte) ([]byte, error) {
+	if len(stream) < KeyIDLength {
+		return nil, fmt.Errorf("invalid ciphertext")
+	}
+
+	id := binary.BigEndian.Uint32(stream)
+	aead, ok := c.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: 0x%08X", ErrCryptoKeyNotFound, id)
+	}
+
+	stream = stream[KeyIDLength:]
+	nonceSize := aead.NonceSize()
+	if len(stream) < nonceSize {
+		return nil, fmt.Errorf("invalid ciphertext")
+	}
+
+	return aead.Open(nil, stream[:nonceSize], stream[nonceSize:], nil)
+}
+
+func (c *AEADCrypto) String() string {
+	return fmt.Sprintf("%s(0x%08X)", c.name, c.primary)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// CryptoFactory 加解密器的构造方法, key 为加密参数, 通常第一个参数为令牌
+type CryptoFactory func(key ...string) (Crypto, error)
+
+// 加密方案名称(大写)与构造方法的对应关系
+var cryptoFactories = map[string]CryptoFactory{
+	"NO": func(_ ...string) (Crypto, error) { return DefaultCrypto(), nil },
+	// 兼容旧版本, 密文不携带密钥标识
+	"TOKEN": func(key ...string) (Crypto, error) {
+		if len(key) < 1 || key[0] == "" {
+			return nil, fmt.Errorf("%w: TOKEN", ErrCryptoKeyEmpty)
+		}
+		return &TokenCrypto{Token: key[0]}, nil
+	},
+	"AES-GCM": func(key ...string) (Crypto, error) {
+		return NewAEADCrypto("AES-GCM", newAESGCM, key...)
+	},
+	// 适用于没有AES硬件加速的设备
+	"CHACHA20-POLY1305": func(key ...string) (Crypto, error) {
+		return NewAEADCrypto("CHACHA20-POLY1305", chacha20poly1305.New, key...)
+	},
+}
+
+// RegisterCrypto 添加一个加密方案, 对于已经存在的方案则不允许修改, 必须在启动之前注册
+func RegisterCrypto(option string, factory CryptoFactory) bool {
+	option = strings.ToUpper(option)
+	if _, ok := cryptoFactories[option]; ok {
+		return false
+	}
+	cryptoFactories[option] = factory
+	return true
+}
+
+// CryptoPlans 全部已注册的加密方案
+func CryptoPlans() []string {
+	plans := make([]string, 0, len(cryptoFactories))
+	for k := range cryptoFactories {
+		plans = append(plans, k)
+	}
+	sort.Strings(plans)
+	return plans
+}
+
+// 以令牌之外的参数作为密钥的 AEAD 加密方案
+var aeadPlans = map[string]bool{"AES-GCM": true, "CHACHA20-POLY1305": true}
+
+// CryptoKeys 由令牌和显式指定的加密参数构造 CreateCrypto 的参数:
+// AEAD 方案以显式指定的密钥加解密(第一个用于加密), 未指定时采用令牌; 其余方案的第一个参数总是令牌
+func CryptoKeys(option, token string, key ...string) []string {
+	if aeadPlans[strings.ToUpper(option)] && len(key) > 0 {
+		return key
+	}
+	return append([]string{token}, key...)
+}
+
+// CreateCrypto 设置加密方案, 对于未注册的方案会返回 ErrCryptoPlanUnknown 而不会退化为不加密
 //
-//	@param	option	string		加密方案, 支持token/no (令牌加密和不加密)
+//	@param	option	string		加密方案, 支持no/token/aes-gcm/chacha20-poly1305, 以及通过 RegisterCrypto 注册的方案
 //	@param	key 	[]string	其他加密参数
-func CreateCrypto(option string, key ...string) Crypto {
-	var cry Crypto
-	switch strings.ToUpper(option) {
-	case "TOKEN":
-		cry = &TokenCrypto{Token: key[0]}
-	default:
-		cry = DefaultCrypto()
+func CreateCrypto(option string, key ...string) (Crypto, error) {
+	factory, ok := cryptoFactories[strings.ToUpper(option)]
+	if !ok {
+		return nil, fmt.Errorf("%w: '%s', available: %v", ErrCryptoPlanUnknown, option, CryptoPlans())
 	}
 
-	return cry
+	return factory(key...)
 }
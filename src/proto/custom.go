@@ -0,0 +1,53 @@
+package proto
+
+import (
+	"bytes"
+	"encoding"
+	"github.com/Chendemo12/fastapi-tool/helper"
+)
+
+// 自定义消息的编解码
+//
+// Message 的编解码方法未导出, 因此包外定义的消息需嵌入 NotImplementMessage, 并通过以下任一方式编解码:
+//
+//   - 实现 encoding.BinaryMarshaler 和 encoding.BinaryUnmarshaler 接口, 自行定义字节序列;
+//   - MarshalMethod 返回 JsonMarshalMethod, 此时消息本身以JSON编解码.
+//
+// 内置消息不受影响, 仍采用其自身的编解码方法
+
+// 是否是通过 AddDescriptor 添加的自定义消息
+func isCustomMessage(m Message) bool { return IsMessageDefined(m.MessageType()) }
+
+// 构建消息序列
+func buildMessage(m Message) ([]byte, error) {
+	if !isCustomMessage(m) {
+		return m.build()
+	}
+	if bm, ok := m.(encoding.BinaryMarshaler); ok {
+		return bm.MarshalBinary()
+	}
+	if m.MarshalMethod() == JsonMarshalMethod {
+		return helper.JsonMarshal(m)
+	}
+
+	return nil, ErrMethodNotImplemented
+}
+
+// 从字节序中解析消息
+func parseMessage(m Message, stream []byte) error {
+	if !isCustomMessage(m) {
+		// 针对不同的解析类型选择最优的解析方法
+		if m.MarshalMethod() == BinaryMarshalMethod {
+			return m.parseFrom(bytes.NewBuffer(stream))
+		}
+		return m.parse(stream)
+	}
+	if bm, ok := m.(encoding.BinaryUnmarshaler); ok {
+		return bm.UnmarshalBinary(stream)
+	}
+	if m.MarshalMethod() == JsonMarshalMethod {
+		return helper.JsonUnmarshal(stream, m)
+	}
+
+	return ErrMethodNotImplemented
+}
@@ -64,7 +64,7 @@ func init() {
 		message:     &RegisterMessage{},
 		text:        "RegisterMessage",
 		userDefined: false,
-		ackMessage:  &MessageResponse{},
+		ackMessage:  &MessageResponse{Type: RegisterMessageRespType},
 	}
 
 	descriptors[RegisterMessageRespType] = &Descriptor{
@@ -98,6 +98,78 @@ func init() {
 		ackMessage:  &MessageResponse{}, // 需要给个确认消息
 	}
 
+	descriptors[HPMessageType] = &Descriptor{
+		code:        HPMessageType,
+		message:     &PMessage{Headers: Headers{}},
+		text:        "ProducerMessageWithHeaders",
+		userDefined: false,
+		ackMessage:  &MessageResponse{},
+	}
+
+	descriptors[HCMessageType] = &Descriptor{
+		code:        HCMessageType,
+		message:     &CMessage{PM: &PMessage{Headers: Headers{}}},
+		text:        "ConsumerMessageWithHeaders",
+		userDefined: false,
+		ackMessage:  &MessageResponse{},
+	}
+
+	descriptors[ReplyMessageType] = &Descriptor{
+		code:        ReplyMessageType,
+		message:     &ReplyMessage{PMessage{Headers: Headers{}}},
+		text:        "ReplyMessage",
+		userDefined: false,
+		ackMessage:  nil, // 请求方已离线时回复会被丢弃, 无需确认
+	}
+
+	descriptors[BatchMessageType] = &Descriptor{
+		code:        BatchMessageType,
+		message:     &BatchMessage{},
+		text:        "BatchMessage",
+		userDefined: false,
+		ackMessage:  &MessageResponse{Type: BatchMessageRespType},
+	}
+
+	descriptors[BatchMessageRespType] = &Descriptor{
+		code:        BatchMessageRespType,
+		message:     &MessageResponse{Type: BatchMessageRespType},
+		text:        "BatchMessageResponse",
+		userDefined: false,
+		ackMessage:  nil, // 响应包含每个消息的偏移量
+	}
+
+	descriptors[SubscribeMessageType] = &Descriptor{
+		code:        SubscribeMessageType,
+		message:     &SubscribeMessage{Type: SubscribeMessageType},
+		text:        "SubscribeMessage",
+		userDefined: false,
+		ackMessage:  &MessageResponse{Type: SubscribeMessageRespType},
+	}
+
+	descriptors[UnsubscribeMessageType] = &Descriptor{
+		code:        UnsubscribeMessageType,
+		message:     &SubscribeMessage{Type: UnsubscribeMessageType},
+		text:        "UnsubscribeMessage",
+		userDefined: false,
+		ackMessage:  &MessageResponse{Type: SubscribeMessageRespType},
+	}
+
+	descriptors[SubscribeMessageRespType] = &Descriptor{
+		code:        SubscribeMessageRespType,
+		message:     &MessageResponse{Type: SubscribeMessageRespType},
+		text:        "SubscribeMessageResponse",
+		userDefined: false,
+		ackMessage:  nil, // 不需要响应
+	}
+
+	descriptors[AckMessageType] = &Descriptor{
+		code:        AckMessageType,
+		message:     &AckMessage{},
+		text:        "AckMessage",
+		userDefined: false,
+		ackMessage:  nil, // 确认丢失时消息会被重新推送, 无需响应
+	}
+
 	descriptors[HeartbeatMessageType] = &Descriptor{
 		code:        HeartbeatMessageType,
 		message:     &HeartbeatMessage{},
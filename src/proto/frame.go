@@ -3,17 +3,22 @@ package proto
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
+	"sync"
 )
 
 // TransferFrame 传输协议帧
 //
 // 帧与底层的传输协议无关, 帧是包含了具体消息的增加了冗余校验等信息的数据报;
 // 帧内部可以包含一条或多条相同类型的消息, 因此帧可一次性传输多条相同的消息;
-// 帧的大小没有限制, 真正对帧大小有限制的是底层的传输层, 具体是 transfer.Transfer 的要求;
+// 帧的大小仅受帧版本的限制, 超过传输层单个消息长度的帧由 TransferFrame.DrainTo 分段发送, 并由 FrameScanner 重新组装;
+// 帧存在 FrameV1 和 FrameV2 两种格式, 具体采用哪一种由连接在注册时确定, 同一个连接内的帧版本不变;
 //
-//	帧结构：
+//	v1 帧结构：
 //		|   head   |   mType  |   dataSize   |        data        |   checksum   |   tail   |
 //		|----------|----------|--------------|--------------------|--------------|----------|
 //	len	|     1	   |    1     |       2      |      N bytes       |       2      |     1    |
@@ -21,6 +26,17 @@ import (
 //	取值	|   0x3C   |          |              |                    |              |   0x0D   |
 //		|----------|----------|--------------|--------------------|--------------|----------|
 //
+//	v2 帧结构：
+//		|   head   |  version |   flags  |   mType  |   dataSize   |        data        |   checksum   |   tail   |
+//		|----------|----------|----------|----------|--------------|--------------------|--------------|----------|
+//	len	|     1	   |    1     |     1    |    1     |       4      |      N bytes       |       4      |     1    |
+//	   	|----------|----------|----------|----------|--------------|--------------------|--------------|----------|
+//	取值	|   0x3C   |   0x02   |          |          |              |                    |              |   0x0D   |
+//		|----------|----------|----------|----------|--------------|--------------------|--------------|----------|
+//
+//	v2 帧的 checksum 依据 flags 中的 FlagCRC32C 确定算法, 若未设置则为 CalcChecksum 的结果(高位补0)
+//	v2 帧的 data 若设置了 FlagCompressed, 则其解密后的首字节为 CompressCode, 其后为压缩后的消息
+//
 //	# Usage：
 //
 //	将帧载荷解析成具体的协议：
@@ -33,34 +49,132 @@ import (
 //		frame.BuildWith(proto.MessageType, []byte{})
 //		frame.BuildFrom(X)
 type TransferFrame struct {
-	counter  uint64      // 用以追踪此对象的实例是否由池创建
-	head     byte        // 恒为 FrameHead
-	mType    MessageType // data 包含的消息类型
-	dataSize []byte      // 标识消息总长度,2个字节, data 的长度, 同样适用于多帧报文
-	data     []byte      // 若干个消息
-	checksum []byte      // checksum 经典校验和算法,2个字节, data 的校验和
-	tail     byte        // 恒为 FrameTail
+	counter  uint64       // 用以追踪此对象的实例是否由池创建
+	head     byte         // 恒为 FrameHead
+	version  FrameVersion // 帧格式版本
+	flags    FrameFlag    // 标志位, 仅 v2 帧有效
+	mType    MessageType  // data 包含的消息类型
+	dataSize uint32       // 标识消息总长度, data 的长度, 同样适用于多帧报文
+	data     []byte       // 若干个消息
+	checksum uint32       // data 的校验和, v1 帧为2个字节, v2 帧为4个字节
+	tail     byte         // 恒为 FrameTail
+	// 构建帧时所采用的压缩器, 解析帧时依据 FlagCompressed 自动选择解压器
+	compressor Compressor
+}
+
+// MaxFrameDataSize 解析 v2 帧时所允许的最大载荷长度, 用于避免因错误的长度字段而分配过大的内存
+var MaxFrameDataSize uint32 = 16 << 20
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// MaxTransferMessageLength 传输层单个消息的最大长度, TCP 传输层以2字节记录消息的长度
+const MaxTransferMessageLength = math.MaxUint16
+
+// Drainer 以消息为单位发送数据的连接, 写入的数据在 Drain 时作为一个消息发出;
+// 若同时实现了 sync.Locker, 则 TransferFrame.DrainTo 在写入整个帧期间持有锁, 以免分段发送的帧被其他帧打断
+type Drainer interface {
+	io.Writer
+	Drain() error
+}
+
+// DetectFrameVersion 依据帧的第二个字节推断帧版本
+//
+// v1 帧的第二个字节为消息类别, v2 帧的第二个字节为版本号;
+// 由于 RegisterMessageRespType 仅由服务端发出, 因此服务端可以据此识别客户端所采用的帧版本
+func DetectFrameVersion(second byte) FrameVersion {
+	if FrameVersion(second) == FrameV2 {
+		return FrameV2
+	}
+	return FrameV1
 }
 
 // 构建缺省字段
 func (f *TransferFrame) buildFields() {
-	binary.BigEndian.PutUint16(f.dataSize, uint16(len(f.data)))
-	binary.BigEndian.PutUint16(f.checksum, CalcChecksum(f.data))
+	f.dataSize = uint32(len(f.data))
+	f.checksum = f.calcChecksum()
+}
+
+// 依据帧版本和标志位计算 data 的校验和
+func (f *TransferFrame) calcChecksum() uint32 {
+	if f.version == FrameV2 && f.HasFlag(FlagCRC32C) {
+		return crc32.Checksum(f.data, crc32cTable)
+	}
+	return uint32(CalcChecksum(f.data))
+}
+
+// 编码 data 之前的字段, 此方法不修改帧, 因此同一个帧可被并发写入多个连接
+func (f *TransferFrame) encodeHead() []byte {
+	size := uint32(len(f.data))
+	if f.version == FrameV2 {
+		content := make([]byte, 8)
+		content[0] = f.head
+		content[1] = byte(f.version)
+		content[2] = byte(f.flags)
+		content[3] = byte(f.mType)
+		binary.BigEndian.PutUint32(content[4:], size)
+		return content
+	}
+
+	content := make([]byte, 4)
+	content[0] = f.head
+	content[1] = byte(f.mType)
+	binary.BigEndian.PutUint16(content[2:], uint16(size))
+	return content
+}
+
+// 编码 data 之后的字段
+func (f *TransferFrame) encodeTail() []byte {
+	checksum := f.calcChecksum()
+	if f.version == FrameV2 {
+		content := make([]byte, 5)
+		binary.BigEndian.PutUint32(content, checksum)
+		content[4] = f.tail
+		return content
+	}
+
+	content := make([]byte, 3)
+	binary.BigEndian.PutUint16(content, uint16(checksum))
+	content[2] = f.tail
+	return content
+}
+
+// 检查载荷长度是否超出了当前帧版本的限制
+func (f *TransferFrame) checkDataSize() error {
+	if uint64(len(f.data)) > f.version.MaxDataSize() {
+		return fmt.Errorf("%w: %d bytes in %s frame", ErrFrameTooLarge, len(f.data), f.version)
+	}
+	return nil
+}
+
+// 将帧的版本, 类型和标志位传递给消息, 以使消息选择对应的编码格式
+func (f *TransferFrame) bindMessage(m Message, typ MessageType) {
+	setMessageVersion(m, f.version)
+	setMessageHeaders(m, typ)
+	setMessageMarshal(m, f.MessageMarshalMethod())
+	setMessagePartition(m, f.version == FrameV2 && f.HasFlag(FlagPartition))
 }
 
 // 依据帧类型创建一个新的消息指针实例
 func (f *TransferFrame) newMessage() (msg Message) {
 	switch f.mType {
-	case CMessageType:
+	case CMessageType, HCMessageType:
 		msg = &CMessage{PM: &PMessage{}}
-	case PMessageType:
+	case PMessageType, HPMessageType:
 		msg = &PMessage{}
 	case RegisterMessageType:
 		msg = &RegisterMessage{}
-	case RegisterMessageRespType, MessageRespType:
-		msg = &MessageResponse{}
+	case RegisterMessageRespType, MessageRespType, BatchMessageRespType, SubscribeMessageRespType:
+		msg = &MessageResponse{Type: f.mType}
 	case HeartbeatMessageType:
 		msg = &HeartbeatMessage{}
+	case ReplyMessageType:
+		msg = &ReplyMessage{}
+	case BatchMessageType:
+		msg = &BatchMessage{}
+	case SubscribeMessageType, UnsubscribeMessageType:
+		msg = &SubscribeMessage{Type: f.mType}
+	case AckMessageType:
+		msg = &AckMessage{}
 	default:
 		msg = &NotImplementMessage{}
 	}
@@ -72,11 +186,69 @@ func (f *TransferFrame) Head() byte { return f.head }
 
 func (f *TransferFrame) Type() MessageType { return f.mType }
 
-// DataSize 获得消息的总长度, 由 dataSize 标识
-func (f *TransferFrame) DataSize() int {
-	return int(binary.BigEndian.Uint16(f.dataSize))
+// Version 获取帧格式版本
+func (f *TransferFrame) Version() FrameVersion { return f.version }
+
+// SetVersion 修改帧格式版本, 对于 FrameV2 会默认启用 FlagCRC32C, 对于 FrameV1 则清除仅 v2 帧有效的全部标志位
+// 在解析之前设置为 FrameVersionAuto 则会依据数据流自动识别版本
+func (f *TransferFrame) SetVersion(version FrameVersion) *TransferFrame {
+	f.version = version
+	switch version {
+	case FrameV2:
+		f.flags |= FlagCRC32C
+	case FrameV1:
+		f.flags = 0
+	}
+	return f
+}
+
+// SetCompressor 设置构建帧时所采用的压缩器, 仅对 FrameV2 帧有效
+// 压缩发生在加密之前, 若压缩后未能减小载荷长度则保持不压缩
+func (f *TransferFrame) SetCompressor(compressor Compressor) *TransferFrame {
+	f.compressor = compressor
+	return f
+}
+
+// Compressed 帧载荷是否处于压缩状态
+func (f *TransferFrame) Compressed() bool { return f.HasFlag(FlagCompressed) }
+
+// MessageMarshalMethod 帧内控制消息的序列化方法, 仅 FrameV2 帧可通过 FlagBinaryMarshal 选择二进制编码
+func (f *TransferFrame) MessageMarshalMethod() MarshalMethodType {
+	if f.version == FrameV2 && f.HasFlag(FlagBinaryMarshal) {
+		return BinaryMarshalMethod
+	}
+	return JsonMarshalMethod
+}
+
+// SetMessageMarshalMethod 修改帧内控制消息的序列化方法, 对于 FrameV1 帧始终为 JsonMarshalMethod
+func (f *TransferFrame) SetMessageMarshalMethod(method MarshalMethodType) *TransferFrame {
+	if method == BinaryMarshalMethod {
+		return f.SetFlag(FlagBinaryMarshal)
+	}
+	return f.ClearFlag(FlagBinaryMarshal)
+}
+
+// Flags 获取帧标志位
+func (f *TransferFrame) Flags() FrameFlag { return f.flags }
+
+// HasFlag 是否设置了某一个标志位
+func (f *TransferFrame) HasFlag(flag FrameFlag) bool { return f.flags&flag == flag }
+
+// SetFlag 设置标志位, 仅对 v2 帧有效
+func (f *TransferFrame) SetFlag(flag FrameFlag) *TransferFrame {
+	f.flags |= flag
+	return f
 }
 
+// ClearFlag 清除标志位
+func (f *TransferFrame) ClearFlag(flag FrameFlag) *TransferFrame {
+	f.flags &^= flag
+	return f
+}
+
+// DataSize 获得消息的总长度, 由 dataSize 标识
+func (f *TransferFrame) DataSize() int { return int(f.dataSize) }
+
 func (f *TransferFrame) Tail() byte { return f.tail }
 
 func (f *TransferFrame) Payload() []byte { return f.data }
@@ -96,9 +268,7 @@ func (f *TransferFrame) SetPayload(data []byte) *TransferFrame {
 }
 
 // Checksum 获取帧校验和, 由 checksum 标识
-func (f *TransferFrame) Checksum() uint16 {
-	return binary.BigEndian.Uint16(f.checksum)
-}
+func (f *TransferFrame) Checksum() uint32 { return f.checksum }
 
 func (f *TransferFrame) MarshalMethod() MarshalMethodType {
 	return BinaryMarshalMethod
@@ -106,21 +276,29 @@ func (f *TransferFrame) MarshalMethod() MarshalMethodType {
 
 func (f *TransferFrame) String() string {
 	return fmt.Sprintf(
-		"<frame:%s> [ CS::%d ] with %d bytes of payload",
-		descriptors[f.mType].text, f.Checksum(), len(f.data),
+		"<frame:%s> [ V::%s | CS::%d ] with %d bytes of payload",
+		descriptors[f.mType].text, f.version, f.checksum, len(f.data),
 	)
 }
 
 // Length 获得帧总长
-func (f *TransferFrame) Length() int { return f.DataSize() + 7 }
+func (f *TransferFrame) Length() int {
+	if f.version == FrameV2 {
+		return f.DataSize() + FrameV2MinLength
+	}
+	return f.DataSize() + FrameMinLength
+}
 
 func (f *TransferFrame) Reset() {
 	f.head = FrameHead
+	f.version = FrameV1
+	f.flags = 0
 	f.mType = NotImplementMessageType
-	f.dataSize = make([]byte, 2)
+	f.dataSize = 0
 	f.data = make([]byte, 0)
-	f.checksum = make([]byte, 2)
+	f.checksum = 0
 	f.tail = FrameTail
+	f.compressor = nil
 }
 
 // =================================== 帧的编解码 ==================================
@@ -129,90 +307,165 @@ func (f *TransferFrame) Reset() {
 func (f *TransferFrame) Build() []byte {
 	f.buildFields()
 
-	length := len(f.data) + 7
-	content := make([]byte, length)
-	content[0] = f.head
-	content[1] = byte(f.mType)
-	content[2] = f.dataSize[0]
-	content[3] = f.dataSize[1]
-
-	copy(content[4:len(f.data)+4], f.data)
+	head := f.encodeHead()
+	tail := f.encodeTail()
 
-	content[length-3] = f.checksum[0]
-	content[length-2] = f.checksum[1]
-	content[length-1] = f.tail
+	content := make([]byte, 0, len(head)+len(f.data)+len(tail))
+	content = append(content, head...)
+	content = append(content, f.data...)
+	content = append(content, tail...)
 
 	return content
 }
 
+// 压缩载荷, 仅当帧版本为 FrameV2 且消息允许压缩时有效
+func (f *TransferFrame) compress() error {
+	f.ClearFlag(FlagCompressed)
+	if f.version != FrameV2 || f.compressor == nil || f.compressor.Code() == NoCompressCode {
+		return nil
+	}
+	if !f.mType.CompressionAllowed() || len(f.data) < MinCompressSize {
+		return nil
+	}
+
+	_bytes, err := f.compressor.Compress(f.data)
+	if err != nil {
+		return fmt.Errorf("message compress failed: %v", err)
+	}
+	if len(_bytes)+1 >= len(f.data) { // 压缩无收益
+		return nil
+	}
+
+	data := make([]byte, 0, len(_bytes)+1)
+	data = append(data, byte(f.compressor.Code()))
+	f.data = append(data, _bytes...)
+	f.SetFlag(FlagCompressed)
+
+	return nil
+}
+
+// 解压载荷, 依据首字节的 CompressCode 选择解压器, 需在解密之后调用
+func (f *TransferFrame) decompress() error {
+	if !f.HasFlag(FlagCompressed) {
+		return nil
+	}
+	if len(f.data) < 1 {
+		return fmt.Errorf("%w: compress code", ErrFrameTruncated)
+	}
+
+	compressor := GetCompressor(CompressCode(f.data[0]))
+	if compressor == nil {
+		return fmt.Errorf("%w: code %d", ErrCompressorNotFound, f.data[0])
+	}
+	_bytes, err := compressor.Decompress(f.data[1:])
+	if err != nil {
+		return fmt.Errorf("message decompress failed: %w", err)
+	}
+
+	f.data = _bytes
+	f.ClearFlag(FlagCompressed) // 避免重复解压
+
+	return nil
+}
+
 // BuildWith 补充字段,编码消息帧, 仅适用于构建包含单个消息的帧
 // 若需要包含多个消息, 需使用 FrameCombine 方法
 func (f *TransferFrame) BuildWith(typ MessageType, data []byte, encrypt ...EncryptFunc) error {
 	f.mType = typ
 	f.data = data[:]
 
-	if len(encrypt) < 1 || !typ.EncryptionAllowed() { // 未开启加密，某些消息不允许加密传输
-		return nil
+	if err := f.compress(); err != nil { // 先压缩后加密
+		return err
 	}
 
-	// 开启加密
-	_bytes, err := encrypt[0](f.data)
-	if err != nil {
-		return fmt.Errorf("Message encrypt failed: %v", err)
+	if len(encrypt) > 0 && typ.EncryptionAllowed() { // 开启加密，某些消息不允许加密传输
+		_bytes, err := encrypt[0](f.data)
+		if err != nil {
+			return fmt.Errorf("Message encrypt failed: %v", err)
+		}
+		f.data = _bytes[:]
 	}
-	f.data = _bytes[:]
+	f.buildFields()
 
-	return nil
+	return f.checkDataSize()
 }
 
 // BuildFrom 从协议中构建消息帧, 仅适用于构建包含单个消息的帧
 // 若需要包含多个消息, 需使用 FrameCombine 方法
 func (f *TransferFrame) BuildFrom(m Message, encrypt ...EncryptFunc) error {
-	_bytes, err := m.build()
+	f.bindMessage(m, m.MessageType())
+	_bytes, err := buildMessage(m)
 	if err != nil {
-		return fmt.Errorf("message build failed: %v", err)
+		return fmt.Errorf("message build failed: %w", err)
 	}
 
 	return f.BuildWith(m.MessageType(), _bytes, encrypt...)
 }
 
-// WriteTo 将预构建的消息流直接写入 io.Writer 内
-// 相比于返回[]byte的 BuildWith 和 BuildFrom 方法而言,能减少一倍的内存分配
-func (f *TransferFrame) WriteTo(writer io.Writer) (int64, error) {
-	f.buildFields()
-	var all = 0
+// DrainTo 将帧写入连接并发出; 超过 MaxTransferMessageLength 的帧被分割为多个消息依次发出,
+// 在此之前会先发出连接中已写入的数据, 以使每一个消息均不超过最大长度; 接收方须通过 FrameScanner.AllowPartial 重新组装
+func (f *TransferFrame) DrainTo(w Drainer) error {
+	if err := f.checkDataSize(); err != nil {
+		return err
+	}
+	if l, ok := w.(sync.Locker); ok {
+		l.Lock()
+		defer l.Unlock()
+	}
 
-	i, err := writer.Write([]byte{f.head})
-	if err != nil {
-		return int64(i), err
+	length := len(f.data) + FrameMinLength
+	if f.version == FrameV2 {
+		length = len(f.data) + FrameV2MinLength
+	}
+	if length <= MaxTransferMessageLength {
+		if _, err := f.WriteTo(w); err != nil {
+			return err
+		}
+		return w.Drain()
 	}
-	all += i
 
-	i, err = writer.Write([]byte{byte(f.mType)})
-	if err != nil {
-		return int64(i), err
+	if err := w.Drain(); err != nil {
+		return err
+	}
+	stream := f.Build()
+	for len(stream) > 0 {
+		n := len(stream)
+		if n > MaxTransferMessageLength {
+			n = MaxTransferMessageLength
+		}
+		if _, err := w.Write(stream[:n]); err != nil {
+			return err
+		}
+		if err := w.Drain(); err != nil {
+			return err
+		}
+		stream = stream[n:]
 	}
-	all += i
 
-	i, err = writer.Write(f.dataSize)
-	if err != nil {
-		return int64(i), err
+	return nil
+}
+
+// WriteTo 将预构建的消息流直接写入 io.Writer 内
+// 相比于返回[]byte的 BuildWith 和 BuildFrom 方法而言,能减少一倍的内存分配
+func (f *TransferFrame) WriteTo(writer io.Writer) (int64, error) {
+	if err := f.checkDataSize(); err != nil {
+		return 0, err
 	}
-	all += i
+	var all = 0
 
-	i, err = writer.Write(f.data)
+	i, err := writer.Write(f.encodeHead())
 	if err != nil {
 		return int64(i), err
 	}
 	all += i
 
-	i, err = writer.Write(f.checksum)
+	i, err = writer.Write(f.data)
 	if err != nil {
 		return int64(i), err
 	}
 	all += i
 
-	i, err = writer.Write([]byte{f.tail})
+	i, err = writer.Write(f.encodeTail())
 	if err != nil {
 		return int64(i), err
 	}
@@ -226,51 +479,198 @@ func (f *TransferFrame) Parse(stream []byte) error {
 	return f.ParseFrom(bytes.NewReader(stream))
 }
 
-// ParseFrom 从流中解析数据帧
+// 从流中读取恰好 len(p) 个字节, 数据不足时返回 ErrFrameTruncated
+func readFrameField(reader io.Reader, p []byte, field string) error {
+	_, err := io.ReadFull(reader, p)
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %s", ErrFrameTruncated, field)
+	}
+	return fmt.Errorf("%s did not read: %v", field, err)
+}
+
+// ParseFrom 从流中解析数据帧, 并校验帧头, 帧尾和校验和
+// 若帧版本为 FrameVersionAuto, 则依据第二个字节识别帧版本, 解析完成后可通过 Version 获取
 func (f *TransferFrame) ParseFrom(reader io.Reader) error {
 	bc := bcPool.Get()
 	defer bcPool.Put(bc)
 
-	// 此处一定 > 7个字节
-	bc.i, bc.err = reader.Read(bc.oneByte)
-	bc.i, bc.err = reader.Read(bc.oneByte)
-	f.mType = MessageType(bc.oneByte[0])
+	if bc.err = readFrameField(reader, bc.oneByte, "head"); bc.err != nil {
+		return bc.err
+	}
+	f.head = bc.oneByte[0]
+	if f.head != FrameHead {
+		return fmt.Errorf("%w: 0x%02X", ErrFrameHeadInvalid, f.head)
+	}
+
+	if bc.err = readFrameField(reader, bc.oneByte, "type"); bc.err != nil {
+		return bc.err
+	}
+	if f.version == FrameVersionAuto {
+		f.SetVersion(DetectFrameVersion(bc.oneByte[0]))
+	}
+
+	if f.version == FrameV2 { // 第二个字节为版本号
+		if v := FrameVersion(bc.oneByte[0]); v != FrameV2 {
+			return fmt.Errorf("%w: 0x%02X", ErrFrameVersionInvalid, byte(v))
+		}
+		if bc.err = readFrameField(reader, bc.twoByte, "flags"); bc.err != nil {
+			return bc.err
+		}
+		f.flags = FrameFlag(bc.twoByte[0])
+		f.mType = MessageType(bc.twoByte[1])
+
+		if bc.err = readFrameField(reader, bc.fourByte, "dataSize"); bc.err != nil {
+			return bc.err
+		}
+		f.dataSize = bc.FourValue()
+		if f.dataSize > MaxFrameDataSize {
+			return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, f.dataSize)
+		}
+	} else {
+		f.mType = MessageType(bc.oneByte[0])
+
+		if bc.err = readFrameField(reader, bc.twoByte, "dataSize"); bc.err != nil {
+			return bc.err
+		}
+		f.dataSize = uint32(bc.TwoValue())
+	}
 
-	bc.i, bc.err = reader.Read(f.dataSize)
+	// 对于 bytes.Reader 可提前获知剩余的长度, 避免因错误的长度字段而分配内存
+	if r, ok := reader.(interface{ Len() int }); ok && f.DataSize() > r.Len() {
+		return fmt.Errorf("%w: data", ErrFrameTruncated)
+	}
 	f.data = make([]byte, f.DataSize())
+	if bc.err = readFrameField(reader, f.data, "data"); bc.err != nil {
+		return bc.err
+	}
 
-	bc.i, bc.err = reader.Read(f.data)
+	if f.version == FrameV2 {
+		bc.err = readFrameField(reader, bc.fourByte, "checksum")
+		f.checksum = bc.FourValue()
+	} else {
+		bc.err = readFrameField(reader, bc.twoByte, "checksum")
+		f.checksum = uint32(bc.TwoValue())
+	}
 	if bc.err != nil {
 		return bc.err
 	}
-	bc.i, bc.err = reader.Read(f.checksum)
-	if bc.err != nil {
-		return fmt.Errorf("checksum date read failed: %v", bc.err)
+
+	if bc.err = readFrameField(reader, bc.oneByte, "tail"); bc.err != nil {
+		return bc.err
+	}
+	f.tail = bc.oneByte[0]
+	if f.tail != FrameTail {
+		return fmt.Errorf("%w: 0x%02X", ErrFrameTailInvalid, f.tail)
+	}
+
+	if cs := f.calcChecksum(); cs != f.checksum {
+		return fmt.Errorf("%w: expect %d, got %d", ErrFrameChecksumMismatch, cs, f.checksum)
 	}
 
 	return nil
 }
 
+// FrameScanner 从一段字节序中依次解析出若干个帧
+//
+// 当遇到损坏的帧时, 会丢弃当前帧头并向后查找下一个 FrameHead 以重新同步,
+// 因此某一个字节的错误最多只会导致其所在的帧被丢弃, 而不会影响之后的帧;
+// 通过 AllowPartial 允许字节流的末尾为不完整的帧, 以重新组装被分割为多个传输层消息的帧
+//
+//	# Usage：
+//
+//		scanner := NewFrameScanner(stream, FrameV1)
+//		for scanner.More() {
+//			frame := &TransferFrame{}
+//			frame.Reset()
+//			err := scanner.Next(frame)
+//		}
+type FrameScanner struct {
+	stream    []byte
+	pos       int
+	skipped   int
+	version   FrameVersion
+	partial   bool   // 是否允许末尾为不完整的帧
+	remainder []byte // 末尾不完整的帧
+}
+
+// NewFrameScanner 创建一个帧扫描器, 若 version 为 FrameVersionAuto 则以第一个解析成功的帧版本为准
+func NewFrameScanner(stream []byte, version FrameVersion) *FrameScanner {
+	return &FrameScanner{stream: stream, version: version}
+}
+
+// More 是否还有未解析的数据
+func (s *FrameScanner) More() bool { return s.pos < len(s.stream) }
+
+// Version 当前所采用的帧版本
+func (s *FrameScanner) Version() FrameVersion { return s.version }
+
+// Skipped 因帧损坏而丢弃的字节数
+func (s *FrameScanner) Skipped() int { return s.skipped }
+
+// AllowPartial 允许字节流的末尾为不完整的帧: 此时 Next 返回 ErrFrameIncomplete 且不丢弃数据,
+// 调用方应通过 Remainder 取出, 并与后续收到的数据拼接后重新解析
+func (s *FrameScanner) AllowPartial() *FrameScanner {
+	s.partial = true
+	return s
+}
+
+// Remainder 字节流末尾不完整的帧, 引用原始的字节流, 不存在时为nil
+func (s *FrameScanner) Remainder() []byte { return s.remainder }
+
+// Next 解析下一个帧, 若解析失败则返回错误, 并已移动到下一个可能的帧头处
+func (s *FrameScanner) Next(frame *TransferFrame) error {
+	start := s.pos
+	reader := bytes.NewReader(s.stream[start:])
+
+	frame.SetVersion(s.version)
+	err := frame.ParseFrom(reader)
+	if err == nil {
+		s.pos = len(s.stream) - reader.Len()
+		if s.version == FrameVersionAuto {
+			s.version = frame.Version()
+		}
+		return nil
+	}
+
+	// 帧头有效但数据不足, 等待后续的数据
+	if s.partial && errors.Is(err, ErrFrameTruncated) {
+		s.remainder = s.stream[start:]
+		s.pos = len(s.stream)
+		return ErrFrameIncomplete
+	}
+
+	// 帧损坏, 从下一个帧头处重新开始解析
+	next := bytes.IndexByte(s.stream[start+1:], FrameHead)
+	if next < 0 {
+		s.pos = len(s.stream)
+	} else {
+		s.pos = start + 1 + next
+	}
+	s.skipped += s.pos - start
+
+	return err
+}
+
 // =================================== 帧的编解码 End ==============================
 
 // Unmarshal 反序列化帧消息体
 func (f *TransferFrame) Unmarshal(msg Message, decrypt ...DecryptFunc) error {
 	var err error
+	f.bindMessage(msg, f.mType)
 	if len(decrypt) > 0 && msg.MessageType().EncryptionAllowed() { // 消息允许加密
 		f.data, err = decrypt[0](f.data)
 		if err != nil {
 			return err
 		}
 	}
-
-	// 针对不同的解析类型选择最优的解析方法
-	if msg.MarshalMethod() == BinaryMarshalMethod {
-		err = msg.parseFrom(bytes.NewBuffer(f.data))
-	} else {
-		err = msg.parse(f.data)
+	if err = f.decompress(); err != nil { // 先解密后解压
+		return err
 	}
 
-	return err
+	return parseMessage(msg, f.data)
 }
 
 // UnmarshalTo 将帧消息解析成某一个具体的协议消息
@@ -302,22 +702,37 @@ func FrameSplit[T Message](f *TransferFrame, msgs *[]T, decrypt ...DecryptFunc)
 			return err
 		}
 	}
+	if err = f.decompress(); err != nil {
+		return err
+	}
 
 	stream := bytes.NewReader(f.data)
 
+	// 帧类型与期望的消息类型不一致时, 不应 panic
+	appendMsg := func(msg Message) error {
+		v, ok := msg.(T)
+		if !ok {
+			return fmt.Errorf("%w: %s is not the expected message", ErrMessageTypeMismatch, f.Text())
+		}
+		*msgs = append(*msgs, v)
+		return nil
+	}
+
 	if f.mType.CombinationAllowed() { // 允许组合，循环解析消息
 		for err == nil && stream.Len() > 0 {
 			msg = f.newMessage()
+			f.bindMessage(msg, f.mType)
 			err = msg.parseFrom(stream)
 			if err == nil {
-				*msgs = append(*msgs, msg.(T))
+				err = appendMsg(msg)
 			}
 		}
 	} else { // 此类型不允许组合，因此帧内只包含一个消息
 		msg = f.newMessage()
+		f.bindMessage(msg, f.mType)
 		err = msg.parseFrom(stream)
 		if err == nil {
-			*msgs = append(*msgs, msg.(T))
+			err = appendMsg(msg)
 		}
 	}
 
@@ -325,7 +740,7 @@ func FrameSplit[T Message](f *TransferFrame, msgs *[]T, decrypt ...DecryptFunc)
 }
 
 // FrameCombine 组合消息帧，将若干个消息，组合到一个帧内
-// 在调用此方法之前需首先设置帧类型 TransferFrame.SetType
+// 在调用此方法之前需首先设置帧类型 TransferFrame.SetType, 若消息携带消息头则帧类型必须为 HPMessageType 或 HCMessageType
 // 组合空消息帧无意义, 因此需自行保证 msgs 不为空
 func FrameCombine[T Message](f *TransferFrame, msgs []T, encrypt ...EncryptFunc) error {
 	_ = msgs[0]
@@ -339,6 +754,7 @@ func FrameCombine[T Message](f *TransferFrame, msgs []T, encrypt ...EncryptFunc)
 	}
 
 	for i := 0; i < end; i++ {
+		f.bindMessage(msgs[i], f.mType)
 		_bytes, err = msgs[i].build()
 		if err != nil {
 			return err
@@ -346,6 +762,10 @@ func FrameCombine[T Message](f *TransferFrame, msgs []T, encrypt ...EncryptFunc)
 		f.data = append(f.data, _bytes...)
 	}
 
+	if err = f.compress(); err != nil {
+		return err
+	}
+
 	if len(encrypt) > 0 && f.mType.EncryptionAllowed() {
 		_bytes, err = encrypt[0](f.data)
 		if err != nil {
@@ -353,6 +773,7 @@ func FrameCombine[T Message](f *TransferFrame, msgs []T, encrypt ...EncryptFunc)
 		}
 		f.data = _bytes[:]
 	}
+	f.buildFields()
 
-	return nil
+	return f.checkDataSize()
 }
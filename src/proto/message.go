@@ -8,6 +8,10 @@ import (
 	"fmt"
 	"github.com/Chendemo12/fastapi-tool/helper"
 	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
 )
 
 // ========================================== 生产者消息数据协议定义 ==========================================
@@ -16,19 +20,28 @@ type MessageType byte
 
 // 如果增加了新的协议代码，都需要在 descriptors 中添加其类型
 const (
-	NotImplementMessageType MessageType = 0
-	RegisterMessageType     MessageType = 1   // 客户端消费者/生产者注册消息类别 c -> s RegisterMessage
-	RegisterMessageRespType MessageType = 2   // s -> c MessageResponse
-	HeartbeatMessageType    MessageType = 4   // c -> s HeartbeatMessage
-	MessageRespType         MessageType = 100 // 生产者消息响应 s -> c MessageResponse
-	PMessageType            MessageType = 101 // 生产者消息类别 c -> s PMessage
-	CMessageType            MessageType = 102 // 消费者消息类别 s -> c CMessage
+	NotImplementMessageType  MessageType = 0
+	RegisterMessageType      MessageType = 1   // 客户端消费者/生产者注册消息类别 c -> s RegisterMessage
+	RegisterMessageRespType  MessageType = 2   // s -> c MessageResponse
+	HeartbeatMessageType     MessageType = 4   // c -> s HeartbeatMessage
+	MessageRespType          MessageType = 100 // 生产者消息响应 s -> c MessageResponse
+	PMessageType             MessageType = 101 // 生产者消息类别 c -> s PMessage
+	CMessageType             MessageType = 102 // 消费者消息类别 s -> c CMessage
+	HPMessageType            MessageType = 103 // 携带消息头的生产者消息类别 c -> s PMessage
+	HCMessageType            MessageType = 104 // 携带消息头的消费者消息类别 s -> c CMessage
+	ReplyMessageType         MessageType = 105 // 请求的回复消息类别 c -> s ReplyMessage
+	BatchMessageType         MessageType = 106 // 批量生产者消息类别 c -> s BatchMessage
+	BatchMessageRespType     MessageType = 107 // 批量生产者消息响应 s -> c MessageResponse
+	SubscribeMessageType     MessageType = 108 // 消费者订阅主题 c -> s SubscribeMessage
+	UnsubscribeMessageType   MessageType = 109 // 消费者取消订阅主题 c -> s SubscribeMessage
+	SubscribeMessageRespType MessageType = 110 // 订阅和取消订阅的响应 s -> c MessageResponse
+	AckMessageType           MessageType = 111 // 消费者确认已处理的消息 c -> s AckMessage
 )
 
 // EncryptionAllowed 是否允许加密消息体
 func (m MessageType) EncryptionAllowed() bool {
 	switch m {
-	case RegisterMessageRespType, MessageRespType:
+	case RegisterMessageRespType, MessageRespType, BatchMessageRespType, SubscribeMessageRespType:
 		// 为保证客户端在token错误情况下也可以识别注册响应，此消息应禁止加密
 		return false
 	default:
@@ -36,12 +49,23 @@ func (m MessageType) EncryptionAllowed() bool {
 	}
 }
 
+// CompressionAllowed 是否允许压缩消息体
+func (m MessageType) CompressionAllowed() bool {
+	switch m {
+	case PMessageType, CMessageType, HPMessageType, HCMessageType, ReplyMessageType, BatchMessageType:
+		return true
+	default:
+		// 注册和响应等消息较短, 且需要兼容不支持压缩的对端
+		return false
+	}
+}
+
 // CombinationAllowed 是否允许组合多个消息为一个传输帧 TransferFrame
 func (m MessageType) CombinationAllowed() bool {
 	switch m {
-	case PMessageType, CMessageType:
+	case PMessageType, CMessageType, HPMessageType, HCMessageType:
 		return true
-	case RegisterMessageType, HeartbeatMessageType:
+	case RegisterMessageType, HeartbeatMessageType, SubscribeMessageType, UnsubscribeMessageType, AckMessageType:
 		// 具有实时性和身份验证，不允许组合
 		return false
 	default:
@@ -61,18 +85,256 @@ type Message interface {
 	build() ([]byte, error)           // 构建消息序列, 由于很难预先确定编码后的消息长度,因此暂不实现WriteTo方法
 }
 
+// 编码格式依赖于帧版本的消息
+type versionedMessage interface {
+	setFrameVersion(version FrameVersion)
+}
+
+// 将帧版本传递给消息, 以使消息选择对应的编码格式
+func setMessageVersion(m Message, version FrameVersion) {
+	if vm, ok := m.(versionedMessage); ok {
+		vm.setFrameVersion(version)
+	}
+}
+
+// FieldError 消息字段解析错误, 可通过 errors.Is 判断是 ErrMessageTruncated 还是 ErrFieldTooLong
+type FieldError struct {
+	Field string // 字段名称
+	Err   error
+}
+
+func (e *FieldError) Error() string { return fmt.Sprintf("%s: %v", e.Field, e.Err) }
+
+func (e *FieldError) Unwrap() error { return e.Err }
+
+// 从流中读取恰好 len(p) 个字节, 数据不足时返回 ErrMessageTruncated
+func readMessageField(reader io.Reader, p []byte, field string) error {
+	_, err := io.ReadFull(reader, p)
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &FieldError{Field: field, Err: ErrMessageTruncated}
+	}
+	return &FieldError{Field: field, Err: err}
+}
+
+// 读取一个长度为 n 的变长字段, 在分配内存之前检查长度, 避免因错误的长度字段而分配过大的内存
+func readMessageBytes(reader io.Reader, n int, field string) ([]byte, error) {
+	if uint64(n) > uint64(MaxFrameDataSize) {
+		return nil, &FieldError{Field: field, Err: ErrFieldTooLong}
+	}
+	// 对于 bytes.Reader 和 bytes.Buffer 可提前获知剩余的长度
+	if r, ok := reader.(interface{ Len() int }); ok && n > r.Len() {
+		return nil, &FieldError{Field: field, Err: ErrMessageTruncated}
+	}
+
+	p := make([]byte, n)
+	return p, readMessageField(reader, p, field)
+}
+
+// 可携带消息头的消息, 是否编码消息头由所属帧的类型决定
+type headersMessage interface {
+	setWithHeaders(with bool)
+}
+
+// 将帧类型传递给消息, 以使消息决定是否编解码消息头
+func setMessageHeaders(m Message, typ MessageType) {
+	if hm, ok := m.(headersMessage); ok {
+		hm.setWithHeaders(typ == HPMessageType || typ == HCMessageType || typ == ReplyMessageType)
+	}
+}
+
+// Headers 消息头, 用于携带 content-type, trace id 等与消息体无关的元数据
+//
+//	编码结构：
+//		|   HeaderNum   |   KeyLen   |        Key        |   ValueLen   |   Value   |  ...  |
+//		|---------------|------------|-------------------|--------------|-----------|-------|
+//	len	|       1       |      1     |  N [1-255] bytes  |       2      |     N     |  ...  |
+//	   	|---------------|------------|-------------------|--------------|-----------|-------|
+//
+//	键按字典序排列, 最多允许255个消息头
+type Headers map[string][]byte
+
+// Get 获取一个消息头, 不存在时返回nil
+func (h Headers) Get(key string) []byte { return h[key] }
+
+// Set 设置一个消息头
+func (h Headers) Set(key string, value []byte) { h[key] = value }
+
+// TTL 消息的存活时间, 未设置或无效时返回false
+func (h Headers) TTL() (time.Duration, bool) {
+	ms, err := strconv.ParseInt(string(h.Get(TTLHeader)), 10, 64)
+	if err != nil || ms <= 0 {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+// SetTTL 设置消息的存活时间, 精度为ms
+func (h Headers) SetTTL(ttl time.Duration) {
+	h.Set(TTLHeader, []byte(strconv.FormatInt(ttl.Milliseconds(), 10)))
+}
+
+// DeliverAt 消息的投递时间, 未设置或无效时返回false
+func (h Headers) DeliverAt() (time.Time, bool) {
+	ms, err := strconv.ParseInt(string(h.Get(DeliverAtHeader)), 10, 64)
+	if err != nil || ms <= 0 {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(ms), true
+}
+
+// SetDeliverAt 设置消息的投递时间, 精度为ms
+func (h Headers) SetDeliverAt(at time.Time) {
+	h.Set(DeliverAtHeader, []byte(strconv.FormatInt(at.UnixMilli(), 10)))
+}
+
+// ProducerSequence 消息的生产者ID和序列号, 未设置或无效时返回false
+func (h Headers) ProducerSequence() (string, uint64, bool) {
+	id := h.Get(ProducerIDHeader)
+	if len(id) == 0 {
+		return "", 0, false
+	}
+	seq, err := strconv.ParseUint(string(h.Get(SequenceHeader)), 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return string(id), seq, true
+}
+
+// SetProducerSequence 设置消息的生产者ID和序列号
+func (h Headers) SetProducerSequence(id string, seq uint64) {
+	h.Set(ProducerIDHeader, []byte(id))
+	h.Set(SequenceHeader, []byte(strconv.FormatUint(seq, 10)))
+}
+
+// Priority 消息的优先级, 未设置或无效时为 PriorityNormal, 超出范围时为 PriorityHigh
+func (h Headers) Priority() MessagePriority {
+	p, err := strconv.ParseUint(string(h.Get(PriorityHeader)), 10, 8)
+	if err != nil {
+		return PriorityNormal
+	}
+	if p > uint64(PriorityHigh) {
+		return PriorityHigh
+	}
+	return MessagePriority(p)
+}
+
+// SetPriority 设置消息的优先级
+func (h Headers) SetPriority(p MessagePriority) {
+	h.Set(PriorityHeader, []byte(strconv.Itoa(int(p))))
+}
+
+// RedeliveryCount 消息被重新推送的次数, 首次推送或无效时为0
+func (h Headers) RedeliveryCount() int {
+	n, err := strconv.Atoi(string(h.Get(RedeliveryHeader)))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// SetRedeliveryCount 设置消息被重新推送的次数
+func (h Headers) SetRedeliveryCount(n int) {
+	h.Set(RedeliveryHeader, []byte(strconv.Itoa(n)))
+}
+
+// 编码后的长度
+func (h Headers) length() int {
+	n := 1
+	for k, v := range h {
+		n += 1 + len(k) + 2 + len(v)
+	}
+	return n
+}
+
+func (h Headers) build() ([]byte, error) {
+	if len(h) > math.MaxUint8 {
+		return nil, fmt.Errorf("%w: %d headers", ErrFieldTooLong, len(h))
+	}
+
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	slice := make([]byte, 0, h.length())
+	slice = append(slice, byte(len(keys)))
+	for _, k := range keys {
+		v := h[k]
+		if len(k) > math.MaxUint8 || len(v) > math.MaxUint16 {
+			return nil, fmt.Errorf("%w: header '%s'", ErrFieldTooLong, k)
+		}
+		slice = append(slice, byte(len(k)))
+		slice = append(slice, k...)
+		slice = binary.BigEndian.AppendUint16(slice, uint16(len(v)))
+		slice = append(slice, v...)
+	}
+
+	return slice, nil
+}
+
+func (h Headers) parseFrom(reader io.Reader, bc *bytesCache) error {
+	if bc.err = readMessageField(reader, bc.oneByte, "headers"); bc.err != nil {
+		return bc.err
+	}
+
+	num := bc.OneValue()
+	for i := 0; i < num; i++ {
+		if bc.err = readMessageField(reader, bc.oneByte, "header key"); bc.err != nil {
+			return bc.err
+		}
+		key, err := readMessageBytes(reader, bc.OneValue(), "header key")
+		if err != nil {
+			return err
+		}
+
+		if bc.err = readMessageField(reader, bc.twoByte, "header value"); bc.err != nil {
+			return bc.err
+		}
+		value, err := readMessageBytes(reader, bc.TwoValue(), "header value")
+		if err != nil {
+			return err
+		}
+
+		h[string(key)] = value
+	}
+
+	return nil
+}
+
 // PMessage 生产者消息数据, 不允许复制
 //
 //	消息结构：
-//		|   TopicLen   |      Topic      |   KeyLen   |        key        |   ValueLen   |   Value   |
-//		|--------------|-----------------|------------|-------------------|--------------|-----------|
-//	len	|      1       | N [1-255] bytes |      1     |  N [1-255] bytes  |       2      |     N     |
-//	   	|--------------|-----------------|------------|-------------------|--------------|-----------|
+//		|   TopicLen   |      Topic      |   KeyLen   |        key        |   ValueLen   |   Value   |   Headers   |
+//		|--------------|-----------------|------------|-------------------|--------------|-----------|-------------|
+//	len	|      1       | N [1-255] bytes |      1     |  N [1-255] bytes  |     2/4      |     N     |      N      |
+//	   	|--------------|-----------------|------------|-------------------|--------------|-----------|-------------|
+//
+//	ValueLen 在 FrameV1 帧内为2个字节, 在 FrameV2 帧内为4个字节
+//	Headers 仅存在于 HPMessageType 帧内, 其编码结构见 Headers; 当 Headers 不为空时消息类别为 HPMessageType
 type PMessage struct {
-	noCopy NoCopy
-	Topic  []byte // 字符串转字节
-	Key    []byte
-	Value  []byte
+	noCopy      NoCopy
+	Topic       []byte // 字符串转字节
+	Key         []byte
+	Value       []byte
+	Headers     Headers      // 消息头, 可以为nil
+	version     FrameVersion // 所属帧的版本, 决定 ValueLen 的长度
+	withHeaders bool         // 所属帧是否携带消息头
+}
+
+func (m *PMessage) setFrameVersion(version FrameVersion) { m.version = version }
+
+func (m *PMessage) setWithHeaders(with bool) { m.withHeaders = with }
+
+// 值长度字段所占的字节数
+func (m *PMessage) valueLenSize() int {
+	if m.version == FrameV2 {
+		return 4
+	}
+	return 2
 }
 
 func (m *PMessage) String() string {
@@ -83,7 +345,12 @@ func (m *PMessage) String() string {
 	)
 }
 
-func (m *PMessage) MessageType() MessageType { return PMessageType }
+func (m *PMessage) MessageType() MessageType {
+	if m.withHeaders || len(m.Headers) > 0 {
+		return HPMessageType
+	}
+	return PMessageType
+}
 
 func (m *PMessage) MarshalMethod() MarshalMethodType {
 	return BinaryMarshalMethod
@@ -91,13 +358,20 @@ func (m *PMessage) MarshalMethod() MarshalMethodType {
 
 // Length 获取编码后的消息序列长度
 func (m *PMessage) length() int {
-	return len(m.Topic) + len(m.Key) + len(m.Value) + 4
+	n := len(m.Topic) + len(m.Key) + len(m.Value) + 2 + m.valueLenSize()
+	if m.withHeaders {
+		n += m.Headers.length()
+	}
+	return n
 }
 
 func (m *PMessage) Reset() {
 	m.Topic = nil
 	m.Key = nil
 	m.Value = nil
+	m.Headers = nil
+	m.version = FrameV1
+	m.withHeaders = false
 }
 
 func (m *PMessage) parse(stream []byte) error {
@@ -109,61 +383,79 @@ func (m *PMessage) parseFrom(reader io.Reader) error {
 	//		Topic       []byte
 	//		KeyLength   byte
 	//		Key         []byte
-	//		ValueLength uint16
+	//		ValueLength uint16/uint32
 	//		Value       []byte
+	//		Headers     (HPMessageType)
 
 	bc := bcPool.Get()
 	defer bcPool.Put(bc)
 
+	var err error
+
 	// topicLength , topic
-	bc.i, bc.err = reader.Read(bc.oneByte)
-	if bc.err != nil {
-		return fmt.Errorf("topic did not read: %v", bc.err)
+	if err = readMessageField(reader, bc.oneByte, "topic"); err != nil {
+		return err
 	}
-
-	m.Topic = make([]byte, bc.OneValue())
-	bc.i, bc.err = reader.Read(m.Topic)
-	if bc.err != nil {
-		return fmt.Errorf("topic did not read: %v", bc.err)
+	if m.Topic, err = readMessageBytes(reader, bc.OneValue(), "topic"); err != nil {
+		return err
 	}
 
 	// keyLength , key
-	bc.i, bc.err = reader.Read(bc.oneByte)
-	if bc.err != nil {
-		return fmt.Errorf("key did not read: %v", bc.err)
+	if err = readMessageField(reader, bc.oneByte, "key"); err != nil {
+		return err
 	}
-
-	m.Key = make([]byte, bc.OneValue())
-	bc.i, bc.err = reader.Read(m.Key)
-	if bc.err != nil {
-		return fmt.Errorf("key did not read: %v", bc.err)
+	if m.Key, err = readMessageBytes(reader, bc.OneValue(), "key"); err != nil {
+		return err
 	}
 
 	// valueLength , value
-	bc.i, bc.err = reader.Read(bc.twoByte)
-	if bc.err != nil {
-		return fmt.Errorf("value did not read: %v", bc.err)
+	var valueLength int
+	if m.version == FrameV2 {
+		err = readMessageField(reader, bc.fourByte, "value")
+		valueLength = int(bc.FourValue())
+	} else {
+		err = readMessageField(reader, bc.twoByte, "value")
+		valueLength = bc.TwoValue()
+	}
+	if err != nil {
+		return err
+	}
+	if m.Value, err = readMessageBytes(reader, valueLength, "value"); err != nil {
+		return err
 	}
 
-	m.Value = make([]byte, bc.TwoValue())
-	bc.i, bc.err = reader.Read(m.Value)
-	if bc.err != nil {
-		return fmt.Errorf("key did not read: %v", bc.err)
+	if m.withHeaders {
+		m.Headers = Headers{}
+		return m.Headers.parseFrom(reader, bc)
 	}
 
 	return nil
 }
 
 func (m *PMessage) build() ([]byte, error) {
+	if len(m.Topic) > math.MaxUint8 || len(m.Key) > math.MaxUint8 {
+		return nil, fmt.Errorf("%w: topic or key longer than %d bytes", ErrFieldTooLong, math.MaxUint8)
+	}
+
 	slice := make([]byte, 0, m.length()) // 分配最大长度
-	vl := make([]byte, 2)
-	binary.BigEndian.PutUint16(vl, uint16(len(m.Value)))
+	vl := make([]byte, m.valueLenSize())
+	if m.version == FrameV2 {
+		if uint64(len(m.Value)) > math.MaxUint32 {
+			return nil, fmt.Errorf("%w: value of %d bytes", ErrFieldTooLong, len(m.Value))
+		}
+		binary.BigEndian.PutUint32(vl, uint32(len(m.Value)))
+	} else {
+		if len(m.Value) > math.MaxUint16 {
+			return nil, fmt.Errorf("%w: value of %d bytes, use FrameV2 instead", ErrFieldTooLong, len(m.Value))
+		}
+		binary.BigEndian.PutUint16(vl, uint16(len(m.Value)))
+	}
 
 	//		TopicLength byte
 	//		Topic       []byte
 	//		KeyLength   byte
 	//		Key         []bytes
-	//		ValueLength uint16
+	//		ValueLength uint16/uint32
 	//		Value       []byte
 	slice = append(slice, byte(len(m.Topic)))
 	slice = append(slice, m.Topic...)
@@ -172,9 +464,37 @@ func (m *PMessage) build() ([]byte, error) {
 	slice = append(slice, vl...)
 	slice = append(slice, m.Value...)
 
+	if m.withHeaders {
+		_bytes, err := m.Headers.build()
+		if err != nil {
+			return nil, err
+		}
+		slice = append(slice, _bytes...)
+	}
+
 	return slice, nil
 }
 
+// ========================================== 回复消息协议定义 ==========================================
+
+// ReplyMessage 请求的回复消息, 编码与 HPMessageType 一致
+// Topic 为请求消息头 ReplyToHeader 的值, Headers 必须包含请求的 CorrelationIDHeader
+type ReplyMessage struct {
+	PMessage
+}
+
+func (m *ReplyMessage) String() string {
+	return fmt.Sprintf(
+		"<Message:%s> to [ T::%s | C::%s ] with %d bytes of payload",
+		descriptors[m.MessageType()].text, m.Topic, m.CorrelationID(), len(m.Value),
+	)
+}
+
+func (m *ReplyMessage) MessageType() MessageType { return ReplyMessageType }
+
+// CorrelationID 所回复请求的关联ID
+func (m *ReplyMessage) CorrelationID() string { return string(m.Headers.Get(CorrelationIDHeader)) }
+
 // ========================================== 消费者消息记录协议定义 ==========================================
 
 // CMessage 消费者消息记录, 不允许复制
@@ -182,12 +502,43 @@ func (m *PMessage) build() ([]byte, error) {
 //	消息结构：
 //		|   TopicLen   |      Topic      |   KeyLen   |        key        |   ValueLen   |   Value   |   Offset   |   ProductTime   |
 //		|--------------|-----------------|------------|-------------------|--------------|-----------|------------|-----------------|
-//	len	|      1       | N [1-255] bytes |      1     |  N [1-255] bytes  |       2      |     N     |      8     |         8       |
+//	len	|      1       | N [1-255] bytes |      1     |  N [1-255] bytes  |     2/4      |     N     |      8     |         8       |
 //	   	|--------------|-----------------|------------|-------------------|--------------|-----------|------------|-----------------|
+//
+//	ValueLen 的长度与 PMessage 一致, 对于 HCMessageType 帧, Value 之后紧跟 Headers
 type CMessage struct {
 	Offset      []byte // uint64
 	ProductTime []byte // time.Time.Unix() 消息创建的Unix时间戳
 	PM          *PMessage
+	// 消息所属的分区, 仅当所在帧设置了 FlagPartition 时才会编码
+	Partition     uint16
+	withPartition bool
+}
+
+// 可携带分区号的消息
+type partitionMessage interface {
+	setWithPartition(with bool)
+}
+
+// 依据帧的标志位确定消息是否携带分区号
+func setMessagePartition(m Message, with bool) {
+	if pm, ok := m.(partitionMessage); ok {
+		pm.setWithPartition(with)
+	}
+}
+
+func (m *CMessage) setWithPartition(with bool) { m.withPartition = with }
+
+func (m *CMessage) setFrameVersion(version FrameVersion) {
+	if m.PM != nil {
+		m.PM.setFrameVersion(version)
+	}
+}
+
+func (m *CMessage) setWithHeaders(with bool) {
+	if m.PM != nil {
+		m.PM.setWithHeaders(with)
+	}
 }
 
 func (m *CMessage) String() string {
@@ -198,7 +549,12 @@ func (m *CMessage) String() string {
 	)
 }
 
-func (m *CMessage) MessageType() MessageType { return CMessageType }
+func (m *CMessage) MessageType() MessageType {
+	if m.PM != nil && m.PM.MessageType() == HPMessageType {
+		return HCMessageType
+	}
+	return CMessageType
+}
 
 func (m *CMessage) MarshalMethod() MarshalMethodType {
 	return BinaryMarshalMethod
@@ -207,6 +563,8 @@ func (m *CMessage) MarshalMethod() MarshalMethodType {
 func (m *CMessage) Reset() {
 	m.Offset = make([]byte, 8)
 	m.ProductTime = make([]byte, 8)
+	m.Partition = 0
+	m.withPartition = false
 	if m.PM != nil {
 		m.PM.Reset()
 	}
@@ -221,25 +579,32 @@ func (m *CMessage) parseFrom(reader io.Reader) error {
 	//		Topic       []byte
 	//		KeyLength   byte
 	//		Key         []byte
-	//		ValueLength uint16
+	//		ValueLength uint16/uint32
 	//		Value       []byte
 	//		Offset      uint64
 	//		ProductTime int64 // time.Time.Unix()
+	//		Partition   uint16 // 仅 FlagPartition
 
 	err := m.PM.parseFrom(reader)
 	if err != nil {
 		return err
 	}
 
-	_, err = reader.Read(m.Offset)
-	if err != nil {
-		return fmt.Errorf("offset did not read: %v", err)
+	if err = readMessageField(reader, m.Offset, "offset"); err != nil {
+		return err
+	}
+	if err = readMessageField(reader, m.ProductTime, "product time"); err != nil {
+		return err
+	}
+	if !m.withPartition {
+		return nil
 	}
 
-	_, err = reader.Read(m.ProductTime)
-	if err != nil {
-		return fmt.Errorf("ProductTime did not read: %v", err)
+	partition := make([]byte, 2)
+	if err = readMessageField(reader, partition, "partition"); err != nil {
+		return err
 	}
+	m.Partition = binary.BigEndian.Uint16(partition)
 
 	return nil
 }
@@ -251,14 +616,21 @@ func (m *CMessage) build() ([]byte, error) {
 	//		Topic       []byte
 	//		KeyLength   byte
 	//		Key         []byte
-	//		ValueLength uint16
+	//		ValueLength uint16/uint32
 	//		Value       []byte
 	//		Offset      uint64
 	//		ProductTime int64 // time.Time.Unix()
-	_bytes, _ := m.PM.build()
+	//		Partition   uint16 // 仅 FlagPartition
+	_bytes, err := m.PM.build()
+	if err != nil {
+		return nil, err
+	}
 	slice = append(slice, _bytes...)
 	slice = append(slice, m.Offset...)
 	slice = append(slice, m.ProductTime...)
+	if m.withPartition {
+		slice = binary.BigEndian.AppendUint16(slice, m.Partition)
+	}
 
 	return slice, nil
 }
@@ -271,6 +643,27 @@ type RegisterMessage struct {
 	Ack    AckType  `json:"ack"`
 	Type   LinkType `json:"type"`
 	Token  string   `json:"token,omitempty"` // 认证密钥的hash值，当此值不为空时强制有效
+	// 客户端实现的协议版本, 旧版本客户端不携带此字段, 视为 LegacyProtocolVersion
+	Version int `json:"version,omitempty"`
+	// 客户端支持的可选能力, 服务端会在注册响应中返回双方协商后的能力集合
+	Capabilities Capabilities `json:"capabilities,omitempty"`
+	// 消费者在各主题内的起始位置, 以主题名称为键, 未指定的主题为 StartLatest; 依赖 ReplayCapability
+	Positions map[string]*StartPosition `json:"positions,omitempty"`
+	// 消费者组名称, 为空时消费者接收主题内的全部消息; 依赖 GroupCapability
+	Group string `json:"group,omitempty"`
+	// 消费者组内分配消息的方式, 以组内首个成员的设置为准, 缺省为 RoundRobinBalance
+	Balance BalanceType `json:"balance,omitempty"`
+	// 消费者ID, 由消费者生成, 在重连后保持不变; 服务端据此将未确认的消息重新推送给重连的消费者, 依赖 AckCapability
+	ID      string            `json:"id,omitempty"`
+	marshal MarshalMethodType // 由所在帧决定的序列化方法
+}
+
+// StartPosition 消费者在主题内的起始位置
+type StartPosition struct {
+	Type  StartPositionType `json:"type"`
+	Value uint64            `json:"value,omitempty" description:"StartOffset 时为偏移量, StartTimestamp 时为Unix毫秒时间戳"`
+	// 各分区的起始偏移量, 优先于 Type 和 Value; 未列出的分区依据 Type 和 Value 确定
+	Offsets map[uint16]uint64 `json:"offsets,omitempty" description:"各分区的起始偏移量"`
 }
 
 func (m *RegisterMessage) String() string {
@@ -280,24 +673,46 @@ func (m *RegisterMessage) String() string {
 	)
 }
 
+// ProtocolVersion 客户端实现的协议版本
+func (m *RegisterMessage) ProtocolVersion() int {
+	if m.Version < LegacyProtocolVersion {
+		return LegacyProtocolVersion
+	}
+	return m.Version
+}
+
 func (m *RegisterMessage) MessageType() MessageType { return RegisterMessageType }
 
 func (m *RegisterMessage) MarshalMethod() MarshalMethodType {
+	if m.marshal == BinaryMarshalMethod {
+		return BinaryMarshalMethod
+	}
 	return JsonMarshalMethod
 }
 
+func (m *RegisterMessage) setMarshalMethod(method MarshalMethodType) { m.marshal = method }
+
 func (m *RegisterMessage) Reset() {}
 
 func (m *RegisterMessage) parse(stream []byte) error {
+	if m.MarshalMethod() == BinaryMarshalMethod {
+		return m.parseBinary(bytes.NewReader(stream))
+	}
 	return helper.JsonUnmarshal(stream, m)
 }
 
 // ParseFrom 从reader解析消息，此操作不够优化，应考虑使用 Parse 方法
 func (m *RegisterMessage) parseFrom(reader io.Reader) error {
+	if m.MarshalMethod() == BinaryMarshalMethod {
+		return m.parseBinary(reader)
+	}
 	return JsonMessageParseFrom(reader, m)
 }
 
 func (m *RegisterMessage) build() ([]byte, error) {
+	if m.MarshalMethod() == BinaryMarshalMethod {
+		return m.buildBinary()
+	}
 	return helper.JsonMarshal(m)
 }
 
@@ -307,6 +722,7 @@ func (m *RegisterMessage) build() ([]byte, error) {
 type HeartbeatMessage struct {
 	Type      LinkType `json:"type" description:"客户端类型"`
 	CreatedAt int64    `json:"created_at" description:"客户端创建时间戳"`
+	marshal   MarshalMethodType
 }
 
 func (m *HeartbeatMessage) MessageType() MessageType {
@@ -314,9 +730,14 @@ func (m *HeartbeatMessage) MessageType() MessageType {
 }
 
 func (m *HeartbeatMessage) MarshalMethod() MarshalMethodType {
+	if m.marshal == BinaryMarshalMethod {
+		return BinaryMarshalMethod
+	}
 	return JsonMarshalMethod
 }
 
+func (m *HeartbeatMessage) setMarshalMethod(method MarshalMethodType) { m.marshal = method }
+
 func (m *HeartbeatMessage) String() string {
 	return fmt.Sprintf(
 		"<Message:%s> from %s", descriptors[m.MessageType()].text, m.Type,
@@ -326,14 +747,23 @@ func (m *HeartbeatMessage) String() string {
 func (m *HeartbeatMessage) Reset() {}
 
 func (m *HeartbeatMessage) parse(stream []byte) error {
+	if m.MarshalMethod() == BinaryMarshalMethod {
+		return m.parseBinary(bytes.NewReader(stream))
+	}
 	return helper.JsonUnmarshal(stream, m)
 }
 
 func (m *HeartbeatMessage) parseFrom(reader io.Reader) error {
+	if m.MarshalMethod() == BinaryMarshalMethod {
+		return m.parseBinary(reader)
+	}
 	return JsonMessageParseFrom(reader, m)
 }
 
 func (m *HeartbeatMessage) build() ([]byte, error) {
+	if m.MarshalMethod() == BinaryMarshalMethod {
+		return m.buildBinary()
+	}
 	return helper.JsonMarshal(m)
 }
 
@@ -351,6 +781,15 @@ type MessageResponse struct {
 	// 消费者需要按照此参数，在此周期内向服务端发送心跳
 	// 生产者在此周期内若没有数据产生，也应发送心跳
 	Keepalive float64 `json:"keepalive" description:"心跳间隔，单位s"`
+	// 协商后的协议版本, 仅注册响应有效
+	Version int `json:"version,omitempty" description:"协商后的协议版本"`
+	// 协商后双方均支持的能力, 仅注册响应有效
+	Capabilities Capabilities `json:"capabilities,omitempty" description:"协商后的能力集合"`
+	// 批量消息中每个消息的偏移量, 仅 BatchMessageRespType 有效
+	Offsets []uint64 `json:"offsets,omitempty" description:"批量消息的偏移量"`
+	// 幂等生产者消息的序列号, 帧内存在多个消息时为最后一个消息的序列号, 仅 MessageRespType 有效
+	Sequence uint64 `json:"sequence,omitempty" description:"幂等生产者消息的序列号"`
+	marshal  MarshalMethodType
 }
 
 func (m *MessageResponse) String() string {
@@ -369,33 +808,45 @@ func (m *MessageResponse) MessageType() MessageType {
 }
 
 func (m *MessageResponse) MarshalMethod() MarshalMethodType {
+	if m.marshal == BinaryMarshalMethod {
+		return BinaryMarshalMethod
+	}
 	return JsonMarshalMethod
 }
 
+func (m *MessageResponse) setMarshalMethod(method MarshalMethodType) { m.marshal = method }
+
 func (m *MessageResponse) Reset() {
 	m.Status = RefusedStatus
 	m.Offset = 0
 	m.ReceiveTime = 0
 	m.TickerInterval = 0
 	m.Keepalive = 0
+	m.Version = 0
+	m.Capabilities = nil
+	m.Offsets = nil
+	m.Sequence = 0
 }
 
 func (m *MessageResponse) parse(stream []byte) error {
+	if m.MarshalMethod() == BinaryMarshalMethod {
+		return m.parseBinary(bytes.NewReader(stream))
+	}
 	return helper.JsonUnmarshal(stream, m)
 }
 
 // ParseFrom 从reader解析消息，此操作不够优化，应考虑使用 Parse 方法
 func (m *MessageResponse) parseFrom(reader io.Reader) error {
-	_bytes := make([]byte, 65526)
-	n, err := reader.Read(_bytes)
-	if err != nil && !errors.Is(err, io.EOF) {
-		return err
+	if m.MarshalMethod() == BinaryMarshalMethod {
+		return m.parseBinary(reader)
 	}
-
-	return helper.JsonUnmarshal(_bytes[:n], m)
+	return JsonMessageParseFrom(reader, m)
 }
 
 func (m *MessageResponse) build() ([]byte, error) {
+	if m.MarshalMethod() == BinaryMarshalMethod {
+		return m.buildBinary()
+	}
 	return helper.JsonMarshal(m)
 }
 
@@ -403,6 +854,8 @@ func (m *MessageResponse) Accepted() bool { return m.Status == AcceptedStatus }
 
 // ========================================== 协议定义 End ==========================================
 
+// NotImplementMessage 未实现的消息, 包外定义的自定义消息应嵌入此结构体,
+// 并实现 encoding.BinaryMarshaler 和 encoding.BinaryUnmarshaler, 或以 JsonMarshalMethod 编解码
 type NotImplementMessage struct{}
 
 func (m NotImplementMessage) String() string {
@@ -102,12 +102,18 @@ type bytesCache struct {
 	err       error
 	oneByte   []byte
 	twoByte   []byte
+	fourByte  []byte
+	threeByte []byte
+	eightByte []byte
 	byteOrder string
 }
 
 func (m *bytesCache) Reset() {
 	m.oneByte = make([]byte, 1)
 	m.twoByte = make([]byte, 2)
+	m.fourByte = make([]byte, 4)
+	m.threeByte = make([]byte, 3)
+	m.eightByte = make([]byte, 8)
 	m.i = 0
 	m.err = nil
 }
@@ -121,6 +127,20 @@ func (m *bytesCache) TwoValue() int {
 	return int(binary.BigEndian.Uint16(m.twoByte))
 }
 
+func (m *bytesCache) FourValue() uint32 {
+	if m.byteOrder == "little" {
+		return binary.LittleEndian.Uint32(m.fourByte)
+	}
+	return binary.BigEndian.Uint32(m.fourByte)
+}
+
+func (m *bytesCache) EightValue() uint64 {
+	if m.byteOrder == "little" {
+		return binary.LittleEndian.Uint64(m.eightByte)
+	}
+	return binary.BigEndian.Uint64(m.eightByte)
+}
+
 type bytesCachePool struct {
 	pool *sync.Pool
 }
@@ -0,0 +1,269 @@
+package proto
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// FieldLayout 帧或消息内一个字段的编码布局, 用于生成协议文档
+type FieldLayout struct {
+	Name        string `json:"name"`
+	Size        string `json:"size" description:"字节数, N表示变长"`
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+// Layouter 可描述自身二进制编码布局的消息, 自定义消息可实现此接口以出现在协议文档中
+type Layouter interface {
+	Layout() []FieldLayout
+}
+
+// MessageSpec 消息的机器可读描述
+type MessageSpec struct {
+	Code           MessageType         `json:"code"`
+	Name           string              `json:"name"`
+	UserDefined    bool                `json:"user_defined" description:"是否为通过 BindMessageHandler 添加的自定义消息"`
+	NeedACK        bool                `json:"need_ack"`
+	Ack            string              `json:"ack,omitempty" description:"响应消息的名称"`
+	Encryption     bool                `json:"encryption" description:"是否允许加密消息体"`
+	Compression    bool                `json:"compression" description:"是否允许压缩消息体"`
+	Combination    bool                `json:"combination" description:"是否允许将多个消息组合为一个帧"`
+	MarshalMethods []MarshalMethodType `json:"marshal_methods"`
+	Binary         []FieldLayout       `json:"binary,omitempty" description:"二进制编码布局"`
+	JSON           []FieldLayout       `json:"json,omitempty" description:"JSON编码字段"`
+}
+
+// Descriptors 获取全部已实现的消息描述符, 包括通过 AddDescriptor 添加的自定义消息, 按消息类别排序
+func Descriptors() []*Descriptor {
+	ds := make([]*Descriptor, 0)
+	for i := 0; i < TotalNumberOfMessages; i++ {
+		if descriptors[i].code == MessageType(i) && MessageType(i) != NotImplementMessageType {
+			ds = append(ds, descriptors[i])
+		}
+	}
+	return ds
+}
+
+// Message 消息定义的实例, 仅用于文档描述
+func (m Descriptor) Message() Message { return m.message }
+
+// AckMessage 消息交互的返回值, 可能为nil
+func (m Descriptor) AckMessage() Message { return m.ackMessage }
+
+// Spec 消息的机器可读描述
+func (m Descriptor) Spec() *MessageSpec {
+	spec := &MessageSpec{
+		Code:           m.code,
+		Name:           m.text,
+		UserDefined:    m.userDefined,
+		NeedACK:        m.NeedACK(),
+		Encryption:     m.code.EncryptionAllowed(),
+		Compression:    m.code.CompressionAllowed(),
+		Combination:    m.code.CombinationAllowed(),
+		MarshalMethods: make([]MarshalMethodType, 0),
+	}
+	if m.ackMessage != nil {
+		spec.Ack = descriptors[m.ackMessage.MessageType()].text
+	}
+	if m.message == nil {
+		return spec
+	}
+
+	if l, ok := m.message.(Layouter); ok {
+		spec.MarshalMethods = append(spec.MarshalMethods, BinaryMarshalMethod)
+		spec.Binary = l.Layout()
+	}
+	// 控制消息同时支持两种编码, 默认为JSON
+	if _, ok := m.message.(marshalMessage); ok || m.message.MarshalMethod() == JsonMarshalMethod {
+		spec.MarshalMethods = append(spec.MarshalMethods, JsonMarshalMethod)
+		spec.JSON = JsonLayout(m.message)
+	}
+
+	return spec
+}
+
+// FrameLayout 帧的编码布局
+func FrameLayout(version FrameVersion) []FieldLayout {
+	head := FieldLayout{Name: "head", Size: "1", Type: "uint8", Description: fmt.Sprintf("恒为 0x%02X", FrameHead)}
+	tail := FieldLayout{Name: "tail", Size: "1", Type: "uint8", Description: fmt.Sprintf("恒为 0x%02X", FrameTail)}
+	mType := FieldLayout{Name: "mType", Size: "1", Type: "uint8", Description: "消息类别"}
+	data := FieldLayout{Name: "data", Size: "N", Type: "bytes", Description: "若干个相同类别的消息, 可能经过压缩和加密"}
+
+	if version == FrameV2 {
+		return []FieldLayout{
+			head,
+			{Name: "version", Size: "1", Type: "uint8", Description: fmt.Sprintf("恒为 0x%02X", byte(FrameV2))},
+			{Name: "flags", Size: "1", Type: "uint8", Description: "标志位"},
+			mType,
+			{Name: "dataSize", Size: "4", Type: "uint32", Description: "data 的长度"},
+			data,
+			{Name: "checksum", Size: "4", Type: "uint32", Description: "FlagCRC32C 时为 CRC32C, 否则为 CalcChecksum"},
+			tail,
+		}
+	}
+
+	return []FieldLayout{
+		head,
+		mType,
+		{Name: "dataSize", Size: "2", Type: "uint16", Description: "data 的长度"},
+		data,
+		{Name: "checksum", Size: "2", Type: "uint16", Description: "CalcChecksum"},
+		tail,
+	}
+}
+
+// FrameFlagLayout v2 帧标志位的含义, 键为标志位的值
+func FrameFlagLayout() map[FrameFlag]string {
+	return map[FrameFlag]string{
+		FlagCRC32C:        "校验和采用 CRC32C",
+		FlagCompressed:    "载荷已压缩, 解密后的首字节为 CompressCode",
+		FlagBinaryMarshal: "控制消息采用二进制编码",
+		FlagPartition:     "消费者消息携带分区号",
+	}
+}
+
+// JsonLayout 依据 json 标签反射得到消息的JSON字段
+func JsonLayout(m Message) []FieldLayout {
+	rt := reflect.TypeOf(m)
+	for rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	if rt.Kind() != reflect.Struct {
+		return nil
+	}
+
+	fields := make([]FieldLayout, 0, rt.NumField())
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, FieldLayout{
+			Name:        name,
+			Size:        "N",
+			Type:        jsonType(field.Type),
+			Description: field.Tag.Get("description"),
+		})
+	}
+
+	return fields
+}
+
+// 字段类型对应的JSON类型
+func jsonType(rt reflect.Type) string {
+	switch rt.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		if rt.Elem().Kind() == reflect.Uint8 {
+			return "string" // base64
+		}
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// ========================================== 内置消息的编码布局 ==========================================
+
+func pmLayout(description string) []FieldLayout {
+	return []FieldLayout{
+		{Name: "topicLen", Size: "1", Type: "uint8"},
+		{Name: "topic", Size: "N", Type: "bytes", Description: "[1-255] bytes"},
+		{Name: "keyLen", Size: "1", Type: "uint8"},
+		{Name: "key", Size: "N", Type: "bytes", Description: "[0-255] bytes"},
+		{Name: "valueLen", Size: "2/4", Type: "uint16/uint32", Description: "FrameV1 为2字节, FrameV2 为4字节"},
+		{Name: "value", Size: "N", Type: "bytes"},
+		{Name: "headers", Size: "N", Type: "headers", Description: description},
+	}
+}
+
+func (m *PMessage) Layout() []FieldLayout {
+	return pmLayout("仅 HPMessageType: num(1) | [keyLen(1) | key | valueLen(2) | value]*, 键按字典序排列")
+}
+
+func (m *CMessage) Layout() []FieldLayout {
+	return append(
+		pmLayout("仅 HCMessageType, 编码同 HPMessageType"),
+		FieldLayout{Name: "offset", Size: "8", Type: "uint64", Description: "消息在主题内的偏移量"},
+		FieldLayout{Name: "productTime", Size: "8", Type: "int64", Description: "消息接收时的Unix时间戳"},
+		FieldLayout{Name: "partition", Size: "2", Type: "uint16", Description: "消息所属的分区, 仅当帧设置了 FlagPartition 时出现"},
+	)
+}
+
+func (m *ReplyMessage) Layout() []FieldLayout {
+	return pmLayout("编码同 HPMessageType, 必须包含 x-correlation-id")
+}
+
+// 二进制编码的字符串列表
+const shortStringsDescription = "num(1) | [len(1) | string]*"
+
+func (m *RegisterMessage) Layout() []FieldLayout {
+	return []FieldLayout{
+		{Name: "type", Size: "1", Type: "uint8", Description: "1: CONSUMER, 2: PRODUCER"},
+		{Name: "ack", Size: "1", Type: "uint8", Description: "1: 0, 2: 1, 3: all"},
+		{Name: "version", Size: "1", Type: "uint8", Description: "协议版本"},
+		{Name: "token", Size: "N", Type: "string", Description: "len(1) | string"},
+		{Name: "topics", Size: "N", Type: "strings", Description: shortStringsDescription},
+		{Name: "capabilities", Size: "N", Type: "strings", Description: shortStringsDescription},
+		{Name: "positions", Size: "N", Type: "array", Description: "num(1) | [topic | type(1) | value(8)]*, type 为 0: latest, 1: earliest, 2: offset, 3: timestamp, 可省略"},
+		{Name: "group", Size: "N", Type: "string", Description: "len(1) | string, 消费者组名称, 可省略"},
+		{Name: "balance", Size: "1", Type: "uint8", Description: "0: 缺省, 1: round-robin, 2: key-hash, 仅在 group 或 offsets 存在时出现"},
+		{Name: "offsets", Size: "N", Type: "array", Description: "num(1) | [topic | num(1) | [partition(2) | offset(8)]*]*, 各主题内各分区的起始偏移量, 可省略"},
+		{Name: "id", Size: "N", Type: "string", Description: "len(1) | string, 消费者ID, 可省略"},
+	}
+}
+
+func (m *BatchMessage) Layout() []FieldLayout {
+	return []FieldLayout{
+		{Name: "num", Size: "2", Type: "uint16", Description: "消息数量"},
+		{Name: "messages", Size: "N", Type: "array", Description: "若干个生产者消息, 编码同 HPMessageType"},
+	}
+}
+
+func (m *SubscribeMessage) Layout() []FieldLayout {
+	return []FieldLayout{
+		{Name: "topics", Size: "N", Type: "strings", Description: shortStringsDescription},
+		{Name: "positions", Size: "N", Type: "array", Description: "编码同 RegisterMessage, 仅订阅时有效, 可省略"},
+		{Name: "offsets", Size: "N", Type: "array", Description: "编码同 RegisterMessage, 仅在 positions 存在时出现"},
+	}
+}
+
+func (m *AckMessage) Layout() []FieldLayout {
+	return []FieldLayout{
+		{Name: "num", Size: "2", Type: "uint16", Description: "确认的消息数量"},
+		{Name: "acks", Size: "N", Type: "array", Description: "[topic(len(1) | string) | partition(2) | offset(8)]*"},
+	}
+}
+
+func (m *HeartbeatMessage) Layout() []FieldLayout {
+	return []FieldLayout{
+		{Name: "type", Size: "1", Type: "uint8", Description: "1: CONSUMER, 2: PRODUCER"},
+		{Name: "createdAt", Size: "8", Type: "int64", Description: "Unix时间戳"},
+	}
+}
+
+func (m *MessageResponse) Layout() []FieldLayout {
+	return []FieldLayout{
+		{Name: "status", Size: "1", Type: "uint8", Description: "MessageResponseStatus 的十进制数值"},
+		{Name: "offset", Size: "8", Type: "uint64"},
+		{Name: "receiveTime", Size: "8", Type: "int64", Description: "Unix时间戳"},
+		{Name: "tickerInterval", Size: "4", Type: "uint32", Description: "单位ms"},
+		{Name: "keepalive", Size: "8", Type: "float64", Description: "单位s, IEEE 754"},
+		{Name: "version", Size: "1", Type: "uint8", Description: "协商后的协议版本"},
+		{Name: "capabilities", Size: "N", Type: "strings", Description: shortStringsDescription},
+		{Name: "offsets", Size: "N", Type: "array", Description: "num(2) | [offset(8)]*, 仅 BatchMessageRespType 有效, 可省略"},
+	}
+}
@@ -0,0 +1,66 @@
+package proto
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Chendemo12/fastapi-tool/helper"
+	"io"
+)
+
+// ========================================== 订阅消息协议定义 ==========================================
+
+// SubscribeMessage 已注册的消费者在不重新连接的情况下订阅或取消订阅主题, 依赖 SubscribeCapability;
+// 服务端以 SubscribeMessageRespType 响应, 此后推送的消息即按新的订阅列表推送
+type SubscribeMessage struct {
+	Type   MessageType `json:"-"`      // SubscribeMessageType 或 UnsubscribeMessageType
+	Topics []string    `json:"topics"` // 订阅或取消订阅的主题名称, 协商了 WildcardCapability 时可为通配符模式
+	// 新订阅的主题的起始位置, 以主题名称为键, 仅订阅时有效; 依赖 ReplayCapability
+	Positions map[string]*StartPosition `json:"positions,omitempty"`
+	marshal   MarshalMethodType         // 由所在帧决定的序列化方法
+}
+
+func (m *SubscribeMessage) String() string {
+	return fmt.Sprintf("<Message:%s> %v", descriptors[m.MessageType()].text, m.Topics)
+}
+
+func (m *SubscribeMessage) MessageType() MessageType {
+	if m.Type == UnsubscribeMessageType {
+		return UnsubscribeMessageType
+	}
+	return SubscribeMessageType
+}
+
+func (m *SubscribeMessage) MarshalMethod() MarshalMethodType {
+	if m.marshal == BinaryMarshalMethod {
+		return BinaryMarshalMethod
+	}
+	return JsonMarshalMethod
+}
+
+func (m *SubscribeMessage) setMarshalMethod(method MarshalMethodType) { m.marshal = method }
+
+func (m *SubscribeMessage) Reset() {
+	m.Topics = nil
+	m.Positions = nil
+}
+
+func (m *SubscribeMessage) parse(stream []byte) error {
+	if m.MarshalMethod() == BinaryMarshalMethod {
+		return m.parseBinary(bytes.NewReader(stream))
+	}
+	return helper.JsonUnmarshal(stream, m)
+}
+
+func (m *SubscribeMessage) parseFrom(reader io.Reader) error {
+	if m.MarshalMethod() == BinaryMarshalMethod {
+		return m.parseBinary(reader)
+	}
+	return JsonMessageParseFrom(reader, m)
+}
+
+func (m *SubscribeMessage) build() ([]byte, error) {
+	if m.MarshalMethod() == BinaryMarshalMethod {
+		return m.buildBinary()
+	}
+	return helper.JsonMarshal(m)
+}
@@ -1,12 +1,14 @@
 package proto
 
 import (
+	"bytes"
 	"container/list"
-	"errors"
+	"fmt"
 	"github.com/Chendemo12/fastapi-tool/helper"
 	"io"
 	"sync"
 	"sync/atomic"
+	"unicode/utf8"
 )
 
 type NoCopy struct{}
@@ -31,11 +33,10 @@ func CalcChecksum(data []byte) uint16 {
 }
 
 // NewCounter 创建一个新的计数器
-func NewCounter() *Counter { return &Counter{v: 0, counter: &atomic.Uint64{}} }
+func NewCounter() *Counter { return &Counter{counter: &atomic.Uint64{}} }
 
-// Counter 计数器
+// Counter 计数器, 可由多个协程并发使用
 type Counter struct {
-	v       uint64 // 必要时存储上一个值
 	counter *atomic.Uint64
 }
 
@@ -48,11 +49,12 @@ func (c *Counter) Increment() {
 	c.counter.Add(1)
 }
 
+// Store 设置计数器的数值
+func (c *Counter) Store(v uint64) { c.counter.Store(v) }
+
 // ValueBeforeIncrement 首先获取当前计数器的数值，然后将计数器 +1
 func (c *Counter) ValueBeforeIncrement() uint64 {
-	c.v = c.counter.Load()
-	c.counter.Add(1)
-	return c.v
+	return c.counter.Add(1) - 1
 }
 
 func NewQueue(capacity int) *Queue {
@@ -71,7 +73,12 @@ type Queue struct {
 
 func (q *Queue) Capacity() int { return q.capacity }
 
-func (q *Queue) Length() int { return q.list.Len() }
+func (q *Queue) Length() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.list.Len()
+}
 
 func (q *Queue) Append(value any) {
 	q.mu.Lock()
@@ -96,28 +103,83 @@ func (q *Queue) PopLeft() any {
 	return element.Value
 }
 
-// Right 获取最右端/最新的元素
+// Right 获取最右端/最新的元素, 队列为空时返回nil
 func (q *Queue) Right() any {
-	//q.mu.Lock()
-	//defer q.mu.Unlock()
+	q.mu.Lock()
+	defer q.mu.Unlock()
 
-	return q.list.Back().Value
+	element := q.list.Back()
+	if element == nil {
+		return nil
+	}
+	return element.Value
 }
 
-// Left 获取最左端/最旧的元素
-func (q *Queue) Left() any { return q.list.Front().Value }
+// Left 获取最左端/最旧的元素, 队列为空时返回nil
+func (q *Queue) Left() any {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	element := q.list.Front()
+	if element == nil {
+		return nil
+	}
+	return element.Value
+}
+
+// Range 自最旧的元素开始逐个迭代, fn 返回false时停止迭代
+func (q *Queue) Range(fn func(value any) bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for element := q.list.Front(); element != nil; element = element.Next() {
+		if !fn(element.Value) {
+			return
+		}
+	}
+}
+
+// TruncateString 将字符串截断为不超过 n 个字节, 截断位置不会落在多字节字符的中间
+func TruncateString(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
 
 // ----------------------------------------------------------------------------
 
-// JsonMessageParseFrom 从reader解析消息，此操作不够优化，应考虑使用 parse 方法
+// 读取全部剩余数据并限制其长度不超过 MaxFrameDataSize, 避免因恶意数据(如压缩炸弹)而分配过大的内存
+func readAllLimited(reader io.Reader) ([]byte, error) {
+	limit := int64(MaxFrameDataSize)
+	_bytes, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(_bytes)) > limit {
+		return nil, fmt.Errorf("%w: payload exceeds %d bytes", ErrFrameTooLarge, limit)
+	}
+	return _bytes, nil
+}
+
+// JsonMessageParseFrom 从reader解析消息, 会读取reader内的全部剩余数据, 因此仅适用于单个消息的帧
 func JsonMessageParseFrom(reader io.Reader, m Message) error {
-	_bytes := make([]byte, 65526)
-	n, err := reader.Read(_bytes)
-	if err != nil && !errors.Is(err, io.EOF) {
-		return err
+	var _bytes []byte
+	var err error
+
+	if buf, ok := reader.(*bytes.Buffer); ok { // 避免额外的复制
+		_bytes = buf.Next(buf.Len())
+	} else {
+		_bytes, err = readAllLimited(reader)
+		if err != nil {
+			return err
+		}
 	}
 
-	return helper.JsonUnmarshal(_bytes[:n], m)
+	return helper.JsonUnmarshal(_bytes, m)
 }
 
 // ----------------------------------------------------------------------------
@@ -0,0 +1,62 @@
+package proto
+
+import "strings"
+
+// 主题名称的层级分隔符和通配符
+const (
+	TopicLevelSeparator = "/"
+	SingleLevelWildcard = "+" // 匹配一个层级
+	MultiLevelWildcard  = "#" // 匹配其后的任意层级, 包括其父层级本身, 必须位于末尾
+)
+
+// InternalTopicPrefix 内部主题的前缀, 此类主题不会被首层级的通配符匹配
+const InternalTopicPrefix = "__"
+
+// IsTopicPattern 主题名称是否为通配符模式, 如 sensors/+/temperature 和 alerts/#;
+// 通配符必须占据整个层级, 且 MultiLevelWildcard 必须位于末尾, 否则视为普通的主题名称
+func IsTopicPattern(name string) bool {
+	levels := strings.Split(name, TopicLevelSeparator)
+	wildcard := false
+	for i, level := range levels {
+		switch level {
+		case SingleLevelWildcard:
+			wildcard = true
+		case MultiLevelWildcard:
+			if i != len(levels)-1 {
+				return false
+			}
+			wildcard = true
+		}
+	}
+	return wildcard
+}
+
+// MatchTopic 主题是否匹配通配符模式, 非通配符模式仅匹配同名的主题;
+// 含有通配符层级的主题(如旧版本消费者以模式名称创建的主题)不会被通配符模式匹配
+func MatchTopic(pattern, topic string) bool {
+	if !IsTopicPattern(pattern) {
+		return pattern == topic
+	}
+
+	levels := strings.Split(pattern, TopicLevelSeparator)
+	if strings.HasPrefix(topic, InternalTopicPrefix) &&
+		(levels[0] == SingleLevelWildcard || levels[0] == MultiLevelWildcard) {
+		return false
+	}
+
+	names := strings.Split(topic, TopicLevelSeparator)
+	for _, name := range names {
+		if name == SingleLevelWildcard || name == MultiLevelWildcard {
+			return false
+		}
+	}
+	for i, level := range levels {
+		if level == MultiLevelWildcard {
+			return true
+		}
+		if i >= len(names) || (level != SingleLevelWildcard && level != names[i]) {
+			return false
+		}
+	}
+	return len(levels) == len(names)
+}
@@ -0,0 +1,511 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/Chendemo12/micromq/src/proto"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 主题日志
+//
+// 每个主题的消息按偏移量顺序追加到目录内的若干个段文件中, 段文件以其首个消息的偏移量命名, 如 00000000000000000042.log;
+// 当前段超过 Options.SegmentBytes 后创建新的段, 仅最后一个段可写入. 每个记录的编码为:
+//
+//	|  CRC32C  |  Size  |  Offset  |  Time  |  KeyLen  |  Key  |  Headers  |  Value  |
+//	|----------|--------|----------|--------|----------|-------|-----------|---------|
+//	|    4     |   4    |    8     |   8    |    2     |   N   |     N     |    N    |
+//
+// Size 为 Offset 至 Value 的长度, CRC32C 覆盖 Size 之后的全部字段, Time 为Unix毫秒时间戳;
+// Headers 编码为 num(2) | [keyLen(2) | key | valueLen(4) | value]*
+
+// FsyncPolicy 写入磁盘的策略
+type FsyncPolicy string
+
+const (
+	FsyncAlways   FsyncPolicy = "always"   // 每个记录写入后立即同步, 最安全但最慢
+	FsyncInterval FsyncPolicy = "interval" // 由调用方定期调用 Log.Sync
+	FsyncNever    FsyncPolicy = "never"    // 由操作系统决定, 仅在关闭时同步
+)
+
+const (
+	DefaultSegmentBytes int64 = 16 << 20 // 默认的段文件大小
+	segmentSuffix             = ".log"
+	recordHeadSize            = 8             // CRC32C + Size
+	recordMinSize             = 8 + 8 + 2 + 2 // Offset + Time + KeyLen + HeadersNum
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	ErrOffsetRegressed = errors.New("record offset is less than the next offset of log")
+	ErrLogClosed       = errors.New("log is closed")
+)
+
+// Options 主题日志的配置
+type Options struct {
+	SegmentBytes   int64         // 段文件的大小上限, 单个记录超过此值时仍会被写入
+	RetentionBytes int64         // 日志的大小上限, 超过后删除最旧的段, 0 表示不限制
+	RetentionAge   time.Duration // 段内最新记录的最长保留时间, 0 表示不限制
+	Fsync          FsyncPolicy   // 写入磁盘的策略, 缺省为 FsyncInterval
+}
+
+func (o Options) clean() Options {
+	if o.SegmentBytes <= 0 {
+		o.SegmentBytes = DefaultSegmentBytes
+	}
+	if o.Fsync != FsyncAlways && o.Fsync != FsyncNever {
+		o.Fsync = FsyncInterval
+	}
+	return o
+}
+
+// Record 日志中的一个消息记录
+type Record struct {
+	Offset  uint64
+	Time    int64 // 写入时的Unix毫秒时间戳
+	Key     []byte
+	Value   []byte
+	Headers proto.Headers // 可能为nil
+}
+
+// 编码一个记录
+func (r *Record) build() ([]byte, error) {
+	if len(r.Key) > math.MaxUint16 {
+		return nil, &proto.FieldError{Field: "key", Err: proto.ErrFieldTooLong}
+	}
+	if len(r.Headers) > math.MaxUint16 {
+		return nil, &proto.FieldError{Field: "headers", Err: proto.ErrFieldTooLong}
+	}
+
+	keys := make([]string, 0, len(r.Headers))
+	size := recordMinSize + len(r.Key) + len(r.Value)
+	for k, v := range r.Headers {
+		if len(k) > math.MaxUint16 || uint64(len(v)) > math.MaxUint32 {
+			return nil, &proto.FieldError{Field: "headers", Err: proto.ErrFieldTooLong}
+		}
+		keys = append(keys, k)
+		size += 2 + len(k) + 4 + len(v)
+	}
+	sort.Strings(keys)
+	if uint64(size) > math.MaxUint32 {
+		return nil, &proto.FieldError{Field: "value", Err: proto.ErrFieldTooLong}
+	}
+
+	slice := make([]byte, recordHeadSize, recordHeadSize+size)
+	binary.BigEndian.PutUint32(slice[4:], uint32(size))
+	slice = binary.BigEndian.AppendUint64(slice, r.Offset)
+	slice = binary.BigEndian.AppendUint64(slice, uint64(r.Time))
+	slice = binary.BigEndian.AppendUint16(slice, uint16(len(r.Key)))
+	slice = append(slice, r.Key...)
+	slice = binary.BigEndian.AppendUint16(slice, uint16(len(keys)))
+	for _, k := range keys {
+		slice = binary.BigEndian.AppendUint16(slice, uint16(len(k)))
+		slice = append(slice, k...)
+		slice = binary.BigEndian.AppendUint32(slice, uint32(len(r.Headers[k])))
+		slice = append(slice, r.Headers[k]...)
+	}
+	slice = append(slice, r.Value...)
+	binary.BigEndian.PutUint32(slice, crc32.Checksum(slice[4:], crcTable))
+
+	return slice, nil
+}
+
+// 解析 Size 之后的字段
+func (r *Record) parse(body []byte) error {
+	if len(body) < recordMinSize {
+		return proto.ErrMessageTruncated
+	}
+	r.Offset = binary.BigEndian.Uint64(body)
+	r.Time = int64(binary.BigEndian.Uint64(body[8:]))
+	body = body[16:]
+
+	var err error
+	if r.Key, body, err = cutBytes(body, int(binary.BigEndian.Uint16(body)), 2); err != nil {
+		return err
+	}
+	if len(body) < 2 {
+		return proto.ErrMessageTruncated
+	}
+	num := int(binary.BigEndian.Uint16(body))
+	body = body[2:]
+	r.Headers = nil
+	if num > 0 {
+		r.Headers = make(proto.Headers, num)
+	}
+	for i := 0; i < num; i++ {
+		var k, v []byte
+		if len(body) < 2 {
+			return proto.ErrMessageTruncated
+		}
+		if k, body, err = cutBytes(body, int(binary.BigEndian.Uint16(body)), 2); err != nil {
+			return err
+		}
+		if len(body) < 4 {
+			return proto.ErrMessageTruncated
+		}
+		if v, body, err = cutBytes(body, int(binary.BigEndian.Uint32(body)), 4); err != nil {
+			return err
+		}
+		r.Headers.Set(string(k), v)
+	}
+	r.Value = body
+
+	return nil
+}
+
+// 跳过长度字段后切出 n 个字节
+func cutBytes(body []byte, n, lenSize int) ([]byte, []byte, error) {
+	if len(body) < lenSize+n {
+		return nil, nil, proto.ErrMessageTruncated
+	}
+	return body[lenSize : lenSize+n], body[lenSize+n:], nil
+}
+
+// 一个段文件
+type segment struct {
+	path     string
+	base     uint64 // 首个记录的偏移量
+	next     uint64 // 下一个记录的偏移量, 空段时等于 base
+	size     int64
+	lastTime int64 // 最新记录的Unix毫秒时间戳
+}
+
+func segmentPath(dir string, base uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", base, segmentSuffix))
+}
+
+// 逐个读取段文件内的有效记录, 返回有效数据的长度; 遇到损坏或不完整的记录时停止
+func (s *segment) scan(limit int64, fn func(r *Record) bool) (int64, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(io.LimitReader(file, limit))
+	head := make([]byte, recordHeadSize)
+	var valid int64
+	for {
+		if _, err = io.ReadFull(reader, head); err != nil {
+			return valid, nil
+		}
+		size := int64(binary.BigEndian.Uint32(head[4:]))
+		if size < recordMinSize || valid+recordHeadSize+size > limit {
+			return valid, nil
+		}
+		body := make([]byte, size)
+		if _, err = io.ReadFull(reader, body); err != nil {
+			return valid, nil
+		}
+		crc := crc32.Update(crc32.Checksum(head[4:], crcTable), crcTable, body)
+		if crc != binary.BigEndian.Uint32(head) {
+			return valid, nil
+		}
+
+		r := &Record{}
+		if r.parse(body) != nil {
+			return valid, nil
+		}
+		valid += recordHeadSize + size
+		if !fn(r) {
+			return valid, nil
+		}
+	}
+}
+
+// Log 一个主题的分段日志, 此对象是线程安全的
+type Log struct {
+	dir       string
+	opts      Options
+	mu        *sync.Mutex
+	segments  []*segment // 按偏移量升序排列, 最后一个为当前段
+	active    *os.File   // 当前段的文件, 在首次写入时打开
+	dirty     bool       // 是否存在尚未同步的写入
+	closed    bool
+	truncated int64 // 恢复时因损坏或写入不完整而截断的字节数
+}
+
+// Open 打开或创建目录内的主题日志, 并校验每个段文件, 截断其末尾损坏或写入不完整的记录
+func Open(dir string, opts Options) (*Log, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{dir: dir, opts: opts.clean(), mu: &sync.Mutex{}, segments: make([]*segment, 0)}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		base, _err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if _err != nil {
+			continue
+		}
+		l.segments = append(l.segments, &segment{path: filepath.Join(dir, name), base: base, next: base})
+	}
+	sort.Slice(l.segments, func(i, j int) bool { return l.segments[i].base < l.segments[j].base })
+
+	for _, s := range l.segments {
+		if err = l.recover(s); err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// 恢复一个段的状态, 并截断无效的数据
+func (l *Log) recover(s *segment) error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	valid, err := s.scan(info.Size(), func(r *Record) bool {
+		s.next = r.Offset + 1
+		s.lastTime = r.Time
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if valid < info.Size() {
+		if err = os.Truncate(s.path, valid); err != nil {
+			return err
+		}
+		l.truncated += info.Size() - valid
+	}
+	s.size = valid
+	if s.lastTime == 0 {
+		s.lastTime = info.ModTime().UnixMilli()
+	}
+
+	return nil
+}
+
+// Dir 日志所在的目录
+func (l *Log) Dir() string { return l.dir }
+
+// Truncated 打开日志时因损坏或写入不完整而截断的字节数
+func (l *Log) Truncated() int64 { return l.truncated }
+
+// NextOffset 下一个记录的偏移量, 空日志时为0
+func (l *Log) NextOffset() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.segments) == 0 {
+		return 0
+	}
+	return l.segments[len(l.segments)-1].next
+}
+
+// OldestOffset 日志内最旧的记录的偏移量, 空日志时等于 NextOffset
+func (l *Log) OldestOffset() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.segments) == 0 {
+		return 0
+	}
+	return l.segments[0].base
+}
+
+// Size 全部段文件的大小
+func (l *Log) Size() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var size int64
+	for _, s := range l.segments {
+		size += s.size
+	}
+	return size
+}
+
+// Segments 段文件的数量
+func (l *Log) Segments() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.segments)
+}
+
+// Append 追加一个记录, 记录的偏移量不能小于 NextOffset
+func (l *Log) Append(r *Record) error {
+	data, err := r.build()
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrLogClosed
+	}
+	var current *segment
+	if len(l.segments) > 0 {
+		current = l.segments[len(l.segments)-1]
+		if r.Offset < current.next {
+			return ErrOffsetRegressed
+		}
+	}
+	if current == nil || (current.size > 0 && current.size+int64(len(data)) > l.opts.SegmentBytes) {
+		if current, err = l.roll(r.Offset); err != nil {
+			return err
+		}
+	}
+	if l.active == nil {
+		l.active, err = os.OpenFile(current.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err = l.active.Write(data); err != nil {
+		return err
+	}
+	current.size += int64(len(data))
+	current.next = r.Offset + 1
+	current.lastTime = r.Time
+
+	if l.opts.Fsync == FsyncAlways {
+		return l.active.Sync()
+	}
+	l.dirty = true
+	return nil
+}
+
+// 关闭当前段, 并创建以 base 为首个偏移量的新段
+func (l *Log) roll(base uint64) (*segment, error) {
+	if l.active != nil {
+		if err := l.active.Sync(); err != nil {
+			return nil, err
+		}
+		_ = l.active.Close()
+		l.active = nil
+		l.dirty = false
+	}
+	// 空的当前段直接以新的偏移量重命名
+	if n := len(l.segments); n > 0 && l.segments[n-1].size == 0 {
+		s := l.segments[n-1]
+		path := segmentPath(l.dir, base)
+		if err := os.Rename(s.path, path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		s.path, s.base, s.next = path, base, base
+		return s, nil
+	}
+
+	s := &segment{path: segmentPath(l.dir, base), base: base, next: base}
+	l.segments = append(l.segments, s)
+	return s, nil
+}
+
+// Read 按顺序读取偏移量不小于 from 的记录, 若 fn 返回false则停止读取
+func (l *Log) Read(from uint64, fn func(r *Record) bool) error {
+	l.mu.Lock()
+	segments := make([]segment, 0, len(l.segments))
+	for _, s := range l.segments {
+		if s.next > from {
+			segments = append(segments, *s) // 仅读取快照时已写入的数据
+		}
+	}
+	l.mu.Unlock()
+
+	stop := false
+	for _, s := range segments {
+		_, err := s.scan(s.size, func(r *Record) bool {
+			if r.Offset < from {
+				return true
+			}
+			stop = !fn(r)
+			return !stop
+		})
+		if err != nil && !os.IsNotExist(err) { // 读取期间段可能已因保留策略而被删除
+			return err
+		}
+		if stop {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// Sync 将尚未同步的写入同步到磁盘
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.dirty || l.active == nil {
+		return nil
+	}
+	l.dirty = false
+	return l.active.Sync()
+}
+
+// Retain 依据保留策略删除最旧的段, 当前段不会被删除, 返回被删除的段的数量
+func (l *Log) Retain(now time.Time) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var total int64
+	for _, s := range l.segments {
+		total += s.size
+	}
+
+	removed := 0
+	for len(l.segments) > 1 {
+		oldest := l.segments[0]
+		tooLarge := l.opts.RetentionBytes > 0 && total > l.opts.RetentionBytes
+		tooOld := l.opts.RetentionAge > 0 && now.Sub(time.UnixMilli(oldest.lastTime)) > l.opts.RetentionAge
+		if !tooLarge && !tooOld {
+			break
+		}
+		if err := os.Remove(oldest.path); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		total -= oldest.size
+		l.segments = l.segments[1:]
+		removed++
+	}
+
+	return removed, nil
+}
+
+// Close 同步并关闭日志, 此后不能再写入
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	if l.active == nil {
+		return nil
+	}
+	err := l.active.Sync()
+	if _err := l.active.Close(); err == nil {
+		err = _err
+	}
+	l.active = nil
+	return err
+}
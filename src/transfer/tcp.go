@@ -1,12 +1,31 @@
 package transfer
 
 import (
+	"errors"
 	"fmt"
 	"github.com/Chendemo12/fastapi-tool/logger"
 	"github.com/Chendemo12/functools/tcp"
 	"github.com/Chendemo12/micromq/src/proto"
+	"sync"
 )
 
+// 每个连接等待处理的帧的最大数量, 超过时暂停读取此连接
+const connFrameBuffer = 64
+
+// 读取到的帧及其解析错误
+type tcpFrame struct {
+	frame *proto.TransferFrame
+	err   error
+}
+
+// TCP 客户端连接, 同一连接上的帧须依次写入, 见 proto.TransferFrame.DrainTo
+type tcpConn struct {
+	*tcp.Remote
+	*sync.Mutex
+	partial []byte        // 上一个消息末尾不完整的帧, 仅由读取此连接的协程访问
+	frames  chan tcpFrame // 等待处理的帧, 由此连接的工作协程按接收顺序依次处理
+}
+
 // TCPTransfer TCP传输层实现
 type TCPTransfer struct {
 	host              string
@@ -14,10 +33,12 @@ type TCPTransfer struct {
 	maxOpenConn       int // 允许的最大连接数, 即 生产者+消费者最多有 maxOpenConn 个
 	tcps              *tcp.Server
 	logger            logger.Iface
+	versions          *sync.Map // 各连接所采用的帧版本: {addr: proto.FrameVersion}
+	conns             *sync.Map // 全部客户端连接: {addr: *tcpConn}
 	onConnected       func(c Conn)
 	onClosed          func(addr string)
 	onReceived        func(frame *proto.TransferFrame, c Conn)
-	onFrameParseError func(frame *proto.TransferFrame, c Conn)
+	onFrameParseError func(frame *proto.TransferFrame, c Conn, err error)
 }
 
 func (t *TCPTransfer) init() *TCPTransfer {
@@ -32,10 +53,48 @@ func (t *TCPTransfer) init() *TCPTransfer {
 		},
 	)
 	t.tcps = ts
+	t.versions = &sync.Map{}
+	t.conns = &sync.Map{}
 
 	return t
 }
 
+// 获取 tcp.Remote 所对应的连接, 首次获取时启动此连接的工作协程;
+// 连接的建立、读取和关闭事件均由同一个协程触发, 因此无需 LoadOrStore
+func (t *TCPTransfer) conn(r *tcp.Remote) *tcpConn {
+	if v, ok := t.conns.Load(r.Addr()); ok {
+		return v.(*tcpConn)
+	}
+
+	c := &tcpConn{Remote: r, Mutex: &sync.Mutex{}, frames: make(chan tcpFrame, connFrameBuffer)}
+	t.conns.Store(r.Addr(), c)
+	go t.work(c)
+
+	return c
+}
+
+// 按接收顺序依次处理一个连接的帧, 以保证同一连接发布的消息按发送顺序分配偏移量, 直至连接关闭
+func (t *TCPTransfer) work(c *tcpConn) {
+	for f := range c.frames {
+		if f.err != nil {
+			t.logger.Warn(fmt.Errorf("server parse frame from '%s' failed: %v", c.Addr(), f.err))
+			t.onFrameParseError(f.frame, c, f.err)
+		} else {
+			t.onReceived(f.frame, c)
+		}
+		framePool.Put(f.frame)
+	}
+}
+
+// 获取连接所采用的帧版本, 若尚未收到此连接的帧, 则返回 proto.FrameVersionAuto
+func (t *TCPTransfer) frameVersion(addr string) proto.FrameVersion {
+	v, ok := t.versions.Load(addr)
+	if !ok {
+		return proto.FrameVersionAuto
+	}
+	return v.(proto.FrameVersion)
+}
+
 func (t *TCPTransfer) SetHost(host string) {
 	t.host = host
 }
@@ -68,13 +127,13 @@ func (t *TCPTransfer) SetOnReceivedHandler(fn func(frame *proto.TransferFrame, c
 }
 
 // SetOnFrameParseErrorHandler 设置当客户端数据帧解析出错时的事件
-func (t *TCPTransfer) SetOnFrameParseErrorHandler(fn func(frame *proto.TransferFrame, c Conn)) {
+func (t *TCPTransfer) SetOnFrameParseErrorHandler(fn func(frame *proto.TransferFrame, c Conn, err error)) {
 	t.onFrameParseError = fn
 }
 
 func (t *TCPTransfer) OnAccepted(r *tcp.Remote) error {
 	t.logger.Debug(r.Addr(), " connected.")
-	t.onConnected(r)
+	t.onConnected(t.conn(r))
 
 	return nil
 }
@@ -84,30 +143,60 @@ func (t *TCPTransfer) OnClosed(r *tcp.Remote) error {
 	addr := r.Addr()
 	t.logger.Debug(addr, " connection lost.")
 
+	t.versions.Delete(addr)
+	if v, ok := t.conns.LoadAndDelete(addr); ok {
+		close(v.(*tcpConn).frames) // 已读取的帧仍会被处理
+	}
 	t.onClosed(addr)
 	return nil
 }
 
 func (t *TCPTransfer) Handler(r *tcp.Remote) error {
-	if r.Len() < proto.FrameMinLength {
+	c := t.conn(r)
+	if c.partial == nil && r.Len() < proto.FrameMinLength {
 		return proto.ErrMessageNotFull
 	}
 
-	frame := framePool.Get()
-	err := frame.ParseFrom(r) // 此操作不应并发读取，避免消息2覆盖消息1的缓冲区
+	// 一次读取的数据内可能包含多个帧, 也可能包含损坏的数据, 损坏的数据会被跳过
+	// 连接的第一个帧决定了此连接的帧版本
+	stream := r.Unread()
+	r.ReadN(len(stream)) // 标记数据已被读取
 
-	// 异步执行，立刻读取下一条消息
-	// 对于生产者来说, 其不关心是否会有响应, 只需一条接一条的生产消息即可
-	go func(f *proto.TransferFrame, c Conn, err error) { // 处理消息帧
-		defer framePool.Put(f)
+	// 超过传输层单个消息长度的帧被分割为多个消息, 与上一个消息末尾不完整的帧拼接后解析
+	owned := c.partial != nil
+	if owned {
+		stream = append(c.partial, stream...)
+		c.partial = nil
+	}
 
-		if err != nil {
-			t.logger.Warn(fmt.Errorf("server parse frame failed: %v", err))
-			t.onFrameParseError(f, c)
-		} else {
-			t.onReceived(f, c)
+	scanner := proto.NewFrameScanner(stream, t.frameVersion(r.Addr())).AllowPartial()
+	for scanner.More() {
+		frame := framePool.Get()
+		err := scanner.Next(frame) // 此操作不应并发读取，避免消息2覆盖消息1的缓冲区
+		if errors.Is(err, proto.ErrFrameIncomplete) {
+			framePool.Put(frame)
+			break
 		}
-	}(frame, r, err)
+		if err == nil {
+			t.versions.LoadOrStore(r.Addr(), frame.Version())
+		}
+
+		// 交由工作协程处理，立刻读取下一条消息
+		c.frames <- tcpFrame{frame: frame, err: err}
+	}
+
+	if remainder := scanner.Remainder(); remainder != nil {
+		// 不完整的帧不会超过连接所协商的帧版本的最大长度, 超过时丢弃, 以免无限缓存
+		if limit := scanner.Version().MaxFrameLength(); len(remainder) > limit {
+			err := fmt.Errorf("%w: %d bytes pending", proto.ErrFrameTooLarge, len(remainder))
+			c.frames <- tcpFrame{frame: framePool.Get(), err: err}
+			return nil
+		}
+		if !owned { // 接收缓冲区会被下一个消息覆盖
+			remainder = append([]byte{}, remainder...)
+		}
+		c.partial = remainder
+	}
 
 	return nil
 }
@@ -31,8 +31,8 @@ type Transfer interface {
 	SetOnClosedHandler(fn func(addr string))
 	// SetOnReceivedHandler 设置当收到客户端数据帧时的事件
 	SetOnReceivedHandler(fn func(frame *proto.TransferFrame, c Conn))
-	// SetOnFrameParseErrorHandler 设置当客户端数据帧解析出错时的事件
-	SetOnFrameParseErrorHandler(fn func(frame *proto.TransferFrame, c Conn))
+	// SetOnFrameParseErrorHandler 设置当客户端数据帧解析出错时的事件, 每一个损坏的帧都会触发一次
+	SetOnFrameParseErrorHandler(fn func(frame *proto.TransferFrame, c Conn, err error))
 	Close(addr string) error // 主动关闭一个客户端连接
 	Serve() error            // 阻塞式启动服务
 	Stop()
@@ -0,0 +1,126 @@
+package test
+
+import (
+	"bytes"
+	"github.com/Chendemo12/micromq/src/engine"
+	"github.com/Chendemo12/micromq/src/proto"
+	"testing"
+	"time"
+)
+
+func TestEngine_AckStopsRedelivery(t *testing.T) {
+	e, tr := serveEngine(t, engine.Config{AckTimeout: 200 * time.Millisecond})
+	c := tr.connect("c1")
+	c.register(t, &proto.RegisterMessage{Topics: []string{"ACKED"}, ID: "c1"})
+
+	e.Publisher(&proto.PMessage{Topic: []byte("ACKED"), Value: []byte("v")})
+	cm := c.receive(t, time.Second)
+	c.ack(t, cm)
+
+	c.silent(t, 3*e.AckTimeout())
+	if n := e.GetTopic([]byte("ACKED")).Redelivered(); n != 0 {
+		t.Errorf("acknowledged message redelivered %d times", n)
+	}
+}
+
+func TestEngine_AckTimeoutRedelivers(t *testing.T) {
+	e, tr := serveEngine(t, engine.Config{AckTimeout: 200 * time.Millisecond})
+	c := tr.connect("c1")
+	c.register(t, &proto.RegisterMessage{Topics: []string{"SLOW"}, ID: "c1"})
+
+	e.Publisher(&proto.PMessage{Topic: []byte("SLOW"), Value: []byte("v")})
+	first := c.receive(t, time.Second)
+	if first.PM.Headers.RedeliveryCount() != 0 {
+		t.Fatalf("first delivery should carry no redelivery count: %v", first.PM.Headers)
+	}
+
+	// 超时未确认的消息被重新推送, 且次数逐次递增
+	for want := 1; want <= 2; want++ {
+		cm := c.receive(t, time.Second)
+		if cmOffset(cm) != cmOffset(first) || string(cm.PM.Value) != "v" {
+			t.Fatalf("redelivered message mismatch: offset %d, value %s", cmOffset(cm), cm.PM.Value)
+		}
+		if n := cm.PM.Headers.RedeliveryCount(); n != want {
+			t.Fatalf("redelivery count mismatch, want %d, got %d", want, n)
+		}
+	}
+	c.ack(t, first)
+	c.silent(t, 3*e.AckTimeout())
+
+	if n := e.GetTopic([]byte("SLOW")).Redelivered(); n != 2 {
+		t.Errorf("redelivered mismatch: %d", n)
+	}
+}
+
+func TestEngine_AckResumeSession(t *testing.T) {
+	e, tr := serveEngine(t, engine.Config{AckTimeout: 5 * time.Second})
+	c := tr.connect("c1")
+	c.register(t, &proto.RegisterMessage{Topics: []string{"RESUME"}, ID: "worker"})
+
+	e.Publisher(&proto.PMessage{Topic: []byte("RESUME"), Value: []byte("v")})
+	first := c.receive(t, time.Second)
+	c.disconnect()
+
+	// 以相同的消费者ID重连后, 上一个连接未确认的消息立即重新推送, 无需等待超时
+	reconnected := tr.connect("c2")
+	reconnected.register(t, &proto.RegisterMessage{Topics: []string{"RESUME"}, ID: "worker"})
+	cm := reconnected.receive(t, time.Second)
+	if cmOffset(cm) != cmOffset(first) || cm.PM.Headers.RedeliveryCount() != 1 {
+		t.Fatalf("resumed message mismatch: offset %d, headers %v", cmOffset(cm), cm.PM.Headers)
+	}
+
+	reconnected.ack(t, cm)
+	consumer, _ := e.QueryConsumer("c2")
+	if n := e.Unacked(consumer); n != 0 {
+		t.Errorf("unacked after ack: %d", n)
+	}
+}
+
+func TestEngine_AckMaxRedeliveries(t *testing.T) {
+	e, tr := serveEngine(t, engine.Config{AckTimeout: 200 * time.Millisecond, MaxRedeliveries: 1})
+	dlq := tr.connect("dlq")
+	dlq.register(t, &proto.RegisterMessage{Topics: []string{e.DeadLetterTopic()}, Ack: proto.NoConfirm})
+	c := tr.connect("c1")
+	c.register(t, &proto.RegisterMessage{Topics: []string{"POISON"}, ID: "c1"})
+
+	e.Publisher(&proto.PMessage{Topic: []byte("POISON"), Value: []byte("v")})
+	c.receive(t, time.Second)
+	if cm := c.receive(t, time.Second); cm.PM.Headers.RedeliveryCount() != 1 {
+		t.Fatalf("redelivery count mismatch: %v", cm.PM.Headers)
+	}
+
+	// 超过最大重新推送次数后转投死信主题, 不再推送给消费者
+	cm := dlq.receive(t, time.Second)
+	h := cm.PM.Headers
+	if string(cm.PM.Value) != "v" || string(h.Get(engine.DeadLetterTopicHeader)) != "POISON" ||
+		!bytes.Contains(h.Get(engine.DeadLetterReasonHeader), []byte(engine.ErrRedeliveryExceeded.Error())) {
+		t.Fatalf("dead letter mismatch: %s %v", cm.PM.Value, h)
+	}
+	c.silent(t, 3*e.AckTimeout())
+}
+
+func TestEngine_DeadLetterHeaders(t *testing.T) {
+	e, tr := serveEngine(t, engine.Config{AckTimeout: 200 * time.Millisecond, MaxRedeliveries: 1})
+	dlq := tr.connect("dlq")
+	dlq.register(t, &proto.RegisterMessage{Topics: []string{e.DeadLetterTopic()}, Ack: proto.NoConfirm})
+	c := tr.connect("c1")
+	c.register(t, &proto.RegisterMessage{Topics: []string{"REQUESTS"}, ID: "c1"})
+
+	headers := proto.Headers{}
+	headers.Set("x-app", []byte("kept"))
+	headers.Set(proto.CorrelationIDHeader, []byte("req-1"))
+	headers.Set(proto.ProducerIDHeader, []byte("producer-1"))
+	headers.Set(proto.SequenceHeader, []byte("7"))
+	e.Publisher(&proto.PMessage{Topic: []byte("REQUESTS"), Value: []byte("v"), Headers: headers})
+
+	// 死信消息保留应用的消息头, 但不携带请求和幂等生产者的消息头
+	h := dlq.receive(t, 2*time.Second).PM.Headers
+	if string(h.Get("x-app")) != "kept" || string(h.Get(engine.DeadLetterTopicHeader)) != "REQUESTS" {
+		t.Errorf("dead letter headers lost: %v", h)
+	}
+	for _, k := range []string{proto.CorrelationIDHeader, proto.ProducerIDHeader, proto.SequenceHeader} {
+		if h.Get(k) != nil {
+			t.Errorf("dead letter should not carry '%s': %v", k, h)
+		}
+	}
+}
@@ -1,10 +1,19 @@
 package test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"github.com/Chendemo12/functools/environ"
 	"github.com/Chendemo12/functools/zaplog"
 	"github.com/Chendemo12/micromq/src/engine"
+	"github.com/Chendemo12/micromq/src/proto"
+	"github.com/Chendemo12/micromq/src/transfer"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestEngineEngine(t *testing.T) {
@@ -36,3 +45,560 @@ func TestEngineEngine(t *testing.T) {
 
 	//handler.Serve()
 }
+
+func TestEngine_CheckSchema(t *testing.T) {
+	handler := engine.New()
+	schema := []byte(`{"type":"object","required":["temperature"],"properties":{"temperature":{"type":"number"}}}`)
+
+	if _, err := handler.RegisterSchema("BAD", []byte(`{"$ref":"file:///etc/passwd"}`), ""); err == nil {
+		t.Errorf("external schema reference should be refused")
+	}
+	if _, err := handler.RegisterSchema("SENSOR", schema, engine.SchemaActionReject); err != nil {
+		t.Fatalf("register schema failed: %v", err)
+	}
+	if _, err := handler.RegisterSchema("METER", schema, engine.SchemaActionQuarantine); err != nil {
+		t.Fatalf("register schema failed: %v", err)
+	}
+
+	valid := &proto.PMessage{Topic: []byte("SENSOR"), Value: []byte(`{"temperature":23.5}`)}
+	if err := handler.CheckSchema(valid); err != nil {
+		t.Errorf("valid message rejected: %v", err)
+	}
+
+	for _, value := range []string{`{"temperature":"hot"}`, `{"humidity":60}`, `{"temperature":1`, `{} {}`} {
+		pm := &proto.PMessage{Topic: []byte("SENSOR"), Value: []byte(value)}
+		if err := handler.CheckSchema(pm); !errors.Is(err, engine.ErrSchemaViolation) {
+			t.Errorf("'%s' should be rejected, got: %v", value, err)
+		}
+	}
+
+	pm := &proto.PMessage{Topic: []byte("METER"), Value: []byte(`not json`)}
+	if err := handler.CheckSchema(pm); err != nil {
+		t.Fatalf("quarantined message should not be rejected: %v", err)
+	}
+	if string(pm.Topic) != handler.QuarantineTopic() || !bytes.Equal(pm.Headers.Get(engine.QuarantineTopicHeader), []byte("METER")) {
+		t.Errorf("message is not quarantined: %s, %v", pm.Topic, pm.Headers)
+	}
+
+	s, _ := handler.QuerySchema("SENSOR")
+	if s.Accepted() != 1 || s.Rejected() != 4 {
+		t.Errorf("schema counter mismatch: %d, %d", s.Accepted(), s.Rejected())
+	}
+
+	// 未设置模式的主题不做校验
+	if !handler.RemoveSchema("SENSOR") || handler.CheckSchema(&proto.PMessage{Topic: []byte("SENSOR")}) != nil {
+		t.Errorf("topic without schema should not be validated")
+	}
+}
+
+// 自定义消息, 用于验证协议自省
+type echoMessage struct {
+	proto.NotImplementMessage
+	Text string `json:"text" description:"回显内容"`
+}
+
+func (m *echoMessage) MessageType() proto.MessageType         { return 200 }
+func (m *echoMessage) MarshalMethod() proto.MarshalMethodType { return proto.JsonMarshalMethod }
+
+func TestEngine_AsyncAPI(t *testing.T) {
+	if !proto.AddDescriptor(&echoMessage{}, &proto.MessageResponse{}, "EchoMessage") {
+		t.Fatalf("add custom descriptor failed")
+	}
+
+	handler := engine.New()
+	handler.GetTopic([]byte("SENSOR"))
+	_, _ = handler.RegisterSchema("SENSOR", []byte(`{"type":"object"}`), engine.SchemaActionQuarantine)
+
+	doc := handler.AsyncAPI("micromq", "v1.0.0")
+	if _, err := json.Marshal(doc); err != nil {
+		t.Fatalf("asyncapi marshal failed: %v", err)
+	}
+
+	echo, ok := doc.Components.Messages["EchoMessage"]
+	if !ok || !echo.UserDefined || echo.Code != 200 || echo.Ack != "MessageResponse" {
+		t.Fatalf("custom message not exported: %+v", echo)
+	}
+	if echo.Payload["properties"].(map[string]any)["text"] == nil {
+		t.Errorf("custom message payload missing: %+v", echo.Payload)
+	}
+
+	pm := doc.Components.Messages["ProducerMessage"]
+	if pm == nil || len(pm.BinaryLayout) == 0 || pm.ContentType != "application/octet-stream" {
+		t.Errorf("producer message layout missing: %+v", pm)
+	}
+	register := doc.Components.Messages["RegisterMessage"]
+	if register == nil || len(register.Marshal) != 2 || register.Ack != "RegisterMessageResponse" {
+		t.Errorf("register message spec mismatch: %+v", register)
+	}
+
+	channel, ok := doc.Channels["SENSOR"]
+	if !ok || channel.Publish == nil || len(channel.Schema) == 0 {
+		t.Errorf("topic channel missing: %+v", channel)
+	}
+	if len(doc.Protocol.Frames["v2"]) != 8 || doc.Protocol.Statuses["12"] != "SchemaInvalid" {
+		t.Errorf("protocol spec mismatch: %+v", doc.Protocol)
+	}
+}
+
+func TestEngine_DelayQueue(t *testing.T) {
+	handler := engine.New()
+	later := &proto.PMessage{Topic: []byte("DELAY"), Key: []byte("later"), Value: []byte("1"), Headers: proto.Headers{}}
+	later.Headers.SetDeliverAt(time.Now().Add(time.Hour))
+
+	if offset := handler.Publisher(later); offset != 0 || handler.GetTopic([]byte("DELAY")).Offset() != 0 {
+		t.Fatalf("delayed message published immediately, offset: %d", offset)
+	}
+	ms := handler.DelayQueue().List()
+	if len(ms) != 1 || ms[0].Topic != "DELAY" || ms[0].Key != "later" {
+		t.Fatalf("delayed message not listed: %+v", ms)
+	}
+	if _, ok := handler.CancelDelayed(ms[0].ID); !ok || handler.DelayQueue().Len() != 0 {
+		t.Fatalf("cancel delayed message failed")
+	}
+	if _, ok := handler.CancelDelayed(ms[0].ID); ok {
+		t.Errorf("delayed message cancelled twice")
+	}
+
+	delivered := make(chan string, 3)
+	q := engine.NewDelayQueue(func(pm *proto.PMessage) { delivered <- string(pm.Key) })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Run(ctx)
+
+	now := time.Now()
+	q.Schedule(&proto.PMessage{Key: []byte("second")}, now.Add(80*time.Millisecond))
+	q.Schedule(&proto.PMessage{Key: []byte("first")}, now.Add(40*time.Millisecond))
+	cancelled := q.Schedule(&proto.PMessage{Key: []byte("cancelled")}, now.Add(60*time.Millisecond))
+	q.Cancel(cancelled.ID)
+
+	for _, want := range []string{"first", "second"} {
+		select {
+		case key := <-delivered:
+			if key != want {
+				t.Fatalf("delivered out of order, want: %s, got: %s", want, key)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("delayed message '%s' not delivered", want)
+		}
+	}
+	if time.Since(now) < 80*time.Millisecond {
+		t.Errorf("delayed message delivered too early")
+	}
+	select {
+	case key := <-delivered:
+		t.Errorf("unexpected delivery: %s", key)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// 记录加密顺序的加解密器, 首次加密时阻塞直到 release 关闭, 以便在推送前填充优先级通道
+type gateCrypto struct {
+	entered chan struct{}
+	release chan struct{}
+	once    *sync.Once
+	order   chan string
+}
+
+func (c *gateCrypto) Encrypt(stream []byte) ([]byte, error) {
+	c.once.Do(func() {
+		close(c.entered)
+		<-c.release
+	})
+	for _, key := range []string{"H1", "H2", "H3", "H4", "H5", "N1", "L1", "L2"} {
+		if bytes.Contains(stream, []byte(key)) {
+			c.order <- key
+		}
+	}
+	return nil, errors.New("skip sending")
+}
+
+func (c *gateCrypto) Decrypt(stream []byte) ([]byte, error) { return stream, nil }
+
+func (c *gateCrypto) String() string { return "gate" }
+
+func TestTopic_PriorityLanes(t *testing.T) {
+	crypto := &gateCrypto{
+		entered: make(chan struct{}),
+		release: make(chan struct{}),
+		once:    &sync.Once{},
+		order:   make(chan string, 10),
+	}
+	topic := engine.NewTopic([]byte("ALARM"), 10, 10).SetStarvationLimit(2).SetCrypto(crypto)
+	topic.AddConsumer(&engine.Consumer{Addr: "probe", Conf: &engine.ConsumerConfig{}})
+
+	publish := func(key string, priority proto.MessagePriority) {
+		pm := &proto.PMessage{Topic: topic.Name, Key: []byte(key), Value: []byte("v"), Headers: proto.Headers{}}
+		pm.Headers.SetPriority(priority)
+		topic.Publisher(pm)
+	}
+
+	publish("gate", proto.PriorityNormal)
+	<-crypto.entered // 阻塞推送, 此后的消息均在通道中等待
+	publish("L1", proto.PriorityLow)
+	publish("L2", proto.PriorityLow)
+	publish("N1", proto.PriorityNormal)
+	for _, key := range []string{"H1", "H2", "H3", "H4", "H5"} {
+		publish(key, proto.PriorityHigh)
+	}
+
+	depth := topic.QueueDepth()
+	if depth[proto.PriorityLow] != 2 || depth[proto.PriorityNormal] != 1 || depth[proto.PriorityHigh] != 5 {
+		t.Fatalf("queue depth mismatch: %v", depth)
+	}
+	close(crypto.release)
+
+	// 高优先级先推送, 低优先级通道连续让行2次后推送一次
+	want := []string{"H1", "H2", "L1", "N1", "H3", "L2", "H4", "H5"}
+	for i, key := range want {
+		select {
+		case got := <-crypto.order:
+			if got != key {
+				t.Fatalf("message %d out of order, want: %s, got: %s", i, key, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message '%s' not consumed", key)
+		}
+	}
+}
+
+// 消息过期而被丢弃时通知测试
+type expiredHandler struct {
+	engine.DefaultEventHandler
+	records chan *engine.HistoryRecord
+}
+
+func (h expiredHandler) OnCMExpired(record *engine.HistoryRecord) { h.records <- record }
+
+func TestEngine_MessageExpired(t *testing.T) {
+	records := make(chan *engine.HistoryRecord, 1)
+	e, tr := serveEngine(t, engine.Config{}, func(e *engine.Engine) {
+		e.SetEventHandler(expiredHandler{records: records})
+	})
+	c := tr.connect("c1")
+	c.register(t, &proto.RegisterMessage{Topics: []string{"EXPIRE"}, ID: "c1"})
+
+	// 持有连接的写锁以阻塞推送, 此后的消息在队列中等待直至过期
+	c.Lock()
+	e.Publisher(&proto.PMessage{Topic: []byte("EXPIRE"), Value: []byte("blocked")})
+	short := &proto.PMessage{Topic: []byte("EXPIRE"), Value: []byte("short"), Headers: proto.Headers{}}
+	short.Headers.SetTTL(50 * time.Millisecond)
+	e.Publisher(short)
+	time.Sleep(150 * time.Millisecond)
+	c.Unlock()
+
+	cm := c.receive(t, time.Second)
+	if string(cm.PM.Value) != "blocked" {
+		t.Fatalf("blocked message mismatch: %s", cm.PM.Value)
+	}
+	c.ack(t, cm)
+
+	select {
+	case record := <-records:
+		if string(record.Value) != "short" || record.Offset != 1 || record.Error != engine.ErrMessageExpired.Error() {
+			t.Errorf("expired record mismatch: %+v", record)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expired message not reported")
+	}
+	c.silent(t, 200*time.Millisecond)
+	if n := e.GetTopic([]byte("EXPIRE")).Expired(); n != 1 {
+		t.Errorf("expired mismatch: %d", n)
+	}
+}
+
+// 仅实现 EventHandler.OnFrameParseError 的事件触发器
+type legacyParseErrorHandler struct {
+	engine.DefaultEventHandler
+	calls *int
+}
+
+func (h legacyParseErrorHandler) OnFrameParseError(_ *proto.TransferFrame, _ transfer.Conn) { *h.calls++ }
+
+// 同时实现 engine.FrameParseErrorHandler 的事件触发器
+type causeParseErrorHandler struct {
+	legacyParseErrorHandler
+	errs *[]error
+}
+
+func (h causeParseErrorHandler) OnFrameParseFailed(_ *proto.TransferFrame, _ transfer.Conn, err error) {
+	*h.errs = append(*h.errs, err)
+}
+
+func TestEngine_FrameParseError(t *testing.T) {
+	frame := &proto.TransferFrame{}
+	frame.Reset()
+
+	calls := 0
+	_, tr := serveEngine(t, engine.Config{}, func(e *engine.Engine) {
+		e.SetEventHandler(legacyParseErrorHandler{calls: &calls})
+	})
+	tr.onFrameParseError(frame, tr.connect("legacy"), proto.ErrFrameChecksumMismatch)
+	if calls != 1 {
+		t.Errorf("legacy handler calls mismatch: %d", calls)
+	}
+
+	// 实现了可选接口时以其代替, 并获取具体的错误原因
+	calls = 0
+	errs := make([]error, 0)
+	_, tr = serveEngine(t, engine.Config{}, func(e *engine.Engine) {
+		e.SetEventHandler(causeParseErrorHandler{legacyParseErrorHandler{calls: &calls}, &errs})
+	})
+	tr.onFrameParseError(frame, tr.connect("cause"), proto.ErrFrameChecksumMismatch)
+	if calls != 0 || len(errs) != 1 || !errors.Is(errs[0], proto.ErrFrameChecksumMismatch) {
+		t.Errorf("cause handler mismatch, legacy calls: %d, errs: %v", calls, errs)
+	}
+}
+
+func TestEngine_PublishIdempotent(t *testing.T) {
+	handler := engine.New()
+	publish := func(id string, seq uint64) (uint64, bool) {
+		pm := &proto.PMessage{Topic: []byte("IDEMPOTENT"), Key: []byte("k"), Value: []byte("v"), Headers: proto.Headers{}}
+		pm.Headers.SetProducerSequence(id, seq)
+		return handler.PublishIdempotent(pm)
+	}
+
+	for seq := uint64(1); seq <= 3; seq++ {
+		if offset, duplicated := publish("p1", seq); duplicated || offset != seq-1 {
+			t.Fatalf("sequence %d published as offset %d, duplicated: %v", seq, offset, duplicated)
+		}
+	}
+	// 重连后重发的消息返回原始偏移量
+	if offset, duplicated := publish("p1", 2); !duplicated || offset != 1 {
+		t.Errorf("duplicate should return original offset 1, got: %d, duplicated: %v", offset, duplicated)
+	}
+	// 不同的生产者ID互不影响, 序列号允许不连续
+	if offset, duplicated := publish("p2", 2); duplicated || offset != 3 {
+		t.Errorf("other producer should be published, got: %d, duplicated: %v", offset, duplicated)
+	}
+	if offset, duplicated := publish("p1", 10); duplicated || offset != 4 {
+		t.Errorf("sequence gap should be published, got: %d, duplicated: %v", offset, duplicated)
+	}
+	// 并发处理的消息帧可能乱序到达
+	if offset, duplicated := publish("p1", 7); duplicated || offset != 5 {
+		t.Errorf("out of order sequence should be published, got: %d, duplicated: %v", offset, duplicated)
+	}
+	// 未携带序列号的消息直接发布
+	if _, duplicated := handler.PublishIdempotent(&proto.PMessage{Topic: []byte("IDEMPOTENT")}); duplicated {
+		t.Errorf("message without sequence should not be duplicated")
+	}
+
+	if n := handler.DuplicateMessages(); n != 1 {
+		t.Errorf("duplicate messages mismatch: %d", n)
+	}
+	if offset := handler.GetTopic([]byte("IDEMPOTENT")).Offset(); offset != 6 {
+		t.Errorf("topic offset mismatch: %d", offset)
+	}
+}
+
+func TestEngine_PublishBatch(t *testing.T) {
+	handler := engine.New()
+	schema := []byte(`{"type":"object","required":["temperature"]}`)
+	if _, err := handler.RegisterSchema("SENSOR", schema, engine.SchemaActionReject); err != nil {
+		t.Fatalf("register schema failed: %v", err)
+	}
+
+	// 任一消息被拒绝时整批消息均不发布
+	_, err := handler.PublishBatch([]*proto.PMessage{
+		{Topic: []byte("DNS_REPORT"), Value: []byte("v")},
+		{Topic: []byte("SENSOR"), Value: []byte(`{"humidity":60}`)},
+	}, false)
+	if !errors.Is(err, engine.ErrSchemaViolation) {
+		t.Fatalf("batch should be rejected, got: %v", err)
+	}
+	if offset := handler.GetTopic([]byte("DNS_REPORT")).Offset(); offset != 0 {
+		t.Errorf("rejected batch should not be published, offset: %d", offset)
+	}
+
+	// 被拒绝的批量消息中需隔离的消息既不被修改, 也不计入统计
+	audit, err := handler.RegisterSchema("AUDIT", schema, engine.SchemaActionQuarantine)
+	if err != nil {
+		t.Fatalf("register schema failed: %v", err)
+	}
+	quarantined := &proto.PMessage{Topic: []byte("AUDIT"), Value: []byte(`{"humidity":60}`)}
+	_, err = handler.PublishBatch([]*proto.PMessage{
+		quarantined,
+		{Topic: []byte("SENSOR"), Value: []byte(`{"temperature":23.5}`)},
+		{Topic: []byte("SENSOR"), Value: []byte(`{"humidity":60}`)},
+	}, false)
+	if !errors.Is(err, engine.ErrSchemaViolation) {
+		t.Fatalf("batch should be rejected, got: %v", err)
+	}
+	sensor, _ := handler.QuerySchema("SENSOR")
+	if string(quarantined.Topic) != "AUDIT" || quarantined.Headers != nil || audit.Quarantined() != 0 ||
+		sensor.Accepted() != 0 || sensor.Rejected() != 2 {
+		t.Errorf("rejected batch has side effects: %s %v, quarantined %d, accepted %d, rejected %d",
+			quarantined.Topic, quarantined.Headers, audit.Quarantined(), sensor.Accepted(), sensor.Rejected())
+	}
+
+	offsets, err := handler.PublishBatch([]*proto.PMessage{
+		{Topic: []byte("DNS_REPORT"), Value: []byte("v")},
+		{Topic: []byte("SENSOR"), Value: []byte(`{"temperature":23.5}`)},
+		{Topic: []byte("DNS_REPORT"), Value: []byte("v")},
+	}, false)
+	if err != nil {
+		t.Fatalf("batch publish failed: %v", err)
+	}
+	if len(offsets) != 3 || offsets[0] != 0 || offsets[1] != 0 || offsets[2] != 1 {
+		t.Errorf("batch offsets mismatch: %v", offsets)
+	}
+
+	// 被接受的批量消息中需隔离的消息转投至隔离主题
+	if _, err = handler.PublishBatch([]*proto.PMessage{quarantined}, false); err != nil {
+		t.Fatalf("batch publish failed: %v", err)
+	}
+	if string(quarantined.Topic) != handler.QuarantineTopic() || audit.Quarantined() != 1 {
+		t.Errorf("quarantine not applied: %s, quarantined %d", quarantined.Topic, audit.Quarantined())
+	}
+}
+
+// 加密总是失败的加解密器, 用于模拟消息帧构建失败
+type failCrypto struct{}
+
+func (c failCrypto) Encrypt(_ []byte) ([]byte, error)      { return nil, errors.New("encrypt failed") }
+func (c failCrypto) Decrypt(stream []byte) ([]byte, error) { return stream, nil }
+func (c failCrypto) String() string                        { return "fail" }
+
+// 死信主题的消息推送完成时通知测试
+type deadLetterHandler struct {
+	engine.DefaultEventHandler
+	records chan *engine.HistoryRecord
+}
+
+func (h deadLetterHandler) OnCMConsumed(record *engine.HistoryRecord) {
+	if string(record.Topic) == "DLQ" {
+		h.records <- record
+	}
+}
+
+func TestEngine_DeadLetter(t *testing.T) {
+	records := make(chan *engine.HistoryRecord, 1)
+	// 死信消息由 Serve 启动的协程发布
+	handler, _ := serveEngine(t, engine.Config{}, func(e *engine.Engine) {
+		e.SetCrypto(failCrypto{}).SetDeadLetterTopic("DLQ").SetEventHandler(deadLetterHandler{records: records})
+	})
+	topic := handler.GetTopic([]byte("ALARM"))
+	if topic.LatestMessage() != nil {
+		t.Errorf("empty topic should have no latest message")
+	}
+	topic.AddConsumer(&engine.Consumer{Addr: "probe", Conf: &engine.ConsumerConfig{}})
+
+	pm := &proto.PMessage{Topic: topic.Name, Key: []byte("k"), Value: []byte("v"), Headers: proto.Headers{}}
+	pm.Headers.Set("trace", []byte("abc"))
+	pm.Headers.SetTTL(time.Minute)
+	handler.Publisher(pm)
+
+	var record *engine.HistoryRecord
+	select {
+	case record = <-records:
+	case <-time.After(time.Second):
+		t.Fatalf("undelivered message not republished to dead-letter topic")
+	}
+
+	h := record.Headers
+	if string(record.Value) != "v" || string(h.Get(engine.DeadLetterTopicHeader)) != "ALARM" ||
+		string(h.Get(engine.DeadLetterOffsetHeader)) != "0" || string(h.Get(engine.DeadLetterConsumerHeader)) != "probe" ||
+		!bytes.Contains(h.Get(engine.DeadLetterReasonHeader), []byte("encrypt failed")) {
+		t.Errorf("dead letter mismatch: %+v", record)
+	}
+	if string(h.Get("trace")) != "abc" || h.Get(proto.TTLHeader) != nil {
+		t.Errorf("dead letter headers mismatch: %v", h)
+	}
+	if topic.Undelivered() != 1 {
+		t.Errorf("undelivered mismatch: %d", topic.Undelivered())
+	}
+}
+
+func TestTopic_ConsumerGroup(t *testing.T) {
+	topic := engine.NewTopic([]byte("JOBS"), 10, 10)
+	group := &engine.ConsumerConfig{Group: "workers"}
+	topic.AddConsumer(&engine.Consumer{Addr: "w1", Conf: group})
+	topic.AddConsumer(&engine.Consumer{Addr: "w2", Conf: group})
+	topic.AddConsumer(&engine.Consumer{Addr: "w2", Conf: group}) // 重复加入
+	topic.AddConsumer(&engine.Consumer{Addr: "monitor", Conf: &engine.ConsumerConfig{}})
+
+	groups := topic.Groups()
+	if len(groups) != 1 || !reflect.DeepEqual(groups["workers"], []string{"w1", "w2"}) {
+		t.Fatalf("groups mismatch: %v", groups)
+	}
+
+	topic.RemoveConsumer("w1")
+	if members := topic.Groups()["workers"]; !reflect.DeepEqual(members, []string{"w2"}) {
+		t.Errorf("group should rebalance to remaining members: %v", members)
+	}
+	topic.RemoveConsumer("w2")
+	if len(topic.Groups()) != 0 {
+		t.Errorf("empty group should be removed: %v", topic.Groups())
+	}
+}
+
+func TestEngine_Partitions(t *testing.T) {
+	partitions := engine.ParseTopicPartitions("ORDERS=3, LOGS=x,=2,EVENTS=2")
+	if !reflect.DeepEqual(partitions, map[string]int{"ORDERS": 3, "EVENTS": 2}) {
+		t.Fatalf("parsed partitions mismatch: %v", partitions)
+	}
+	handler := engine.New(engine.Config{TopicPartitions: partitions})
+
+	// 相同键的消息属于同一分区, 偏移量在分区内连续
+	for i := uint64(0); i < 3; i++ {
+		pm := &proto.PMessage{Topic: []byte("ORDERS"), Key: []byte("order-1"), Value: []byte("v")}
+		if offset := handler.Publisher(pm); offset != i {
+			t.Fatalf("message %d offset mismatch: %d", i, offset)
+		}
+	}
+	// 无键的消息依次分配给各分区
+	for i := 0; i < 2; i++ {
+		if offset := handler.Publisher(&proto.PMessage{Topic: []byte("EVENTS"), Value: []byte("v")}); offset != 0 {
+			t.Errorf("message %d should be the first of its partition, got offset: %d", i, offset)
+		}
+	}
+	if n := handler.GetTopic([]byte("DEFAULT")).Partitions(); n != engine.DefaultPartitions {
+		t.Errorf("default partitions mismatch: %d", n)
+	}
+
+	topic := handler.GetTopic([]byte("ORDERS"))
+	if topic.Partitions() != 3 {
+		t.Fatalf("partitions mismatch: %d", topic.Partitions())
+	}
+	published := 0
+	for i := 0; i < topic.Partitions(); i++ {
+		if offset := topic.PartitionOffset(i); offset == 2 {
+			published++
+		} else if offset != 0 {
+			t.Errorf("partition %d offset mismatch: %d", i, offset)
+		}
+	}
+	if published != 1 {
+		t.Errorf("messages with the same key should be in one partition, got %d partitions", published)
+	}
+}
+
+func TestTopic_PublishOrder(t *testing.T) {
+	const publishers, messages = 8, 200
+	offsets := make(chan uint64, publishers*messages)
+	topic := engine.NewTopic([]byte("ORDERED"), 1, 10) // 通道总是满的, 发布者在加入通道时阻塞
+	topic.SetOnConsumed(func(record *engine.HistoryRecord) { offsets <- record.Offset })
+
+	// 并发发布到同一分区的消息按偏移量的顺序推送
+	wg := &sync.WaitGroup{}
+	for i := 0; i < publishers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < messages; j++ {
+				topic.Publisher(&proto.PMessage{Topic: topic.Name, Key: []byte("k"), Value: []byte("v")})
+			}
+		}()
+	}
+	wg.Wait()
+
+	for want := uint64(0); want < publishers*messages; want++ {
+		select {
+		case offset := <-offsets:
+			if offset != want {
+				t.Fatalf("message consumed out of order, want offset: %d, got: %d", want, offset)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message offset %d not consumed", want)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package test
+
+import (
+	"bytes"
+	"github.com/Chendemo12/micromq/src/proto"
+	"testing"
+)
+
+// 种子的首字节 mode: 最低位选择帧版本, 次低位选择控制消息的序列化方法
+func frameMode(mode byte) (proto.FrameVersion, proto.MarshalMethodType) {
+	method := proto.JsonMarshalMethod
+	if mode&0x02 != 0 {
+		method = proto.BinaryMarshalMethod
+	}
+	return proto.FrameVersion(mode&0x01 + 1), method
+}
+
+// 以某一种消息的合法编码作为种子
+func seedMessage(f *testing.F, version proto.FrameVersion, m proto.Message) {
+	seedMessageWith(f, byte(version-1), m)
+}
+
+// 以某一种控制消息的二进制编码作为种子
+func seedBinaryMessage(f *testing.F, m proto.Message) {
+	seedMessageWith(f, byte(proto.FrameV2-1)|0x02, m)
+}
+
+func seedMessageWith(f *testing.F, mode byte, m proto.Message) {
+	version, method := frameMode(mode)
+	frame := &proto.TransferFrame{}
+	frame.Reset()
+	frame.SetVersion(version).SetMessageMarshalMethod(method)
+	if err := frame.BuildFrom(m); err != nil {
+		f.Fatalf("seed %s build failed: %v", m, err)
+	}
+	f.Add(mode, frame.Payload())
+}
+
+// 将任意载荷作为 typ 类型的消息解码, 任何输入均不允许 panic
+func fuzzMessage(f *testing.F, typ proto.MessageType) {
+	f.Add(byte(0), []byte{})
+	f.Add(byte(1), []byte{0xFF, 0xFF, 0xFF, 0xFF})
+
+	f.Fuzz(func(t *testing.T, mode byte, data []byte) {
+		version, method := frameMode(mode)
+		frame := &proto.TransferFrame{}
+		frame.Reset()
+		frame.SetVersion(version).SetMessageMarshalMethod(method)
+		if err := frame.BuildWith(typ, data); err != nil {
+			return
+		}
+
+		// 经由完整的帧编解码流程
+		parsed := &proto.TransferFrame{}
+		parsed.Reset()
+		parsed.SetVersion(proto.FrameVersionAuto)
+		if err := parsed.Parse(frame.Build()); err != nil {
+			t.Fatalf("valid frame parse failed: %v", err)
+		}
+
+		_, _ = parsed.UnmarshalTo()
+
+		msgs := make([]proto.Message, 0)
+		_ = proto.FrameSplit[proto.Message](parsed, &msgs)
+		for _, msg := range msgs {
+			_ = msg.String()
+		}
+	})
+}
+
+func FuzzPMessage(f *testing.F) {
+	for _, version := range []proto.FrameVersion{proto.FrameV1, proto.FrameV2} {
+		seedMessage(f, version, &proto.PMessage{Topic: []byte("T"), Key: []byte("K"), Value: []byte("V")})
+	}
+	fuzzMessage(f, proto.PMessageType)
+}
+
+func FuzzHPMessage(f *testing.F) {
+	seedMessage(f, proto.FrameV2, &proto.PMessage{
+		Topic: []byte("T"), Key: []byte("K"), Value: []byte("V"), Headers: proto.Headers{"trace": []byte("abc")},
+	})
+	fuzzMessage(f, proto.HPMessageType)
+}
+
+func FuzzReplyMessage(f *testing.F) {
+	rm := &proto.ReplyMessage{PMessage: proto.PMessage{
+		Topic: []byte("reply"), Value: []byte("V"), Headers: proto.Headers{proto.CorrelationIDHeader: []byte("c-1")},
+	}}
+	seedMessage(f, proto.FrameV1, rm)
+	seedMessage(f, proto.FrameV2, rm)
+	seedBinaryMessage(f, rm)
+	fuzzMessage(f, proto.ReplyMessageType)
+}
+
+func FuzzBatchMessage(f *testing.F) {
+	for _, version := range []proto.FrameVersion{proto.FrameV1, proto.FrameV2} {
+		bm := &proto.BatchMessage{}
+		bm.Append(&proto.PMessage{Topic: []byte("T"), Key: []byte("K"), Value: []byte("V")}).
+			Append(&proto.PMessage{Topic: []byte("U"), Value: []byte("W"), Headers: proto.Headers{"a": []byte("b")}})
+		seedMessage(f, version, bm)
+	}
+	fuzzMessage(f, proto.BatchMessageType)
+}
+
+func FuzzCMessage(f *testing.F) {
+	cm := &proto.CMessage{}
+	cm.Reset()
+	cm.PM = &proto.PMessage{Topic: []byte("T"), Key: []byte("K"), Value: []byte("V")}
+	seedMessage(f, proto.FrameV1, cm)
+	fuzzMessage(f, proto.CMessageType)
+}
+
+func FuzzHCMessage(f *testing.F) {
+	cm := &proto.CMessage{}
+	cm.Reset()
+	cm.PM = &proto.PMessage{Topic: []byte("T"), Value: []byte("V"), Headers: proto.Headers{"a": nil}}
+	seedMessage(f, proto.FrameV2, cm)
+	fuzzMessage(f, proto.HCMessageType)
+}
+
+func FuzzRegisterMessage(f *testing.F) {
+	seedMessage(f, proto.FrameV1, &proto.RegisterMessage{
+		Topics: []string{"T"}, Ack: proto.AllConfirm, Type: proto.ConsumerLinkType, Version: proto.ProtocolVersion,
+	})
+	seedBinaryMessage(f, &proto.RegisterMessage{
+		Topics: []string{"T"}, Ack: proto.AllConfirm, Type: proto.ConsumerLinkType, Version: proto.ProtocolVersion,
+		Capabilities: proto.DefaultCapabilities(),
+	})
+	fuzzMessage(f, proto.RegisterMessageType)
+}
+
+func FuzzHeartbeatMessage(f *testing.F) {
+	seedMessage(f, proto.FrameV1, &proto.HeartbeatMessage{Type: proto.ProducerLinkType, CreatedAt: 1})
+	seedBinaryMessage(f, &proto.HeartbeatMessage{Type: proto.ProducerLinkType, CreatedAt: 1})
+	fuzzMessage(f, proto.HeartbeatMessageType)
+}
+
+func FuzzSubscribeMessage(f *testing.F) {
+	sm := &proto.SubscribeMessage{
+		Type: proto.SubscribeMessageType, Topics: []string{"T", "a/#"},
+		Positions: map[string]*proto.StartPosition{"T": {Type: proto.StartEarliest}},
+	}
+	seedMessage(f, proto.FrameV1, sm)
+	seedBinaryMessage(f, sm)
+	fuzzMessage(f, proto.SubscribeMessageType)
+}
+
+func FuzzAckMessage(f *testing.F) {
+	am := &proto.AckMessage{Acks: []*proto.Acknowledgement{{Topic: "T", Partition: 1, Offset: 2}}}
+	seedMessage(f, proto.FrameV1, am)
+	seedBinaryMessage(f, am)
+	fuzzMessage(f, proto.AckMessageType)
+}
+
+func FuzzMessageResponse(f *testing.F) {
+	seedMessage(f, proto.FrameV1, &proto.MessageResponse{Status: proto.AcceptedStatus, Offset: 1})
+	seedBinaryMessage(f, &proto.MessageResponse{Status: proto.AcceptedStatus, Offset: 1, Keepalive: 15})
+	seedBinaryMessage(f, &proto.MessageResponse{Status: proto.AcceptedStatus, Offset: 1, Sequence: 7})
+	fuzzMessage(f, proto.MessageRespType)
+}
+
+func FuzzNotImplementMessage(f *testing.F) {
+	fuzzMessage(f, proto.NotImplementMessageType)
+}
+
+// 任意字节流均不允许使帧解析 panic
+func FuzzFrameScanner(f *testing.F) {
+	frame := &proto.TransferFrame{}
+	frame.Reset()
+	_ = frame.BuildFrom(&proto.PMessage{Topic: []byte("T"), Value: []byte("V")})
+	f.Add(frame.Build())
+	f.Add(bytes.Repeat([]byte{proto.FrameHead, byte(proto.FrameV2)}, 8))
+
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		for _, partial := range []bool{false, true} {
+			scanner := proto.NewFrameScanner(stream, proto.FrameVersionAuto)
+			if partial {
+				scanner.AllowPartial()
+			}
+			for scanner.More() {
+				parsed := &proto.TransferFrame{}
+				parsed.Reset()
+				if err := scanner.Next(parsed); err == nil {
+					_, _ = parsed.UnmarshalTo()
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,281 @@
+package test
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/Chendemo12/fastapi-tool/logger"
+	"github.com/Chendemo12/micromq/src/engine"
+	"github.com/Chendemo12/micromq/src/proto"
+	"github.com/Chendemo12/micromq/src/transfer"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 内存中的传输层, 用于在不监听端口的情况下经由引擎的完整处理流程进行测试
+type memTransfer struct {
+	conns             *sync.Map // {addr: *memConn}
+	started           chan struct{}
+	done              chan struct{}
+	stopOnce          *sync.Once
+	onConnected       func(c transfer.Conn)
+	onClosed          func(addr string)
+	onReceived        func(frame *proto.TransferFrame, c transfer.Conn)
+	onFrameParseError func(frame *proto.TransferFrame, c transfer.Conn, err error)
+}
+
+func (t *memTransfer) SetHost(_ string)                               {}
+func (t *memTransfer) SetPort(_ string)                               {}
+func (t *memTransfer) SetMaxOpenConn(_ int)                           {}
+func (t *memTransfer) SetLogger(_ logger.Iface)                       {}
+func (t *memTransfer) SetOnConnectedHandler(fn func(c transfer.Conn)) { t.onConnected = fn }
+func (t *memTransfer) SetOnClosedHandler(fn func(addr string))        { t.onClosed = fn }
+
+func (t *memTransfer) SetOnReceivedHandler(fn func(frame *proto.TransferFrame, c transfer.Conn)) {
+	t.onReceived = fn
+}
+
+func (t *memTransfer) SetOnFrameParseErrorHandler(fn func(frame *proto.TransferFrame, c transfer.Conn, err error)) {
+	t.onFrameParseError = fn
+}
+
+// Close 服务端主动断开连接
+func (t *memTransfer) Close(addr string) error {
+	if v, ok := t.conns.LoadAndDelete(addr); ok {
+		v.(*memConn).connected.Store(false)
+		t.onClosed(addr)
+	}
+	return nil
+}
+
+func (t *memTransfer) Serve() error {
+	close(t.started)
+	<-t.done
+	return nil
+}
+
+func (t *memTransfer) Stop() { t.stopOnce.Do(func() { close(t.done) }) }
+
+// 建立一个客户端连接
+func (t *memTransfer) connect(addr string) *memConn {
+	c := &memConn{
+		Mutex:     &sync.Mutex{},
+		addr:      addr,
+		transfer:  t,
+		bufLock:   &sync.Mutex{},
+		frames:    make(chan *proto.TransferFrame, 1024),
+		connected: &atomic.Bool{},
+	}
+	c.connected.Store(true)
+	t.conns.Store(addr, c)
+	t.onConnected(c)
+
+	return c
+}
+
+// 以内存传输层启动引擎, 测试结束时停止; setup 在 Serve 之前执行
+func serveEngine(t *testing.T, conf engine.Config, setup ...func(e *engine.Engine)) (*engine.Engine, *memTransfer) {
+	ctx, cancel := context.WithCancel(context.Background())
+	conf.Ctx = ctx
+
+	tr := &memTransfer{
+		conns: &sync.Map{}, started: make(chan struct{}), done: make(chan struct{}), stopOnce: &sync.Once{},
+	}
+	e := engine.New(conf)
+	e.ReplaceTransfer(tr)
+	for _, fn := range setup {
+		fn(e)
+	}
+	t.Cleanup(func() {
+		cancel()
+		e.Stop()
+	})
+	go func() {
+		if err := e.Serve(); err != nil {
+			t.Errorf("engine serve failed: %v", err)
+		}
+	}()
+	<-tr.started
+
+	return e, tr
+}
+
+// 内存中的客户端连接, 服务端写入的帧被解析后依次放入 frames
+type memConn struct {
+	*sync.Mutex // 由 proto.TransferFrame.DrainTo 在写入一个完整的帧期间持有
+	addr        string
+	transfer    *memTransfer
+	bufLock     *sync.Mutex
+	buf         []byte
+	frames      chan *proto.TransferFrame
+	connected   *atomic.Bool
+	pending     []*proto.CMessage // 已收到但尚未读取的消费者消息
+}
+
+func (c *memConn) Addr() string                       { return c.addr }
+func (c *memConn) IsConnected() bool                  { return c.connected.Load() }
+func (c *memConn) Read(_ []byte) (int, error)         { return 0, io.EOF }
+func (c *memConn) ReadN(_ int) []byte                 { return nil }
+func (c *memConn) Len() int                           { return 0 }
+func (c *memConn) Copy(_ []byte) (int, error)         { return 0, io.EOF }
+func (c *memConn) Seek(_ int64, _ int) (int64, error) { return 0, nil }
+func (c *memConn) Close() error                       { return c.transfer.Close(c.addr) }
+
+func (c *memConn) Write(p []byte) (int, error) {
+	if !c.IsConnected() {
+		return 0, io.ErrClosedPipe
+	}
+	c.bufLock.Lock()
+	c.buf = append(c.buf, p...)
+	c.bufLock.Unlock()
+
+	return len(p), nil
+}
+
+func (c *memConn) Drain() error {
+	c.bufLock.Lock()
+	stream := c.buf
+	c.buf = nil
+	c.bufLock.Unlock()
+
+	scanner := proto.NewFrameScanner(stream, proto.FrameVersionAuto)
+	for scanner.More() {
+		frame := &proto.TransferFrame{}
+		frame.Reset()
+		if err := scanner.Next(frame); err != nil {
+			return err
+		}
+		c.frames <- frame
+	}
+	return nil
+}
+
+// 客户端断开连接
+func (c *memConn) disconnect() { _ = c.Close() }
+
+// 向服务端发送一个消息, 由调用方的协程同步处理
+func (c *memConn) send(t *testing.T, m proto.Message) {
+	t.Helper()
+	frame := &proto.TransferFrame{}
+	frame.Reset()
+	frame.SetVersion(proto.FrameV2)
+	if err := frame.BuildFrom(m); err != nil {
+		t.Fatalf("%s build failed: %v", m, err)
+	}
+	parsed := &proto.TransferFrame{}
+	parsed.Reset()
+	parsed.SetVersion(proto.FrameV2)
+	if err := parsed.Parse(frame.Build()); err != nil {
+		t.Fatalf("%s parse failed: %v", m, err)
+	}
+	c.transfer.onReceived(parsed, c)
+}
+
+// 等待服务端写入的下一个指定类型的帧, 其他类型的帧被忽略
+func (c *memConn) expect(t *testing.T, typ proto.MessageType, timeout time.Duration) *proto.TransferFrame {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case frame := <-c.frames:
+			if frame.Type() == typ {
+				return frame
+			}
+		case <-deadline:
+			t.Fatalf("'%s' expect %s in %s", c.addr, proto.GetDescriptor(typ).Text(), timeout)
+			return nil
+		}
+	}
+}
+
+// 以默认能力注册为消费者, 返回注册响应
+func (c *memConn) register(t *testing.T, rm *proto.RegisterMessage) *proto.MessageResponse {
+	t.Helper()
+	if rm.Type == "" {
+		rm.Type = proto.ConsumerLinkType
+	}
+	if rm.Ack == "" {
+		rm.Ack = proto.AllConfirm
+	}
+	if rm.Capabilities == nil {
+		rm.Capabilities = proto.DefaultCapabilities()
+	}
+	rm.Version = proto.ProtocolVersion
+	c.send(t, rm)
+
+	resp := &proto.MessageResponse{}
+	if err := c.expect(t, proto.RegisterMessageRespType, time.Second).Unmarshal(resp); err != nil {
+		t.Fatalf("register response unmarshal failed: %v", err)
+	}
+	if !resp.Accepted() {
+		t.Fatalf("'%s' register refused: %s", c.addr, proto.GetMessageResponseStatusText(resp.Status))
+	}
+	return resp
+}
+
+// 等待下一个推送给消费者的消息
+func (c *memConn) receive(t *testing.T, timeout time.Duration) *proto.CMessage {
+	t.Helper()
+	deadline := time.After(timeout)
+	for len(c.pending) == 0 {
+		select {
+		case frame := <-c.frames:
+			if frame.Type() != proto.CMessageType && frame.Type() != proto.HCMessageType {
+				continue
+			}
+			if err := proto.FrameSplit[*proto.CMessage](frame, &c.pending); err != nil {
+				t.Fatalf("consumer message split failed: %v", err)
+			}
+		case <-deadline:
+			t.Fatalf("'%s' expect consumer message in %s", c.addr, timeout)
+		}
+	}
+	cm := c.pending[0]
+	c.pending = c.pending[1:]
+
+	return cm
+}
+
+// 等待下一个推送给消费者的消息, 但不将其取出
+func (c *memConn) peek(t *testing.T, timeout time.Duration) *proto.CMessage {
+	t.Helper()
+	cm := c.receive(t, timeout)
+	c.pending = append([]*proto.CMessage{cm}, c.pending...)
+
+	return cm
+}
+
+// 在一段时间内不应收到任何推送给消费者的消息
+func (c *memConn) silent(t *testing.T, d time.Duration) {
+	t.Helper()
+	if len(c.pending) > 0 {
+		t.Fatalf("'%s' unexpected consumer message: %s", c.addr, c.pending[0].PM.Value)
+	}
+	deadline := time.After(d)
+	for {
+		select {
+		case frame := <-c.frames:
+			if frame.Type() == proto.CMessageType || frame.Type() == proto.HCMessageType {
+				t.Fatalf("'%s' unexpected consumer message", c.addr)
+			}
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// 确认消费者消息
+func (c *memConn) ack(t *testing.T, cms ...*proto.CMessage) {
+	t.Helper()
+	am := &proto.AckMessage{}
+	for _, cm := range cms {
+		am.Acks = append(am.Acks, &proto.Acknowledgement{
+			Topic: string(cm.PM.Topic), Partition: cm.Partition, Offset: cmOffset(cm),
+		})
+	}
+	c.send(t, am)
+}
+
+func cmOffset(cm *proto.CMessage) uint64 { return binary.BigEndian.Uint64(cm.Offset) }
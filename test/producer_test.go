@@ -4,6 +4,11 @@ import (
 	"context"
 	"github.com/Chendemo12/fastapi-tool/logger"
 	"github.com/Chendemo12/micromq/sdk"
+	"github.com/Chendemo12/micromq/src/proto"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -63,3 +68,165 @@ func TestSdkProducer_Start(t *testing.T) {
 	cancel()
 	producer.Stop()
 }
+
+// 在生产者与服务端之间转发数据的代理, 用于模拟连接中断前写入的数据或服务端的响应丢失
+type lossyProxy struct {
+	net.Listener
+	target        string
+	dropRequests  *atomic.Bool // 丢弃生产者发往服务端的数据
+	dropResponses *atomic.Bool // 丢弃服务端发往生产者的数据
+	mu            *sync.Mutex
+	conns         []net.Conn
+}
+
+func (p *lossyProxy) serve() {
+	for {
+		client, err := p.Accept()
+		if err != nil {
+			return
+		}
+		server, err := net.Dial("tcp", p.target)
+		if err != nil {
+			_ = client.Close()
+			continue
+		}
+		p.mu.Lock()
+		p.conns = append(p.conns, client, server)
+		p.mu.Unlock()
+
+		go p.pipe(server, client, p.dropRequests)
+		go p.pipe(client, server, p.dropResponses)
+	}
+}
+
+func (p *lossyProxy) pipe(dst, src net.Conn, drop *atomic.Bool) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			_ = dst.Close()
+			return
+		}
+		if drop.Load() {
+			continue
+		}
+		if _, err = dst.Write(buf[:n]); err != nil {
+			_ = src.Close()
+			return
+		}
+	}
+}
+
+// 断开全部连接, 此后的连接正常转发
+func (p *lossyProxy) cut() {
+	p.mu.Lock()
+	for _, conn := range p.conns {
+		_ = conn.Close()
+	}
+	p.conns = nil
+	p.mu.Unlock()
+
+	p.dropRequests.Store(false)
+	p.dropResponses.Store(false)
+}
+
+type resendConsumer struct {
+	sdk.CHandler
+	values chan string
+}
+
+func (c *resendConsumer) Topics() []string { return []string{"RESEND"} }
+
+func (c *resendConsumer) Handler(record *sdk.ConsumerMessage) {
+	c.values <- string(record.Value)
+}
+
+// 连接在一批消息的中途断开, 已写入但未被确认的消息在重新注册后重发, 且每个消息仅被发布一次
+func TestSdkProducer_ResendUnacked(t *testing.T) {
+	port := startBroker()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("proxy listen failed: %v", err)
+	}
+	proxy := &lossyProxy{
+		Listener: listener, target: "127.0.0.1:" + port,
+		dropRequests: &atomic.Bool{}, dropResponses: &atomic.Bool{}, mu: &sync.Mutex{},
+	}
+	defer func() { _ = proxy.Close() }()
+	go proxy.serve()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	sc := sdk.Config{Host: "127.0.0.1", Port: port, PCtx: ctx, FrameVersion: proto.FrameV2}
+
+	// 重连后发送的消息超过等待确认的最大数量, 须按服务端下发的发送周期等待确认
+	const num = 80 + sdk.MaxUnacknowledged
+	handler := &resendConsumer{values: make(chan string, num)}
+	consumer, err := sdk.NewConsumer(sc, handler)
+	if err != nil {
+		t.Fatalf("consumer create failed: %v", err)
+	}
+	if err = consumer.Start(); err != nil {
+		t.Fatalf("consumer start failed: %v", err)
+	}
+
+	sc.Port = strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	producer, err := sdk.NewAsyncProducer(sc)
+	if err != nil {
+		t.Fatalf("producer create failed: %v", err)
+	}
+	waitRegistered := func() {
+		for i := 0; i < 200 && !(consumer.IsRegistered() && producer.IsRegistered()); i++ {
+			time.Sleep(50 * time.Millisecond)
+		}
+		if !producer.IsRegistered() {
+			t.Fatalf("producer not registered")
+		}
+	}
+	send := func(from, to int) {
+		for i := from; i < to; i++ {
+			err := producer.Send(func(r *sdk.ProducerMessage) error {
+				r.Topic = "RESEND"
+				r.Value = []byte(strconv.Itoa(i))
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("producer send failed: %v", err)
+			}
+		}
+		time.Sleep(500 * time.Millisecond) // 等待消息写入连接
+	}
+
+	waitRegistered()
+	send(0, 20)
+	proxy.dropResponses.Store(true) // 消息已发布, 但响应丢失
+	send(20, 40)
+	proxy.dropRequests.Store(true) // 消息已写入连接, 但服务端未收到
+	send(40, 60)
+	proxy.cut()
+
+	time.Sleep(200 * time.Millisecond)
+	waitRegistered()
+	send(60, num)
+
+	received := make(map[string]int)
+	timeout := time.After(15 * time.Second)
+	for len(received) < num {
+		select {
+		case v := <-handler.values:
+			received[v]++
+		case <-timeout:
+			t.Fatalf("expect %d messages, received %d", num, len(received))
+		}
+	}
+
+	time.Sleep(500 * time.Millisecond) // 等待可能的重复消息
+	for len(handler.values) > 0 {
+		received[<-handler.values]++
+	}
+	for i := 0; i < num; i++ {
+		if n := received[strconv.Itoa(i)]; n != 1 {
+			t.Errorf("message %d received %d times", i, n)
+		}
+	}
+}
@@ -1,8 +1,14 @@
 package test
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"github.com/Chendemo12/micromq/src/proto"
+	"math"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestTransferFrame_BuildFrom(t *testing.T) {
@@ -20,3 +26,829 @@ func TestTransferFrame_BuildFrom(t *testing.T) {
 		t.Logf("RegisterMessage built: %s", string(frame.Build()))
 	}
 }
+
+func TestTransferFrame_V2RoundTrip(t *testing.T) {
+	pm := &proto.PMessage{
+		Topic: []byte("DNS_REPORT"),
+		Key:   []byte("test.test.com"),
+		Value: bytes.Repeat([]byte("a"), 70000), // 超出 v1 帧的限制
+	}
+
+	frame := &proto.TransferFrame{}
+	frame.Reset()
+	if err := frame.BuildFrom(pm); !errors.Is(err, proto.ErrFieldTooLong) {
+		t.Fatalf("v1 frame should refuse large value, got: %v", err)
+	}
+
+	frame.Reset()
+	frame.SetVersion(proto.FrameV2)
+	if err := frame.BuildFrom(pm); err != nil {
+		t.Fatalf("v2 frame build failed: %v", err)
+	}
+	stream := frame.Build()
+
+	parsed := &proto.TransferFrame{}
+	parsed.Reset()
+	parsed.SetVersion(proto.FrameVersionAuto)
+	if err := parsed.Parse(stream); err != nil {
+		t.Fatalf("v2 frame parse failed: %v", err)
+	}
+	if parsed.Version() != proto.FrameV2 || !parsed.HasFlag(proto.FlagCRC32C) {
+		t.Fatalf("frame version not detected: %s", parsed)
+	}
+
+	msg, err := parsed.UnmarshalTo()
+	if err != nil {
+		t.Fatalf("v2 frame unmarshal failed: %v", err)
+	}
+	got := msg.(*proto.PMessage)
+	if string(got.Topic) != "DNS_REPORT" || len(got.Value) != len(pm.Value) {
+		t.Errorf("unexpected message: %s", got)
+	}
+}
+
+func TestTransferFrame_DetectV1(t *testing.T) {
+	frame := &proto.TransferFrame{}
+	frame.Reset()
+	_ = frame.BuildFrom(&proto.HeartbeatMessage{Type: proto.ProducerLinkType})
+
+	parsed := &proto.TransferFrame{}
+	parsed.Reset()
+	parsed.SetVersion(proto.FrameVersionAuto)
+	if err := parsed.Parse(frame.Build()); err != nil {
+		t.Fatalf("v1 frame parse failed: %v", err)
+	}
+	if parsed.Version() != proto.FrameV1 || parsed.Type() != proto.HeartbeatMessageType {
+		t.Errorf("unexpected frame: %s", parsed)
+	}
+}
+
+func TestTransferFrame_VersionMismatch(t *testing.T) {
+	frame := &proto.TransferFrame{}
+	frame.Reset()
+	frame.SetVersion(proto.FrameV2)
+	_ = frame.BuildFrom(&proto.HeartbeatMessage{Type: proto.ProducerLinkType})
+	stream := frame.Build()
+	stream[1] = 0x03 // 未知的帧版本
+
+	parsed := &proto.TransferFrame{}
+	parsed.Reset()
+	parsed.SetVersion(proto.FrameV2)
+	if err := parsed.Parse(stream); !errors.Is(err, proto.ErrFrameVersionInvalid) {
+		t.Errorf("unknown frame version should be refused, got: %v", err)
+	}
+
+	// 退回 v1 时清除仅 v2 帧有效的标志位, 以免复用的帧按 v2 的规则计算校验和或解压
+	frame.SetFlag(proto.FlagCompressed).SetVersion(proto.FrameV1)
+	if frame.HasFlag(proto.FlagCRC32C) || frame.Compressed() {
+		t.Errorf("v2 flags should be cleared for v1 frame: %s", frame)
+	}
+	if n := proto.FrameV1.MaxFrameLength(); n != math.MaxUint16+proto.FrameMinLength {
+		t.Errorf("v1 max frame length mismatch: %d", n)
+	}
+	if n := proto.FrameVersionAuto.MaxFrameLength(); n != int(proto.MaxFrameDataSize)+proto.FrameV2MinLength {
+		t.Errorf("auto max frame length mismatch: %d", n)
+	}
+}
+
+func TestFrameScanner_Resync(t *testing.T) {
+	build := func(key string) []byte {
+		frame := &proto.TransferFrame{}
+		frame.Reset()
+		_ = frame.BuildFrom(&proto.PMessage{Topic: []byte("T"), Key: []byte(key), Value: []byte("v")})
+		return frame.Build()
+	}
+
+	corrupted := build("bad")
+	corrupted[6] ^= 0xFF // 破坏载荷, 使校验和不匹配
+
+	stream := []byte{0x01, 0x02} // 帧前的垃圾数据
+	stream = append(stream, build("first")...)
+	stream = append(stream, corrupted...)
+	stream = append(stream, build("second")...)
+
+	scanner := proto.NewFrameScanner(stream, proto.FrameV1)
+	keys := make([]string, 0)
+	errs := make([]error, 0)
+	for scanner.More() {
+		frame := &proto.TransferFrame{}
+		frame.Reset()
+		if err := scanner.Next(frame); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		msg, _ := frame.UnmarshalTo()
+		keys = append(keys, string(msg.(*proto.PMessage).Key))
+	}
+
+	if len(keys) != 2 || keys[0] != "first" || keys[1] != "second" {
+		t.Errorf("unexpected frames: %v", keys)
+	}
+	if len(errs) != 2 || !errors.Is(errs[0], proto.ErrFrameHeadInvalid) ||
+		!errors.Is(errs[1], proto.ErrFrameChecksumMismatch) {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+}
+
+// 以消息为单位记录写入的数据, 模拟 TCP 传输层
+type messageRecorder struct {
+	buf      []byte
+	messages [][]byte
+}
+
+func (r *messageRecorder) Write(p []byte) (int, error) {
+	r.buf = append(r.buf, p...)
+	return len(p), nil
+}
+
+func (r *messageRecorder) Drain() error {
+	if len(r.buf) > 0 {
+		r.messages = append(r.messages, r.buf)
+		r.buf = nil
+	}
+	return nil
+}
+
+func TestTransferFrame_DrainTo(t *testing.T) {
+	value := bytes.Repeat([]byte("0123456789abcdef"), 1<<16) // 1MB
+	frame := &proto.TransferFrame{}
+	frame.Reset()
+	frame.SetVersion(proto.FrameV2)
+	if err := frame.BuildFrom(&proto.PMessage{Topic: []byte("T"), Value: value}); err != nil {
+		t.Fatalf("frame build failed: %v", err)
+	}
+	small := &proto.TransferFrame{}
+	small.Reset()
+	small.SetVersion(proto.FrameV2)
+	_ = small.BuildFrom(&proto.PMessage{Topic: []byte("T"), Value: []byte("v")})
+
+	w := &messageRecorder{}
+	_, _ = w.Write([]byte{0x01}) // 已写入但尚未发出的数据
+	if err := frame.DrainTo(w); err != nil {
+		t.Fatalf("drain failed: %v", err)
+	}
+	_ = small.DrainTo(w)
+	if len(w.messages) != 1+(frame.Length()+proto.MaxTransferMessageLength-1)/proto.MaxTransferMessageLength+1 {
+		t.Fatalf("unexpected number of messages: %d", len(w.messages))
+	}
+	for i, m := range w.messages {
+		if len(m) > proto.MaxTransferMessageLength {
+			t.Fatalf("message %d exceeds the transfer limit: %d bytes", i, len(m))
+		}
+	}
+
+	// 逐个消息解析, 不完整的帧与后续的消息拼接
+	var partial []byte
+	values := make([][]byte, 0)
+	for _, m := range w.messages {
+		stream := append(partial, m...)
+		scanner := proto.NewFrameScanner(stream, proto.FrameV2).AllowPartial()
+		for scanner.More() {
+			parsed := &proto.TransferFrame{}
+			parsed.Reset()
+			err := scanner.Next(parsed)
+			if errors.Is(err, proto.ErrFrameIncomplete) {
+				break
+			}
+			if err != nil {
+				continue // 帧之前的垃圾数据
+			}
+			msg, _ := parsed.UnmarshalTo()
+			values = append(values, msg.(*proto.PMessage).Value)
+		}
+		partial = append([]byte{}, scanner.Remainder()...)
+	}
+	if len(values) != 2 || !bytes.Equal(values[0], value) || string(values[1]) != "v" || len(partial) != 0 {
+		t.Errorf("reassembled frames mismatch: %d frames, %d bytes left", len(values), len(partial))
+	}
+
+	// 未允许不完整的帧时, 末尾的数据被视为损坏
+	scanner := proto.NewFrameScanner(w.messages[1], proto.FrameV2)
+	if err := scanner.Next(&proto.TransferFrame{}); !errors.Is(err, proto.ErrFrameTruncated) {
+		t.Errorf("truncated frame should be refused, got: %v", err)
+	}
+}
+
+func TestCapabilities_Intersect(t *testing.T) {
+	broker := proto.Capabilities{proto.FrameV2Capability, "batch"}
+	client := proto.Capabilities{"batch", "unknown"}
+
+	agreed := broker.Intersect(client)
+	if len(agreed) != 1 || !agreed.Has("batch") {
+		t.Errorf("unexpected capabilities: %v", agreed)
+	}
+
+	rm := &proto.RegisterMessage{}
+	if rm.ProtocolVersion() != proto.LegacyProtocolVersion {
+		t.Errorf("legacy client should be treated as version %d", proto.LegacyProtocolVersion)
+	}
+}
+
+func TestTransferFrame_Headers(t *testing.T) {
+	pms := []*proto.PMessage{
+		{Topic: []byte("T"), Key: []byte("k1"), Value: []byte("v1"), Headers: proto.Headers{"trace": []byte("abc")}},
+		{Topic: []byte("T"), Key: []byte("k2"), Value: []byte("v2")},
+	}
+
+	frame := &proto.TransferFrame{}
+	frame.Reset()
+	if err := frame.BuildFrom(pms[0]); err != nil || frame.Type() != proto.HPMessageType {
+		t.Fatalf("headers message should be built as %d, got %d: %v", proto.HPMessageType, frame.Type(), err)
+	}
+
+	// 同一个帧内的消息均按照帧类型编码消息头
+	frame.Reset()
+	frame.BuildWith(proto.HPMessageType, nil)
+	if err := proto.FrameCombine[*proto.PMessage](frame, pms); err != nil {
+		t.Fatalf("frame combine failed: %v", err)
+	}
+
+	parsed := &proto.TransferFrame{}
+	parsed.Reset()
+	if err := parsed.Parse(frame.Build()); err != nil {
+		t.Fatalf("frame parse failed: %v", err)
+	}
+	msgs := make([]*proto.PMessage, 0)
+	if err := proto.FrameSplit[*proto.PMessage](parsed, &msgs); err != nil {
+		t.Fatalf("frame split failed: %v", err)
+	}
+	if len(msgs) != 2 || string(msgs[0].Headers.Get("trace")) != "abc" || len(msgs[1].Headers) != 0 {
+		t.Errorf("unexpected messages: %v", msgs)
+	}
+	if string(msgs[1].Value) != "v2" {
+		t.Errorf("unexpected value: %s", msgs[1].Value)
+	}
+}
+
+func TestTransferFrame_Compress(t *testing.T) {
+	crypto := &proto.TokenCrypto{Token: proto.CalcSHA("123456")}
+	pm := &proto.PMessage{
+		Topic: []byte("SENSOR"),
+		Key:   []byte("k"),
+		Value: bytes.Repeat([]byte(`{"temperature":23.5,"humidity":60}`), 50),
+	}
+
+	for _, compressor := range []proto.Compressor{&proto.GzipCompressor{}, &proto.DeflateCompressor{}} {
+		frame := &proto.TransferFrame{}
+		frame.Reset()
+		frame.SetVersion(proto.FrameV2).SetCompressor(compressor)
+		if err := frame.BuildFrom(pm, crypto.Encrypt); err != nil {
+			t.Fatalf("%s build failed: %v", compressor, err)
+		}
+		if !frame.Compressed() || frame.DataSize() >= len(pm.Value) {
+			t.Fatalf("%s frame is not compressed: %s", compressor, frame)
+		}
+
+		parsed := &proto.TransferFrame{}
+		parsed.Reset()
+		parsed.SetVersion(proto.FrameVersionAuto)
+		if err := parsed.Parse(frame.Build()); err != nil {
+			t.Fatalf("%s parse failed: %v", compressor, err)
+		}
+		msg, err := parsed.UnmarshalTo(crypto.Decrypt)
+		if err != nil {
+			t.Fatalf("%s unmarshal failed: %v", compressor, err)
+		}
+		if !bytes.Equal(msg.(*proto.PMessage).Value, pm.Value) {
+			t.Errorf("%s value mismatch", compressor)
+		}
+	}
+
+	// v1 帧无法携带压缩标志, 不进行压缩
+	frame := &proto.TransferFrame{}
+	frame.Reset()
+	frame.SetCompressor(&proto.GzipCompressor{})
+	if err := frame.BuildFrom(pm); err != nil || frame.Compressed() {
+		t.Errorf("v1 frame should not be compressed: %v", err)
+	}
+}
+
+func TestPMessage_Truncated(t *testing.T) {
+	frame := &proto.TransferFrame{}
+	frame.Reset()
+	_ = frame.BuildFrom(&proto.PMessage{Topic: []byte("T"), Key: []byte("K"), Value: []byte("value")})
+	payload := frame.Payload()
+
+	frame.Reset()
+	_ = frame.BuildWith(proto.PMessageType, payload[:len(payload)-2])
+	_, err := frame.UnmarshalTo()
+
+	var fieldErr *proto.FieldError
+	if !errors.Is(err, proto.ErrMessageTruncated) || !errors.As(err, &fieldErr) || fieldErr.Field != "value" {
+		t.Errorf("expect truncated value, got: %v", err)
+	}
+}
+
+func TestTransferFrame_BinaryMarshal(t *testing.T) {
+	messages := []proto.Message{
+		&proto.RegisterMessage{
+			Topics: []string{"DNS_REPORT", "SENSOR"}, Ack: proto.AllConfirm, Type: proto.ConsumerLinkType,
+			Token: proto.CalcSHA("123456"), Version: proto.ProtocolVersion, Capabilities: proto.DefaultCapabilities(),
+		},
+		&proto.HeartbeatMessage{Type: proto.ProducerLinkType, CreatedAt: time.Now().Unix()},
+		&proto.MessageResponse{
+			Type: proto.MessageRespType, Status: proto.TokenIncorrectStatus, Offset: 1 << 40, ReceiveTime: time.Now().Unix(),
+			TickerInterval: 500, Keepalive: 15.5, Version: proto.ProtocolVersion, Capabilities: proto.DefaultCapabilities(),
+		},
+		&proto.MessageResponse{
+			Type: proto.BatchMessageRespType, Status: proto.AcceptedStatus, Offset: 1 << 33, ReceiveTime: time.Now().Unix(),
+			Offsets: []uint64{7, 1 << 32, 1 << 33},
+		},
+		&proto.MessageResponse{
+			Type: proto.MessageRespType, Status: proto.AcceptedStatus, Offset: 9, ReceiveTime: time.Now().Unix(),
+			Sequence: 1 << 60,
+		},
+	}
+
+	for _, m := range messages {
+		jsonFrame := &proto.TransferFrame{}
+		jsonFrame.Reset()
+		jsonFrame.SetVersion(proto.FrameV2)
+		if err := jsonFrame.BuildFrom(m); err != nil {
+			t.Fatalf("%s json build failed: %v", m, err)
+		}
+
+		frame := &proto.TransferFrame{}
+		frame.Reset()
+		frame.SetVersion(proto.FrameV2).SetMessageMarshalMethod(proto.BinaryMarshalMethod)
+		if err := frame.BuildFrom(m); err != nil {
+			t.Fatalf("%s binary build failed: %v", m, err)
+		}
+		if frame.DataSize() >= jsonFrame.DataSize() {
+			t.Errorf("%s binary payload %d bytes, json %d bytes", m, frame.DataSize(), jsonFrame.DataSize())
+		}
+
+		parsed := &proto.TransferFrame{}
+		parsed.Reset()
+		parsed.SetVersion(proto.FrameVersionAuto)
+		if err := parsed.Parse(frame.Build()); err != nil {
+			t.Fatalf("%s parse failed: %v", m, err)
+		}
+		if parsed.MessageMarshalMethod() != proto.BinaryMarshalMethod {
+			t.Fatalf("%s marshal method lost", m)
+		}
+		msg, err := parsed.UnmarshalTo()
+		if err != nil {
+			t.Fatalf("%s unmarshal failed: %v", m, err)
+		}
+		if msg.String() != m.String() || fmt.Sprintf("%+v", msg) != fmt.Sprintf("%+v", m) {
+			t.Errorf("binary round trip mismatch:\n%+v\n%+v", msg, m)
+		}
+	}
+
+	// v1 帧始终为 JSON
+	frame := &proto.TransferFrame{}
+	frame.Reset()
+	frame.SetMessageMarshalMethod(proto.BinaryMarshalMethod)
+	if frame.MessageMarshalMethod() != proto.JsonMarshalMethod {
+		t.Errorf("v1 frame should always use json")
+	}
+}
+
+// 自定义的二进制消息, 用于验证包外消息的编解码
+type deviceCommand struct {
+	proto.NotImplementMessage
+	Code byte
+	Args []byte
+}
+
+func (m *deviceCommand) MessageType() proto.MessageType { return 201 }
+func (m *deviceCommand) MarshalBinary() ([]byte, error) {
+	return append([]byte{m.Code}, m.Args...), nil
+}
+func (m *deviceCommand) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 {
+		return proto.ErrMessageTruncated
+	}
+	m.Code, m.Args = data[0], append([]byte{}, data[1:]...)
+	return nil
+}
+
+func TestTransferFrame_CustomMessage(t *testing.T) {
+	crypto := &proto.TokenCrypto{Token: "123456"}
+	cases := []struct {
+		m    proto.Message
+		recv proto.Message
+	}{
+		{&deviceCommand{Code: 7, Args: []byte("reboot")}, &deviceCommand{}},
+		{&echoMessage{Text: "hello"}, &echoMessage{}},
+	}
+
+	for _, c := range cases {
+		frame := &proto.TransferFrame{}
+		frame.Reset()
+		frame.SetVersion(proto.FrameV2)
+		if err := frame.BuildFrom(c.m, crypto.Encrypt); err != nil {
+			t.Fatalf("custom message build failed: %v", err)
+		}
+
+		parsed := &proto.TransferFrame{}
+		parsed.Reset()
+		parsed.SetVersion(proto.FrameVersionAuto)
+		if err := parsed.Parse(frame.Build()); err != nil {
+			t.Fatalf("custom frame parse failed: %v", err)
+		}
+		if parsed.Type() != c.m.MessageType() {
+			t.Fatalf("custom message type mismatch: %d", parsed.Type())
+		}
+		if err := parsed.Unmarshal(c.recv, crypto.Decrypt); err != nil {
+			t.Fatalf("custom message unmarshal failed: %v", err)
+		}
+		if fmt.Sprintf("%+v", c.recv) != fmt.Sprintf("%+v", c.m) {
+			t.Errorf("custom round trip mismatch:\n%+v\n%+v", c.recv, c.m)
+		}
+	}
+
+	// 内置消息不允许自定义编解码
+	frame := &proto.TransferFrame{}
+	frame.Reset()
+	if err := frame.BuildFrom(&proto.NotImplementMessage{}); !errors.Is(err, proto.ErrMethodNotImplemented) {
+		t.Errorf("not implemented message should not be built: %v", err)
+	}
+}
+
+func TestReplyMessage_RoundTrip(t *testing.T) {
+	reply := &proto.ReplyMessage{PMessage: proto.PMessage{
+		Topic: []byte("__REPLY__/127.0.0.1:5000"), Key: []byte("dev-1"), Value: []byte(`{"status":"ok"}`),
+		Headers: proto.Headers{proto.CorrelationIDHeader: []byte("8f14e45fceea167a")},
+	}}
+
+	for _, version := range []proto.FrameVersion{proto.FrameV1, proto.FrameV2} {
+		frame := &proto.TransferFrame{}
+		frame.Reset()
+		frame.SetVersion(version)
+		if err := frame.BuildFrom(reply); err != nil {
+			t.Fatalf("reply build failed: %v", err)
+		}
+
+		parsed := &proto.TransferFrame{}
+		parsed.Reset()
+		parsed.SetVersion(proto.FrameVersionAuto)
+		if err := parsed.Parse(frame.Build()); err != nil {
+			t.Fatalf("reply parse failed: %v", err)
+		}
+		msg, err := parsed.UnmarshalTo()
+		if err != nil {
+			t.Fatalf("reply unmarshal failed: %v", err)
+		}
+		got, ok := msg.(*proto.ReplyMessage)
+		if !ok || got.CorrelationID() != reply.CorrelationID() || !bytes.Equal(got.Value, reply.Value) ||
+			string(got.Topic) != string(reply.Topic) {
+			t.Errorf("reply round trip mismatch: %s", msg)
+		}
+	}
+}
+
+func TestHeaders_TTL(t *testing.T) {
+	h := proto.Headers{}
+	if _, ok := h.TTL(); ok {
+		t.Errorf("ttl should not be set")
+	}
+
+	h.SetTTL(1500 * time.Millisecond)
+	if ttl, ok := h.TTL(); !ok || ttl != 1500*time.Millisecond || string(h.Get(proto.TTLHeader)) != "1500" {
+		t.Errorf("ttl mismatch: %v %s", ttl, h.Get(proto.TTLHeader))
+	}
+
+	for _, v := range []string{"0", "-1", "1.5s", ""} {
+		h.Set(proto.TTLHeader, []byte(v))
+		if _, ok := h.TTL(); ok {
+			t.Errorf("invalid ttl '%s' should be ignored", v)
+		}
+	}
+}
+
+func TestHeaders_RedeliveryCount(t *testing.T) {
+	h := proto.Headers{}
+	if n := h.RedeliveryCount(); n != 0 {
+		t.Errorf("default redelivery count should be 0, got: %d", n)
+	}
+
+	h.SetRedeliveryCount(3)
+	if n := h.RedeliveryCount(); n != 3 || string(h.Get(proto.RedeliveryHeader)) != "3" {
+		t.Errorf("redelivery count mismatch: %d", n)
+	}
+
+	h.Set(proto.RedeliveryHeader, []byte("-1"))
+	if n := h.RedeliveryCount(); n != 0 {
+		t.Errorf("invalid redelivery count should be 0, got: %d", n)
+	}
+}
+
+func TestHeaders_Priority(t *testing.T) {
+	h := proto.Headers{}
+	if p := h.Priority(); p != proto.PriorityNormal {
+		t.Errorf("default priority should be normal, got: %s", p)
+	}
+
+	h.SetPriority(proto.PriorityHigh)
+	if p := h.Priority(); p != proto.PriorityHigh || string(h.Get(proto.PriorityHeader)) != "2" {
+		t.Errorf("priority mismatch: %s", p)
+	}
+
+	for v, want := range map[string]proto.MessagePriority{"0": proto.PriorityLow, "9": proto.PriorityHigh, "-1": proto.PriorityNormal, "high": proto.PriorityNormal} {
+		h.Set(proto.PriorityHeader, []byte(v))
+		if p := h.Priority(); p != want {
+			t.Errorf("priority '%s' should be %s, got: %s", v, want, p)
+		}
+	}
+}
+
+func TestBatchMessage_RoundTrip(t *testing.T) {
+	batch := &proto.BatchMessage{}
+	batch.Append(&proto.PMessage{Topic: []byte("DNS_REPORT"), Key: []byte("k1"), Value: []byte("v1")})
+	batch.Append(&proto.PMessage{
+		Topic: []byte("SENSOR"), Key: []byte("k2"), Value: bytes.Repeat([]byte("v"), 300),
+		Headers: proto.Headers{"trace": []byte("abc")},
+	})
+
+	for _, version := range []proto.FrameVersion{proto.FrameV1, proto.FrameV2} {
+		frame := &proto.TransferFrame{}
+		frame.Reset()
+		frame.SetVersion(version)
+		if err := frame.BuildFrom(batch); err != nil {
+			t.Fatalf("batch build failed: %v", err)
+		}
+
+		parsed := &proto.TransferFrame{}
+		parsed.Reset()
+		parsed.SetVersion(proto.FrameVersionAuto)
+		if err := parsed.Parse(frame.Build()); err != nil {
+			t.Fatalf("batch parse failed: %v", err)
+		}
+		msg, err := parsed.UnmarshalTo()
+		if err != nil {
+			t.Fatalf("batch unmarshal failed: %v", err)
+		}
+		got, ok := msg.(*proto.BatchMessage)
+		if !ok || len(got.Messages) != len(batch.Messages) {
+			t.Fatalf("batch round trip mismatch: %s", msg)
+		}
+		for i, pm := range got.Messages {
+			want := batch.Messages[i]
+			if string(pm.Topic) != string(want.Topic) || string(pm.Key) != string(want.Key) ||
+				!bytes.Equal(pm.Value, want.Value) || string(pm.Headers.Get("trace")) != string(want.Headers.Get("trace")) {
+				t.Errorf("messages[%d] mismatch: %s", i, pm)
+			}
+		}
+	}
+}
+
+func TestRegisterMessage_Positions(t *testing.T) {
+	rm := &proto.RegisterMessage{
+		Topics: []string{"A", "B", "C"}, Ack: proto.AllConfirm, Type: proto.ConsumerLinkType,
+		Version: proto.ProtocolVersion, Capabilities: proto.DefaultCapabilities(),
+		Positions: map[string]*proto.StartPosition{
+			"A": {Type: proto.StartEarliest},
+			"B": {Type: proto.StartOffset, Value: 1 << 40, Offsets: map[uint16]uint64{0: 5, 3: 1 << 33}},
+			"C": {Type: proto.StartTimestamp, Value: uint64(time.Now().UnixMilli())},
+		},
+	}
+
+	for _, method := range []proto.MarshalMethodType{proto.JsonMarshalMethod, proto.BinaryMarshalMethod} {
+		frame := &proto.TransferFrame{}
+		frame.Reset()
+		frame.SetVersion(proto.FrameV2).SetMessageMarshalMethod(method)
+		if err := frame.BuildFrom(rm); err != nil {
+			t.Fatalf("%s build failed: %v", method, err)
+		}
+
+		parsed := &proto.TransferFrame{}
+		parsed.Reset()
+		parsed.SetVersion(proto.FrameVersionAuto)
+		if err := parsed.Parse(frame.Build()); err != nil {
+			t.Fatalf("%s parse failed: %v", method, err)
+		}
+		msg := &proto.RegisterMessage{}
+		if err := parsed.Unmarshal(msg); err != nil {
+			t.Fatalf("%s unmarshal failed: %v", method, err)
+		}
+		if !reflect.DeepEqual(msg.Positions, rm.Positions) {
+			t.Errorf("%s positions mismatch: %v", method, msg.Positions)
+		}
+	}
+
+	// 省略起始位置时与旧版本的编码一致
+	rm.Positions = nil
+	frame := &proto.TransferFrame{}
+	frame.Reset()
+	frame.SetVersion(proto.FrameV2).SetMessageMarshalMethod(proto.BinaryMarshalMethod)
+	if err := frame.BuildFrom(rm); err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	msg := &proto.RegisterMessage{}
+	if err := frame.Unmarshal(msg); err != nil || msg.Positions != nil {
+		t.Errorf("positions should be omitted: %v, %v", msg.Positions, err)
+	}
+}
+
+func TestCMessage_Partition(t *testing.T) {
+	cms := []*proto.CMessage{
+		{Offset: make([]byte, 8), ProductTime: make([]byte, 8), PM: &proto.PMessage{Topic: []byte("T"), Key: []byte("k1")}, Partition: 3},
+		{Offset: make([]byte, 8), ProductTime: make([]byte, 8), PM: &proto.PMessage{Topic: []byte("T"), Key: []byte("k2")}, Partition: 1},
+	}
+
+	for _, flagged := range []bool{true, false} {
+		frame := &proto.TransferFrame{}
+		frame.Reset()
+		frame.SetVersion(proto.FrameV2)
+		if flagged {
+			frame.SetFlag(proto.FlagPartition)
+		}
+		frame.BuildWith(proto.CMessageType, nil)
+		if err := proto.FrameCombine[*proto.CMessage](frame, cms); err != nil {
+			t.Fatalf("frame combine failed: %v", err)
+		}
+
+		parsed := &proto.TransferFrame{}
+		parsed.Reset()
+		parsed.SetVersion(proto.FrameVersionAuto)
+		if err := parsed.Parse(frame.Build()); err != nil {
+			t.Fatalf("frame parse failed: %v", err)
+		}
+		msgs := make([]*proto.CMessage, 0)
+		if err := proto.FrameSplit[*proto.CMessage](parsed, &msgs); err != nil {
+			t.Fatalf("frame split failed: %v", err)
+		}
+		if len(msgs) != 2 || string(msgs[1].PM.Key) != "k2" {
+			t.Fatalf("unexpected messages: %v", msgs)
+		}
+
+		// 未设置 FlagPartition 的帧不携带分区号
+		want := []uint16{3, 1}
+		if !flagged {
+			want = []uint16{0, 0}
+		}
+		if msgs[0].Partition != want[0] || msgs[1].Partition != want[1] {
+			t.Errorf("flagged: %v, partition mismatch: %d, %d", flagged, msgs[0].Partition, msgs[1].Partition)
+		}
+	}
+}
+
+func TestRegisterMessage_Group(t *testing.T) {
+	rm := &proto.RegisterMessage{
+		Topics: []string{"A"}, Ack: proto.AllConfirm, Type: proto.ConsumerLinkType,
+		Version: proto.ProtocolVersion, Group: "workers", Balance: proto.KeyHashBalance,
+	}
+
+	frame := &proto.TransferFrame{}
+	frame.Reset()
+	frame.SetVersion(proto.FrameV2).SetMessageMarshalMethod(proto.BinaryMarshalMethod)
+	if err := frame.BuildFrom(rm); err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	msg := &proto.RegisterMessage{}
+	if err := frame.Unmarshal(msg); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	if msg.Group != "workers" || msg.Balance != proto.KeyHashBalance || msg.Positions != nil {
+		t.Errorf("group mismatch: %+v", msg)
+	}
+}
+
+func TestRegisterMessage_ID(t *testing.T) {
+	rm := &proto.RegisterMessage{
+		Topics: []string{"A"}, Ack: proto.AllConfirm, Type: proto.ConsumerLinkType,
+		Version: proto.ProtocolVersion, ID: "consumer-1",
+	}
+
+	frame := &proto.TransferFrame{}
+	frame.Reset()
+	frame.SetVersion(proto.FrameV2).SetMessageMarshalMethod(proto.BinaryMarshalMethod)
+	if err := frame.BuildFrom(rm); err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	msg := &proto.RegisterMessage{}
+	if err := frame.Unmarshal(msg); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	if msg.ID != "consumer-1" || msg.Group != "" || msg.Positions != nil {
+		t.Errorf("id mismatch: %+v", msg)
+	}
+}
+
+func TestAckMessage(t *testing.T) {
+	am := &proto.AckMessage{Acks: []*proto.Acknowledgement{
+		{Topic: "A", Partition: 0, Offset: 1},
+		{Topic: "sensors/kitchen", Partition: 3, Offset: 1 << 40},
+	}}
+
+	for _, method := range []proto.MarshalMethodType{proto.JsonMarshalMethod, proto.BinaryMarshalMethod} {
+		frame := &proto.TransferFrame{}
+		frame.Reset()
+		frame.SetVersion(proto.FrameV2).SetMessageMarshalMethod(method)
+		if err := frame.BuildFrom(am); err != nil {
+			t.Fatalf("%s build failed: %v", method, err)
+		}
+		if proto.GetDescriptor(proto.AckMessageType).NeedACK() {
+			t.Fatalf("ack message should not be acknowledged")
+		}
+
+		parsed := &proto.TransferFrame{}
+		parsed.Reset()
+		parsed.SetVersion(proto.FrameVersionAuto)
+		if err := parsed.Parse(frame.Build()); err != nil {
+			t.Fatalf("%s parse failed: %v", method, err)
+		}
+		msg := &proto.AckMessage{}
+		if err := parsed.Unmarshal(msg); err != nil {
+			t.Fatalf("%s unmarshal failed: %v", method, err)
+		}
+		if parsed.Type() != proto.AckMessageType || !reflect.DeepEqual(msg.Acks, am.Acks) {
+			t.Errorf("%s ack message mismatch: %+v", method, msg.Acks)
+		}
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		want    bool
+	}{
+		{"sensors/+/temperature", "sensors/kitchen/temperature", true},
+		{"sensors/+/temperature", "sensors/kitchen/humidity", false},
+		{"sensors/+/temperature", "sensors/a/b/temperature", false},
+		{"alerts/#", "alerts", true},
+		{"alerts/#", "alerts/disk/full", true},
+		{"alerts/#", "alert", false},
+		{"+/+", "a/b", true},
+		{"+", "a/b", false},
+		{"#", "a/b", true},
+		{"#", "__DEAD_LETTER__", false},
+		{"__REPLY__/#", "__REPLY__/abc", true},
+		{"a/#/b", "a/#/b", true}, // 非末尾的 # 视为普通的主题名称
+		{"a/#/b", "a/x/b", false},
+		{"a/+", "a/#", false}, // 含有通配符层级的主题不被模式匹配
+		{"a+/b", "ax/b", false},
+		{"ORDERS", "ORDERS", true},
+	}
+	for _, tt := range tests {
+		if got := proto.MatchTopic(tt.pattern, tt.topic); got != tt.want {
+			t.Errorf("MatchTopic(%q, %q) = %v, want %v", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+	if proto.IsTopicPattern("a+/b") || proto.IsTopicPattern("a/#/b") || !proto.IsTopicPattern("a/+/b") {
+		t.Errorf("IsTopicPattern mismatch")
+	}
+}
+
+func TestSubscribeMessage(t *testing.T) {
+	messages := []*proto.SubscribeMessage{
+		{
+			Type: proto.SubscribeMessageType, Topics: []string{"A", "sensors/+/temperature"},
+			Positions: map[string]*proto.StartPosition{
+				"A": {Type: proto.StartOffset, Value: 7, Offsets: map[uint16]uint64{1: 9}},
+			},
+		},
+		{Type: proto.UnsubscribeMessageType, Topics: []string{"A"}},
+	}
+
+	for _, sm := range messages {
+		for _, method := range []proto.MarshalMethodType{proto.JsonMarshalMethod, proto.BinaryMarshalMethod} {
+			frame := &proto.TransferFrame{}
+			frame.Reset()
+			frame.SetVersion(proto.FrameV2).SetMessageMarshalMethod(method)
+			if err := frame.BuildFrom(sm); err != nil {
+				t.Fatalf("%s build failed: %v", method, err)
+			}
+			if frame.Type() != sm.Type {
+				t.Fatalf("%s frame type mismatch: %d", method, frame.Type())
+			}
+
+			parsed := &proto.TransferFrame{}
+			parsed.Reset()
+			parsed.SetVersion(proto.FrameVersionAuto)
+			if err := parsed.Parse(frame.Build()); err != nil {
+				t.Fatalf("%s parse failed: %v", method, err)
+			}
+			msg := &proto.SubscribeMessage{Type: parsed.Type()}
+			if err := parsed.Unmarshal(msg); err != nil {
+				t.Fatalf("%s unmarshal failed: %v", method, err)
+			}
+			if msg.MessageType() != sm.Type || !reflect.DeepEqual(msg.Topics, sm.Topics) ||
+				!reflect.DeepEqual(msg.Positions, sm.Positions) {
+				t.Errorf("%s subscribe message mismatch: %+v", method, msg)
+			}
+		}
+	}
+}
+
+func TestTruncateString(t *testing.T) {
+	cases := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"abc", 5, "abc"},
+		{"abcdef", 3, "abc"},
+		{"消息", 4, "消"}, // 截断位置落在第二个字符中间
+		{"消息", 3, "消"},
+		{"消息", 2, ""},
+	}
+	for _, c := range cases {
+		if got := proto.TruncateString(c.s, c.n); got != c.want {
+			t.Errorf("TruncateString(%q, %d) = %q, want %q", c.s, c.n, got, c.want)
+		}
+	}
+}
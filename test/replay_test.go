@@ -0,0 +1,127 @@
+package test
+
+import (
+	"github.com/Chendemo12/micromq/src/engine"
+	"github.com/Chendemo12/micromq/src/proto"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 回放的两种来源: 未配置数据目录时为历史记录, 否则为分区日志
+func replaySources(t *testing.T) map[string]func() engine.Config {
+	return map[string]func() engine.Config{
+		"history": func() engine.Config { return engine.Config{} },
+		"log":     func() engine.Config { return engine.Config{DataDir: t.TempDir()} },
+	}
+}
+
+// 发布 n 个消息, 并等待其全部推送完成
+func publishAndWait(t *testing.T, e *engine.Engine, topic string, from, n int) {
+	t.Helper()
+	for i := from; i < from+n; i++ {
+		e.Publisher(&proto.PMessage{Topic: []byte(topic), Value: []byte(strconv.Itoa(i))})
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		r := e.GetTopic([]byte(topic)).LatestMessage()
+		if r != nil && r.Offset == uint64(from+n-1) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("messages %d-%d not consumed", from, from+n-1)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 依次接收偏移量为 offsets 的消息
+func receiveOffsets(t *testing.T, c *memConn, offsets ...uint64) {
+	t.Helper()
+	for _, want := range offsets {
+		cm := c.receive(t, 2*time.Second)
+		if got := cmOffset(cm); got != want || string(cm.PM.Value) != strconv.FormatUint(want, 10) {
+			t.Fatalf("'%s' offset mismatch, want %d, got %d(%s)", c.addr, want, got, cm.PM.Value)
+		}
+	}
+}
+
+func TestEngine_ReplayPositions(t *testing.T) {
+	for source, conf := range replaySources(t) {
+		t.Run(source, func(t *testing.T) {
+			e, tr := serveEngine(t, conf())
+
+			// 历史记录的时间戳精度为秒, 因此两批消息跨越一个整秒
+			publishAndWait(t, e, "REPLAY", 0, 3)
+			time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+			after := uint64(time.Now().UnixMilli())
+			publishAndWait(t, e, "REPLAY", 3, 2)
+
+			cases := []struct {
+				name string
+				pos  *proto.StartPosition
+				want []uint64
+			}{
+				{"earliest", &proto.StartPosition{Type: proto.StartEarliest}, []uint64{0, 1, 2, 3, 4}},
+				{"offset", &proto.StartPosition{Type: proto.StartOffset, Value: 2}, []uint64{2, 3, 4}},
+				{"timestamp", &proto.StartPosition{Type: proto.StartTimestamp, Value: after}, []uint64{3, 4}},
+				{"latest", &proto.StartPosition{Type: proto.StartLatest}, nil},
+			}
+			conns := make([]*memConn, 0, len(cases))
+			for _, c := range cases {
+				con := tr.connect(c.name)
+				con.register(t, &proto.RegisterMessage{
+					Topics: []string{"REPLAY"}, Ack: proto.NoConfirm,
+					Positions: map[string]*proto.StartPosition{"REPLAY": c.pos},
+				})
+				receiveOffsets(t, con, c.want...)
+				conns = append(conns, con)
+			}
+
+			// 回放完成后切换为实时推送, 下一个消息既不重复也不遗漏
+			publishAndWait(t, e, "REPLAY", 5, 1)
+			for _, con := range conns {
+				receiveOffsets(t, con, 5)
+				con.silent(t, 50*time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestEngine_ReplayHandover(t *testing.T) {
+	const history, live = 50, 200
+
+	for source, conf := range replaySources(t) {
+		t.Run(source, func(t *testing.T) {
+			e, tr := serveEngine(t, conf())
+			publishAndWait(t, e, "HANDOVER", 0, history)
+
+			// 回放期间持续发布实时消息, 消费者收到的偏移量应连续且不重复
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := history; i < history+live; i++ {
+					e.Publisher(&proto.PMessage{Topic: []byte("HANDOVER"), Value: []byte(strconv.Itoa(i))})
+				}
+			}()
+			con := tr.connect("c1")
+			con.register(t, &proto.RegisterMessage{
+				Topics: []string{"HANDOVER"}, Ack: proto.NoConfirm,
+				Positions: map[string]*proto.StartPosition{"HANDOVER": {Type: proto.StartEarliest}},
+			})
+			<-done
+
+			// 历史记录容量有限, 回放期间推送完成的实时消息可能淘汰最早的记录, 因此仅日志保证自0开始
+			first := cmOffset(con.peek(t, 2*time.Second))
+			if source == "log" && first != 0 {
+				t.Fatalf("log replay should start at 0, got %d", first)
+			}
+			offsets := make([]uint64, 0, history+live)
+			for i := first; i < history+live; i++ {
+				offsets = append(offsets, i)
+			}
+			receiveOffsets(t, con, offsets...)
+			con.silent(t, 100*time.Millisecond)
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package test
+
+import (
+	"github.com/Chendemo12/micromq/src/engine"
+	"github.com/Chendemo12/micromq/src/proto"
+	"testing"
+	"time"
+)
+
+// 两个请求方使用相同的关联ID, 回复仍各自路由至发起请求的连接
+func TestEngine_RequestRouting(t *testing.T) {
+	_, tr := serveEngine(t, engine.Config{})
+	responder := tr.connect("responder")
+	responder.register(t, &proto.RegisterMessage{Topics: []string{"RPC"}, Ack: proto.NoConfirm})
+
+	requesters := []*memConn{tr.connect("r1"), tr.connect("r2")}
+	for _, r := range requesters {
+		r.register(t, &proto.RegisterMessage{Type: proto.ProducerLinkType})
+		headers := proto.Headers{}
+		headers.Set(proto.CorrelationIDHeader, []byte("req-1"))
+		r.send(t, &proto.PMessage{Topic: []byte("RPC"), Value: []byte(r.addr), Headers: headers})
+	}
+
+	for range requesters {
+		cm := responder.receive(t, time.Second)
+		if string(cm.PM.Headers.Get(proto.ReplyToHeader)) != engine.ReplyTopic(string(cm.PM.Value)) {
+			t.Fatalf("reply-to mismatch: %v", cm.PM.Headers)
+		}
+		headers := proto.Headers{}
+		headers.Set(proto.CorrelationIDHeader, cm.PM.Headers.Get(proto.CorrelationIDHeader))
+		responder.send(t, &proto.ReplyMessage{PMessage: proto.PMessage{
+			Topic: cm.PM.Headers.Get(proto.ReplyToHeader), Value: append([]byte("reply-"), cm.PM.Value...), Headers: headers,
+		}})
+	}
+
+	for _, r := range requesters {
+		if cm := r.receive(t, time.Second); string(cm.PM.Value) != "reply-"+r.addr {
+			t.Errorf("'%s' received reply of another requester: %s", r.addr, cm.PM.Value)
+		}
+		r.silent(t, 50*time.Millisecond)
+	}
+}
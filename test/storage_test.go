@@ -0,0 +1,151 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Chendemo12/micromq/src/engine"
+	"github.com/Chendemo12/micromq/src/proto"
+	"github.com/Chendemo12/micromq/src/storage"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func appendRecords(t *testing.T, log *storage.Log, from, to uint64, at time.Time) {
+	for offset := from; offset < to; offset++ {
+		err := log.Append(&storage.Record{
+			Offset:  offset,
+			Time:    at.UnixMilli(),
+			Key:     []byte(fmt.Sprintf("k%d", offset)),
+			Value:   []byte(fmt.Sprintf("value-%d", offset)),
+			Headers: proto.Headers{"trace": []byte("abc")},
+		})
+		if err != nil {
+			t.Fatalf("append %d failed: %v", offset, err)
+		}
+	}
+}
+
+func TestLog_Recover(t *testing.T) {
+	dir := t.TempDir()
+	log, err := storage.Open(dir, storage.Options{SegmentBytes: 256, Fsync: storage.FsyncAlways})
+	if err != nil {
+		t.Fatalf("open log failed: %v", err)
+	}
+	appendRecords(t, log, 0, 20, time.Now())
+	if log.Segments() < 2 {
+		t.Errorf("log should be segmented, segments: %d", log.Segments())
+	}
+	if err = log.Append(&storage.Record{Offset: 3}); !errors.Is(err, storage.ErrOffsetRegressed) {
+		t.Errorf("regressed offset should be refused, got: %v", err)
+	}
+	_ = log.Close()
+
+	// 模拟断电时写入不完整的记录
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	last := segments[len(segments)-1]
+	file, _ := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0o644)
+	_, _ = file.Write([]byte{0x12, 0x34, 0x00, 0x00, 0x00, 0x40, 0x01})
+	_ = file.Close()
+
+	log, err = storage.Open(dir, storage.Options{SegmentBytes: 256})
+	if err != nil {
+		t.Fatalf("reopen log failed: %v", err)
+	}
+	defer log.Close()
+	if log.Truncated() != 7 || log.NextOffset() != 20 || log.OldestOffset() != 0 {
+		t.Fatalf("recover mismatch, truncated: %d, next: %d", log.Truncated(), log.NextOffset())
+	}
+
+	appendRecords(t, log, 20, 22, time.Now())
+	want := uint64(5)
+	err = log.Read(5, func(r *storage.Record) bool {
+		if r.Offset != want || string(r.Value) != fmt.Sprintf("value-%d", want) || string(r.Headers.Get("trace")) != "abc" {
+			t.Errorf("record mismatch, want offset %d: %+v", want, r)
+		}
+		want++
+		return true
+	})
+	if err != nil || want != 22 {
+		t.Errorf("read stopped at %d: %v", want, err)
+	}
+}
+
+func TestLog_Retain(t *testing.T) {
+	log, err := storage.Open(t.TempDir(), storage.Options{SegmentBytes: 256, RetentionAge: time.Hour})
+	if err != nil {
+		t.Fatalf("open log failed: %v", err)
+	}
+	defer log.Close()
+
+	appendRecords(t, log, 0, 10, time.Now().Add(-2*time.Hour))
+	appendRecords(t, log, 10, 20, time.Now())
+	removed, err := log.Retain(time.Now())
+	if err != nil || removed == 0 {
+		t.Fatalf("expired segments should be removed: %d, %v", removed, err)
+	}
+	if oldest := log.OldestOffset(); oldest == 0 || oldest > 10 {
+		t.Errorf("oldest offset mismatch: %d", oldest)
+	}
+
+	// 当前段不会被删除
+	limited, _ := storage.Open(t.TempDir(), storage.Options{SegmentBytes: 256, RetentionBytes: 300})
+	defer limited.Close()
+	appendRecords(t, limited, 0, 20, time.Now())
+	_, _ = limited.Retain(time.Now())
+	if limited.Segments() != 1 || limited.NextOffset() != 20 {
+		t.Errorf("only the active segment should be kept, segments: %d", limited.Segments())
+	}
+}
+
+func TestEngine_PersistentTopic(t *testing.T) {
+	dir := t.TempDir()
+	handler := engine.New(engine.Config{DataDir: dir})
+	for i := 0; i < 3; i++ {
+		handler.Publisher(&proto.PMessage{Topic: []byte("SENSOR/1"), Key: []byte("k"), Value: []byte("v")})
+	}
+	_ = handler.GetTopic([]byte("SENSOR/1")).Log().Close()
+
+	// 重启后偏移量从日志中继续
+	handler = engine.New(engine.Config{DataDir: dir})
+	topic := handler.GetTopic([]byte("SENSOR/1"))
+	defer topic.Log().Close()
+	if offset := handler.Publisher(&proto.PMessage{Topic: topic.Name, Value: []byte("v")}); offset != 3 {
+		t.Errorf("offset should continue after restart, got: %d", offset)
+	}
+	if next := topic.Log().NextOffset(); next != 4 {
+		t.Errorf("log next offset mismatch: %d", next)
+	}
+}
+
+func TestEngine_PersistentRestart(t *testing.T) {
+	dir := t.TempDir()
+	e, _ := serveEngine(t, engine.Config{DataDir: dir})
+	publishAndWait(t, e, "RESTART", 0, 3)
+	e.Stop()
+
+	// 重启后历史记录自日志恢复, 但未推送的消息不会自动推送给新的消费者
+	e, tr := serveEngine(t, engine.Config{DataDir: dir})
+	topic := e.GetTopic([]byte("RESTART"))
+	latest := topic.LatestMessage()
+	if latest == nil || latest.Offset != 2 || string(latest.Value) != "2" {
+		t.Fatalf("history not recovered from log: %+v", latest)
+	}
+
+	live := tr.connect("live")
+	live.register(t, &proto.RegisterMessage{Topics: []string{"RESTART"}, Ack: proto.NoConfirm})
+	live.silent(t, 100*time.Millisecond)
+
+	// 指定起始位置的消费者自日志回放重启前的消息, 然后继续接收实时消息
+	replayed := tr.connect("replayed")
+	replayed.register(t, &proto.RegisterMessage{
+		Topics: []string{"RESTART"}, Ack: proto.NoConfirm,
+		Positions: map[string]*proto.StartPosition{"RESTART": {Type: proto.StartEarliest}},
+	})
+	receiveOffsets(t, replayed, 0, 1, 2)
+
+	publishAndWait(t, e, "RESTART", 3, 1)
+	receiveOffsets(t, live, 3)
+	receiveOffsets(t, replayed, 3)
+}
@@ -0,0 +1,149 @@
+package test
+
+import (
+	"context"
+	"github.com/Chendemo12/micromq/sdk"
+	"github.com/Chendemo12/micromq/src/engine"
+	"github.com/Chendemo12/micromq/src/proto"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 发送订阅或取消订阅消息, 并等待服务端接受
+func (c *memConn) subscribe(t *testing.T, typ proto.MessageType, topics ...string) {
+	t.Helper()
+	c.send(t, &proto.SubscribeMessage{Type: typ, Topics: topics})
+
+	resp := &proto.MessageResponse{}
+	if err := c.expect(t, proto.SubscribeMessageRespType, time.Second).Unmarshal(resp); err != nil {
+		t.Fatalf("subscribe response unmarshal failed: %v", err)
+	}
+	if !resp.Accepted() {
+		t.Fatalf("'%s' subscription refused: %s", c.addr, proto.GetMessageResponseStatusText(resp.Status))
+	}
+}
+
+func TestEngine_Subscribe(t *testing.T) {
+	e, tr := serveEngine(t, engine.Config{})
+	c := tr.connect("c1")
+	c.register(t, &proto.RegisterMessage{Topics: []string{"SUB_A"}, Ack: proto.NoConfirm})
+	consumer, _ := e.QueryConsumer("c1")
+
+	c.subscribe(t, proto.SubscribeMessageType, "SUB_B")
+	if !e.GetTopic([]byte("SUB_B")).HasConsumer("c1") || !reflect.DeepEqual(consumer.Conf.Topics, []string{"SUB_A", "SUB_B"}) {
+		t.Fatalf("subscribe not applied: %v", consumer.Conf.Topics)
+	}
+	e.Publisher(&proto.PMessage{Topic: []byte("SUB_B"), Value: []byte("b")})
+	if cm := c.receive(t, time.Second); string(cm.PM.Topic) != "SUB_B" {
+		t.Errorf("message from unexpected topic: %s", cm.PM.Topic)
+	}
+
+	c.subscribe(t, proto.UnsubscribeMessageType, "SUB_A")
+	if e.GetTopic([]byte("SUB_A")).HasConsumer("c1") || !reflect.DeepEqual(consumer.Conf.Topics, []string{"SUB_B"}) {
+		t.Fatalf("unsubscribe not applied: %v", consumer.Conf.Topics)
+	}
+	e.Publisher(&proto.PMessage{Topic: []byte("SUB_A"), Value: []byte("a")})
+	c.silent(t, 100*time.Millisecond)
+}
+
+type subscribeConsumer struct {
+	sdk.CHandler
+	values chan string
+}
+
+func (c *subscribeConsumer) Topics() []string { return []string{"SDK_SUB_A"} }
+
+func (c *subscribeConsumer) Handler(record *sdk.ConsumerMessage) {
+	c.values <- record.Topic + ":" + string(record.Value)
+}
+
+// 运行期间修改的订阅列表在断线重连后依然有效
+func TestSdkConsumer_SubscribeReconnect(t *testing.T) {
+	port := startBroker()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("proxy listen failed: %v", err)
+	}
+	proxy := &lossyProxy{
+		Listener: listener, target: "127.0.0.1:" + port,
+		dropRequests: &atomic.Bool{}, dropResponses: &atomic.Bool{}, mu: &sync.Mutex{},
+	}
+	defer func() { _ = proxy.Close() }()
+	go proxy.serve()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	sc := sdk.Config{Host: "127.0.0.1", Port: port, PCtx: ctx, FrameVersion: proto.FrameV2}
+
+	producer, err := sdk.NewAsyncProducer(sc)
+	if err != nil {
+		t.Fatalf("producer create failed: %v", err)
+	}
+	defer producer.Stop()
+
+	sc.Port = strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	handler := &subscribeConsumer{values: make(chan string, 16)}
+	consumer, err := sdk.NewConsumer(sc, handler)
+	if err != nil {
+		t.Fatalf("consumer create failed: %v", err)
+	}
+	if err = consumer.Start(); err != nil {
+		t.Fatalf("consumer start failed: %v", err)
+	}
+	defer consumer.Stop()
+
+	waitRegistered := func(registered bool) {
+		t.Helper()
+		for i := 0; i < 200 && (consumer.IsRegistered() != registered || !producer.IsRegistered()); i++ {
+			time.Sleep(50 * time.Millisecond)
+		}
+		if consumer.IsRegistered() != registered || !producer.IsRegistered() {
+			t.Fatalf("consumer registered should be %v", registered)
+		}
+	}
+	waitRegistered(true)
+
+	if err = consumer.Subscribe("SDK_SUB_B"); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+	if err = consumer.Unsubscribe("SDK_SUB_A"); err != nil {
+		t.Fatalf("unsubscribe failed: %v", err)
+	}
+
+	// 断线重连后以最新的订阅列表重新注册
+	proxy.cut()
+	waitRegistered(false)
+	waitRegistered(true)
+	if topics := consumer.Topics(); !reflect.DeepEqual(topics, []string{"SDK_SUB_B"}) {
+		t.Fatalf("topics mismatch after reconnect: %v", topics)
+	}
+
+	for _, topic := range []string{"SDK_SUB_A", "SDK_SUB_B"} {
+		err = producer.Send(func(r *sdk.ProducerMessage) error {
+			r.Topic = topic
+			r.Value = []byte("v")
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("producer send failed: %v", err)
+		}
+	}
+	select {
+	case v := <-handler.values:
+		if v != "SDK_SUB_B:v" {
+			t.Fatalf("unexpected message: %s", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("subscribed message not received after reconnect")
+	}
+	select {
+	case v := <-handler.values:
+		t.Errorf("unsubscribed message received: %s", v)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/Chendemo12/micromq/src/proto"
 	"testing"
@@ -121,3 +122,57 @@ func TestTokenCrypto_Encrypt_Example(t *testing.T) {
 }
 
 func TestTokenCrypto_Decrypt(t *testing.T) {}
+
+func TestCreateCrypto(t *testing.T) {
+	if _, err := proto.CreateCrypto("rot13", "key"); !errors.Is(err, proto.ErrCryptoPlanUnknown) {
+		t.Errorf("unknown plan should be refused, got: %v", err)
+	}
+	for _, plan := range []string{"token", "aes-gcm", "chacha20-poly1305"} {
+		if _, err := proto.CreateCrypto(plan); !errors.Is(err, proto.ErrCryptoKeyEmpty) {
+			t.Errorf("%s without key should be refused, got: %v", plan, err)
+		}
+		if _, err := proto.CreateCrypto(plan, ""); !errors.Is(err, proto.ErrCryptoKeyEmpty) {
+			t.Errorf("%s empty key should be refused, got: %v", plan, err)
+		}
+	}
+
+	for _, plan := range []string{"aes-gcm", "chacha20-poly1305"} {
+		old, err := proto.CreateCrypto(plan, "old-token")
+		if err != nil {
+			t.Fatalf("%s create failed: %v", plan, err)
+		}
+		encryptData, err := old.Encrypt([]byte("hello"))
+		if err != nil {
+			t.Fatalf("%s encrypt failed: %v", plan, err)
+		}
+
+		// 轮换密钥后仍可解密旧密钥加密的数据
+		rotated, _ := proto.CreateCrypto(plan, "new-token", "old-token")
+		_bytes, err := rotated.Decrypt(encryptData)
+		if err != nil || string(_bytes) != "hello" {
+			t.Errorf("%s decrypt with rotated key failed: %v", plan, err)
+		}
+
+		other, _ := proto.CreateCrypto(plan, "new-token")
+		if _, err = other.Decrypt(encryptData); !errors.Is(err, proto.ErrCryptoKeyNotFound) {
+			t.Errorf("%s unknown key id should be refused, got: %v", plan, err)
+		}
+
+		// 显式指定密钥时以第一个密钥加密, 令牌不参与
+		keys := proto.CryptoKeys(plan, "token", "new-token", "old-token")
+		if fmt.Sprint(keys) != "[new-token old-token]" {
+			t.Errorf("%s keys mismatch: %v", plan, keys)
+		}
+		rotated, _ = proto.CreateCrypto(plan, keys...)
+		encryptData, _ = rotated.Encrypt([]byte("hello"))
+		if _bytes, err = other.Decrypt(encryptData); err != nil || string(_bytes) != "hello" {
+			t.Errorf("%s should encrypt with the first explicit key: %v", plan, err)
+		}
+		if keys = proto.CryptoKeys(plan, "token"); fmt.Sprint(keys) != "[token]" {
+			t.Errorf("%s should fall back to token: %v", plan, keys)
+		}
+	}
+	if keys := proto.CryptoKeys("token", "token", "extra"); fmt.Sprint(keys) != "[token extra]" {
+		t.Errorf("token plan keys mismatch: %v", keys)
+	}
+}
@@ -0,0 +1,171 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"github.com/Chendemo12/micromq/sdk"
+	"github.com/Chendemo12/micromq/src/mq"
+	"github.com/Chendemo12/micromq/src/proto"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testBrokerPort = "17390"
+
+var brokerOnce = &sync.Once{}
+
+// 启动测试包内共享的服务端, 并返回其端口;
+// HTTP 服务在同一进程内只能启动一次, 且关闭时会退出进程, 因此服务端在测试结束之前一直运行
+func startBroker() string {
+	brokerOnce.Do(func() {
+		conf := mq.DefaultConf()
+		conf.Broker.Port = testBrokerPort
+		conf.EdgeHttpPort = "17391"
+		go mq.New(conf).Serve()
+
+		for i := 0; i < 100; i++ { // 等待服务端开始监听
+			conn, err := net.Dial("tcp", "127.0.0.1:"+testBrokerPort)
+			if err == nil {
+				_ = conn.Close()
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+
+	return testBrokerPort
+}
+
+type largeConsumer struct {
+	sdk.CHandler
+	values chan []byte
+}
+
+func (c *largeConsumer) Topics() []string { return []string{"LARGE"} }
+
+func (c *largeConsumer) Handler(record *sdk.ConsumerMessage) {
+	c.values <- append([]byte{}, record.Value...)
+}
+
+// 超过传输层单个消息长度的帧经由 TCP 连接分段发送, 并由接收方重新组装
+func TestTransfer_LargeFrame(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	sc := sdk.Config{Host: "127.0.0.1", Port: startBroker(), PCtx: ctx, FrameVersion: proto.FrameV2}
+
+	handler := &largeConsumer{values: make(chan []byte, 2)}
+	consumer, err := sdk.NewConsumer(sc, handler)
+	if err != nil {
+		t.Fatalf("consumer create failed: %v", err)
+	}
+	if err = consumer.Start(); err != nil {
+		t.Fatalf("consumer start failed: %v", err)
+	}
+	producer, err := sdk.NewAsyncProducer(sc)
+	if err != nil {
+		t.Fatalf("producer create failed: %v", err)
+	}
+	for i := 0; i < 100 && !(consumer.IsRegistered() && producer.IsRegistered()); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	value := make([]byte, 1<<20+1234)
+	for i := range value {
+		value[i] = byte(i * 31)
+	}
+	for _, v := range [][]byte{value, []byte("small")} {
+		v := v
+		err = producer.Send(func(r *sdk.ProducerMessage) error {
+			r.Topic = "LARGE"
+			r.Value = v
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("producer send failed: %v", err)
+		}
+	}
+
+	// 服务端不保证两个消息的推送顺序, 因此按内容匹配
+	var large, small bool
+	for !(large && small) {
+		select {
+		case got := <-handler.values:
+			switch {
+			case !large && bytes.Equal(got, value):
+				large = true
+			case !small && bytes.Equal(got, []byte("small")):
+				small = true
+			default:
+				t.Fatalf("unexpected value of %d bytes received", len(got))
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("messages not received, large: %v, small: %v", large, small)
+		}
+	}
+}
+
+type orderedConsumer struct {
+	sdk.CHandler
+	records chan [2]uint64 // 消息的发送序号和偏移量
+}
+
+func (c *orderedConsumer) Topics() []string { return []string{"ORDERED"} }
+
+func (c *orderedConsumer) Handler(record *sdk.ConsumerMessage) {
+	i, _ := strconv.ParseUint(string(record.Value), 10, 64)
+	c.records <- [2]uint64{i, record.Offset}
+}
+
+// 同一连接的帧依次处理, 因此同一生产者发布到同一分区的消息按发送顺序分配偏移量
+func TestTransfer_ConnectionOrder(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	sc := sdk.Config{Host: "127.0.0.1", Port: startBroker(), PCtx: ctx, FrameVersion: proto.FrameV2}
+
+	const num = 500
+	handler := &orderedConsumer{records: make(chan [2]uint64, num)}
+	consumer, err := sdk.NewConsumer(sc, handler)
+	if err != nil {
+		t.Fatalf("consumer create failed: %v", err)
+	}
+	if err = consumer.Start(); err != nil {
+		t.Fatalf("consumer start failed: %v", err)
+	}
+	producer, err := sdk.NewAsyncProducer(sc)
+	if err != nil {
+		t.Fatalf("producer create failed: %v", err)
+	}
+	for i := 0; i < 100 && !(consumer.IsRegistered() && producer.IsRegistered()); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	for i := 0; i < num; i++ {
+		err = producer.Send(func(r *sdk.ProducerMessage) error {
+			r.Topic = "ORDERED"
+			r.Key = "same-partition"
+			r.Value = []byte(strconv.Itoa(i))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("producer send failed: %v", err)
+		}
+	}
+
+	offsets := make([]uint64, num)
+	for n := 0; n < num; n++ {
+		select {
+		case r := <-handler.records:
+			offsets[r[0]] = r[1]
+		case <-time.After(10 * time.Second):
+			t.Fatalf("expect %d messages, received %d", num, n)
+		}
+	}
+	for i := 1; i < num; i++ {
+		if offsets[i] <= offsets[i-1] {
+			t.Fatalf("message %d offset %d not after message %d offset %d", i, offsets[i], i-1, offsets[i-1])
+		}
+	}
+}
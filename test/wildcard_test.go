@@ -0,0 +1,68 @@
+package test
+
+import (
+	"github.com/Chendemo12/micromq/src/engine"
+	"github.com/Chendemo12/micromq/src/proto"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// 接收 n 个消息, 返回其主题名称(已排序)
+func receiveTopics(t *testing.T, c *memConn, n int) []string {
+	t.Helper()
+	topics := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		topics = append(topics, string(c.receive(t, time.Second).PM.Topic))
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func TestEngine_Wildcard(t *testing.T) {
+	e, tr := serveEngine(t, engine.Config{})
+	e.GetTopic([]byte("sensors/kitchen/temperature")) // 模式注册之前已存在的主题
+	c := tr.connect("c1")
+	c.register(t, &proto.RegisterMessage{Topics: []string{"sensors/+/temperature", "alerts/#"}, Ack: proto.NoConfirm})
+
+	// 模式注册之后创建的匹配主题自动加入此消费者
+	for _, topic := range []string{
+		"sensors/kitchen/temperature", "sensors/garage/temperature", "alerts", "alerts/fire/floor1",
+		"sensors/kitchen/humidity", "sensors/a/b/temperature", "alertsx",
+	} {
+		e.Publisher(&proto.PMessage{Topic: []byte(topic), Value: []byte("v")})
+	}
+
+	want := []string{"alerts", "alerts/fire/floor1", "sensors/garage/temperature", "sensors/kitchen/temperature"}
+	if got := receiveTopics(t, c, len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("wildcard topics mismatch: %v", got)
+	}
+	c.silent(t, 100*time.Millisecond)
+}
+
+func TestEngine_WildcardReservedTopics(t *testing.T) {
+	e, tr := serveEngine(t, engine.Config{})
+	c := tr.connect("c1")
+	c.register(t, &proto.RegisterMessage{
+		Topics: []string{"#", "+", "__REPLY__/+", "__REPLY__/#", "+/+"}, Ack: proto.NoConfirm,
+	})
+
+	// 死信主题, 隔离主题和其他连接的回复主题不会被任何通配符模式匹配
+	for _, topic := range []string{e.DeadLetterTopic(), e.QuarantineTopic(), engine.ReplyTopic("other"), "news"} {
+		e.Publisher(&proto.PMessage{Topic: []byte(topic), Value: []byte("v")})
+	}
+	if got := receiveTopics(t, c, 1); !reflect.DeepEqual(got, []string{"news"}) {
+		t.Errorf("wildcard topics mismatch: %v", got)
+	}
+	c.silent(t, 100*time.Millisecond)
+
+	// 以名称订阅的保留主题不受影响
+	named := tr.connect("c2")
+	named.register(t, &proto.RegisterMessage{Topics: []string{e.DeadLetterTopic()}, Ack: proto.NoConfirm})
+	e.Publisher(&proto.PMessage{Topic: []byte(e.DeadLetterTopic()), Value: []byte("v")})
+	if cm := named.receive(t, time.Second); string(cm.PM.Topic) != e.DeadLetterTopic() {
+		t.Errorf("named reserved topic mismatch: %s", cm.PM.Topic)
+	}
+	c.silent(t, 100*time.Millisecond)
+}